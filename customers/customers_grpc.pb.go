@@ -0,0 +1,280 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             (unknown)
+// source: customers.proto
+
+package main
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// CustomersClient is the client API for Customers service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type CustomersClient interface {
+	// ListCustomers streams all customers, or only those with the given ids.
+	ListCustomers(ctx context.Context, in *ListCustomersRequest, opts ...grpc.CallOption) (Customers_ListCustomersClient, error)
+	GetCustomer(ctx context.Context, in *GetCustomerRequest, opts ...grpc.CallOption) (*CustomerRecord, error)
+	CreateCustomer(ctx context.Context, in *CreateCustomerRequest, opts ...grpc.CallOption) (*CustomerRecord, error)
+	UpdateCustomer(ctx context.Context, in *UpdateCustomerRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	DeleteCustomer(ctx context.Context, in *DeleteCustomerRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+}
+
+type customersClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewCustomersClient(cc grpc.ClientConnInterface) CustomersClient {
+	return &customersClient{cc}
+}
+
+func (c *customersClient) ListCustomers(ctx context.Context, in *ListCustomersRequest, opts ...grpc.CallOption) (Customers_ListCustomersClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Customers_ServiceDesc.Streams[0], "/customers.v1.Customers/ListCustomers", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &customersListCustomersClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Customers_ListCustomersClient interface {
+	Recv() (*CustomerRecord, error)
+	grpc.ClientStream
+}
+
+type customersListCustomersClient struct {
+	grpc.ClientStream
+}
+
+func (x *customersListCustomersClient) Recv() (*CustomerRecord, error) {
+	m := new(CustomerRecord)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *customersClient) GetCustomer(ctx context.Context, in *GetCustomerRequest, opts ...grpc.CallOption) (*CustomerRecord, error) {
+	out := new(CustomerRecord)
+	err := c.cc.Invoke(ctx, "/customers.v1.Customers/GetCustomer", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *customersClient) CreateCustomer(ctx context.Context, in *CreateCustomerRequest, opts ...grpc.CallOption) (*CustomerRecord, error) {
+	out := new(CustomerRecord)
+	err := c.cc.Invoke(ctx, "/customers.v1.Customers/CreateCustomer", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *customersClient) UpdateCustomer(ctx context.Context, in *UpdateCustomerRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/customers.v1.Customers/UpdateCustomer", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *customersClient) DeleteCustomer(ctx context.Context, in *DeleteCustomerRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/customers.v1.Customers/DeleteCustomer", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CustomersServer is the server API for Customers service.
+// All implementations must embed UnimplementedCustomersServer
+// for forward compatibility
+type CustomersServer interface {
+	// ListCustomers streams all customers, or only those with the given ids.
+	ListCustomers(*ListCustomersRequest, Customers_ListCustomersServer) error
+	GetCustomer(context.Context, *GetCustomerRequest) (*CustomerRecord, error)
+	CreateCustomer(context.Context, *CreateCustomerRequest) (*CustomerRecord, error)
+	UpdateCustomer(context.Context, *UpdateCustomerRequest) (*emptypb.Empty, error)
+	DeleteCustomer(context.Context, *DeleteCustomerRequest) (*emptypb.Empty, error)
+	mustEmbedUnimplementedCustomersServer()
+}
+
+// UnimplementedCustomersServer must be embedded to have forward compatible implementations.
+type UnimplementedCustomersServer struct {
+}
+
+func (UnimplementedCustomersServer) ListCustomers(*ListCustomersRequest, Customers_ListCustomersServer) error {
+	return status.Errorf(codes.Unimplemented, "method ListCustomers not implemented")
+}
+func (UnimplementedCustomersServer) GetCustomer(context.Context, *GetCustomerRequest) (*CustomerRecord, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetCustomer not implemented")
+}
+func (UnimplementedCustomersServer) CreateCustomer(context.Context, *CreateCustomerRequest) (*CustomerRecord, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateCustomer not implemented")
+}
+func (UnimplementedCustomersServer) UpdateCustomer(context.Context, *UpdateCustomerRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateCustomer not implemented")
+}
+func (UnimplementedCustomersServer) DeleteCustomer(context.Context, *DeleteCustomerRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteCustomer not implemented")
+}
+func (UnimplementedCustomersServer) mustEmbedUnimplementedCustomersServer() {}
+
+// UnsafeCustomersServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to CustomersServer will
+// result in compilation errors.
+type UnsafeCustomersServer interface {
+	mustEmbedUnimplementedCustomersServer()
+}
+
+func RegisterCustomersServer(s grpc.ServiceRegistrar, srv CustomersServer) {
+	s.RegisterService(&Customers_ServiceDesc, srv)
+}
+
+func _Customers_ListCustomers_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListCustomersRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CustomersServer).ListCustomers(m, &customersListCustomersServer{stream})
+}
+
+type Customers_ListCustomersServer interface {
+	Send(*CustomerRecord) error
+	grpc.ServerStream
+}
+
+type customersListCustomersServer struct {
+	grpc.ServerStream
+}
+
+func (x *customersListCustomersServer) Send(m *CustomerRecord) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Customers_GetCustomer_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetCustomerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CustomersServer).GetCustomer(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/customers.v1.Customers/GetCustomer",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CustomersServer).GetCustomer(ctx, req.(*GetCustomerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Customers_CreateCustomer_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateCustomerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CustomersServer).CreateCustomer(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/customers.v1.Customers/CreateCustomer",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CustomersServer).CreateCustomer(ctx, req.(*CreateCustomerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Customers_UpdateCustomer_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateCustomerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CustomersServer).UpdateCustomer(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/customers.v1.Customers/UpdateCustomer",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CustomersServer).UpdateCustomer(ctx, req.(*UpdateCustomerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Customers_DeleteCustomer_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteCustomerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CustomersServer).DeleteCustomer(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/customers.v1.Customers/DeleteCustomer",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CustomersServer).DeleteCustomer(ctx, req.(*DeleteCustomerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Customers_ServiceDesc is the grpc.ServiceDesc for Customers service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Customers_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "customers.v1.Customers",
+	HandlerType: (*CustomersServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetCustomer",
+			Handler:    _Customers_GetCustomer_Handler,
+		},
+		{
+			MethodName: "CreateCustomer",
+			Handler:    _Customers_CreateCustomer_Handler,
+		},
+		{
+			MethodName: "UpdateCustomer",
+			Handler:    _Customers_UpdateCustomer_Handler,
+		},
+		{
+			MethodName: "DeleteCustomer",
+			Handler:    _Customers_DeleteCustomer_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ListCustomers",
+			Handler:       _Customers_ListCustomers_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "customers.proto",
+}
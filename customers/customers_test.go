@@ -2,15 +2,20 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
 	"github.com/DATA-DOG/go-sqlmock"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestGetCustomer(t *testing.T) {
@@ -60,11 +65,14 @@ func TestGetCustomer(t *testing.T) {
 }
 
 func TestGetCustomers(t *testing.T) {
-	db, mock, err := sqlmock.New()
+	mockDB, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatalf("Error initializing mock database: %v", err)
 	}
-	defer db.Close()
+	defer mockDB.Close()
+	prevDB := db
+	db = mockDB
+	defer func() { db = prevDB }()
 
 	rows := sqlmock.NewRows([]string{"id", "name", "surname", "age", "phone_number", "debit_card", "credit_card", "date_of_birth", "date_of_issue", "issuing_authority", "has_foreign_country_tax_liability"}).
 		AddRow(1, "fdsg", "gfd", 30, "1234567890", "1234-5678-9101-1121", "5432-1098-7654-3210", time.Now(), time.Now(), "Authority XYZ", false).
@@ -94,13 +102,43 @@ func TestGetCustomers(t *testing.T) {
 	}
 }
 
-func TestCreateCustomer(t *testing.T) {
-	db, mock, err := sqlmock.New()
+func TestGetCustomersEmpty(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatalf("Error initializing mock database: %v", err)
 	}
-	defer db.Close()
+	defer mockDB.Close()
+	prevDB := db
+	db = mockDB
+	defer func() { db = prevDB }()
+
+	mock.ExpectQuery("^SELECT .* FROM customers\\.public\\.customers").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "surname", "age", "phone_number", "debit_card", "credit_card", "date_of_birth", "date_of_issue", "issuing_authority", "has_foreign_country_tax_liability"}))
+
+	rr := httptest.NewRecorder()
+	GetCustomers(rr, httptest.NewRequest("GET", "/customer", nil))
 
+	if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != "[]" {
+		t.Errorf("Expected an empty JSON array, got %d %q", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Error verifying mock database expectations: %v", err)
+	}
+}
+
+func TestCreateCustomer(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error initializing mock database: %v", err)
+	}
+	defer mockDB.Close()
+	prevDB := db
+	db = mockDB
+	defer func() { db = prevDB }()
+
+	// The handler sees the times after a JSON round trip, without a
+	// monotonic clock reading.
+	now := time.Now().UTC().Round(0)
 	newCustomer := Customer{
 		Name:                          "Victoria",
 		Surname:                       "N",
@@ -108,15 +146,15 @@ func TestCreateCustomer(t *testing.T) {
 		PhoneNumber:                   "1234567890",
 		DebitCard:                     "1234-5678-9101-1121",
 		CreditCard:                    "5432-1098-7654-3210",
-		DateOfBirth:                   time.Now(),
-		DateOfIssue:                   time.Now(),
+		DateOfBirth:                   now,
+		DateOfIssue:                   now,
 		IssuingAuthority:              "Authority XYZ",
 		HasForeignCountryTaxLiability: false,
 	}
 
-	mock.ExpectExec("INSERT INTO customers.public.customers").
+	mock.ExpectQuery("INSERT INTO customers.public.customers").
 		WithArgs(newCustomer.Name, newCustomer.Surname, newCustomer.Age, newCustomer.PhoneNumber, newCustomer.DebitCard, newCustomer.CreditCard, newCustomer.DateOfBirth, newCustomer.DateOfIssue, newCustomer.IssuingAuthority, newCustomer.HasForeignCountryTaxLiability).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
 
 	reqBody, err := json.Marshal(newCustomer)
 	if err != nil {
@@ -127,6 +165,7 @@ func TestCreateCustomer(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
 
@@ -145,12 +184,16 @@ func TestCreateCustomer(t *testing.T) {
 }
 
 func TestUpdateCustomer(t *testing.T) {
-	db, mock, err := sqlmock.New()
+	mockDB, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatalf("Error initializing mock database: %v", err)
 	}
-	defer db.Close()
+	defer mockDB.Close()
+	prevDB := db
+	db = mockDB
+	defer func() { db = prevDB }()
 
+	now := time.Now().UTC().Round(0)
 	updatedCustomer := Customer{
 		Name:                          "test name",
 		Surname:                       "test",
@@ -158,14 +201,14 @@ func TestUpdateCustomer(t *testing.T) {
 		PhoneNumber:                   "9876543210",
 		DebitCard:                     "5678-9101-1121-3141",
 		CreditCard:                    "8765-4321-0987-6543",
-		DateOfBirth:                   time.Now(),
-		DateOfIssue:                   time.Now(),
+		DateOfBirth:                   now,
+		DateOfIssue:                   now,
 		IssuingAuthority:              "Authority ABC",
 		HasForeignCountryTaxLiability: true,
 	}
 
 	mock.ExpectExec("UPDATE customers.public.customers SET").
-		WithArgs(updatedCustomer.Name, updatedCustomer.Surname, updatedCustomer.Age, updatedCustomer.PhoneNumber, updatedCustomer.DebitCard, updatedCustomer.CreditCard, updatedCustomer.DateOfBirth, updatedCustomer.DateOfIssue, updatedCustomer.IssuingAuthority, updatedCustomer.HasForeignCountryTaxLiability, 1).
+		WithArgs(updatedCustomer.Name, updatedCustomer.Surname, updatedCustomer.Age, updatedCustomer.PhoneNumber, updatedCustomer.DebitCard, updatedCustomer.CreditCard, updatedCustomer.DateOfBirth, updatedCustomer.DateOfIssue, updatedCustomer.IssuingAuthority, updatedCustomer.HasForeignCountryTaxLiability, "1").
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
 	reqBody, err := json.Marshal(updatedCustomer)
@@ -177,6 +220,7 @@ func TestUpdateCustomer(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
 
@@ -201,7 +245,7 @@ func TestDeleteCustomer(t *testing.T) {
 	}
 	defer db.Close()
 
-	mock.ExpectExec("DELETE FROM customers.public.customers WHERE id = $1").
+	mock.ExpectExec("DELETE FROM customers\\.public\\.customers WHERE id = \\$1").
 		WithArgs(1).
 		WillReturnResult(sqlmock.NewResult(0, 1)) // Return a successful delete operation
 
@@ -253,3 +297,102 @@ func TestDeleteCustomer(t *testing.T) {
 		t.Errorf("Error verifying mock database expectations: %v", err)
 	}
 }
+
+func TestUpdateCustomerRejectsInvalidBodies(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"wrong content type", "text/plain", `{"name": "V"}`, http.StatusUnsupportedMediaType},
+		{"unknown field", "application/json", `{"name": "V", "email": "v.n@example.com"}`, http.StatusBadRequest},
+		{"too large", "application/json", `{"name": "` + strings.Repeat("x", maxBodyBytes) + `"}`, http.StatusRequestEntityTooLarge},
+		{"too deep", "application/json", strings.Repeat("[", maxJSONDepth+1) + strings.Repeat("]", maxJSONDepth+1), http.StatusBadRequest},
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/customer/{id}", UpdateCustomer).Methods("PUT")
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("PUT", "/customer/1", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", tt.contentType)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != tt.want {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.want, status)
+		}
+	}
+}
+
+func TestGRPCGetCustomer(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error initializing mock database: %v", err)
+	}
+	defer mockDB.Close()
+	prevDB := db
+	db = mockDB
+	defer func() { db = prevDB }()
+
+	born := time.Date(1994, 5, 20, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("^SELECT id, name, surname, age, phone_number, debit_card, credit_card, date_of_birth, date_of_issue, issuing_authority, has_foreign_country_tax_liability FROM customers\\.public\\.customers WHERE id = \\$1").
+		WithArgs(int32(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "surname", "age", "phone_number", "debit_card", "credit_card", "date_of_birth", "date_of_issue", "issuing_authority", "has_foreign_country_tax_liability"}).
+			AddRow(1, "Vi", "N", 20, "1234567890", "1234-5678-9101-1121", "5432-1098-7654-3210", born, born, "Authority XYZ", false))
+	mock.ExpectQuery("^SELECT .* FROM customers\\.public\\.customers WHERE id = \\$1").
+		WithArgs(int32(2)).
+		WillReturnError(sql.ErrNoRows)
+
+	c, err := customersServer{}.GetCustomer(context.Background(), &GetCustomerRequest{Id: 1})
+	if err != nil {
+		t.Fatalf("GetCustomer returned error: %v", err)
+	}
+	if c.Name != "Vi" || !c.DateOfBirth.AsTime().Equal(born) {
+		t.Errorf("Unexpected customer: %v", c)
+	}
+
+	_, err = customersServer{}.GetCustomer(context.Background(), &GetCustomerRequest{Id: 2})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound for a missing customer, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Error verifying mock database expectations: %v", err)
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	rr := httptest.NewRecorder()
+	OpenAPIHandler(rr, httptest.NewRequest("GET", "/openapi.json", nil))
+
+	var doc struct {
+		Paths      map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]map[string]interface{} `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := doc.Paths["/customer/{id}"]["put"]; !ok {
+		t.Errorf("PUT /customer/{id} is not documented")
+	}
+	props := doc.Components.Schemas["Customer"].Properties
+	body, _ := json.Marshal(Customer{})
+	var fields map[string]interface{}
+	json.Unmarshal(body, &fields)
+	if len(props) != len(fields) {
+		t.Errorf("Customer schema has %d properties, the model encodes %d", len(props), len(fields))
+	}
+	if props["date_of_birth"]["format"] != "date-time" || props["age"]["type"] != "integer" || props["id"]["readOnly"] != true {
+		t.Errorf("unexpected Customer schema %v", props)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// customersServer serves the Customers gRPC API from the same table as the
+// REST handlers.
+type customersServer struct {
+	UnimplementedCustomersServer
+}
+
+func newGRPCServer() *grpc.Server {
+	srv := grpc.NewServer(grpc.MaxRecvMsgSize(maxBodyBytes))
+	RegisterCustomersServer(srv, customersServer{})
+	return srv
+}
+
+func (customersServer) ListCustomers(req *ListCustomersRequest, stream Customers_ListCustomersServer) error {
+	query := "SELECT " + customerColumns + " FROM customers.public.customers"
+	var args []interface{}
+	if len(req.Ids) > 0 {
+		query += " WHERE id = ANY($1)"
+		args = append(args, pq.Array(req.Ids))
+	}
+
+	rows, err := db.QueryContext(stream.Context(), query, args...)
+	if err != nil {
+		log.Println("Error querying customers:", err)
+		return status.Error(codes.Internal, "Internal server error")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c Customer
+		if err := scanCustomer(rows, &c); err != nil {
+			log.Println("Error scanning customer row:", err)
+			return status.Error(codes.Internal, "Internal server error")
+		}
+		if err := stream.Send(customerToProto(c)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (customersServer) GetCustomer(ctx context.Context, req *GetCustomerRequest) (*CustomerRecord, error) {
+	var c Customer
+	err := scanCustomer(db.QueryRowContext(ctx, "SELECT "+customerColumns+" FROM customers.public.customers WHERE id = $1", req.Id), &c)
+	if err == sql.ErrNoRows {
+		return nil, status.Error(codes.NotFound, "Customer not found")
+	}
+	if err != nil {
+		log.Println("Error querying customer by ID:", err)
+		return nil, status.Error(codes.Internal, "Internal server error")
+	}
+	return customerToProto(c), nil
+}
+
+func (customersServer) CreateCustomer(ctx context.Context, req *CreateCustomerRequest) (*CustomerRecord, error) {
+	if req.Customer == nil {
+		return nil, status.Error(codes.InvalidArgument, "customer is required")
+	}
+	c := customerFromProto(req.Customer)
+
+	err := db.QueryRowContext(ctx, "INSERT INTO customers.public.customers(name, surname, age, phone_number, debit_card, credit_card, date_of_birth, date_of_issue, issuing_authority, has_foreign_country_tax_liability) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id",
+		c.Name, c.Surname, c.Age, c.PhoneNumber, c.DebitCard, c.CreditCard, c.DateOfBirth, c.DateOfIssue, c.IssuingAuthority, c.HasForeignCountryTaxLiability).Scan(&c.ID)
+	if err != nil {
+		log.Println("Error inserting new customer:", err)
+		return nil, status.Error(codes.Internal, "Internal server error")
+	}
+	return customerToProto(c), nil
+}
+
+func (customersServer) UpdateCustomer(ctx context.Context, req *UpdateCustomerRequest) (*emptypb.Empty, error) {
+	if req.Customer == nil {
+		return nil, status.Error(codes.InvalidArgument, "customer is required")
+	}
+	c := customerFromProto(req.Customer)
+
+	_, err := db.ExecContext(ctx, "UPDATE customers.public.customers SET name=$1, surname=$2, age=$3, phone_number=$4, debit_card=$5, credit_card=$6, date_of_birth=$7, date_of_issue=$8, issuing_authority=$9, has_foreign_country_tax_liability=$10 WHERE id=$11",
+		c.Name, c.Surname, c.Age, c.PhoneNumber, c.DebitCard, c.CreditCard, c.DateOfBirth, c.DateOfIssue, c.IssuingAuthority, c.HasForeignCountryTaxLiability, req.Id)
+	if err != nil {
+		log.Println("Error updating customer:", err)
+		return nil, status.Error(codes.Internal, "Internal server error")
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (customersServer) DeleteCustomer(ctx context.Context, req *DeleteCustomerRequest) (*emptypb.Empty, error) {
+	_, err := db.ExecContext(ctx, "DELETE FROM customers.public.customers WHERE id = $1", req.Id)
+	if err != nil {
+		log.Println("Error deleting customer:", err)
+		return nil, status.Error(codes.Internal, "Internal server error")
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func customerToProto(c Customer) *CustomerRecord {
+	return &CustomerRecord{
+		Id:                            int32(c.ID),
+		Name:                          c.Name,
+		Surname:                       c.Surname,
+		Age:                           int32(c.Age),
+		PhoneNumber:                   c.PhoneNumber,
+		DebitCard:                     c.DebitCard,
+		CreditCard:                    c.CreditCard,
+		DateOfBirth:                   timestamppb.New(c.DateOfBirth),
+		DateOfIssue:                   timestamppb.New(c.DateOfIssue),
+		IssuingAuthority:              c.IssuingAuthority,
+		HasForeignCountryTaxLiability: c.HasForeignCountryTaxLiability,
+	}
+}
+
+func customerFromProto(p *CustomerRecord) Customer {
+	return Customer{
+		ID:                            int(p.Id),
+		Name:                          p.Name,
+		Surname:                       p.Surname,
+		Age:                           int(p.Age),
+		PhoneNumber:                   p.PhoneNumber,
+		DebitCard:                     p.DebitCard,
+		CreditCard:                    p.CreditCard,
+		DateOfBirth:                   timeFromProto(p.DateOfBirth),
+		DateOfIssue:                   timeFromProto(p.DateOfIssue),
+		IssuingAuthority:              p.IssuingAuthority,
+		HasForeignCountryTaxLiability: p.HasForeignCountryTaxLiability,
+	}
+}
+
+// timeFromProto maps an unset timestamp to the zero time, as a missing date
+// in a REST request body would be.
+func timeFromProto(ts *timestamppb.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+	return ts.AsTime()
+}
@@ -9,10 +9,39 @@ import (
 	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/lib/pq"
 )
 
+// customerColumns are the columns scanCustomer reads, in order.
+const customerColumns = "id, name, surname, age, phone_number, debit_card, credit_card, date_of_birth, date_of_issue, issuing_authority, has_foreign_country_tax_liability"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanCustomer(row rowScanner, c *Customer) error {
+	return row.Scan(&c.ID, &c.Name, &c.Surname, &c.Age, &c.PhoneNumber, &c.DebitCard, &c.CreditCard, &c.DateOfBirth, &c.DateOfIssue, &c.IssuingAuthority, &c.HasForeignCountryTaxLiability)
+}
+
 func GetCustomers(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query("SELECT id, name, surname, age, phone_number, debit_card, credit_card, date_of_birth, date_of_issue, issuing_authority, has_foreign_country_tax_liability FROM customers.public.customers")
+	query := "SELECT " + customerColumns + " FROM customers.public.customers"
+	var args []interface{}
+	if idStrs := r.URL.Query()["id"]; len(idStrs) > 0 {
+		ids := make([]int64, 0, len(idStrs))
+		for _, idStr := range idStrs {
+			id, err := strconv.ParseInt(strings.TrimSpace(idStr), 10, 64)
+			if err != nil {
+				log.Println("Invalid customer ID:", err)
+				respondWithError(w, http.StatusBadRequest, "Invalid customer ID")
+				return
+			}
+			ids = append(ids, id)
+		}
+		query += " WHERE id = ANY($1)"
+		args = append(args, pq.Array(ids))
+	}
+
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		log.Println("Error querying customers:", err)
 		respondWithError(w, http.StatusInternalServerError, "Internal server error")
@@ -20,10 +49,10 @@ func GetCustomers(w http.ResponseWriter, r *http.Request) {
 	}
 	defer rows.Close()
 
-	var customers []Customer
+	customers := []Customer{}
 	for rows.Next() {
 		var c Customer
-		err := rows.Scan(&c.ID, &c.Name, &c.Surname, &c.Age, &c.PhoneNumber, &c.DebitCard, &c.CreditCard, &c.DateOfBirth, &c.DateOfIssue, &c.IssuingAuthority, &c.HasForeignCountryTaxLiability)
+		err := scanCustomer(rows, &c)
 		if err != nil {
 			log.Println("Error scanning customer row:", err)
 			respondWithError(w, http.StatusInternalServerError, "Internal server error")
@@ -56,7 +85,7 @@ func GetCustomer(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var c Customer
-	err = db.QueryRow("SELECT id, name, surname, age, phone_number, debit_card, credit_card, date_of_birth, date_of_issue, issuing_authority, has_foreign_country_tax_liability FROM customers.public.customers WHERE id = $1", id).Scan(&c.ID, &c.Name, &c.Surname, &c.Age, &c.PhoneNumber, &c.DebitCard, &c.CreditCard, &c.DateOfBirth, &c.DateOfIssue, &c.IssuingAuthority, &c.HasForeignCountryTaxLiability)
+	err = scanCustomer(db.QueryRow("SELECT "+customerColumns+" FROM customers.public.customers WHERE id = $1", id), &c)
 	if err != nil {
 		log.Println("Error querying customer by ID:", err)
 		if err == sql.ErrNoRows {
@@ -79,10 +108,10 @@ func CreateCustomer(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var newCustomer Customer
-	err := json.NewDecoder(r.Body).Decode(&newCustomer)
+	err := decodeJSONBody(r, &newCustomer)
 	if err != nil {
 		log.Println("Error decoding request body:", err)
-		respondWithError(w, http.StatusBadRequest, "Bad request")
+		respondWithBodyError(w, err)
 		return
 	}
 
@@ -104,10 +133,10 @@ func UpdateCustomer(w http.ResponseWriter, r *http.Request) {
 	id := params["id"]
 
 	var updatedCustomer Customer
-	err := json.NewDecoder(r.Body).Decode(&updatedCustomer)
+	err := decodeJSONBody(r, &updatedCustomer)
 	if err != nil {
 		log.Println("Error decoding request body:", err)
-		respondWithError(w, http.StatusBadRequest, "Bad request")
+		respondWithBodyError(w, err)
 		return
 	}
 
@@ -137,8 +166,8 @@ func DeleteCustomer(w http.ResponseWriter, r *http.Request) {
 }
 
 func respondWithError(w http.ResponseWriter, statusCode int, message string) {
-	w.WriteHeader(statusCode)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
 	errMsg := map[string]string{"error": message}
 	json.NewEncoder(w).Encode(errMsg)
 }
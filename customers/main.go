@@ -3,6 +3,7 @@ package main
 import (
 	"github.com/gorilla/mux"
 	"log"
+	"net"
 	"net/http"
 )
 
@@ -15,6 +16,17 @@ func main() {
 	router.HandleFunc("/customer", CreateCustomer).Methods("POST")
 	router.HandleFunc("/customer/{id}", UpdateCustomer).Methods("PUT")
 	router.HandleFunc("/customer/{id}", DeleteCustomer).Methods("DELETE")
+	router.HandleFunc("/openapi.json", OpenAPIHandler).Methods("GET")
+
+	grpcAddr := getEnv("GRPC_ADDR", ":9090")
+	lis, err := net.Listen("tcp", grpcAddr)
+	if err != nil {
+		log.Fatal("Error listening for gRPC:", err)
+	}
+	go func() {
+		log.Println("gRPC server started on", grpcAddr)
+		log.Fatal(newGRPCServer().Serve(lis))
+	}()
 
 	log.Println("Server started")
 	log.Fatal(http.ListenAndServe(":8080", router))
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// startAdmin serves the admin API on its own listener. It stays off unless an
+// admin token is configured, since it can drain upstreams and reload config.
+// The listener is bound once at startup; reloads do not move it. It returns
+// the server to shut down, or nil when the API is off.
+func startAdmin(cfg AdminConfig) *http.Server {
+	if cfg.Token == "" {
+		log.Println("Admin API disabled: GATEWAY_ADMIN_TOKEN is not set")
+		return nil
+	}
+
+	srv := &http.Server{Addr: cfg.Addr, Handler: adminAuth(cfg.Token, adminRouter())}
+	go func() {
+		log.Printf("Admin API listening on %s", cfg.Addr)
+		err := srv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Println("Error starting admin server:", err)
+		}
+	}()
+	return srv
+}
+
+func adminRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/routes", AdminRoutesHandler).Methods("GET")
+	router.HandleFunc("/upstreams", AdminUpstreamsHandler).Methods("GET")
+	router.HandleFunc("/upstreams/{name}/drain", AdminDrainHandler(true)).Methods("POST")
+	router.HandleFunc("/upstreams/{name}/undrain", AdminDrainHandler(false)).Methods("POST")
+	router.HandleFunc("/circuit-breakers", AdminCircuitBreakersHandler).Methods("GET")
+	router.HandleFunc("/rate-limits", AdminRateLimitsHandler).Methods("GET")
+	router.HandleFunc("/keys", AdminKeysHandler).Methods("GET")
+	router.HandleFunc("/config", AdminConfigHandler).Methods("GET")
+	router.HandleFunc("/config/reload", AdminReloadHandler).Methods("POST")
+	router.HandleFunc("/cache", AdminCacheHandler).Methods("GET")
+	router.HandleFunc("/cache/purge", AdminCachePurgeHandler).Methods("POST")
+	router.HandleFunc("/ip-filters", AdminIPFiltersHandler).Methods("GET")
+	router.HandleFunc("/waf", AdminWAFHandler).Methods("GET")
+	router.HandleFunc("/splits", AdminSplitsHandler).Methods("GET")
+	router.HandleFunc("/mirrors", AdminMirrorsHandler).Methods("GET")
+	router.HandleFunc("/recording", AdminRecordingHandler).Methods("GET")
+	router.HandleFunc("/usage", AdminUsageHandler).Methods("GET")
+	router.HandleFunc("/middleware", AdminMiddlewareHandler).Methods("GET")
+	router.HandleFunc("/faults", AdminFaultsHandler).Methods("GET")
+	router.HandleFunc("/faults/{route}", AdminSetFaultHandler).Methods("PUT")
+	router.HandleFunc("/faults/{route}", AdminClearFaultHandler).Methods("DELETE")
+	return router
+}
+
+// adminAuth checks the admin bearer token. It is deliberately separate from
+// the user JWTs so that a leaked user token never grants admin access.
+func adminAuth(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := extractToken(r)
+		if given == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func AdminRoutesHandler(w http.ResponseWriter, r *http.Request) {
+	gw := currentGateway()
+	writeJSON(w, http.StatusOK, gw.config.Routes)
+}
+
+func AdminUpstreamsHandler(w http.ResponseWriter, r *http.Request) {
+	gw := currentGateway()
+	names := make([]string, 0, len(gw.pools))
+	for name := range gw.pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	type upstream struct {
+		Name        string           `json:"name"`
+		Instances   []instanceStatus `json:"instances"`
+		Concurrency *limiterStatus   `json:"concurrency,omitempty"`
+	}
+	out := make([]upstream, 0, len(names))
+	for _, name := range names {
+		u := upstream{Name: name, Instances: gw.pools[name].status()}
+		if l := gw.pools[name].limiter; l != nil {
+			u.Concurrency = l.status()
+		}
+		out = append(out, u)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// AdminDrainHandler stops (or resumes) sending new requests to one instance.
+// Requests already in flight are left to finish; their count is reported by
+// GET /upstreams.
+func AdminDrainHandler(drain bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Instance string `json:"instance"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Instance == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "instance is required"})
+			return
+		}
+
+		pool, ok := currentGateway().pools[mux.Vars(r)["name"]]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "Upstream not found"})
+			return
+		}
+		inst := pool.instance(body.Instance)
+		if inst == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "Instance not found"})
+			return
+		}
+
+		inst.setDraining(drain)
+		log.Printf("Admin: upstream %s instance %s draining=%v", pool.name, inst.URL, drain)
+		writeJSON(w, http.StatusOK, inst.status())
+	}
+}
+
+// AdminCircuitBreakersHandler reports the state of every upstream's circuit
+// breaker, with how often it opened and the requests it rejected.
+func AdminCircuitBreakersHandler(w http.ResponseWriter, r *http.Request) {
+	gw := currentGateway()
+	names := make([]string, 0, len(gw.pools))
+	for name, pool := range gw.pools {
+		if pool.breaker != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	out := make([]breakerStatus, 0, len(names))
+	for _, name := range names {
+		out = append(out, gw.pools[name].breaker.status(name))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// AdminRateLimitsHandler reports every rate-limited route's settings, the
+// clients it is tracking and its allowed and limited counts.
+func AdminRateLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	gw := currentGateway()
+	out := []rateLimitStatus{}
+	for _, rc := range gw.config.Routes {
+		if l := gw.routes[rc.name()].rateLimiter; l != nil {
+			out = append(out, l.status(rc.name()))
+		}
+	}
+	for _, rt := range gw.endpointList() {
+		if rt.rateLimiter != nil {
+			out = append(out, rt.rateLimiter.status(rt.Name))
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// AdminKeysHandler lists the keys used to verify user tokens. Tokens are
+// signed with a shared HMAC secret, which has no public part, so only its
+// identity and algorithm are shown.
+func AdminKeysHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, []map[string]string{
+		{"kid": "default", "alg": "HS256", "kty": "oct"},
+	})
+}
+
+func AdminConfigHandler(w http.ResponseWriter, r *http.Request) {
+	gw := currentGateway()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"version":   gw.config.Version,
+		"source":    configSource(),
+		"loaded_at": gw.loadedAt.Format(time.RFC3339),
+	})
+}
+
+func AdminReloadHandler(w http.ResponseWriter, r *http.Request) {
+	gw, err := reloadConfig()
+	if err != nil {
+		log.Println("Admin: config reload failed:", err)
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		return
+	}
+	log.Printf("Admin: reloaded config version %s", gw.config.Version)
+	writeJSON(w, http.StatusOK, map[string]string{"version": gw.config.Version})
+}
+
+func AdminCacheHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentGateway().cache.Stats())
+}
+
+// AdminCachePurgeHandler drops cached responses whose path starts with the
+// given prefix, e.g. {"prefix": "/customer/42"}. No prefix empties the cache.
+func AdminCachePurgeHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Prefix string `json:"prefix"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+			return
+		}
+	}
+
+	n := currentGateway().cache.Purge(body.Prefix)
+	log.Printf("Admin: purged %d cached responses with prefix %q", n, body.Prefix)
+	writeJSON(w, http.StatusOK, map[string]int{"purged": n})
+}
+
+// AdminIPFiltersHandler lists the IP filters of every route and endpoint with their hit counts
+// since the last config load.
+func AdminIPFiltersHandler(w http.ResponseWriter, r *http.Request) {
+	gw := currentGateway()
+	out := []ipFilterStatus{}
+	for _, rc := range gw.config.Routes {
+		for _, f := range gw.routes[rc.name()].ipFilters {
+			out = append(out, f.status(rc.name()))
+		}
+	}
+	for _, rt := range gw.endpointList() {
+		for _, f := range rt.ipFilters {
+			out = append(out, f.status(rt.Name))
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func AdminWAFHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentGateway().waf.status())
+}
+
+// AdminSplitsHandler reports each split route's variants with their request,
+// error and latency figures since the last config load.
+func AdminSplitsHandler(w http.ResponseWriter, r *http.Request) {
+	gw := currentGateway()
+	out := []splitStatus{}
+	for _, rc := range gw.config.Routes {
+		if s := gw.routes[rc.name()].split; s != nil {
+			out = append(out, s.status(rc.name()))
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// AdminMirrorsHandler reports each mirrored route's comparison counts and
+// its most recent differences.
+func AdminMirrorsHandler(w http.ResponseWriter, r *http.Request) {
+	gw := currentGateway()
+	out := []mirrorStatus{}
+	for _, rc := range gw.config.Routes {
+		if m := gw.routes[rc.name()].mirror; m != nil {
+			out = append(out, m.status(rc.name()))
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// AdminFaultsHandler lists every route's faults, where they were set and how
+// many requests they hit since the last config load.
+func AdminFaultsHandler(w http.ResponseWriter, r *http.Request) {
+	gw := currentGateway()
+	out := []faultStatus{}
+	for _, rc := range gw.config.Routes {
+		out = append(out, gw.routes[rc.name()].faults.status(rc.name()))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// AdminSetFaultHandler replaces a route's faults, e.g.
+// {"abort": {"status": 503, "percent": 50}}. The change is kept across
+// config reloads.
+func AdminSetFaultHandler(w http.ResponseWriter, r *http.Request) {
+	rt, ok := currentGateway().routes[mux.Vars(r)["route"]]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Route not found"})
+		return
+	}
+	var cfg FaultConfig
+	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		return
+	}
+	if err := cfg.validate(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	rt.faults.set(&cfg)
+	log.Printf("Admin: faults on route %s set", rt.name())
+	writeJSON(w, http.StatusOK, rt.faults.status(rt.name()))
+}
+
+// AdminClearFaultHandler turns a route's faults off, including ones from the
+// config, until they are set again.
+func AdminClearFaultHandler(w http.ResponseWriter, r *http.Request) {
+	rt, ok := currentGateway().routes[mux.Vars(r)["route"]]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Route not found"})
+		return
+	}
+	rt.faults.set(nil)
+	log.Printf("Admin: faults on route %s cleared", rt.name())
+	writeJSON(w, http.StatusOK, rt.faults.status(rt.name()))
+}
+
+// AdminUsageHandler reports request counts per user, day and month with the
+// user's limits, for billing. ?tenant= limits it to one user.
+func AdminUsageHandler(w http.ResponseWriter, r *http.Request) {
+	q := currentGateway().quotas
+	if q == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Quotas are not configured"})
+		return
+	}
+	report, err := q.report(r.URL.Query().Get("tenant"))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// AdminMiddlewareHandler lists the middleware routes can use, each route's
+// chain, outermost first, and how often each plugin ran and failed.
+func AdminMiddlewareHandler(w http.ResponseWriter, r *http.Request) {
+	gw := currentGateway()
+	chains := make(map[string][]string)
+	for name, rt := range gw.routes {
+		chain := defaultChain
+		if rt.Middleware != nil {
+			chain = nil
+			for _, e := range rt.Middleware {
+				chain = append(chain, e.Name)
+			}
+		}
+		chains[name] = chain
+	}
+	endpoints := make(map[string][]string)
+	for name, rt := range gw.endpoints {
+		for _, e := range rt.Middleware {
+			endpoints[name] = append(endpoints[name], e.Name)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"available": middlewareNames(),
+		"routes":    chains,
+		"endpoints": endpoints,
+		"plugins":   gw.pluginStatuses(),
+	})
+}
+
+func AdminRecordingHandler(w http.ResponseWriter, r *http.Request) {
+	rec := currentGateway().recorder
+	if rec == nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"enabled": false})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"enabled":  true,
+		"path":     rec.path,
+		"recorded": atomic.LoadInt64(&rec.recorded),
+		"dropped":  atomic.LoadInt64(&rec.dropped),
+	})
+}
+
+func configSource() string {
+	if configPath == "" {
+		return "built-in"
+	}
+	return configPath
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// audit logs who did what on a route, after the response is sent:
+//
+//	{"name": "audit", "config": {"methods": ["POST", "PUT", "DELETE"], "headers": ["X-Request-Id"]}}
+//
+// Placed after "jwt" in a chain it knows the user. Methods defaults to every
+// method; Headers are request headers added to each line.
+func init() {
+	RegisterMiddleware("audit", newAuditLog)
+}
+
+func newAuditLog(route RouteConfig, config json.RawMessage) (Middleware, error) {
+	var cfg struct {
+		Methods []string `json:"methods"`
+		Headers []string `json:"headers"`
+	}
+	if len(config) > 0 {
+		if err := json.Unmarshal(config, &cfg); err != nil {
+			return nil, fmt.Errorf("invalid config: %w", err)
+		}
+	}
+	methods := make(map[string]bool)
+	for _, m := range cfg.Methods {
+		methods[strings.ToUpper(m)] = true
+	}
+
+	return MiddlewareFunc(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(methods) > 0 && !methods[r.Method] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w}
+			next.ServeHTTP(sw, r)
+
+			user := "-"
+			if claims := claimsFromRequest(r); claims != nil {
+				user = claims.Username
+			}
+			line := fmt.Sprintf("route=%s user=%s method=%s path=%s status=%d duration=%s",
+				route.name(), user, r.Method, r.URL.RequestURI(), sw.status, time.Since(start).Round(time.Millisecond))
+			for _, h := range cfg.Headers {
+				line += fmt.Sprintf(" %s=%q", strings.ToLower(h), r.Header.Get(h))
+			}
+			log.Printf("Audit: %s", line)
+		})
+	}), nil
+}
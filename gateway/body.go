@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+)
+
+var (
+	errBodyTooLarge = errors.New("request body too large")
+	errJSONTooDeep  = errors.New("JSON nesting too deep")
+)
+
+// bodyLimitMiddleware enforces the route's request body rules before anything
+// reaches the upstream: 413 for oversized bodies, 415 for disallowed content
+// types and 400 for JSON nested deeper than allowed.
+func bodyLimitMiddleware(rt *route, next http.Handler) http.Handler {
+	cfg := rt.Body
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody || r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if cfg.MaxBytes > 0 && r.ContentLength > cfg.MaxBytes {
+			writeBodyError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+			return
+		}
+
+		body, err := readLimited(r.Body, cfg.MaxBytes)
+		r.Body.Close()
+		if err == errBodyTooLarge {
+			writeBodyError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+			return
+		}
+		if err != nil {
+			writeBodyError(w, http.StatusBadRequest, "Error reading request body")
+			return
+		}
+
+		if len(body) > 0 {
+			mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if len(cfg.ContentTypes) > 0 && !contentTypeAllowed(mediaType, cfg.ContentTypes) {
+				writeBodyError(w, http.StatusUnsupportedMediaType, "Unsupported content type")
+				return
+			}
+			if cfg.MaxJSONDepth > 0 && isJSONMediaType(mediaType) {
+				if err := checkJSONDepth(body, cfg.MaxJSONDepth); err == errJSONTooDeep {
+					writeBodyError(w, http.StatusBadRequest, "JSON nesting too deep")
+					return
+				} else if err != nil {
+					writeBodyError(w, http.StatusBadRequest, "Invalid JSON body")
+					return
+				}
+			}
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readLimited reads all of body, failing with errBodyTooLarge once more than
+// max bytes arrive. A max of zero means no limit.
+func readLimited(body io.Reader, max int64) ([]byte, error) {
+	if max <= 0 {
+		return io.ReadAll(body)
+	}
+	data, err := io.ReadAll(io.LimitReader(body, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, errBodyTooLarge
+	}
+	return data, nil
+}
+
+// defaultMaxBodyBytes bounds the bodies that steps buffer on routes without
+// a body.max_bytes of their own.
+const defaultMaxBodyBytes = 1 << 20
+
+// maxBodyBytes is the most of a request body that the route's steps buffer.
+func (rt *route) maxBodyBytes() int64 {
+	if rt.Body != nil && rt.Body.MaxBytes > 0 {
+		return rt.Body.MaxBytes
+	}
+	return defaultMaxBodyBytes
+}
+
+// bufferBody reads the whole request body for a step that needs it and puts
+// it back for the next. The limit holds whether or not the body step ran
+// first; when the body is too large or unreadable bufferBody answers the
+// request itself and returns false.
+func bufferBody(w http.ResponseWriter, r *http.Request, max int64) ([]byte, bool) {
+	body, err := readLimited(r.Body, max)
+	r.Body.Close()
+	if err == errBodyTooLarge {
+		writeBodyError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+		return nil, false
+	}
+	if err != nil {
+		writeBodyError(w, http.StatusBadRequest, "Error reading request body")
+		return nil, false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return body, true
+}
+
+func isJSONMediaType(mediaType string) bool {
+	return mediaType == "application/json" || (len(mediaType) > 5 && mediaType[len(mediaType)-5:] == "+json")
+}
+
+// checkJSONDepth walks the token stream without building values, so deeply
+// nested payloads are rejected before anything decodes them. The services
+// run the same check from customers/body.go.
+func checkJSONDepth(data []byte, max int) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+			if depth > max {
+				return errJSONTooDeep
+			}
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+}
+
+// writeBodyError uses the same {"error": "..."} shape as the services.
+func writeBodyError(w http.ResponseWriter, statusCode int, message string) {
+	writeJSON(w, statusCode, map[string]string{"error": message})
+}
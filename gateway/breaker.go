@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errCircuitOpen = errors.New("upstream circuit breaker is open")
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// circuitBreaker stops sending requests to an upstream after a run of
+// failed responses. Once OpenFor has passed it lets one request through
+// at a time; a success closes the breaker again and a failure reopens it.
+type circuitBreaker struct {
+	cfg *CircuitBreakerConfig
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+	opens    int64
+	rejected int64
+}
+
+type breakerStatus struct {
+	Upstream string    `json:"upstream"`
+	State    string    `json:"state"`
+	Failures int       `json:"failures"`
+	OpenedAt time.Time `json:"opened_at,omitempty"`
+	Opens    int64     `json:"opens"`
+	Rejected int64     `json:"rejected"`
+}
+
+func newCircuitBreaker(cfg *CircuitBreakerConfig) *circuitBreaker {
+	return &circuitBreaker{cfg: cfg, state: breakerClosed}
+}
+
+// allow reports whether a request may go to the upstream, and if not, how
+// long until the breaker lets one through.
+func (b *circuitBreaker) allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		wait := b.cfg.openFor() - time.Since(b.openedAt)
+		if wait > 0 {
+			b.rejected++
+			return false, wait
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return true, 0
+	case breakerHalfOpen:
+		if b.probing {
+			b.rejected++
+			return false, time.Second
+		}
+		b.probing = true
+	}
+	return true, 0
+}
+
+// record counts the response to an allowed request. Status 0 means the
+// handler never wrote a header, which is a 200.
+func (b *circuitBreaker) record(status int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if status < http.StatusInternalServerError {
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.cfg.failureThreshold() {
+		if b.state != breakerOpen {
+			b.opens++
+		}
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+func (b *circuitBreaker) status(upstream string) breakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := breakerStatus{
+		Upstream: upstream,
+		State:    b.state,
+		Failures: b.failures,
+		Opens:    b.opens,
+		Rejected: b.rejected,
+	}
+	if b.state != breakerClosed {
+		s.OpenedAt = b.openedAt
+	}
+	return s
+}
+
+// breakerMiddleware answers 503 while the breaker of the upstream the
+// request is sent to is open, and feeds it the responses of the others.
+func breakerMiddleware(rt *route, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := rt.upstreamFor(r).breaker
+		if b == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ok, wait := b.allow(); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": errCircuitOpen.Error()})
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		// A panic counts as a failure, so a probe never leaves the breaker
+		// half open for good.
+		status := http.StatusInternalServerError
+		defer func() { b.record(status) }()
+		next.ServeHTTP(sw, r)
+		status = sw.status
+	})
+}
+
+func (c *CircuitBreakerConfig) failureThreshold() int {
+	if c.FailureThreshold > 0 {
+		return c.FailureThreshold
+	}
+	return 5
+}
+
+func (c *CircuitBreakerConfig) openFor() time.Duration {
+	if c.OpenFor.Duration > 0 {
+		return c.OpenFor.Duration
+	}
+	return 30 * time.Second
+}
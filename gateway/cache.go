@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheStore holds cached upstream responses. The gateway ships an in-memory
+// LRU; anything shared between gateway replicas can implement the same
+// interface and be installed with SetCacheStore.
+type CacheStore interface {
+	Get(key string) (*cachedResponse, bool)
+	Set(key string, entry *cachedResponse)
+	Delete(key string)
+	// Purge removes every entry whose key starts with prefix and returns how
+	// many were removed. An empty prefix empties the store.
+	Purge(prefix string) int
+	Stats() CacheStats
+}
+
+type CacheStats struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+}
+
+type cachedResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	ETag       string
+	// Vary holds the request header values the response was stored for.
+	Vary     map[string]string
+	StoredAt time.Time
+	Expires  time.Time
+}
+
+func (e *cachedResponse) size() int64 {
+	n := int64(len(e.Body))
+	for k, vs := range e.Header {
+		n += int64(len(k))
+		for _, v := range vs {
+			n += int64(len(v))
+		}
+	}
+	return n
+}
+
+func (e *cachedResponse) fresh(now time.Time) bool {
+	return now.Before(e.Expires)
+}
+
+func (e *cachedResponse) matches(r *http.Request) bool {
+	for name, value := range e.Vary {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+type lruStore struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	ll       *list.List
+	items    map[string]*list.Element
+	hits     int64
+	misses   int64
+}
+
+type lruItem struct {
+	key   string
+	entry *cachedResponse
+}
+
+func newLRUStore(maxBytes int64) *lruStore {
+	return &lruStore{maxBytes: maxBytes, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (s *lruStore) Get(key string) (*cachedResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		s.misses++
+		return nil, false
+	}
+	s.hits++
+	s.ll.MoveToFront(el)
+	return el.Value.(*lruItem).entry, true
+}
+
+func (s *lruStore) Set(key string, entry *cachedResponse) {
+	size := entry.size()
+	if size > s.maxBytes {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[key]; ok {
+		s.removeElement(el)
+	}
+	s.items[key] = s.ll.PushFront(&lruItem{key: key, entry: entry})
+	s.bytes += size
+	for s.bytes > s.maxBytes {
+		s.removeElement(s.ll.Back())
+	}
+}
+
+func (s *lruStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[key]; ok {
+		s.removeElement(el)
+	}
+}
+
+func (s *lruStore) Purge(prefix string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for key, el := range s.items {
+		if strings.HasPrefix(key, prefix) {
+			s.removeElement(el)
+			n++
+		}
+	}
+	return n
+}
+
+func (s *lruStore) Stats() CacheStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return CacheStats{Entries: len(s.items), Bytes: s.bytes, Hits: s.hits, Misses: s.misses}
+}
+
+func (s *lruStore) removeElement(el *list.Element) {
+	item := el.Value.(*lruItem)
+	s.ll.Remove(el)
+	delete(s.items, item.key)
+	s.bytes -= item.entry.size()
+}
+
+// cacheMiddleware serves GET requests from store when the upstream allowed
+// it, revalidates stale entries that carry an ETag, and drops the route's
+// entries after any successful write through the gateway.
+func cacheMiddleware(store CacheStore, rt *route, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			sw := &statusWriter{ResponseWriter: w}
+			next.ServeHTTP(sw, r)
+			// A handler that never wrote a header answered 200.
+			status := sw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			if r.Method != http.MethodHead && status >= http.StatusOK && status < http.StatusBadRequest {
+				store.Purge("/" + rt.Service)
+			}
+			return
+		}
+
+		reqCC := parseCacheControl(r.Header.Get("Cache-Control"))
+		if _, ok := reqCC["no-store"]; ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := cacheKey(rt, r)
+		now := time.Now()
+		entry, ok := store.Get(key)
+		if ok && !entry.matches(r) {
+			ok = false
+		}
+		_, noCache := reqCC["no-cache"]
+		if ok && entry.fresh(now) && !noCache {
+			writeCached(w, r, entry, "HIT")
+			return
+		}
+
+		upstreamReq := r.Clone(r.Context())
+		upstreamReq.Header.Del("If-None-Match")
+		upstreamReq.Header.Del("If-Modified-Since")
+		if ok && entry.ETag != "" {
+			upstreamReq.Header.Set("If-None-Match", entry.ETag)
+		}
+
+		capture := newResponseCapture()
+		next.ServeHTTP(capture, upstreamReq)
+
+		if ok && capture.status == http.StatusNotModified {
+			refreshed := *entry
+			refreshed.StoredAt = now
+			h := capture.header
+			if h.Get("Cache-Control") == "" {
+				h = entry.Header
+			}
+			if ttl, cacheable := cacheTTL(rt, h); cacheable {
+				refreshed.Expires = now.Add(ttl)
+			}
+			store.Set(key, &refreshed)
+			writeCached(w, r, &refreshed, "REVALIDATED")
+			return
+		}
+
+		if ttl, cacheable := cacheTTL(rt, capture.header); capture.status == http.StatusOK && cacheable {
+			entry := &cachedResponse{
+				StatusCode: capture.status,
+				Header:     capture.header.Clone(),
+				Body:       capture.body.Bytes(),
+				ETag:       capture.header.Get("ETag"),
+				Vary:       varyValues(capture.header, r),
+				StoredAt:   now,
+				Expires:    now.Add(ttl),
+			}
+			store.Set(key, entry)
+			writeCached(w, r, entry, "MISS")
+			return
+		}
+
+		copyHeaders(w.Header(), capture.header)
+		w.Header().Set("X-Cache", "BYPASS")
+		w.WriteHeader(capture.status)
+		w.Write(capture.body.Bytes())
+	})
+}
+
+// cacheKey starts with the request path so that purges by path prefix work.
+// Routes with hosts keep their entries apart from other routes on the same
+// path. Routes with vary_by_user get one entry per authenticated user.
+func cacheKey(rt *route, r *http.Request) string {
+	key := r.URL.Path + "?" + r.URL.RawQuery
+	if len(rt.Hosts) > 0 {
+		key += "\x00route=" + rt.name()
+	}
+	if v := variantFromRequest(r); v != nil {
+		key += "\x00variant=" + v.name
+	}
+	if rt.Cache.VaryByUser {
+		if claims := claimsFromRequest(r); claims != nil {
+			key += "\x00user=" + claims.Username
+		}
+	}
+	return key
+}
+
+// cacheTTL decides whether a response may be stored and for how long. A
+// route TTL overrides the upstream's max-age but never makes a response
+// cacheable that the upstream marked no-store, or private on a shared key.
+func cacheTTL(rt *route, h http.Header) (time.Duration, bool) {
+	cc := parseCacheControl(h.Get("Cache-Control"))
+	if _, ok := cc["no-store"]; ok {
+		return 0, false
+	}
+	if !rt.Cache.VaryByUser {
+		if _, ok := cc["private"]; ok {
+			return 0, false
+		}
+		if h.Get("Set-Cookie") != "" {
+			return 0, false
+		}
+	}
+	if strings.TrimSpace(h.Get("Vary")) == "*" {
+		return 0, false
+	}
+	if _, ok := cc["no-cache"]; ok {
+		// Stored only to be revalidated on every request.
+		return 0, h.Get("ETag") != ""
+	}
+	if rt.Cache.TTL.Duration > 0 {
+		return rt.Cache.TTL.Duration, true
+	}
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[directive]; ok {
+			secs, err := strconv.Atoi(v)
+			if err != nil || secs <= 0 {
+				return 0, false
+			}
+			return time.Duration(secs) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+func writeCached(w http.ResponseWriter, r *http.Request, entry *cachedResponse, status string) {
+	copyHeaders(w.Header(), entry.Header)
+	w.Header().Set("X-Cache", status)
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.StoredAt).Seconds())))
+
+	if entry.ETag != "" && etagMatches(r.Header.Get("If-None-Match"), entry.ETag) {
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(entry.StatusCode)
+	w.Write(entry.Body)
+}
+
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	weak := strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == weak {
+			return true
+		}
+	}
+	return false
+}
+
+func varyValues(h http.Header, r *http.Request) map[string]string {
+	vary := make(map[string]string)
+	for _, line := range h.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" {
+				vary[name] = r.Header.Get(name)
+			}
+		}
+	}
+	return vary
+}
+
+func parseCacheControl(v string) map[string]string {
+	cc := make(map[string]string)
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value := part, ""
+		if i := strings.Index(part, "="); i >= 0 {
+			name, value = part[:i], strings.Trim(part[i+1:], `"`)
+		}
+		cc[strings.ToLower(name)] = value
+	}
+	return cc
+}
+
+// responseCapture buffers a response so that middleware can inspect or store
+// it before anything is sent to the client.
+type responseCapture struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseCapture() *responseCapture {
+	return &responseCapture{header: make(http.Header), status: http.StatusOK}
+}
+
+func (c *responseCapture) Header() http.Header { return c.header }
+
+func (c *responseCapture) WriteHeader(status int) { c.status = status }
+
+func (c *responseCapture) Write(b []byte) (int, error) { return c.body.Write(b) }
+
+// statusWriter remembers the status code written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// flightGroup runs one call per key at a time; callers arriving while it is
+// in progress wait for and share its result.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done    chan struct{}
+	capture *responseCapture
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[string]*flightCall)}
+}
+
+// do returns the shared response for key and whether it came from another
+// caller's request. A caller that waits for another's request gives up with
+// ctx's error when ctx is done.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() *responseCapture) (capture *responseCapture, shared bool, err error) {
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-c.done:
+			return c.capture, true, nil
+		case <-ctx.Done():
+			return nil, true, ctx.Err()
+		}
+	}
+	c := &flightCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	// A panicking call still releases the key and gives everyone, the
+	// caller included, a 502 instead of a nil response.
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Coalesce: call for %q panicked: %v", key, p)
+			c.capture = newResponseCapture()
+			writeJSON(c.capture, http.StatusBadGateway, map[string]string{"error": "Error proxying request"})
+			capture = c.capture
+		}
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+	c.capture = fn()
+	return c.capture, false, nil
+}
+
+// coalesceMiddleware collapses identical concurrent GETs into one upstream
+// call. Requests are identical when method, path, query, the configured
+// headers, the conditional headers and the authenticated user all match.
+func coalesceMiddleware(rt *route, next http.Handler) http.Handler {
+	group := newFlightGroup()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		capture, shared, err := group.do(r.Context(), coalesceKey(rt, r), func() *responseCapture {
+			// The upstream call must not be cancelled just because the first
+			// client went away while others are still waiting for it.
+			ctx, cancel := context.WithTimeout(detachedContext{r.Context()}, rt.Coalesce.timeout())
+			defer cancel()
+			capture := newResponseCapture()
+			next.ServeHTTP(capture, r.WithContext(ctx))
+			return capture
+		})
+		if err != nil {
+			// The client went away while waiting; nobody is left to answer.
+			return
+		}
+
+		copyHeaders(w.Header(), capture.header)
+		if shared {
+			w.Header().Set("X-Coalesced", "true")
+		}
+		w.WriteHeader(capture.status)
+		w.Write(capture.body.Bytes())
+	})
+}
+
+func coalesceKey(rt *route, r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteString(" ")
+	b.WriteString(r.URL.Path)
+	b.WriteString("?")
+	b.WriteString(r.URL.RawQuery)
+
+	headers := append([]string(nil), rt.Coalesce.Headers...)
+	sort.Strings(headers)
+	for _, name := range headers {
+		b.WriteString("\x00")
+		b.WriteString(http.CanonicalHeaderKey(name))
+		b.WriteString("=")
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	// A conditional GET may be answered with an empty 304, which only suits
+	// clients that sent the same conditions.
+	for _, name := range []string{"If-None-Match", "If-Modified-Since"} {
+		if v := r.Header.Values(name); len(v) > 0 {
+			b.WriteString("\x00")
+			b.WriteString(name)
+			b.WriteString("=")
+			b.WriteString(strings.Join(v, ","))
+		}
+	}
+	if v := variantFromRequest(r); v != nil {
+		b.WriteString("\x00variant=")
+		b.WriteString(v.name)
+	}
+	if claims := claimsFromRequest(r); claims != nil {
+		b.WriteString("\x00user=")
+		b.WriteString(claims.Username)
+	}
+	return b.String()
+}
+
+func (c *CoalesceConfig) timeout() time.Duration {
+	if c.Timeout.Duration > 0 {
+		return c.Timeout.Duration
+	}
+	return 30 * time.Second
+}
+
+// detachedContext keeps the values of its parent but not its cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type sectionError struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+type sectionResult struct {
+	name  string
+	body  json.RawMessage
+	err   *sectionError
+	isReq bool
+}
+
+// compositeHandler fans a request out to its sections in parallel and merges
+// the JSON results into one object keyed by section name. Each section is
+// fetched through the gateway's own routes, so their auth, caching and
+// transformations apply. Failed sections are listed under "errors"; if a
+// required section fails the whole request fails with its status.
+func compositeHandler(gw *gatewayState, cfg CompositeConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		results := make([]sectionResult, len(cfg.Sections))
+
+		var wg sync.WaitGroup
+		for i, section := range cfg.Sections {
+			wg.Add(1)
+			go func(i int, section CompositeSectionConfig) {
+				defer wg.Done()
+				results[i] = fetchSection(gw, r, section, vars, cfg.sectionTimeout(section))
+			}(i, section)
+		}
+		wg.Wait()
+
+		out := make(map[string]interface{})
+		errs := make(map[string]*sectionError)
+		for _, res := range results {
+			if res.err == nil {
+				out[res.name] = res.body
+				continue
+			}
+			if res.isReq {
+				writeJSON(w, requiredSectionStatus(res.err.Status), map[string]string{"error": res.name + ": " + res.err.Error})
+				return
+			}
+			out[res.name] = nil
+			errs[res.name] = res.err
+		}
+		if len(errs) > 0 {
+			out["errors"] = errs
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
+
+func fetchSection(gw *gatewayState, r *http.Request, section CompositeSectionConfig, vars map[string]string, timeout time.Duration) sectionResult {
+	res := sectionResult{name: section.Name, isReq: section.Required}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, expandPath(section.Path, vars), nil)
+	if err != nil {
+		res.err = &sectionError{Status: http.StatusInternalServerError, Error: "invalid section path"}
+		return res
+	}
+	// Sections resolve to the routes of the host the composite was called on.
+	req.Host = r.Host
+	req.RemoteAddr = r.RemoteAddr
+	copyHeaders(req.Header, r.Header)
+	// Sections are merged as plain JSON, so they must not come back encoded.
+	req.Header.Del("Accept-Encoding")
+	req.Header.Del("If-None-Match")
+
+	capture := newResponseCapture()
+	gw.router.ServeHTTP(capture, req)
+
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		res.err = &sectionError{Status: http.StatusGatewayTimeout, Error: "timeout after " + timeout.String()}
+	case capture.status < 200 || capture.status > 299:
+		res.err = &sectionError{Status: capture.status, Error: strings.TrimSpace(capture.body.String())}
+	case !json.Valid(capture.body.Bytes()):
+		res.err = &sectionError{Status: http.StatusBadGateway, Error: "section did not return JSON"}
+	default:
+		res.body = json.RawMessage(bytes.TrimSpace(capture.body.Bytes()))
+	}
+	return res
+}
+
+// expandPath fills {name} placeholders in a section path from the composite
+// route's variables. Values in the query string are query-escaped, so that
+// they cannot add parameters of their own.
+func expandPath(path string, vars map[string]string) string {
+	query := ""
+	if i := strings.Index(path, "?"); i >= 0 {
+		path, query = path[:i], path[i:]
+	}
+	for name, value := range vars {
+		path = strings.ReplaceAll(path, "{"+name+"}", url.PathEscape(value))
+		query = strings.ReplaceAll(query, "{"+name+"}", url.QueryEscape(value))
+	}
+	return path + query
+}
+
+func requiredSectionStatus(status int) int {
+	if status >= 400 && status < 500 || status == http.StatusGatewayTimeout {
+		return status
+	}
+	return http.StatusBadGateway
+}
+
+func (c CompositeConfig) sectionTimeout(s CompositeSectionConfig) time.Duration {
+	if s.Timeout.Duration > 0 {
+		return s.Timeout.Duration
+	}
+	if c.Timeout.Duration > 0 {
+		return c.Timeout.Duration
+	}
+	return 5 * time.Second
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+var defaultCompressibleTypes = []string{"application/json", "text/*"}
+
+// compressMiddleware compresses responses the client can decode, preferring
+// brotli over gzip. Responses the upstream already encoded are passed through
+// untouched.
+func compressMiddleware(rt *route, next http.Handler) http.Handler {
+	cfg := rt.Compression
+	types := cfg.ContentTypes
+	if len(types) == 0 {
+		types = defaultCompressibleTypes
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		capture := newResponseCapture()
+		next.ServeHTTP(capture, r)
+
+		h := capture.header
+		body := capture.body.Bytes()
+		copyHeaders(w.Header(), h)
+		addVary(w.Header(), "Accept-Encoding")
+
+		if !shouldCompress(capture, cfg.MinSize, types) {
+			w.WriteHeader(capture.status)
+			w.Write(body)
+			return
+		}
+
+		compressed, err := encodeBody(encoding, body)
+		if err != nil {
+			w.WriteHeader(capture.status)
+			w.Write(body)
+			return
+		}
+
+		w.Header().Set("Content-Encoding", encoding)
+		w.Header().Set("Content-Length", strconv.Itoa(len(compressed)))
+		if etag := w.Header().Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			// The bytes differ from the upstream representation.
+			w.Header().Set("ETag", "W/"+etag)
+		}
+		w.WriteHeader(capture.status)
+		w.Write(compressed)
+	})
+}
+
+func shouldCompress(c *responseCapture, minSize int, types []string) bool {
+	if c.header.Get("Content-Encoding") != "" {
+		return false
+	}
+	if c.status < http.StatusOK || c.status == http.StatusNoContent || c.status == http.StatusNotModified {
+		return false
+	}
+	if strings.Contains(c.header.Get("Cache-Control"), "no-transform") {
+		return false
+	}
+	if c.body.Len() < minSize || c.body.Len() == 0 {
+		return false
+	}
+	return contentTypeAllowed(c.header.Get("Content-Type"), types)
+}
+
+// contentTypeAllowed matches the media type against entries like
+// "application/json" or "text/*".
+func contentTypeAllowed(contentType string, allowed []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if a == mediaType || a == "*/*" {
+			return true
+		}
+		if strings.HasSuffix(a, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(a, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateEncoding picks br or gzip from an Accept-Encoding header, honouring
+// q-values. It returns "" when neither is acceptable.
+func negotiateEncoding(acceptEncoding string) string {
+	type candidate struct {
+		name string
+		q    float64
+	}
+	q := map[string]float64{}
+	wildcard := -1.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+		weight := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					weight = v
+				}
+			}
+		}
+		if name == "*" {
+			wildcard = weight
+		} else {
+			q[name] = weight
+		}
+	}
+
+	var candidates []candidate
+	for _, name := range []string{"br", "gzip"} {
+		weight, ok := q[name]
+		if !ok {
+			weight = wildcard
+		}
+		if weight > 0 {
+			candidates = append(candidates, candidate{name, weight})
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+	return candidates[0].name
+}
+
+func encodeBody(encoding string, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch encoding {
+	case "br":
+		bw := brotli.NewWriterLevel(&buf, brotli.DefaultCompression)
+		if _, err = bw.Write(body); err == nil {
+			err = bw.Close()
+		}
+	default:
+		gw := gzip.NewWriter(&buf)
+		if _, err = gw.Write(body); err == nil {
+			err = gw.Close()
+		}
+	}
+	return buf.Bytes(), err
+}
+
+func addVary(h http.Header, name string) {
+	for _, line := range h.Values("Vary") {
+		for _, v := range strings.Split(line, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
@@ -0,0 +1,863 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Version   string                    `json:"version"`
+	Routes    []RouteConfig             `json:"routes"`
+	Upstreams map[string]UpstreamConfig `json:"upstreams"`
+	Admin     AdminConfig               `json:"admin"`
+	Cache     CacheStoreConfig          `json:"cache"`
+	// TrustedProxies lists the CIDRs whose X-Forwarded-For entries are
+	// believed when working out the client address.
+	TrustedProxies []string  `json:"trusted_proxies"`
+	WAF            WAFConfig `json:"waf"`
+	// Composites are routes that merge several gateway routes into one
+	// response.
+	Composites []CompositeConfig `json:"composites"`
+	GraphQL    *GraphQLConfig    `json:"graphql"`
+	// Record appends request/response pairs to a JSONL file for
+	// "gateway replay".
+	Record *RecordConfig `json:"record"`
+	// Quotas count every user's requests and limit them per day and month.
+	Quotas *QuotaConfig `json:"quotas"`
+	// OpenAPI serves one OpenAPI document for the gateway, merged from the
+	// upstreams' own, with a docs page.
+	OpenAPI *OpenAPIConfig `json:"openapi"`
+	// Plugins are Lua scripts that routes list in their middleware chain
+	// by the plugin's name.
+	Plugins map[string]PluginConfig `json:"plugins"`
+}
+
+type RouteConfig struct {
+	Service  string   `json:"service"`
+	Upstream string   `json:"upstream"`
+	Methods  []string `json:"methods"`
+	// Name identifies the route in the admin API, logs and other config
+	// sections, and defaults to Service. Routes that serve the same service
+	// on different hosts need names of their own.
+	Name string `json:"name,omitempty"`
+	// Hosts limits the route to requests for these hosts, either exact
+	// ("api.example.com") or wildcards for any subdomain
+	// ("*.partners.example.com"). Without hosts the route serves any host
+	// that no other route of its service claims.
+	Hosts []string `json:"hosts,omitempty"`
+	// Cache enables response caching for GET requests on the route.
+	Cache *CacheConfig `json:"cache,omitempty"`
+	// Coalesce collapses identical concurrent GETs into one upstream call.
+	Coalesce *CoalesceConfig `json:"coalesce,omitempty"`
+	// Compression gzip/brotli-encodes responses per Accept-Encoding.
+	Compression *CompressionConfig `json:"compression,omitempty"`
+	// RateLimit limits how fast each user, or each client address for
+	// anonymous requests, may call the route.
+	RateLimit *RateLimitConfig `json:"rate_limit,omitempty"`
+	// Body limits request bodies before they are proxied.
+	Body *BodyConfig `json:"body,omitempty"`
+	// CORS answers preflight requests and adds CORS headers for browsers.
+	CORS *CORSConfig `json:"cors,omitempty"`
+	// IPFilters restrict the route, or some methods and paths of it, to
+	// client addresses.
+	IPFilters []IPFilterConfig `json:"ip_filters,omitempty"`
+	// WAF runs the firewall rules against requests on the route.
+	WAF *RouteWAFConfig `json:"waf,omitempty"`
+	// Transform rewrites requests and responses between clients and the
+	// upstream.
+	Transform *TransformConfig `json:"transform,omitempty"`
+	// GRPC transcodes the route's REST requests to calls on a gRPC upstream.
+	GRPC *GRPCRouteConfig `json:"grpc,omitempty"`
+	// Split sends part of the route's traffic to other upstreams, e.g. a
+	// canary release.
+	Split *SplitConfig `json:"split,omitempty"`
+	// Mirror copies a sample of requests to a shadow upstream and compares
+	// its responses with the primary's.
+	Mirror *MirrorConfig `json:"mirror,omitempty"`
+	// Mock answers the route from canned responses instead of the upstream.
+	Mock *MockConfig `json:"mock,omitempty"`
+	// Fault delays, aborts or resets a share of requests for chaos testing.
+	// It can also be changed at runtime through the admin API.
+	Fault *FaultConfig `json:"fault,omitempty"`
+	// Idempotency replays the stored response to POSTs that repeat an
+	// Idempotency-Key.
+	Idempotency *IdempotencyConfig `json:"idempotency,omitempty"`
+	// Validation checks requests against the route's OpenAPI spec before
+	// they are proxied.
+	Validation *ValidationConfig `json:"validation,omitempty"`
+	// Middleware replaces the default chain with this one, outermost first.
+	// It can reorder or leave out the built-in steps and add registered
+	// ones; without "jwt" the route is public.
+	Middleware []MiddlewareConfig `json:"middleware,omitempty"`
+}
+
+type MiddlewareConfig struct {
+	// Name is a built-in step, such as "jwt" or "cache", a middleware
+	// compiled in with RegisterMiddleware, or a plugin.
+	Name string `json:"name"`
+	// Config is passed to a registered middleware's factory.
+	Config json.RawMessage `json:"config,omitempty"`
+}
+
+// PluginConfig loads a Lua script as middleware; see luaPlugin.
+type PluginConfig struct {
+	// File is the script, relative to the config file's directory.
+	File string `json:"file"`
+	// Config is the script's global "config" table.
+	Config json.RawMessage `json:"config,omitempty"`
+	// Timeout bounds each call into the script (default 100ms).
+	Timeout Duration `json:"timeout"`
+	// MaxStackSlots bounds the Lua stack (default 65536).
+	MaxStackSlots int `json:"max_stack_slots"`
+	// MaxMemoryBytes bounds what one call may allocate for strings and
+	// table entries (default 16 MiB).
+	MaxMemoryBytes int64 `json:"max_memory_bytes"`
+	// MaxBodyBytes is the largest body the script sees (default 64 KiB);
+	// larger ones are nil.
+	MaxBodyBytes int64 `json:"max_body_bytes"`
+	// FailOpen passes requests through unchanged when the script fails,
+	// instead of answering 500.
+	FailOpen bool `json:"fail_open"`
+}
+
+type UpstreamConfig struct {
+	Targets     []string          `json:"targets"`
+	HealthCheck HealthCheckConfig `json:"health_check"`
+	// Concurrency bounds the requests in flight to the upstream.
+	Concurrency *ConcurrencyConfig `json:"concurrency,omitempty"`
+	// CircuitBreaker stops requests to the upstream while it keeps failing.
+	CircuitBreaker *CircuitBreakerConfig `json:"circuit_breaker,omitempty"`
+}
+
+type CircuitBreakerConfig struct {
+	// FailureThreshold is the number of 5xx responses in a row that opens
+	// the breaker (default 5).
+	FailureThreshold int `json:"failure_threshold"`
+	// OpenFor is how long requests are rejected before one is let through
+	// to probe the upstream (default 30s).
+	OpenFor Duration `json:"open_for"`
+}
+
+type ConcurrencyConfig struct {
+	// MaxInFlight is the limit, or with Adaptive the highest it can grow to.
+	MaxInFlight int `json:"max_in_flight"`
+	// MaxQueue requests wait for a slot, for up to QueueTimeout; they
+	// default to MaxInFlight and 1s.
+	MaxQueue     int                        `json:"max_queue"`
+	QueueTimeout Duration                   `json:"queue_timeout"`
+	Adaptive     *AdaptiveConcurrencyConfig `json:"adaptive,omitempty"`
+}
+
+type AdaptiveConcurrencyConfig struct {
+	// LatencyThreshold is the response time above which the limit is
+	// lowered; it defaults to 500ms.
+	LatencyThreshold Duration `json:"latency_threshold"`
+	MinLimit         int      `json:"min_limit"`
+}
+
+type HealthCheckConfig struct {
+	Path     string   `json:"path"`
+	Interval Duration `json:"interval"`
+	Timeout  Duration `json:"timeout"`
+}
+
+type CacheConfig struct {
+	// TTL overrides the upstream's max-age when set.
+	TTL Duration `json:"ttl"`
+	// VaryByUser keys entries by the authenticated user, which also allows
+	// responses marked Cache-Control: private to be stored.
+	VaryByUser bool `json:"vary_by_user"`
+}
+
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	// Burst is how many requests may come at once (default
+	// RequestsPerSecond rounded up).
+	Burst int `json:"burst"`
+}
+
+type IdempotencyConfig struct {
+	// TTL is how long a key is remembered; it defaults to 24h.
+	TTL Duration `json:"ttl"`
+	// Lease is how long a key stays reserved while its first request runs
+	// (default 1m); after that the key can be used again.
+	Lease Duration `json:"lease"`
+	// Required rejects POSTs without an Idempotency-Key.
+	Required bool `json:"required"`
+}
+
+type ValidationConfig struct {
+	// Strict also rejects query parameters and body fields the spec does not
+	// declare, unless a schema allows additional properties.
+	Strict bool `json:"strict"`
+}
+
+type CoalesceConfig struct {
+	// Headers lists request headers that make otherwise identical requests
+	// distinct, e.g. Accept. The authenticated user is always part of the key.
+	Headers []string `json:"headers"`
+	// Timeout bounds the shared upstream call; it defaults to 30s.
+	Timeout Duration `json:"timeout"`
+}
+
+type CompressionConfig struct {
+	// MinSize is the smallest body, in bytes, worth compressing.
+	MinSize int `json:"min_size"`
+	// ContentTypes lists media types to compress, e.g. "application/json" or
+	// "text/*". It defaults to JSON and text.
+	ContentTypes []string `json:"content_types"`
+}
+
+type BodyConfig struct {
+	MaxBytes     int64    `json:"max_bytes"`
+	ContentTypes []string `json:"content_types"`
+	MaxJSONDepth int      `json:"max_json_depth"`
+}
+
+type CORSConfig struct {
+	// AllowedOrigins holds exact origins, "*", or patterns such as
+	// "https://*.example.com".
+	AllowedOrigins []string `json:"allowed_origins"`
+	// AllowedMethods defaults to the route's methods, or to the common ones
+	// when the route accepts any method.
+	AllowedMethods []string `json:"allowed_methods"`
+	// AllowedHeaders defaults to Authorization and Content-Type.
+	AllowedHeaders   []string `json:"allowed_headers"`
+	ExposedHeaders   []string `json:"exposed_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	MaxAge           Duration `json:"max_age"`
+}
+
+type IPFilterConfig struct {
+	// Methods and Path (a regexp on the request path) narrow the requests the
+	// filter applies to; both default to everything.
+	Methods []string `json:"methods"`
+	Path    string   `json:"path"`
+	// Allow and Deny hold CIDRs or single addresses. Deny wins.
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+type WAFConfig struct {
+	// Rules defaults to a built-in set covering SQL injection, path traversal
+	// and oversized parameters.
+	Rules []WAFRuleConfig `json:"rules"`
+	// BlockScore is the total score at which requests are rejected.
+	BlockScore int `json:"block_score"`
+	// MaxBodyBytes bounds how much of a body is inspected.
+	MaxBodyBytes int64 `json:"max_body_bytes"`
+}
+
+type WAFRuleConfig struct {
+	ID string `json:"id"`
+	// Targets are any of method, path, query, headers and body.
+	Targets []string `json:"targets"`
+	// Pattern is a regexp; MaxLength fires on values longer than it.
+	Pattern   string `json:"pattern,omitempty"`
+	MaxLength int    `json:"max_length,omitempty"`
+	// Action is block, log or score.
+	Action string `json:"action"`
+	Score  int    `json:"score,omitempty"`
+}
+
+type RouteWAFConfig struct {
+	// Rules names the rules to run; empty means all of them.
+	Rules      []string `json:"rules"`
+	BlockScore int      `json:"block_score"`
+}
+
+type MirrorConfig struct {
+	Upstream string `json:"upstream"`
+	// Percent of eligible requests to mirror.
+	Percent int `json:"percent"`
+	// Methods that are mirrored, GET and HEAD when empty. Add writes only
+	// when the shadow upstream has its own storage.
+	Methods      []string `json:"methods"`
+	Timeout      Duration `json:"timeout"`
+	MaxBodyBytes int64    `json:"max_body_bytes"`
+	// MaxInFlight caps concurrent shadow requests; beyond it requests are
+	// not mirrored.
+	MaxInFlight int `json:"max_in_flight"`
+}
+
+type MockConfig struct {
+	// Passthrough proxies requests no response matches to the upstream
+	// instead of answering 404.
+	Passthrough bool                 `json:"passthrough"`
+	Responses   []MockResponseConfig `json:"responses"`
+}
+
+type MockResponseConfig struct {
+	// Method to match, any method when empty.
+	Method string `json:"method"`
+	// Path to match, with {name} parameters, e.g. /customer/{id}.
+	Path    string            `json:"path"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	// Body, or File relative to the config file, is a text/template with
+	// .Params, .Query, .Method and .Path.
+	Body    string   `json:"body"`
+	File    string   `json:"file"`
+	Latency Duration `json:"latency"`
+	// ErrorPercent of requests get ErrorStatus (default 500) instead.
+	ErrorPercent int `json:"error_percent"`
+	ErrorStatus  int `json:"error_status"`
+}
+
+type FaultConfig struct {
+	// Header, when set, limits the faults to requests that carry it.
+	Header string            `json:"header,omitempty"`
+	Delay  *FaultDelayConfig `json:"delay,omitempty"`
+	Abort  *FaultAbortConfig `json:"abort,omitempty"`
+	Reset  *FaultResetConfig `json:"reset,omitempty"`
+}
+
+type FaultDelayConfig struct {
+	Duration Duration `json:"duration"`
+	Percent  int      `json:"percent"`
+}
+
+type FaultAbortConfig struct {
+	Status  int `json:"status"`
+	Percent int `json:"percent"`
+}
+
+type FaultResetConfig struct {
+	Percent int `json:"percent"`
+}
+
+type SplitConfig struct {
+	// Sticky "user" keeps each user on one variant by hashing their
+	// username; otherwise every request is assigned at random.
+	Sticky   string               `json:"sticky"`
+	Variants []SplitVariantConfig `json:"variants"`
+}
+
+type SplitVariantConfig struct {
+	Name     string `json:"name"`
+	Upstream string `json:"upstream"`
+	// Weight is the percentage of traffic the variant receives. Whatever the
+	// variants leave goes to the route's own upstream.
+	Weight int `json:"weight"`
+	// Header sends every request carrying it to the variant regardless of
+	// weight, e.g. X-Canary: true.
+	Header *SplitHeaderConfig `json:"header,omitempty"`
+}
+
+type SplitHeaderConfig struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type GRPCRouteConfig struct {
+	// Service is the full gRPC service name, e.g. "customers.v1.Customers".
+	Service string `json:"service"`
+}
+
+type TransformConfig struct {
+	PathRewrite *PathRewriteConfig     `json:"path_rewrite,omitempty"`
+	Query       QueryTransformConfig   `json:"query"`
+	Request     MessageTransformConfig `json:"request"`
+	Response    MessageTransformConfig `json:"response"`
+}
+
+// PathRewriteConfig rewrites the upstream path with a regexp; the
+// replacement may refer to captures as $1 or ${name}.
+type PathRewriteConfig struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+type QueryTransformConfig struct {
+	Rename map[string]string `json:"rename"`
+	Remove []string          `json:"remove"`
+	Add    map[string]string `json:"add"`
+}
+
+type MessageTransformConfig struct {
+	AddHeaders    map[string]string `json:"add_headers"`
+	RemoveHeaders []string          `json:"remove_headers"`
+	RenameHeaders map[string]string `json:"rename_headers"`
+	// RenameFields maps dot-separated JSON field paths to new field names;
+	// RemoveFields drops fields. Both apply to every element of arrays.
+	RenameFields map[string]string `json:"rename_fields"`
+	RemoveFields []string          `json:"remove_fields"`
+}
+
+type CompositeConfig struct {
+	// Path is a mux path template such as "/customer/{id}/overview".
+	Path string `json:"path"`
+	// Name identifies the composite in logs and the admin API and defaults
+	// to Path. Composites that serve the same path on different hosts need
+	// names of their own.
+	Name     string                   `json:"name,omitempty"`
+	Timeout  Duration                 `json:"timeout"`
+	Sections []CompositeSectionConfig `json:"sections"`
+	EndpointConfig
+}
+
+// EndpointConfig holds the route settings that also apply to the gateway's
+// own endpoints, composites and GraphQL. Their chain defaults to
+// endpointChain and may only use those built-in steps, besides compiled-in
+// middleware and plugins.
+type EndpointConfig struct {
+	Hosts      []string           `json:"hosts,omitempty"`
+	IPFilters  []IPFilterConfig   `json:"ip_filters,omitempty"`
+	CORS       *CORSConfig        `json:"cors,omitempty"`
+	WAF        *RouteWAFConfig    `json:"waf,omitempty"`
+	RateLimit  *RateLimitConfig   `json:"rate_limit,omitempty"`
+	Middleware []MiddlewareConfig `json:"middleware,omitempty"`
+}
+
+type CompositeSectionConfig struct {
+	// Name is the section's key in the merged response.
+	Name string `json:"name"`
+	// Path is a gateway path; {name} placeholders take the composite path's
+	// variables, e.g. "/invest-account?owner_id={id}".
+	Path    string   `json:"path"`
+	Timeout Duration `json:"timeout"`
+	// Required sections fail the whole response instead of being reported
+	// under "errors".
+	Required bool `json:"required"`
+}
+
+type RecordConfig struct {
+	Path string `json:"path"`
+	// Routes limits recording to the named routes; empty records all.
+	Routes []string `json:"routes"`
+	// RedactHeaders are stored as "[REDACTED]", by default Authorization,
+	// Cookie and Set-Cookie. RedactFields are dotted JSON field paths
+	// redacted in request and response bodies.
+	RedactHeaders []string `json:"redact_headers"`
+	RedactFields  []string `json:"redact_fields"`
+	// MaxBodyBytes caps how much of each body is recorded, 64 KiB by default.
+	MaxBodyBytes int64 `json:"max_body_bytes"`
+}
+
+type QuotaConfig struct {
+	// Daily and Monthly are the default limits; 0 is unlimited.
+	Daily   int64 `json:"daily"`
+	Monthly int64 `json:"monthly"`
+	// Tenants replaces both limits for the named users.
+	Tenants map[string]QuotaLimitConfig `json:"tenants"`
+	// Path is the file usage is saved to every FlushInterval (default 10s).
+	// Without it usage is only kept in memory.
+	Path          string   `json:"path"`
+	FlushInterval Duration `json:"flush_interval"`
+}
+
+type QuotaLimitConfig struct {
+	Daily   int64 `json:"daily"`
+	Monthly int64 `json:"monthly"`
+}
+
+// GraphQLConfig enables a GraphQL endpoint over the customers and
+// invest-accounts routes.
+type GraphQLConfig struct {
+	Path string `json:"path"`
+	// CustomersRoute and InvestAccountsRoute name the routes whose upstreams
+	// resolve the Customer and InvestAccount types.
+	CustomersRoute      string `json:"customers_route"`
+	InvestAccountsRoute string `json:"invest_accounts_route"`
+	// MaxDepth limits selection nesting; MaxComplexity limits the estimated
+	// number of fields resolved, counting each list as ten items.
+	MaxDepth      int `json:"max_depth"`
+	MaxComplexity int `json:"max_complexity"`
+	EndpointConfig
+}
+
+type OpenAPIConfig struct {
+	// Path serves the document, "/openapi.json" by default, and DocsPath a
+	// Swagger UI page for it, "/docs" by default. Neither needs a token.
+	Path     string `json:"path"`
+	DocsPath string `json:"docs_path"`
+	Title    string `json:"title"`
+	// SpecPath is where the upstreams serve their documents, "/openapi.json"
+	// by default. Sources gives a URL per route instead, which gRPC routes
+	// need.
+	SpecPath string            `json:"spec_path"`
+	Sources  map[string]string `json:"sources"`
+	// Refresh is how long the merged document is reused, 1m by default.
+	Refresh Duration `json:"refresh"`
+}
+
+type CacheStoreConfig struct {
+	MaxBytes int64 `json:"max_bytes"`
+}
+
+type AdminConfig struct {
+	Addr  string `json:"addr"`
+	Token string `json:"token"`
+}
+
+// Duration is a time.Duration that reads and writes as a string like "5s" in JSON.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"5s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func defaultConfig() *Config {
+	methods := []string{"GET", "POST", "PUT", "DELETE"}
+	body := &BodyConfig{MaxBytes: 1 << 20, ContentTypes: []string{"application/json"}, MaxJSONDepth: 16}
+	return &Config{
+		Version: "default",
+		Routes: []RouteConfig{
+			{Service: "customer", Upstream: "customers", Methods: methods, Body: body},
+			{Service: "invest-account", Upstream: "invest-accounts", Methods: methods, Body: body},
+		},
+		Upstreams: map[string]UpstreamConfig{
+			"customers":       {Targets: []string{CustomersURL}},
+			"invest-accounts": {Targets: []string{InvestAccountsURL}},
+		},
+		Composites: []CompositeConfig{
+			{
+				Path: "/customer/{id}/overview",
+				Sections: []CompositeSectionConfig{
+					{Name: "customer", Path: "/customer/{id}", Required: true},
+					{Name: "invest_accounts", Path: "/invest-account?owner_id={id}"},
+				},
+			},
+		},
+		GraphQL: &GraphQLConfig{CustomersRoute: "customer", InvestAccountsRoute: "invest-account"},
+		OpenAPI: &OpenAPIConfig{},
+	}
+}
+
+// loadConfig reads the gateway config from path. An empty path yields the
+// built-in routes for the customers and invest-accounts services.
+func loadConfig(path string) (*Config, error) {
+	var cfg *Config
+	if path == "" {
+		cfg = defaultConfig()
+	} else {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		cfg = &Config{}
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		if cfg.Version == "" {
+			sum := sha256.Sum256(data)
+			cfg.Version = hex.EncodeToString(sum[:])[:12]
+		}
+	}
+
+	cfg.Admin.Addr = getEnv("GATEWAY_ADMIN_ADDR", cfg.Admin.Addr)
+	cfg.Admin.Token = getEnv("GATEWAY_ADMIN_TOKEN", cfg.Admin.Token)
+	cfg.setDefaults()
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) setDefaults() {
+	if c.Admin.Addr == "" {
+		c.Admin.Addr = ":9081"
+	}
+	if c.Cache.MaxBytes <= 0 {
+		c.Cache.MaxBytes = 64 << 20
+	}
+	if g := c.GraphQL; g != nil {
+		if g.Path == "" {
+			g.Path = "/graphql"
+		}
+		if g.MaxDepth <= 0 {
+			g.MaxDepth = 8
+		}
+		if g.MaxComplexity <= 0 {
+			g.MaxComplexity = 500
+		}
+	}
+	if o := c.OpenAPI; o != nil {
+		if o.Path == "" {
+			o.Path = "/openapi.json"
+		}
+		if o.DocsPath == "" {
+			o.DocsPath = "/docs"
+		}
+		if o.Title == "" {
+			o.Title = "API Gateway"
+		}
+		if o.SpecPath == "" {
+			o.SpecPath = "/openapi.json"
+		}
+	}
+}
+
+func (c *Config) validate() error {
+	for name, up := range c.Upstreams {
+		if len(up.Targets) == 0 {
+			return fmt.Errorf("upstream %q has no targets", name)
+		}
+		for _, target := range up.Targets {
+			u, err := url.Parse(target)
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("upstream %q has invalid target %q", name, target)
+			}
+		}
+		if c := up.Concurrency; c != nil {
+			if c.MaxInFlight <= 0 || c.MaxQueue < 0 {
+				return fmt.Errorf("upstream %q needs a positive max_in_flight and a max_queue of at least 0", name)
+			}
+			if c.Adaptive != nil && c.Adaptive.MinLimit > c.MaxInFlight {
+				return fmt.Errorf("upstream %q has an adaptive min_limit above max_in_flight", name)
+			}
+		}
+		if b := up.CircuitBreaker; b != nil && (b.FailureThreshold < 0 || b.OpenFor.Duration < 0) {
+			return fmt.Errorf("upstream %q has a negative circuit breaker setting", name)
+		}
+	}
+
+	seen := make(map[string]bool)
+	// served maps each service and host pattern to the route serving it, ""
+	// standing for any host.
+	served := make(map[string]string)
+	for _, rt := range c.Routes {
+		if rt.Service == "" || strings.Contains(rt.Service, "/") {
+			return fmt.Errorf("route has invalid service %q", rt.Service)
+		}
+		if strings.Contains(rt.Name, "/") {
+			return fmt.Errorf("route has invalid name %q", rt.Name)
+		}
+		if seen[rt.name()] {
+			return fmt.Errorf("route %q is declared twice", rt.name())
+		}
+		seen[rt.name()] = true
+		hosts := rt.Hosts
+		if len(hosts) == 0 {
+			hosts = []string{""}
+		}
+		for _, host := range hosts {
+			if host != "" && !validHostPattern(host) {
+				return fmt.Errorf("route %q has invalid host %q", rt.name(), host)
+			}
+			key := rt.Service + " " + strings.ToLower(host)
+			if other, ok := served[key]; ok {
+				if host == "" {
+					return fmt.Errorf("routes %q and %q both serve %s on any host", other, rt.name(), rt.Service)
+				}
+				return fmt.Errorf("routes %q and %q both serve %s on %s", other, rt.name(), rt.Service, host)
+			}
+			served[key] = rt.name()
+		}
+		if _, ok := c.Upstreams[rt.Upstream]; !ok {
+			return fmt.Errorf("route %q refers to unknown upstream %q", rt.name(), rt.Upstream)
+		}
+		if l := rt.RateLimit; l != nil && (l.RequestsPerSecond <= 0 || l.Burst < 0) {
+			return fmt.Errorf("route %q needs a positive rate limit", rt.name())
+		}
+		if c := rt.CORS; c != nil && c.AllowCredentials {
+			for _, origin := range c.AllowedOrigins {
+				if origin == "*" {
+					return fmt.Errorf("route %q allows credentials from any origin", rt.name())
+				}
+			}
+		}
+		if rt.Split != nil {
+			if err := rt.Split.validate(c.Upstreams); err != nil {
+				return fmt.Errorf("route %q: %w", rt.name(), err)
+			}
+		}
+		if m := rt.Mirror; m != nil {
+			if _, ok := c.Upstreams[m.Upstream]; !ok {
+				return fmt.Errorf("route %q mirrors to unknown upstream %q", rt.name(), m.Upstream)
+			}
+			if m.Percent < 0 || m.Percent > 100 {
+				return fmt.Errorf("route %q has mirror percent %d outside 0-100", rt.name(), m.Percent)
+			}
+		}
+		if rt.GRPC != nil {
+			if err := rt.GRPC.validate(); err != nil {
+				return fmt.Errorf("route %q: %w", rt.name(), err)
+			}
+		}
+		if rt.Mock != nil {
+			if err := rt.Mock.validate(); err != nil {
+				return fmt.Errorf("route %q: %w", rt.name(), err)
+			}
+		}
+		if rt.Fault != nil {
+			if err := rt.Fault.validate(); err != nil {
+				return fmt.Errorf("route %q: %w", rt.name(), err)
+			}
+		}
+		if err := validateChain(rt.Middleware, c.Plugins); err != nil {
+			return fmt.Errorf("route %q: %w", rt.name(), err)
+		}
+	}
+
+	for name, p := range c.Plugins {
+		if _, ok := builtinMiddleware[name]; ok {
+			return fmt.Errorf("plugin %q has the name of a built-in middleware", name)
+		}
+		if _, ok := registeredMiddleware(name); ok {
+			return fmt.Errorf("plugin %q has the name of a registered middleware", name)
+		}
+		if p.File == "" {
+			return fmt.Errorf("plugin %q needs a file", name)
+		}
+		if p.MaxStackSlots < 0 || p.MaxBodyBytes < 0 {
+			return fmt.Errorf("plugin %q has a negative limit", name)
+		}
+	}
+
+	for _, comp := range c.Composites {
+		if !strings.HasPrefix(comp.Path, "/") || len(comp.Sections) == 0 {
+			return fmt.Errorf("composite %q needs an absolute path and at least one section", comp.Path)
+		}
+		if seen["composite "+comp.name()] {
+			return fmt.Errorf("composite %q is declared twice", comp.name())
+		}
+		seen["composite "+comp.name()] = true
+		if err := comp.EndpointConfig.validate(c.Plugins); err != nil {
+			return fmt.Errorf("composite %q: %w", comp.name(), err)
+		}
+		hosts := comp.Hosts
+		if len(hosts) == 0 {
+			hosts = []string{""}
+		}
+		for _, host := range hosts {
+			key := "composite " + comp.Path + " " + strings.ToLower(host)
+			if other, ok := served[key]; ok {
+				return fmt.Errorf("composites %q and %q both serve %s on the same hosts", other, comp.name(), comp.Path)
+			}
+			served[key] = comp.name()
+		}
+		names := make(map[string]bool)
+		for _, s := range comp.Sections {
+			if s.Name == "" || s.Name == "errors" || names[s.Name] {
+				return fmt.Errorf("composite %q has invalid or duplicate section name %q", comp.Path, s.Name)
+			}
+			names[s.Name] = true
+		}
+	}
+
+	if c.Record != nil && c.Record.Path == "" {
+		return fmt.Errorf("record needs a path")
+	}
+
+	if q := c.Quotas; q != nil {
+		limits := []QuotaLimitConfig{{Daily: q.Daily, Monthly: q.Monthly}}
+		for _, l := range q.Tenants {
+			limits = append(limits, l)
+		}
+		for _, l := range limits {
+			if l.Daily < 0 || l.Monthly < 0 {
+				return fmt.Errorf("quota limits must not be negative")
+			}
+		}
+	}
+
+	if g := c.GraphQL; g != nil {
+		if !strings.HasPrefix(g.Path, "/") {
+			return fmt.Errorf("graphql path %q must be absolute", g.Path)
+		}
+		if err := g.EndpointConfig.validate(c.Plugins); err != nil {
+			return fmt.Errorf("graphql: %w", err)
+		}
+		for _, name := range []string{g.CustomersRoute, g.InvestAccountsRoute} {
+			if !seen[name] {
+				return fmt.Errorf("graphql refers to unknown route %q", name)
+			}
+			if c.route(name).GRPC != nil {
+				return fmt.Errorf("graphql needs an HTTP upstream, route %q is gRPC", name)
+			}
+		}
+	}
+
+	if o := c.OpenAPI; o != nil {
+		if !strings.HasPrefix(o.Path, "/") || !strings.HasPrefix(o.DocsPath, "/") || o.Path == o.DocsPath {
+			return fmt.Errorf("openapi needs distinct absolute path and docs_path")
+		}
+		for name, source := range o.Sources {
+			if !seen[name] {
+				return fmt.Errorf("openapi has a source for unknown route %q", name)
+			}
+			if u, err := url.Parse(source); err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("openapi source %q for route %q is not an absolute URL", source, name)
+			}
+		}
+	}
+	return nil
+}
+
+// validate checks the settings an endpoint shares with routes.
+func (e *EndpointConfig) validate(plugins map[string]PluginConfig) error {
+	for _, host := range e.Hosts {
+		if !validHostPattern(host) {
+			return fmt.Errorf("invalid host %q", host)
+		}
+	}
+	if c := e.CORS; c != nil && c.AllowCredentials {
+		for _, origin := range c.AllowedOrigins {
+			if origin == "*" {
+				return fmt.Errorf("credentials cannot be allowed from any origin")
+			}
+		}
+	}
+	if l := e.RateLimit; l != nil && (l.RequestsPerSecond <= 0 || l.Burst < 0) {
+		return fmt.Errorf("rate limit needs a positive rate")
+	}
+	for _, m := range e.Middleware {
+		if _, ok := builtinMiddleware[m.Name]; ok && !endpointSteps[m.Name] {
+			return fmt.Errorf("middleware %q does not apply to endpoints", m.Name)
+		}
+	}
+	return validateChain(e.Middleware, plugins)
+}
+
+func (c *Config) route(name string) *RouteConfig {
+	for i := range c.Routes {
+		if c.Routes[i].name() == name {
+			return &c.Routes[i]
+		}
+	}
+	return nil
+}
+
+func (c *CompositeConfig) name() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.Path
+}
+
+func (rc *RouteConfig) name() string {
+	if rc.Name != "" {
+		return rc.Name
+	}
+	return rc.Service
+}
+
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var defaultCORSHeaders = []string{"Authorization", "Content-Type"}
+
+// defaultCORSMethods is used when neither the CORS block nor the route lists
+// methods, since such a route accepts any method.
+var defaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+type corsPolicy struct {
+	anyOrigin        bool
+	origins          map[string]bool
+	patterns         []*regexp.Regexp
+	methods          string
+	headers          map[string]bool
+	allowHeaders     string
+	exposeHeaders    string
+	allowCredentials bool
+	maxAge           string
+}
+
+func newCORSPolicy(rt *route) *corsPolicy {
+	cfg := rt.CORS
+	p := &corsPolicy{
+		origins:          make(map[string]bool),
+		headers:          make(map[string]bool),
+		exposeHeaders:    strings.Join(cfg.ExposedHeaders, ", "),
+		allowCredentials: cfg.AllowCredentials,
+	}
+
+	for _, origin := range cfg.AllowedOrigins {
+		switch {
+		case origin == "*":
+			p.anyOrigin = true
+		case strings.Contains(origin, "*"):
+			p.patterns = append(p.patterns, originPattern(origin))
+		default:
+			p.origins[strings.ToLower(origin)] = true
+		}
+	}
+
+	methods := cfg.AllowedMethods
+	if len(methods) == 0 {
+		methods = rt.Methods
+	}
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	p.methods = strings.ToUpper(strings.Join(methods, ", "))
+
+	headers := cfg.AllowedHeaders
+	if len(headers) == 0 {
+		headers = defaultCORSHeaders
+	}
+	for _, h := range headers {
+		p.headers[http.CanonicalHeaderKey(h)] = true
+	}
+	p.allowHeaders = strings.Join(headers, ", ")
+
+	if cfg.MaxAge.Duration > 0 {
+		p.maxAge = strconv.Itoa(int(cfg.MaxAge.Seconds()))
+	}
+	return p
+}
+
+// originPattern turns "https://*.example.com" into a regexp where each "*"
+// stands for one or more hostname characters.
+func originPattern(pattern string) *regexp.Regexp {
+	parts := strings.Split(strings.ToLower(pattern), "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, "[a-z0-9.-]+") + "$")
+}
+
+func (p *corsPolicy) allowsOrigin(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if p.origins[origin] {
+		return true
+	}
+	for _, re := range p.patterns {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *corsPolicy) allowsMethod(method string) bool {
+	for _, m := range strings.Split(p.methods, ", ") {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *corsPolicy) allowsHeaders(requested string) bool {
+	for _, h := range strings.Split(requested, ",") {
+		h = strings.TrimSpace(h)
+		if h != "" && !p.headers[http.CanonicalHeaderKey(h)] {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *corsPolicy) setOrigin(h http.Header, origin string) {
+	// Config validation keeps "*" and credentials apart, so that no site can
+	// read credentialed responses.
+	if p.anyOrigin {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+		addVary(h, "Origin")
+	}
+	if p.allowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// corsMiddleware answers preflight requests itself, so they never reach
+// JWTMiddleware, and adds CORS headers to actual requests from allowed
+// origins. Requests from other origins get no CORS headers and are blocked
+// by the browser.
+func corsMiddleware(rt *route, next http.Handler) http.Handler {
+	p := newCORSPolicy(rt)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		reqMethod := r.Header.Get("Access-Control-Request-Method")
+		if r.Method == http.MethodOptions && reqMethod != "" {
+			h := w.Header()
+			addVary(h, "Origin")
+			addVary(h, "Access-Control-Request-Method")
+			addVary(h, "Access-Control-Request-Headers")
+			if p.allowsOrigin(origin) && p.allowsMethod(reqMethod) && p.allowsHeaders(r.Header.Get("Access-Control-Request-Headers")) {
+				p.setOrigin(h, origin)
+				h.Set("Access-Control-Allow-Methods", p.methods)
+				h.Set("Access-Control-Allow-Headers", p.allowHeaders)
+				if p.maxAge != "" {
+					h.Set("Access-Control-Max-Age", p.maxAge)
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if p.allowsOrigin(origin) {
+			p.setOrigin(w.Header(), origin)
+			if p.exposeHeaders != "" {
+				w.Header().Set("Access-Control-Expose-Headers", p.exposeHeaders)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
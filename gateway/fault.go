@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// faultInjector holds a route's current faults. Every route has one so that
+// faults can be switched on at runtime even when the config has none.
+type faultInjector struct {
+	state atomic.Value
+
+	delayed int64
+	aborted int64
+	reset   int64
+}
+
+type faultState struct {
+	cfg *FaultConfig
+	// admin is set once the faults were changed through the admin API; such
+	// changes are kept across reloads.
+	admin bool
+}
+
+type faultStatus struct {
+	Route   string       `json:"route"`
+	Source  string       `json:"source"`
+	Fault   *FaultConfig `json:"fault"`
+	Delayed int64        `json:"delayed"`
+	Aborted int64        `json:"aborted"`
+	Reset   int64        `json:"reset"`
+}
+
+func newFaultInjector(cfg *FaultConfig) *faultInjector {
+	f := &faultInjector{}
+	f.state.Store(&faultState{cfg: cfg})
+	return f
+}
+
+func (f *faultInjector) current() *faultState {
+	return f.state.Load().(*faultState)
+}
+
+// set replaces the faults from the admin API. A nil config turns them off.
+func (f *faultInjector) set(cfg *FaultConfig) {
+	f.state.Store(&faultState{cfg: cfg, admin: true})
+}
+
+func (f *faultInjector) status(route string) faultStatus {
+	s := f.current()
+	source := "config"
+	if s.admin {
+		source = "admin"
+	}
+	return faultStatus{
+		Route:   route,
+		Source:  source,
+		Fault:   s.cfg,
+		Delayed: atomic.LoadInt64(&f.delayed),
+		Aborted: atomic.LoadInt64(&f.aborted),
+		Reset:   atomic.LoadInt64(&f.reset),
+	}
+}
+
+// faultMiddleware delays, aborts or resets a share of the route's requests as
+// if the upstream misbehaved. With a trigger header only requests carrying it
+// are affected. A delayed request can still be aborted or reset afterwards.
+func faultMiddleware(f *faultInjector, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := f.current().cfg
+		if cfg == nil || (cfg.Header != "" && r.Header.Get(cfg.Header) == "") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if d := cfg.Delay; d != nil && hit(d.Percent) {
+			atomic.AddInt64(&f.delayed, 1)
+			select {
+			case <-time.After(d.Duration.Duration):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if a := cfg.Abort; a != nil && hit(a.Percent) {
+			atomic.AddInt64(&f.aborted, 1)
+			writeJSON(w, a.Status, map[string]string{"error": "Injected fault"})
+			return
+		}
+		if rs := cfg.Reset; rs != nil && hit(rs.Percent) {
+			atomic.AddInt64(&f.reset, 1)
+			resetConnection(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func hit(percent int) bool {
+	return percent > 0 && rand.Intn(100) < percent
+}
+
+// resetConnection drops the client connection without a response. Where the
+// connection cannot be taken over, as for composite sections, the request
+// fails with 502 instead.
+func resetConnection(w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "Injected connection reset"})
+		return
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		log.Printf("Fault: hijacking connection: %s", err)
+		return
+	}
+	// With no linger the close sends a TCP RST rather than a FIN.
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
+
+func (c *FaultConfig) validate() error {
+	if d := c.Delay; d != nil && (d.Percent < 0 || d.Percent > 100 || d.Duration.Duration <= 0) {
+		return fmt.Errorf("fault delay needs a positive duration and a percent within 0-100")
+	}
+	if a := c.Abort; a != nil && (a.Percent < 0 || a.Percent > 100 || a.Status < 400 || a.Status > 599) {
+		return fmt.Errorf("fault abort needs a 4xx or 5xx status and a percent within 0-100")
+	}
+	if rs := c.Reset; rs != nil && (rs.Percent < 0 || rs.Percent > 100) {
+		return fmt.Errorf("fault reset percent %d is outside 0-100", rs.Percent)
+	}
+	return nil
+}
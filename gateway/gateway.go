@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -29,16 +34,53 @@ type Claims struct {
 }
 
 func main() {
-	router := mux.NewRouter()
-	router.HandleFunc("/login", LoginHandler).Methods("POST")
-	router.HandleFunc("/{service:customer|invest-account}{rest:.*}", JWTMiddleware(Handler)).Methods("GET", "POST", "PUT", "DELETE")
-	fmt.Println("Gateway listening on :8081")
-	err := http.ListenAndServe(":8081", router)
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+
+	configPath = getEnv("GATEWAY_CONFIG", "")
+	gw, err := reloadConfig()
 	if err != nil {
+		fmt.Println("Error loading config:", err)
+		return
+	}
+	fmt.Printf("Loaded config version %s\n", gw.config.Version)
+
+	admin := startAdmin(gw.config.Admin)
+
+	srv := &http.Server{Addr: ":8081", Handler: http.HandlerFunc(serveGateway)}
+	serveErr := make(chan error, 1)
+	go func() {
+		fmt.Println("Gateway listening on :8081")
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	// On SIGINT or SIGTERM, finish the requests in flight before saving
+	// usage counts and recordings, so a deploy loses neither.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
 		fmt.Println("Error starting server:", err)
+	case sig := <-stop:
+		fmt.Printf("Received %s, shutting down\n", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			fmt.Println("Error shutting down server:", err)
+		}
+		if admin != nil {
+			admin.Shutdown(ctx)
+		}
+	}
+	if gw := currentGateway(); gw != nil {
+		gw.shutdown()
 	}
 }
 
+// shutdownTimeout bounds how long requests in flight get to finish.
+const shutdownTimeout = 15 * time.Second
+
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	var creds Credentials
 	err := json.NewDecoder(r.Body).Decode(&creds)
@@ -80,7 +122,8 @@ func JWTMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+		claims := &Claims{}
+		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
 			return jwtSecret, nil
 		})
 
@@ -94,52 +137,83 @@ func JWTMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		ctx := context.WithValue(r.Context(), claimsContextKey{}, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+type claimsContextKey struct{}
+
+// claimsFromRequest returns the claims JWTMiddleware verified for r, or nil.
+func claimsFromRequest(r *http.Request) *Claims {
+	claims, _ := r.Context().Value(claimsContextKey{}).(*Claims)
+	return claims
+}
+
 func Handler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	service := vars["service"]
-	rest := vars["rest"]
-
-	var targetURL string
-	switch service {
-	case "customer":
-		targetURL = CustomersURL + "/customer" + rest
-	case "invest-account":
-		targetURL = InvestAccountsURL + "/invest-account" + rest
-	default:
+
+	gw := currentGateway()
+	if gw == nil {
+		http.Error(w, "Gateway not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	rt := gw.routeFor(service, r)
+	if rt == nil {
 		http.Error(w, "Path not supported", http.StatusNotFound)
 		return
 	}
 
-	go proxyRequest(w, r, targetURL)
+	rt.handler.ServeHTTP(w, r)
+}
+
+var upstreamClient = &http.Client{}
+
+// proxy forwards the request to the next available instance of the route's
+// upstream pool, or of the pool of the split variant chosen for it.
+func (rt *route) proxy(w http.ResponseWriter, r *http.Request) {
+	inst, err := rt.upstreamFor(r).pick()
+	if err != nil {
+		fmt.Printf("Error proxying request for %s: %s\n", rt.name(), err.Error())
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	atomic.AddInt64(&inst.inFlight, 1)
+	defer atomic.AddInt64(&inst.inFlight, -1)
+
+	targetURL := inst.URL + r.URL.EscapedPath()
+	if r.URL.RawQuery != "" {
+		targetURL += "?" + r.URL.RawQuery
+	}
+	proxyRequest(w, r, targetURL)
 }
 
 func proxyRequest(w http.ResponseWriter, r *http.Request, targetURL string) {
-	client := &http.Client{}
-	req, err := http.NewRequest(r.Method, targetURL, r.Body)
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, targetURL, r.Body)
 	if err != nil {
 		http.Error(w, "Error creating request", http.StatusInternalServerError)
 		return
 	}
 
+	req.ContentLength = r.ContentLength
 	copyHeaders(req.Header, r.Header)
 
-	resp, err := client.Do(req)
+	resp, err := upstreamClient.Do(req)
 	if err != nil {
 		fmt.Printf("Error proxying request to %s: %s\n", targetURL, err.Error())
 		http.Error(w, "Error proxying request", http.StatusBadGateway)
 		return
 	}
+	defer resp.Body.Close()
 
 	copyHeaders(w.Header(), resp.Header)
 	w.WriteHeader(resp.StatusCode)
 	_, err = io.Copy(w, resp.Body)
 	if err != nil {
-		http.Error(w, "Error copying response", http.StatusInternalServerError)
-		return
+		fmt.Printf("Error copying response from %s: %s\n", targetURL, err.Error())
 	}
 }
 
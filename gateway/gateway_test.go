@@ -1,29 +1,56 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
+	lua "github.com/yuin/gopher-lua"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func TestHandler(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/customer/1" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"id": 1, "name": "V N"}`))
+	}))
+	defer mockServer.Close()
+
+	prevURL := CustomersURL
+	CustomersURL = mockServer.URL
+	defer func() { CustomersURL = prevURL }()
+	useTestGateway(t, defaultConfig())
+
 	req, err := http.NewRequest("GET", "/customer/1", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	req = mux.SetURLVars(req, map[string]string{"service": "customer", "rest": "/1"})
+	req.Header.Set("Authorization", "Bearer "+testToken(t, "admin"))
 
 	rr := httptest.NewRecorder()
-	router := mux.NewRouter()
-	router.HandleFunc("/customer/{id}", Handler).Methods("GET")
-
-	mockServer := httptest.NewServer(router)
-	defer mockServer.Close()
-
-	CustomersURL = mockServer.URL
-	req.Header.Set("Authorization", "Bearer mockToken")
-
 	Handler(rr, req)
 
 	if status := rr.Code; status != http.StatusOK {
@@ -37,3 +64,2552 @@ func TestHandler(t *testing.T) {
 			rr.Body.String(), expected)
 	}
 }
+
+func useTestGateway(t *testing.T, cfg *Config) *gatewayState {
+	t.Helper()
+	cfg.setDefaults()
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	gw, err := buildGateway(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current.Store(gw)
+	t.Cleanup(gw.close)
+	return gw
+}
+
+func testToken(t *testing.T, username string) string {
+	t.Helper()
+	claims := &Claims{
+		Username:       username,
+		StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Minute).Unix()},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func testBackend(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend", name)
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestAdminDrainStopsTraffic(t *testing.T) {
+	a := testBackend(t, "a")
+	b := testBackend(t, "b")
+	cfg := defaultConfig()
+	cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{a.URL, b.URL}}
+	useTestGateway(t, cfg)
+
+	admin := adminAuth("admin-secret", adminRouter())
+
+	rr := httptest.NewRecorder()
+	admin.ServeHTTP(rr, httptest.NewRequest("GET", "/upstreams", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without admin token, got %d", rr.Code)
+	}
+
+	req := httptest.NewRequest("POST", "/upstreams/customers/drain", strings.NewReader(`{"instance":"`+a.URL+`"}`))
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	rr = httptest.NewRecorder()
+	admin.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("drain returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	token := testToken(t, "admin")
+	for i := 0; i < 4; i++ {
+		req := httptest.NewRequest("GET", "/customer/1?full=true", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		serveGateway(rr, req)
+
+		if got := rr.Header().Get("X-Backend"); got != "b" {
+			t.Fatalf("request %d went to backend %q, want b", i, got)
+		}
+		if rr.Body.String() != "/customer/1?full=true" {
+			t.Errorf("upstream saw %q", rr.Body.String())
+		}
+	}
+}
+
+func TestCacheServesAndRevalidates(t *testing.T) {
+	var calls, conditional int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(`[{"id":1}]`))
+	}))
+	defer backend.Close()
+
+	cfg := defaultConfig()
+	cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{backend.URL}}
+	cfg.Routes[0].Cache = &CacheConfig{}
+	useTestGateway(t, cfg)
+	token := testToken(t, "admin")
+
+	do := func(method, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/customer", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rr := httptest.NewRecorder()
+		serveGateway(rr, req)
+		return rr
+	}
+
+	if rr := do("GET", ""); rr.Header().Get("X-Cache") != "MISS" || rr.Body.String() != `[{"id":1}]` {
+		t.Fatalf("first GET: X-Cache=%q body=%q", rr.Header().Get("X-Cache"), rr.Body.String())
+	}
+	if rr := do("GET", ""); rr.Header().Get("X-Cache") != "HIT" || rr.Body.String() != `[{"id":1}]` {
+		t.Fatalf("second GET: X-Cache=%q body=%q", rr.Header().Get("X-Cache"), rr.Body.String())
+	}
+	if rr := do("GET", `"v1"`); rr.Code != http.StatusNotModified {
+		t.Fatalf("conditional GET returned %d, want 304", rr.Code)
+	}
+	if calls != 1 {
+		t.Fatalf("upstream called %d times, want 1", calls)
+	}
+
+	do("POST", "")
+	if rr := do("GET", ""); rr.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("GET after POST: X-Cache=%q, want MISS", rr.Header().Get("X-Cache"))
+	}
+	if conditional != 0 {
+		t.Errorf("purged entry was revalidated instead of refetched")
+	}
+}
+
+func TestCachePurgeOnWrite(t *testing.T) {
+	store := newLRUStore(1 << 20)
+	rt := &route{RouteConfig: RouteConfig{Service: "customer", Cache: &CacheConfig{}}}
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		purged  bool
+	}{
+		{"no header written", func(w http.ResponseWriter, r *http.Request) {}, true},
+		{"204", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }, true},
+		{"500", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusInternalServerError) }, false},
+	}
+	for _, tt := range tests {
+		store.Set("/customer/1", &cachedResponse{StatusCode: http.StatusOK, Expires: time.Now().Add(time.Minute)})
+		req := httptest.NewRequest("DELETE", "/customer/1", nil)
+		cacheMiddleware(store, rt, tt.handler).ServeHTTP(httptest.NewRecorder(), req)
+		if purged := store.Stats().Entries == 0; purged != tt.purged {
+			t.Errorf("%s: purged = %v, want %v", tt.name, purged, tt.purged)
+		}
+	}
+}
+
+func TestCoalesceSharesUpstreamCall(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		w.Write([]byte(`{"id":42}`))
+	}))
+	defer backend.Close()
+
+	cfg := defaultConfig()
+	cfg.Upstreams["invest-accounts"] = UpstreamConfig{Targets: []string{backend.URL}}
+	cfg.Routes[1].Coalesce = &CoalesceConfig{}
+	useTestGateway(t, cfg)
+	token := testToken(t, "admin")
+
+	const clients = 5
+	var wg sync.WaitGroup
+	bodies := make([]string, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest("GET", "/invest-account/42", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rr := httptest.NewRecorder()
+			serveGateway(rr, req)
+			bodies[i] = rr.Body.String()
+		}(i)
+	}
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("upstream called %d times, want 1", n)
+	}
+	for i, body := range bodies {
+		if body != `{"id":42}` {
+			t.Errorf("client %d got %q", i, body)
+		}
+	}
+}
+
+func TestCoalescePanicReleasesWaiters(t *testing.T) {
+	group := newFlightGroup()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	leader := make(chan *responseCapture)
+	go func() {
+		capture, _, _ := group.do(context.Background(), "k", func() *responseCapture {
+			close(started)
+			<-release
+			panic("boom")
+		})
+		leader <- capture
+	}()
+	<-started
+
+	waiter := make(chan *responseCapture)
+	go func() {
+		capture, shared, _ := group.do(context.Background(), "k", func() *responseCapture {
+			t.Error("waiter ran its own call")
+			return newResponseCapture()
+		})
+		if !shared {
+			t.Error("waiter did not share the leader's call")
+		}
+		waiter <- capture
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	for _, ch := range []chan *responseCapture{leader, waiter} {
+		select {
+		case capture := <-ch:
+			if capture == nil || capture.status != http.StatusBadGateway {
+				t.Errorf("got %+v, want a 502", capture)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("call did not finish after the panic")
+		}
+	}
+
+	capture, shared, _ := group.do(context.Background(), "k", func() *responseCapture { return newResponseCapture() })
+	if shared || capture.status != http.StatusOK {
+		t.Errorf("key was not released: shared %v, status %d", shared, capture.status)
+	}
+}
+
+func TestCoalesceWaiterGivesUp(t *testing.T) {
+	group := newFlightGroup()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	go group.do(context.Background(), "k", func() *responseCapture {
+		close(started)
+		<-release
+		return newResponseCapture()
+	})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	capture, _, err := group.do(ctx, "k", func() *responseCapture { return newResponseCapture() })
+	if capture != nil || err != context.DeadlineExceeded {
+		t.Errorf("waiter got %+v, %v; want it to give up with its context", capture, err)
+	}
+}
+
+func TestCoalesceKeepsConditionalRequestsApart(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(`{"id":42}`))
+	}))
+	defer backend.Close()
+
+	cfg := defaultConfig()
+	cfg.Upstreams["invest-accounts"] = UpstreamConfig{Targets: []string{backend.URL}}
+	cfg.Routes[1].Coalesce = &CoalesceConfig{}
+	useTestGateway(t, cfg)
+	token := testToken(t, "admin")
+
+	var wg sync.WaitGroup
+	results := make([]*httptest.ResponseRecorder, 2)
+	for i, etag := range []string{"", `"v1"`} {
+		wg.Add(1)
+		go func(i int, etag string) {
+			defer wg.Done()
+			req := httptest.NewRequest("GET", "/invest-account/42", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			if etag != "" {
+				req.Header.Set("If-None-Match", etag)
+			}
+			results[i] = httptest.NewRecorder()
+			serveGateway(results[i], req)
+		}(i, etag)
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&calls) == 2 })
+	close(release)
+	wg.Wait()
+
+	if rr := results[0]; rr.Code != http.StatusOK || rr.Body.String() != `{"id":42}` {
+		t.Errorf("unconditional GET got %d %q", rr.Code, rr.Body.String())
+	}
+	if rr := results[1]; rr.Code != http.StatusNotModified {
+		t.Errorf("conditional GET got %d, want 304", rr.Code)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var calls, failing int32 = 0, 1
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	cfg := defaultConfig()
+	cfg.Upstreams["customers"] = UpstreamConfig{
+		Targets:        []string{backend.URL},
+		CircuitBreaker: &CircuitBreakerConfig{FailureThreshold: 2, OpenFor: Duration{50 * time.Millisecond}},
+	}
+	useTestGateway(t, cfg)
+	token := testToken(t, "admin")
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/customer/1", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		serveGateway(rr, req)
+		return rr
+	}
+	breakers := func() []breakerStatus {
+		rr := httptest.NewRecorder()
+		adminRouter().ServeHTTP(rr, httptest.NewRequest("GET", "/circuit-breakers", nil))
+		var out []breakerStatus
+		if err := json.Unmarshal(rr.Body.Bytes(), &out); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	for i := 0; i < 2; i++ {
+		if rr := get(); rr.Code != http.StatusInternalServerError {
+			t.Fatalf("request %d: got %d want 500", i, rr.Code)
+		}
+	}
+	rr := get()
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != "1" {
+		t.Errorf("open breaker: status %d, Retry-After %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("upstream called %d times, want 2", n)
+	}
+	if b := breakers(); len(b) != 1 || b[0].Upstream != "customers" || b[0].State != breakerOpen || b[0].Opens != 1 || b[0].Rejected != 1 {
+		t.Errorf("unexpected breaker status: %+v", b)
+	}
+
+	// After open_for one request probes the upstream; a success closes it.
+	time.Sleep(60 * time.Millisecond)
+	atomic.StoreInt32(&failing, 0)
+	if rr := get(); rr.Code != http.StatusOK {
+		t.Errorf("probe: got %d want 200", rr.Code)
+	}
+	if b := breakers(); len(b) != 1 || b[0].State != breakerClosed || b[0].Failures != 0 {
+		t.Errorf("breaker did not close: %+v", b)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	backend := testBackend(t, "customers")
+	cfg := defaultConfig()
+	cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{backend.URL}}
+	cfg.Routes[0].RateLimit = &RateLimitConfig{RequestsPerSecond: 0.5, Burst: 2}
+	useTestGateway(t, cfg)
+	get := func(user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/customer/1", nil)
+		req.Header.Set("Authorization", "Bearer "+testToken(t, user))
+		rr := httptest.NewRecorder()
+		serveGateway(rr, req)
+		return rr
+	}
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if rr := get("alice"); rr.Code != want {
+			t.Errorf("request %d: got %d want %d", i, rr.Code, want)
+		} else if want == http.StatusTooManyRequests && rr.Header().Get("Retry-After") != "2" {
+			t.Errorf("Retry-After = %q, want 2", rr.Header().Get("Retry-After"))
+		}
+	}
+	if rr := get("bob"); rr.Code != http.StatusOK {
+		t.Errorf("other user: got %d want 200", rr.Code)
+	}
+
+	rr := httptest.NewRecorder()
+	adminRouter().ServeHTTP(rr, httptest.NewRequest("GET", "/rate-limits", nil))
+	var limits []rateLimitStatus
+	if err := json.Unmarshal(rr.Body.Bytes(), &limits); err != nil {
+		t.Fatal(err)
+	}
+	if len(limits) != 1 || limits[0].Route != "customer" || limits[0].Clients != 2 || limits[0].Allowed != 3 || limits[0].Limited != 1 {
+		t.Errorf("unexpected rate limit status: %s", rr.Body.String())
+	}
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	body := strings.Repeat(`{"name":"V N"},`, 100)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/customer/encoded" {
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+		w.Write([]byte(body))
+	}))
+	defer backend.Close()
+
+	cfg := defaultConfig()
+	cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{backend.URL}}
+	cfg.Routes[0].Compression = &CompressionConfig{MinSize: 256}
+	useTestGateway(t, cfg)
+	token := testToken(t, "admin")
+
+	get := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rr := httptest.NewRecorder()
+		serveGateway(rr, req)
+		return rr
+	}
+
+	rr := get("/customer", "gzip;q=0.8, br")
+	if enc := rr.Header().Get("Content-Encoding"); enc != "br" {
+		t.Fatalf("Content-Encoding = %q, want br", enc)
+	}
+
+	rr = get("/customer", "gzip")
+	if enc := rr.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", enc)
+	}
+	zr, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, _ := io.ReadAll(zr)
+	if string(plain) != body {
+		t.Errorf("decompressed body does not match upstream body")
+	}
+
+	rr = get("/customer/encoded", "gzip")
+	if rr.Body.String() != body {
+		t.Errorf("already encoded response was modified")
+	}
+
+	rr = get("/customer", "identity")
+	if rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != body {
+		t.Errorf("response compressed for a client that did not ask for it")
+	}
+}
+
+func TestBodyLimits(t *testing.T) {
+	backend := testBackend(t, "customers")
+	cfg := defaultConfig()
+	cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{backend.URL}}
+	cfg.Routes[0].Body = &BodyConfig{MaxBytes: 64, ContentTypes: []string{"application/json"}, MaxJSONDepth: 3}
+	useTestGateway(t, cfg)
+	token := testToken(t, "admin")
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"valid", "application/json", `{"name":"V N"}`, http.StatusOK},
+		{"too large", "application/json", `{"name":"` + strings.Repeat("x", 64) + `"}`, http.StatusRequestEntityTooLarge},
+		{"wrong type", "text/plain", `name=V N`, http.StatusUnsupportedMediaType},
+		{"missing type", "", `{"name":"V N"}`, http.StatusUnsupportedMediaType},
+		{"too deep", "application/json; charset=utf-8", `{"a":{"b":{"c":{}}}}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/customer", strings.NewReader(tt.body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		rr := httptest.NewRecorder()
+		serveGateway(rr, req)
+		if rr.Code != tt.want {
+			t.Errorf("%s: got %d want %d (%s)", tt.name, rr.Code, tt.want, rr.Body.String())
+		}
+	}
+}
+
+func TestCORSPreflightSkipsAuth(t *testing.T) {
+	backend := testBackend(t, "customers")
+	cfg := defaultConfig()
+	cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{backend.URL}}
+	cfg.Routes[0].CORS = &CORSConfig{
+		AllowedOrigins:   []string{"https://app.example.com", "https://*.staging.example.com"},
+		AllowCredentials: true,
+		MaxAge:           Duration{10 * time.Minute},
+	}
+	useTestGateway(t, cfg)
+
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("OPTIONS", "/customer/1", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "DELETE")
+		req.Header.Set("Access-Control-Request-Headers", "authorization, content-type")
+		rr := httptest.NewRecorder()
+		serveGateway(rr, req)
+		return rr
+	}
+
+	rr := preflight("https://pr-12.staging.example.com")
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("preflight returned %d, want 204", rr.Code)
+	}
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "https://pr-12.staging.example.com" {
+		t.Errorf("Access-Control-Allow-Origin = %q", got)
+	}
+	if got := rr.Header().Get("Access-Control-Max-Age"); got != "600" {
+		t.Errorf("Access-Control-Max-Age = %q, want 600", got)
+	}
+
+	rr = preflight("https://evil.example.org")
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("disallowed origin got Access-Control-Allow-Origin %q", got)
+	}
+
+	bad := defaultConfig()
+	bad.Routes[0].CORS = &CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}
+	if err := bad.validate(); err == nil {
+		t.Error("credentials from any origin validated")
+	}
+
+	req := httptest.NewRequest("GET", "/customer/1", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Authorization", "Bearer "+testToken(t, "admin"))
+	rr = httptest.NewRecorder()
+	serveGateway(rr, req)
+	if rr.Code != http.StatusOK || rr.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("actual request: status %d, headers %v", rr.Code, rr.Header())
+	}
+}
+
+func TestCORSDefaultMethods(t *testing.T) {
+	backend := testBackend(t, "customers")
+	cfg := defaultConfig()
+	cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{backend.URL}}
+	cfg.Routes[0].Methods = nil
+	cfg.Routes[0].CORS = &CORSConfig{AllowedOrigins: []string{"*"}}
+	useTestGateway(t, cfg)
+
+	for _, method := range []string{"GET", "PATCH", "DELETE"} {
+		req := httptest.NewRequest("OPTIONS", "/customer/1", nil)
+		req.Header.Set("Origin", "https://app.example.com")
+		req.Header.Set("Access-Control-Request-Method", method)
+		rr := httptest.NewRecorder()
+		serveGateway(rr, req)
+		if rr.Code != http.StatusNoContent || rr.Header().Get("Access-Control-Allow-Origin") != "*" {
+			t.Errorf("%s preflight: status %d, headers %v", method, rr.Code, rr.Header())
+		}
+		if got := rr.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(got, method) {
+			t.Errorf("%s preflight: Access-Control-Allow-Methods = %q", method, got)
+		}
+	}
+}
+
+func TestIPFilterRestrictsDeletes(t *testing.T) {
+	backend := testBackend(t, "customers")
+	cfg := defaultConfig()
+	cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{backend.URL}}
+	cfg.TrustedProxies = []string{"10.0.0.0/8"}
+	cfg.Routes[0].IPFilters = []IPFilterConfig{
+		{Methods: []string{"DELETE"}, Path: "^/customer/[^/]+$", Allow: []string{"192.0.2.0/24"}},
+	}
+	gw := useTestGateway(t, cfg)
+	token := testToken(t, "admin")
+
+	tests := []struct {
+		method, remoteAddr, forwardedFor string
+		want                             int
+	}{
+		{"DELETE", "192.0.2.10:5000", "", http.StatusOK},
+		{"DELETE", "198.51.100.7:5000", "", http.StatusForbidden},
+		{"DELETE", "10.1.2.3:5000", "198.51.100.7, 192.0.2.10", http.StatusOK},
+		{"DELETE", "10.1.2.3:5000", "192.0.2.10, 198.51.100.7", http.StatusForbidden},
+		{"DELETE", "198.51.100.7:5000", "192.0.2.10", http.StatusForbidden},
+		{"GET", "198.51.100.7:5000", "", http.StatusOK},
+	}
+	for i, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/customer/1", nil)
+		req.RemoteAddr = tt.remoteAddr
+		req.Header.Set("Authorization", "Bearer "+token)
+		if tt.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+		}
+		rr := httptest.NewRecorder()
+		serveGateway(rr, req)
+		if rr.Code != tt.want {
+			t.Errorf("case %d: got %d want %d", i, rr.Code, tt.want)
+		}
+	}
+
+	st := gw.routes["customer"].ipFilters[0].status("customer")
+	if st.Allowed != 2 || st.Denied != 3 {
+		t.Errorf("counters allowed=%d denied=%d, want 2 and 3", st.Allowed, st.Denied)
+	}
+}
+
+func TestWAFBlocksInjection(t *testing.T) {
+	backend := testBackend(t, "customers")
+	cfg := defaultConfig()
+	cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{backend.URL}}
+	cfg.Routes[0].WAF = &RouteWAFConfig{}
+	useTestGateway(t, cfg)
+	token := testToken(t, "admin")
+
+	tests := []struct {
+		name, method, target, body string
+		want                       int
+	}{
+		{"plain", "GET", "/customer/1", "", http.StatusOK},
+		{"union select", "GET", "/customer?name=x%27%20UNION%20SELECT%20credit_card%20FROM%20customers", "", http.StatusForbidden},
+		{"tautology", "PUT", "/customer/1", `{"name": "x' OR '1'='1"}`, http.StatusForbidden},
+		{"stacked id", "DELETE", "/customer/1;%20DROP%20TABLE%20customers", "", http.StatusForbidden},
+		{"traversal", "GET", "/customer?file=..%2F..%2Fetc%2Fpasswd", "", http.StatusForbidden},
+		{"oversized", "GET", "/customer?name=" + strings.Repeat("a", 5000), "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		serveGateway(rr, req)
+		if rr.Code != tt.want {
+			t.Errorf("%s: got %d want %d", tt.name, rr.Code, tt.want)
+		}
+	}
+}
+
+func TestTransformRequestAndResponse(t *testing.T) {
+	var gotPath, gotQuery, gotBody, gotHeader string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotQuery, gotHeader = r.URL.Path, r.URL.RawQuery, r.Header.Get("X-Client")
+		body, _ := io.ReadAll(r.Body)
+		gotBody = string(body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Internal", "1")
+		w.Write([]byte(`[{"id":1,"phone_number":"123","credit_card":"5432"},{"id":2,"phone_number":"456","credit_card":"8765"}]`))
+	}))
+	defer backend.Close()
+
+	cfg := defaultConfig()
+	cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{backend.URL}}
+	cfg.Routes[0].Transform = &TransformConfig{
+		PathRewrite: &PathRewriteConfig{Pattern: `^/customer/by-id/(\d+)$`, Replacement: "/customer/$1"},
+		Query:       QueryTransformConfig{Rename: map[string]string{"q": "name"}},
+		Request: MessageTransformConfig{
+			RenameHeaders: map[string]string{"X-Client-Id": "X-Client"},
+			RenameFields:  map[string]string{"phoneNumber": "phone_number"},
+		},
+		Response: MessageTransformConfig{
+			RemoveHeaders: []string{"X-Internal"},
+			RenameFields:  map[string]string{"phone_number": "phoneNumber"},
+			RemoveFields:  []string{"credit_card"},
+		},
+	}
+	useTestGateway(t, cfg)
+
+	req := httptest.NewRequest("PUT", "/customer/by-id/7?q=V", strings.NewReader(`{"phoneNumber":"123"}`))
+	req.Header.Set("Authorization", "Bearer "+testToken(t, "admin"))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Client-Id", "web")
+	rr := httptest.NewRecorder()
+	serveGateway(rr, req)
+
+	if gotPath != "/customer/7" || gotQuery != "name=V" || gotHeader != "web" {
+		t.Errorf("upstream saw path %q query %q X-Client %q", gotPath, gotQuery, gotHeader)
+	}
+	if strings.TrimSpace(gotBody) != `{"phone_number":"123"}` {
+		t.Errorf("upstream saw body %s", gotBody)
+	}
+	if rr.Header().Get("X-Internal") != "" {
+		t.Errorf("X-Internal header was not removed")
+	}
+	want := `[{"id":1,"phoneNumber":"123"},{"id":2,"phoneNumber":"456"}]`
+	if strings.TrimSpace(rr.Body.String()) != want {
+		t.Errorf("got body %s want %s", rr.Body.String(), want)
+	}
+
+	// The body limit holds even when the chain leaves out the body step.
+	cfg.Routes[0].Body = &BodyConfig{MaxBytes: 8}
+	cfg.Routes[0].Middleware = []MiddlewareConfig{{Name: "transform"}}
+	useTestGateway(t, cfg)
+	req = httptest.NewRequest("PUT", "/customer/by-id/7", strings.NewReader(`{"phoneNumber":"123"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr = httptest.NewRecorder()
+	serveGateway(rr, req)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body returned %d", rr.Code)
+	}
+}
+
+func TestTransformEncodedResponses(t *testing.T) {
+	var gotEncoding atomic.Value
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotEncoding.Store(r.Header.Get("Accept-Encoding"))
+		doc := `{"id":1,"credit_card":"5432"}`
+		switch r.URL.Path {
+		case "/customer/1":
+			// Compressed whatever the request asked for.
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			zw.Write([]byte(doc))
+			zw.Close()
+		case "/customer/2":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Encoding", "br")
+			w.Write([]byte("not really brotli"))
+		case "/customer/3":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(doc))
+		case "/customer/4":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"id":1,"credit_card":`))
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("not found"))
+		}
+	}))
+	defer backend.Close()
+
+	cfg := defaultConfig()
+	cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{backend.URL}}
+	cfg.Routes[0].Transform = &TransformConfig{Response: MessageTransformConfig{RemoveFields: []string{"credit_card"}}}
+	useTestGateway(t, cfg)
+	get := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set("Authorization", "Bearer "+testToken(t, "admin"))
+		req.Header.Set("Accept-Encoding", "br")
+		rr := httptest.NewRecorder()
+		serveGateway(rr, req)
+		return rr
+	}
+
+	rr := get("/customer/1")
+	if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != `{"id":1}` || rr.Header().Get("Content-Encoding") != "" {
+		t.Errorf("gzipped response: %d %v %q", rr.Code, rr.Header(), rr.Body.String())
+	}
+	if got := gotEncoding.Load(); got == "br" {
+		t.Errorf("client Accept-Encoding was sent upstream")
+	}
+	if rr := get("/customer/2"); rr.Code != http.StatusBadGateway {
+		t.Errorf("undecodable response: %d %q", rr.Code, rr.Body.String())
+	}
+	if rr := get("/customer/3"); rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != `{"id":1}` {
+		t.Errorf("JSON sent as text/plain: %d %q", rr.Code, rr.Body.String())
+	}
+	if rr := get("/customer/4"); rr.Code != http.StatusBadGateway {
+		t.Errorf("truncated JSON: %d %q", rr.Code, rr.Body.String())
+	}
+	if rr := get("/customer/5"); rr.Code != http.StatusNotFound || rr.Body.String() != "not found" {
+		t.Errorf("plain text error: %d %q", rr.Code, rr.Body.String())
+	}
+
+	// The proxy decodes the gzip it asks for itself; gzip that reaches the
+	// transform some other way is decoded there.
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(`[{"id":1,"credit_card":"5432"}]`))
+	zw.Close()
+	h := http.Header{"Content-Type": {"application/json"}, "Content-Encoding": {"gzip"}}
+	out, err := transformResponse(h, buf.Bytes(), cfg.Routes[0].Transform.Response)
+	if err != nil || strings.TrimSpace(string(out)) != `[{"id":1}]` || h.Get("Content-Encoding") != "" {
+		t.Errorf("gzipped body: %q %v %v", out, h, err)
+	}
+}
+
+func TestCompositeOverview(t *testing.T) {
+	customers := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/customer/7" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":7,"name":"V N"}`))
+	}))
+	defer customers.Close()
+	var accountsQuery atomic.Value
+	accounts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accountsQuery.Store(r.URL.RawQuery)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte(`[]`))
+	}))
+	defer accounts.Close()
+
+	cfg := defaultConfig()
+	cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{customers.URL}}
+	cfg.Upstreams["invest-accounts"] = UpstreamConfig{Targets: []string{accounts.URL}}
+	cfg.Composites[0].Sections[1].Timeout = Duration{50 * time.Millisecond}
+	useTestGateway(t, cfg)
+	token := testToken(t, "admin")
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		serveGateway(rr, req)
+		return rr
+	}
+
+	rr := get("/customer/7/overview")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("overview returned %d: %s", rr.Code, rr.Body.String())
+	}
+	var overview struct {
+		Customer       map[string]interface{}  `json:"customer"`
+		InvestAccounts []interface{}           `json:"invest_accounts"`
+		Errors         map[string]sectionError `json:"errors"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &overview); err != nil {
+		t.Fatal(err)
+	}
+	if q := accountsQuery.Load(); q != "owner_id=7" {
+		t.Errorf("accounts queried with %v", q)
+	}
+	if overview.Customer["name"] != "V N" {
+		t.Errorf("customer section = %v", overview.Customer)
+	}
+	if overview.Errors["invest_accounts"].Status != http.StatusGatewayTimeout {
+		t.Errorf("invest_accounts error = %+v, want a timeout", overview.Errors["invest_accounts"])
+	}
+
+	if rr := get("/customer/8/overview"); rr.Code != http.StatusNotFound {
+		t.Errorf("missing customer returned %d, want 404", rr.Code)
+	}
+	// Values cannot add query parameters of their own.
+	path := expandPath("/customer/{id}?owner_id={id}", map[string]string{"id": "1&owner_id=2"})
+	if path != "/customer/1&owner_id=2?owner_id=1%26owner_id%3D2" {
+		t.Errorf("expanded to %s", path)
+	}
+
+	// Composites run through a chain of their own, like routes.
+	cfg.Composites[0].IPFilters = []IPFilterConfig{{Deny: []string{"10.0.0.0/8"}}}
+	cfg.Composites[0].RateLimit = &RateLimitConfig{RequestsPerSecond: 0.001, Burst: 1}
+	useTestGateway(t, cfg)
+	req := httptest.NewRequest("GET", "/customer/7/overview", nil)
+	req.RemoteAddr = "10.1.2.3:1234"
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr = httptest.NewRecorder()
+	serveGateway(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("denied address got %d", rr.Code)
+	}
+	if rr := get("/customer/7/overview"); rr.Code != http.StatusOK {
+		t.Errorf("first request got %d", rr.Code)
+	}
+	if rr := get("/customer/7/overview"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("request over the limit got %d", rr.Code)
+	}
+	cfg.Composites[0].Middleware = []MiddlewareConfig{{Name: "cache"}}
+	if err := cfg.validate(); err == nil {
+		t.Error("composite with a cache step validated")
+	}
+}
+
+func TestGraphQLBatchesAndLimits(t *testing.T) {
+	customers := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id":1,"name":"A"},{"id":2,"name":"B"},{"id":3,"name":"C"}]`))
+	}))
+	defer customers.Close()
+	var accountCalls int32
+	var accountsQuery atomic.Value
+	accounts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&accountCalls, 1)
+		accountsQuery.Store(r.URL.RawQuery)
+		w.Write([]byte(`[{"id":10,"owner_id":1},{"id":11,"owner_id":1},{"id":12,"owner_id":3}]`))
+	}))
+	defer accounts.Close()
+
+	cfg := defaultConfig()
+	cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{customers.URL}}
+	cfg.Upstreams["invest-accounts"] = UpstreamConfig{Targets: []string{accounts.URL}}
+	cfg.GraphQL.MaxDepth = 3
+	useTestGateway(t, cfg)
+	token := testToken(t, "admin")
+
+	post := func(query string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"query": query})
+		req := httptest.NewRequest("POST", "/graphql", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		serveGateway(rr, req)
+		return rr
+	}
+
+	rr := post(`{ customers { name investAccounts { id } } }`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("query returned %d: %s", rr.Code, rr.Body.String())
+	}
+	var result struct {
+		Data struct {
+			Customers []struct {
+				Name           string `json:"name"`
+				InvestAccounts []struct {
+					ID int `json:"id"`
+				} `json:"investAccounts"`
+			} `json:"customers"`
+		} `json:"data"`
+		Errors []interface{} `json:"errors"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Errors) > 0 {
+		t.Fatalf("unexpected errors: %v", result.Errors)
+	}
+	if n := atomic.LoadInt32(&accountCalls); n != 1 {
+		t.Errorf("accounts backend called %d times, want 1", n)
+	}
+	if q := accountsQuery.Load(); q != "owner_id=1&owner_id=2&owner_id=3" {
+		t.Errorf("accounts queried with %v", q)
+	}
+	got := result.Data.Customers
+	if len(got) != 3 || len(got[0].InvestAccounts) != 2 || len(got[1].InvestAccounts) != 0 || got[2].InvestAccounts[0].ID != 12 {
+		t.Errorf("unexpected result: %s", rr.Body.String())
+	}
+
+	if rr := post(`{ customers { investAccounts { owner { name } } } }`); rr.Code != http.StatusBadRequest {
+		t.Errorf("query deeper than the limit returned %d", rr.Code)
+	}
+}
+
+func TestGraphQLUsesRouteChain(t *testing.T) {
+	var customerCalls int32
+	customers := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&customerCalls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"id":1,"name":"A","surname":"S","phone_number":"123","credit_card":"4111"}]`))
+	}))
+	defer customers.Close()
+	accounts := testBackend(t, "accounts")
+
+	cfg := defaultConfig()
+	cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{customers.URL}}
+	cfg.Upstreams["invest-accounts"] = UpstreamConfig{Targets: []string{accounts.URL}}
+	cfg.Routes[0].Transform = &TransformConfig{Response: MessageTransformConfig{
+		RemoveFields: []string{"surname"},
+		RenameFields: map[string]string{"phone_number": "phone"},
+	}}
+	cfg.Routes[0].Cache = &CacheConfig{TTL: Duration{time.Minute}}
+	useTestGateway(t, cfg)
+	token := testToken(t, "admin")
+
+	post := func(query string) map[string]interface{} {
+		body, _ := json.Marshal(map[string]string{"query": query})
+		req := httptest.NewRequest("POST", "/graphql", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		serveGateway(rr, req)
+		var out map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &out)
+		return out
+	}
+
+	out := post(`{ customers { name phoneNumber } }`)
+	if out["errors"] != nil || !strings.Contains(fmt.Sprint(out["data"]), "phoneNumber:123") {
+		t.Errorf("renamed field: %v", out)
+	}
+	// The route's cache answers the second query.
+	post(`{ customers { name } }`)
+	if n := atomic.LoadInt32(&customerCalls); n != 1 {
+		t.Errorf("customers backend called %d times, want 1", n)
+	}
+	for _, field := range []string{"surname", "creditCard", "debitCard"} {
+		if out := post(`{ customers { ` + field + ` } }`); out["errors"] == nil {
+			t.Errorf("%s is queryable: %v", field, out)
+		}
+	}
+
+	// The endpoint itself takes route settings such as a rate limit.
+	cfg.GraphQL.RateLimit = &RateLimitConfig{RequestsPerSecond: 0.001, Burst: 1}
+	useTestGateway(t, cfg)
+	if out := post(`{ customers { name } }`); out["errors"] != nil {
+		t.Errorf("first query: %v", out)
+	}
+	if out := post(`{ customers { name } }`); out["data"] != nil {
+		t.Errorf("query over the limit: %v", out)
+	}
+}
+
+type testCustomersServer struct {
+	UnimplementedCustomersServer
+}
+
+func (testCustomersServer) ListCustomers(req *ListCustomersRequest, stream Customers_ListCustomersServer) error {
+	for _, id := range req.Ids {
+		if err := stream.Send(&CustomerRecord{Id: id, Name: "C" + strconv.Itoa(int(id))}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (testCustomersServer) GetCustomer(ctx context.Context, req *GetCustomerRequest) (*CustomerRecord, error) {
+	if req.Id != 1 {
+		return nil, status.Error(codes.NotFound, "Customer not found")
+	}
+	return &CustomerRecord{Id: 1, Name: "V", DateOfBirth: timestamppb.New(time.Date(1994, 5, 20, 0, 0, 0, 0, time.UTC))}, nil
+}
+
+func (testCustomersServer) CreateCustomer(ctx context.Context, req *CreateCustomerRequest) (*CustomerRecord, error) {
+	req.Customer.Id = 42
+	return req.Customer, nil
+}
+
+func TestGRPCTranscoding(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	RegisterCustomersServer(srv, testCustomersServer{})
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	cfg := defaultConfig()
+	cfg.GraphQL = nil
+	cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{"http://" + lis.Addr().String()}}
+	cfg.Routes[0].GRPC = &GRPCRouteConfig{Service: "customers.v1.Customers"}
+	useTestGateway(t, cfg)
+	token := testToken(t, "admin")
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		serveGateway(rr, req)
+		return rr
+	}
+
+	rr := do("GET", "/customer/1", "")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"date_of_birth":"1994-05-20T00:00:00Z"`) || !strings.Contains(rr.Body.String(), `"has_foreign_country_tax_liability":false`) {
+		t.Errorf("get returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = do("GET", "/customer?id=2&id=3", "")
+	var list []map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil || len(list) != 2 || list[1]["name"] != "C3" {
+		t.Errorf("list returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	if rr := do("GET", "/customer/9", ""); rr.Code != http.StatusNotFound || !strings.Contains(rr.Body.String(), "Customer not found") {
+		t.Errorf("missing customer returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = do("POST", "/customer", `{"name": "New", "age": 30}`)
+	if rr.Code != http.StatusCreated || !strings.Contains(rr.Body.String(), `"id":42`) {
+		t.Errorf("create returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	if rr := do("POST", "/customer", `{"nickname": "x"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("create with an unknown field returned %d", rr.Code)
+	}
+	if rr := do("DELETE", "/customer/1", ""); rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unimplemented method returned %d", rr.Code)
+	}
+
+	// The body limit holds even when the chain leaves out the body step.
+	cfg.Routes[0].Body = &BodyConfig{MaxBytes: 16}
+	cfg.Routes[0].Middleware = []MiddlewareConfig{{Name: "jwt"}}
+	useTestGateway(t, cfg)
+	if rr := do("POST", "/customer", `{"name": "New", "age": 30}`); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body returned %d", rr.Code)
+	}
+}
+
+func TestTrafficSplit(t *testing.T) {
+	stable := testBackend(t, "stable")
+	canary := testBackend(t, "canary")
+	cfg := defaultConfig()
+	cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{stable.URL}}
+	cfg.Upstreams["customers-v2"] = UpstreamConfig{Targets: []string{canary.URL}}
+	cfg.Routes[0].Split = &SplitConfig{
+		Sticky: "user",
+		Variants: []SplitVariantConfig{{
+			Name:     "canary",
+			Upstream: "customers-v2",
+			Weight:   50,
+			Header:   &SplitHeaderConfig{Name: "X-Canary", Value: "true"},
+		}},
+	}
+	useTestGateway(t, cfg)
+
+	get := func(username string, canary bool) string {
+		req := httptest.NewRequest("GET", "/customer/1", nil)
+		req.Header.Set("Authorization", "Bearer "+testToken(t, username))
+		if canary {
+			req.Header.Set("X-Canary", "true")
+		}
+		rr := httptest.NewRecorder()
+		serveGateway(rr, req)
+		if rr.Header().Get("X-Variant") == "" {
+			t.Errorf("no X-Variant header")
+		}
+		return rr.Header().Get("X-Backend")
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		user := "user" + strconv.Itoa(i)
+		first := get(user, false)
+		if again := get(user, false); again != first {
+			t.Errorf("%s moved from %s to %s", user, first, again)
+		}
+		seen[first] = true
+	}
+	if !seen["stable"] || !seen["canary"] {
+		t.Errorf("50%% split over 20 users only reached %v", seen)
+	}
+	if got := get("user0", true); got != "canary" {
+		t.Errorf("X-Canary request went to %s", got)
+	}
+
+	rr := httptest.NewRecorder()
+	adminRouter().ServeHTTP(rr, httptest.NewRequest("GET", "/splits", nil))
+	var splits []splitStatus
+	if err := json.Unmarshal(rr.Body.Bytes(), &splits); err != nil {
+		t.Fatal(err)
+	}
+	if len(splits) != 1 || len(splits[0].Variants) != 2 {
+		t.Fatalf("unexpected split status: %s", rr.Body.String())
+	}
+	if total := splits[0].Variants[0].Requests + splits[0].Variants[1].Requests; total != 41 {
+		t.Errorf("variants counted %d requests, want 41", total)
+	}
+}
+
+func TestMirrorComparesShadowResponses(t *testing.T) {
+	primary := testBackend(t, "primary")
+	shadowed := make(chan string, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		shadowed <- r.Header.Get("X-Shadow-Request")
+		if r.URL.Path == "/invest-account/2" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer shadow.Close()
+
+	cfg := defaultConfig()
+	cfg.Upstreams["invest-accounts"] = UpstreamConfig{Targets: []string{primary.URL}}
+	cfg.Upstreams["invest-accounts-next"] = UpstreamConfig{Targets: []string{shadow.URL}}
+	cfg.Routes[1].Mirror = &MirrorConfig{Upstream: "invest-accounts-next", Percent: 100}
+	useTestGateway(t, cfg)
+	token := testToken(t, "admin")
+
+	for _, path := range []string{"/invest-account/1", "/invest-account/2"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		serveGateway(rr, req)
+		if rr.Code != http.StatusOK || rr.Header().Get("X-Backend") != "primary" {
+			t.Errorf("%s answered %d from %q", path, rr.Code, rr.Header().Get("X-Backend"))
+		}
+		if got := <-shadowed; got != "true" {
+			t.Errorf("shadow request marked %q", got)
+		}
+	}
+	req := httptest.NewRequest("POST", "/invest-account", strings.NewReader(`{}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	serveGateway(httptest.NewRecorder(), req)
+
+	m := currentGateway().routes["invest-account"].mirror
+	var st mirrorStatus
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if st = m.status("invest-account"); st.Mirrored == 2 {
+			break
+		}
+	}
+	if st.Mirrored != 2 || st.Matched != 1 || st.StatusMismatch != 1 {
+		t.Errorf("unexpected mirror status %+v", st)
+	}
+	if len(st.RecentDiffs) != 1 || st.RecentDiffs[0].Shadow.Status != http.StatusInternalServerError {
+		t.Errorf("unexpected diffs %+v", st.RecentDiffs)
+	}
+	if len(shadowed) != 0 {
+		t.Errorf("POST was mirrored")
+	}
+
+	// A panicking primary still frees the shadow's slot and counts as an
+	// error.
+	pm := newMirror(&MirrorConfig{Percent: 100, MaxInFlight: 1}, m.pool)
+	panics := mirrorMiddleware(pm, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { panic(http.ErrAbortHandler) }))
+	for i := 0; i < 2; i++ {
+		func() {
+			defer func() { recover() }()
+			panics.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/invest-account/1", nil))
+		}()
+		waitFor(t, func() bool { return pm.status("invest-account").Errors == int64(i+1) && len(pm.slots) == 0 })
+	}
+	if st := pm.status("invest-account"); st.Dropped != 0 {
+		t.Errorf("shadow slot leaked: %+v", st)
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	var version int32 = 1
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/customer/2" && atomic.LoadInt32(&version) == 2 {
+			w.Write([]byte(`{"id": 2, "name": "changed", "credit_card": "x"}`))
+			return
+		}
+		w.Write([]byte(`{"id": ` + strings.TrimPrefix(r.URL.Path, "/customer/") + `, "name": "V", "credit_card": "5432"}`))
+	}))
+	defer backend.Close()
+
+	path := t.TempDir() + "/recording.jsonl"
+	cfg := defaultConfig()
+	cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{backend.URL}}
+	cfg.Record = &RecordConfig{Path: path, Routes: []string{"customer"}, RedactFields: []string{"credit_card"}}
+	gw := useTestGateway(t, cfg)
+	token := testToken(t, "admin")
+
+	for _, p := range []string{"/customer/1", "/customer/2", "/invest-account/1"} {
+		req := httptest.NewRequest("GET", p, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		serveGateway(httptest.NewRecorder(), req)
+	}
+	gw.recorder.close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), token) || strings.Contains(string(data), "5432") {
+		t.Errorf("recording is not redacted: %s", data)
+	}
+	if n := strings.Count(string(data), "\n"); n != 2 {
+		t.Fatalf("recorded %d exchanges, want 2", n)
+	}
+
+	cfg = defaultConfig()
+	cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{backend.URL}}
+	useTestGateway(t, cfg)
+	target := httptest.NewServer(http.HandlerFunc(serveGateway))
+	defer target.Close()
+	atomic.StoreInt32(&version, 2)
+
+	var out bytes.Buffer
+	total, mismatches, _, err := replay(bytes.NewReader(data), replayOptions{target: target.URL, token: token}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || mismatches != 1 || !strings.Contains(out.String(), `"uri":"/customer/2"`) {
+		t.Errorf("replayed %d with %d mismatches: %s", total, mismatches, out.String())
+	}
+}
+
+func TestReplayTruncatedBodies(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"id": 1, "name": "a long list of customers", "credit_card": "5432"}]`))
+	}))
+	defer backend.Close()
+
+	path := t.TempDir() + "/recording.jsonl"
+	cfg := defaultConfig()
+	cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{backend.URL}}
+	cfg.Record = &RecordConfig{Path: path, MaxBodyBytes: 16, RedactFields: []string{"credit_card"}}
+	cfg.Routes[0].Body = nil
+	gw := useTestGateway(t, cfg)
+	token := testToken(t, "admin")
+
+	for _, body := range []string{"", `{"name": "longer than sixteen bytes"}`} {
+		method := "GET"
+		if body != "" {
+			method = "POST"
+		}
+		req := httptest.NewRequest(method, "/customer", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		serveGateway(httptest.NewRecorder(), req)
+	}
+	gw.recorder.close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The cut JSON cannot be redacted, so it is not recorded at all.
+	if strings.Count(string(data), `"truncated":true`) != 3 || strings.Contains(string(data), "5432") {
+		t.Errorf("recording: %s", data)
+	}
+
+	target := httptest.NewServer(http.HandlerFunc(serveGateway))
+	defer target.Close()
+	var out bytes.Buffer
+	total, mismatches, skipped, err := replay(bytes.NewReader(data), replayOptions{target: target.URL, token: token}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 || mismatches != 0 || skipped != 1 || !strings.Contains(out.String(), `"skipped"`) {
+		t.Errorf("replayed %d with %d mismatches and %d skipped: %s", total, mismatches, skipped, out.String())
+	}
+}
+
+func TestMockResponses(t *testing.T) {
+	backend := testBackend(t, "customers")
+	file := filepath.Join(t.TempDir(), "customers.json")
+	if err := os.WriteFile(file, []byte(`[{"id": 1, "owner": "{{.Query.Get "owner"}}"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{backend.URL}}
+	cfg.Routes[0].Mock = &MockConfig{
+		Passthrough: true,
+		Responses: []MockResponseConfig{
+			{Method: "GET", Path: "/customer", File: file},
+			{Method: "GET", Path: "/customer/{id}", Body: `{"id": {{.Params.id}}, "name": "Mock"}`},
+			{Method: "DELETE", Path: "/customer/{id}", ErrorPercent: 100, ErrorStatus: 503},
+		},
+	}
+	useTestGateway(t, cfg)
+
+	send := func(method, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Authorization", "Bearer "+testToken(t, "alice"))
+		rr := httptest.NewRecorder()
+		serveGateway(rr, req)
+		return rr
+	}
+
+	rr := send("GET", "/customer/42")
+	if rr.Code != http.StatusOK || rr.Header().Get("X-Mock") != "true" {
+		t.Fatalf("got %d %v", rr.Code, rr.Header())
+	}
+	if body := strings.TrimSpace(rr.Body.String()); body != `{"id": 42, "name": "Mock"}` {
+		t.Errorf("templated body = %s", body)
+	}
+	if body := send("GET", "/customer?owner=bob").Body.String(); body != `[{"id": 1, "owner": "bob"}]` {
+		t.Errorf("file body = %s", body)
+	}
+	if rr := send("DELETE", "/customer/1"); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("injected error returned %d", rr.Code)
+	}
+	if rr := send("PUT", "/customer/1"); rr.Header().Get("X-Backend") != "customers" {
+		t.Errorf("unmatched request was not passed through: %d %v", rr.Code, rr.Header())
+	}
+
+	cfg.Routes[0].Mock.Responses[0].File = filepath.Join(t.TempDir(), "missing.json")
+	if _, err := buildGateway(cfg, nil); err == nil {
+		t.Error("missing mock file did not fail the build")
+	}
+}
+
+func TestFaultInjection(t *testing.T) {
+	backend := testBackend(t, "customers")
+	newConfig := func() *Config {
+		cfg := defaultConfig()
+		cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{backend.URL}}
+		cfg.Routes[0].Fault = &FaultConfig{
+			Header: "X-Chaos",
+			Abort:  &FaultAbortConfig{Status: http.StatusServiceUnavailable, Percent: 100},
+		}
+		return cfg
+	}
+	gw := useTestGateway(t, newConfig())
+	server := httptest.NewServer(http.HandlerFunc(serveGateway))
+	defer server.Close()
+
+	get := func(chaos bool) (*http.Response, error) {
+		req, _ := http.NewRequest("GET", server.URL+"/customer/1", nil)
+		req.Header.Set("Authorization", "Bearer "+testToken(t, "alice"))
+		if chaos {
+			req.Header.Set("X-Chaos", "1")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	if resp, err := get(false); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("request without the trigger header: %v %v", resp, err)
+	}
+	if resp, err := get(true); err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("triggered request: %v %v", resp, err)
+	}
+
+	admin := adminRouter()
+	rr := httptest.NewRecorder()
+	admin.ServeHTTP(rr, httptest.NewRequest("PUT", "/faults/customer", strings.NewReader(`{"reset": {"percent": 100}}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("setting faults returned %d: %s", rr.Code, rr.Body.String())
+	}
+	if _, err := get(false); err == nil {
+		t.Error("reset fault did not break the connection")
+	}
+
+	// Admin changes survive a reload of the same config.
+	rebuilt, err := buildGateway(newConfig(), gw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rebuilt.close()
+	if s := rebuilt.routes["customer"].faults.status("customer"); s.Source != "admin" || s.Fault.Reset == nil {
+		t.Errorf("faults after reload = %+v", s)
+	}
+
+	rr = httptest.NewRecorder()
+	admin.ServeHTTP(rr, httptest.NewRequest("DELETE", "/faults/customer", nil))
+	if resp, err := get(true); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("request after clearing faults: %v %v", resp, err)
+	}
+
+	rr = httptest.NewRecorder()
+	admin.ServeHTTP(rr, httptest.NewRequest("PUT", "/faults/customer", strings.NewReader(`{"abort": {"status": 200, "percent": 10}}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid abort status accepted: %d", rr.Code)
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	var created int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && atomic.AddInt32(&created, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"id": %d}`, atomic.LoadInt32(&created))
+	}))
+	defer backend.Close()
+	cfg := defaultConfig()
+	cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{backend.URL}}
+	cfg.Routes[0].Idempotency = &IdempotencyConfig{Required: true}
+	useTestGateway(t, cfg)
+
+	post := func(user, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/customer", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+testToken(t, user))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		rr := httptest.NewRecorder()
+		serveGateway(rr, req)
+		return rr
+	}
+
+	if rr := post("alice", "", `{"name": "Jane"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("POST without a key returned %d", rr.Code)
+	}
+	// The first attempt fails upstream and is not stored, so the retry goes
+	// through.
+	if rr := post("alice", "k1", `{"name": "Jane"}`); rr.Code != http.StatusInternalServerError {
+		t.Fatalf("first attempt returned %d", rr.Code)
+	}
+	first := post("alice", "k1", `{"name": "Jane"}`)
+	if first.Code != http.StatusCreated || first.Body.String() != `{"id": 2}` {
+		t.Fatalf("retry returned %d %s", first.Code, first.Body.String())
+	}
+	replay := post("alice", "k1", `{"name": "Jane"}`)
+	if replay.Code != http.StatusCreated || replay.Body.String() != `{"id": 2}` || replay.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("replay returned %d %s %v", replay.Code, replay.Body.String(), replay.Header())
+	}
+	if rr := post("alice", "k1", `{"name": "John"}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("reused key with another body returned %d", rr.Code)
+	}
+	if rr := post("bob", "k1", `{"name": "Jane"}`); rr.Body.String() != `{"id": 3}` {
+		t.Errorf("another user's key was not independent: %s", rr.Body.String())
+	}
+	if n := atomic.LoadInt32(&created); n != 3 {
+		t.Errorf("upstream saw %d creates, want 3", n)
+	}
+
+	// The body limit holds even when the chain leaves out the body step.
+	cfg.Routes[0].Body = &BodyConfig{MaxBytes: 16}
+	cfg.Routes[0].Middleware = []MiddlewareConfig{{Name: "jwt"}, {Name: "idempotency"}}
+	useTestGateway(t, cfg)
+	if rr := post("alice", "k2", `{"name": "Jane Jane Jane"}`); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body returned %d", rr.Code)
+	}
+}
+
+func TestIdempotencyKeyRelease(t *testing.T) {
+	store := newMemoryIdempotencyStore()
+	rt := &route{RouteConfig: RouteConfig{Service: "customer", Idempotency: &IdempotencyConfig{Lease: Duration{20 * time.Millisecond}}}}
+	post := func(h http.Handler) {
+		req := httptest.NewRequest("POST", "/customer", strings.NewReader(`{}`))
+		req.Header.Set("Idempotency-Key", "k1")
+		idempotencyMiddleware(store, rt, h).ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// A handler that panics leaves the key free for the retry.
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("panic was swallowed")
+			}
+		}()
+		post(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { panic(http.ErrAbortHandler) }))
+	}()
+	if _, ok := store.Reserve("/customer\x00k1", "x", time.Minute); !ok {
+		t.Error("key still reserved after a panic")
+	}
+
+	// A reservation that is never completed lapses after the lease, a
+	// completed one lasts for the TTL.
+	if _, ok := store.Reserve("stuck", "x", 20*time.Millisecond); !ok {
+		t.Fatal("could not reserve")
+	}
+	store.Reserve("done", "x", 20*time.Millisecond)
+	store.Complete("done", &cachedResponse{StatusCode: http.StatusCreated}, time.Hour)
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := store.Reserve("stuck", "x", time.Minute); !ok {
+		t.Error("stale reservation outlived its lease")
+	}
+	if rec, ok := store.Reserve("done", "x", time.Minute); ok || rec.Response == nil {
+		t.Error("completed key expired with the lease")
+	}
+}
+
+func TestInstalledStores(t *testing.T) {
+	cache := newLRUStore(1 << 20)
+	idempotency := newMemoryIdempotencyStore()
+	usage, _ := newFileUsageStore("", 0)
+	SetCacheStore(cache)
+	SetIdempotencyStore(idempotency)
+	SetUsageStore(usage)
+	t.Cleanup(func() {
+		SetCacheStore(nil)
+		SetIdempotencyStore(nil)
+		SetUsageStore(nil)
+	})
+
+	cfg := defaultConfig()
+	cfg.Quotas = &QuotaConfig{Daily: 10, Path: filepath.Join(t.TempDir(), "usage.json")}
+	gw := useTestGateway(t, cfg)
+	if gw.cache != CacheStore(cache) || gw.idempotency != IdempotencyStore(idempotency) || gw.quotas.store != UsageStore(usage) {
+		t.Fatal("installed stores not used")
+	}
+	// They stay in use across reloads that would replace the built-in ones.
+	cfg = defaultConfig()
+	cfg.Cache.MaxBytes = 1 << 10
+	cfg.Quotas = &QuotaConfig{Daily: 10}
+	cfg.setDefaults()
+	next, err := buildGateway(cfg, gw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.close()
+	if next.cache != CacheStore(cache) || next.idempotency != IdempotencyStore(idempotency) || next.quotas.store != UsageStore(usage) {
+		t.Error("installed stores replaced on reload")
+	}
+}
+
+func TestConcurrencyLimiterPriorities(t *testing.T) {
+	l := newConcurrencyLimiter(&ConcurrencyConfig{MaxInFlight: 2, MaxQueue: 1, QueueTimeout: Duration{time.Second}})
+	ctx := context.Background()
+
+	releaseWrite, err := l.acquire(ctx, priorityHigh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reads may only fill part of the limit, so these have to wait.
+	lowErr := make(chan error, 1)
+	go func() {
+		_, err := l.acquire(ctx, priorityLow)
+		lowErr <- err
+	}()
+	waitFor(t, func() bool { return l.status().Queued == 1 })
+
+	normalDone := make(chan func(int), 1)
+	go func() {
+		release, err := l.acquire(ctx, priorityNormal)
+		if err != nil {
+			t.Error(err)
+		}
+		normalDone <- release
+	}()
+	// The queue is full, so the dashboard read makes room for the normal one.
+	if err := <-lowErr; err != errShed {
+		t.Fatalf("low priority request got %v, want it shed", err)
+	}
+	waitFor(t, func() bool { return l.status().Queued == 1 })
+
+	// A write still fits beside the first one.
+	releaseWrite2, err := l.acquire(ctx, priorityHigh)
+	if err != nil {
+		t.Fatalf("write was not admitted: %v", err)
+	}
+	releaseWrite(http.StatusOK)
+	releaseWrite2(http.StatusOK)
+	(<-normalDone)(http.StatusOK)
+
+	if s := l.status(); s.InFlight != 0 || s.Admitted != 3 || s.Shed["low"] != 1 {
+		t.Errorf("unexpected limiter status %+v", s)
+	}
+
+	adaptive := newConcurrencyLimiter(&ConcurrencyConfig{MaxInFlight: 10, Adaptive: &AdaptiveConcurrencyConfig{MinLimit: 2}})
+	for i := 0; i < 20; i++ {
+		release, _ := adaptive.acquire(ctx, priorityHigh)
+		release(http.StatusServiceUnavailable)
+	}
+	if limit := adaptive.status().Limit; limit != 2 {
+		t.Errorf("limit after failures = %d, want the minimum 2", limit)
+	}
+	for i := 0; i < 50; i++ {
+		release, _ := adaptive.acquire(ctx, priorityHigh)
+		release(http.StatusOK)
+	}
+	if limit := adaptive.status().Limit; limit <= 2 {
+		t.Errorf("limit did not grow after successes: %d", limit)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatal("condition not met within 1s")
+}
+
+func TestUpstreamConcurrencyLimit(t *testing.T) {
+	started := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-unblock
+	}))
+	defer backend.Close()
+	defer close(unblock)
+
+	cfg := defaultConfig()
+	cfg.Upstreams["customers"] = UpstreamConfig{
+		Targets:     []string{backend.URL},
+		Concurrency: &ConcurrencyConfig{MaxInFlight: 1, QueueTimeout: Duration{50 * time.Millisecond}},
+	}
+	useTestGateway(t, cfg)
+
+	send := func(method string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/customer/1", strings.NewReader("{}"))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+testToken(t, "alice"))
+		rr := httptest.NewRecorder()
+		serveGateway(rr, req)
+		return rr
+	}
+	go send("PUT")
+	<-started
+
+	rr := send("GET")
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("request over the limit returned %d %v", rr.Code, rr.Header())
+	}
+
+	rr = httptest.NewRecorder()
+	adminRouter().ServeHTTP(rr, httptest.NewRequest("GET", "/upstreams", nil))
+	if !strings.Contains(rr.Body.String(), `"timeouts":1`) {
+		t.Errorf("admin status does not show the timeout: %s", rr.Body.String())
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	customers := testBackend(t, "customers")
+	accounts := testBackend(t, "invest-accounts")
+	path := filepath.Join(t.TempDir(), "usage.json")
+	cfg := defaultConfig()
+	cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{customers.URL}}
+	cfg.Upstreams["invest-accounts"] = UpstreamConfig{Targets: []string{accounts.URL}}
+	cfg.Quotas = &QuotaConfig{Daily: 3, Tenants: map[string]QuotaLimitConfig{"partner": {}}, Path: path}
+	gw := useTestGateway(t, cfg)
+
+	get := func(user, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set("Authorization", "Bearer "+testToken(t, user))
+		rr := httptest.NewRecorder()
+		serveGateway(rr, req)
+		return rr
+	}
+
+	if rr := get("alice", "/customer/1"); rr.Code != http.StatusOK || rr.Header().Get("X-Quota-Remaining") != "2" {
+		t.Fatalf("first request: %d %v", rr.Code, rr.Header())
+	}
+	// A composite is one call, however many routes it reads.
+	get("alice", "/customer/1/overview")
+	if rr := get("alice", "/customer/1"); rr.Code != http.StatusOK || rr.Header().Get("X-Quota-Remaining") != "0" {
+		t.Fatalf("third request: %d %v", rr.Code, rr.Header())
+	}
+	rr := get("alice", "/customer/1")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("request over quota returned %d", rr.Code)
+	}
+	var body struct {
+		Quota struct {
+			Period string `json:"period"`
+			Limit  int64  `json:"limit"`
+		} `json:"quota"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || body.Quota.Period != "daily" || body.Quota.Limit != 3 {
+		t.Errorf("429 body = %s", rr.Body.String())
+	}
+	for i := 0; i < 5; i++ {
+		if rr := get("partner", "/customer/1"); rr.Code != http.StatusOK || rr.Header().Get("X-Quota-Limit") != "" {
+			t.Fatalf("unlimited tenant got %d %v", rr.Code, rr.Header())
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	adminRouter().ServeHTTP(rr, httptest.NewRequest("GET", "/usage?tenant=alice", nil))
+	var report []tenantUsage
+	if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	month := time.Now().UTC().Format("2006-01")
+	if len(report) != 1 || report[0].Monthly[month] != 3 || len(report[0].Daily) != 1 {
+		t.Errorf("usage report = %s", rr.Body.String())
+	}
+
+	// Usage survives a restart through the file.
+	if err := gw.quotas.store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store, err := newFileUsageStore(path, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	usage, _ := store.Usage()
+	if usage["alice"][month] != 3 || usage["partner"][month] != 5 {
+		t.Errorf("reloaded usage = %v", usage)
+	}
+}
+
+func TestShutdownSavesUsage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	cfg := defaultConfig()
+	cfg.Quotas = &QuotaConfig{Daily: 10, Path: path, FlushInterval: Duration{time.Hour}}
+	cfg.setDefaults()
+	gw, err := buildGateway(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw.quotas.store.Add("alice", []string{"2026-01"}, 2)
+	gw.shutdown()
+
+	store, err := newFileUsageStore(path, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if usage, _ := store.Usage(); usage["alice"]["2026-01"] != 2 {
+		t.Errorf("usage after shutdown = %v", usage)
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	customer := map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"id":           map[string]interface{}{"type": "integer"},
+			"phone_number": map[string]interface{}{"type": "string"},
+			"credit_card":  map[string]interface{}{"type": "string"},
+		},
+	}
+	ref := map[string]interface{}{"$ref": "#/components/schemas/Customer"}
+	ok := func(schema interface{}) map[string]interface{} {
+		return map[string]interface{}{"200": map[string]interface{}{
+			"description": "OK",
+			"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}},
+		}}
+	}
+	specServer := func(spec map[string]interface{}) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/openapi.json" {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(spec)
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	customers := specServer(map[string]interface{}{
+		"openapi": "3.0.3",
+		"paths": map[string]interface{}{
+			"/customer": map[string]interface{}{
+				"get":  map[string]interface{}{"responses": ok(map[string]interface{}{"type": "array", "items": ref})},
+				"post": map[string]interface{}{"requestBody": map[string]interface{}{"content": map[string]interface{}{"application/json": map[string]interface{}{"schema": ref}}}, "responses": ok(ref)},
+			},
+			"/customer/{id}": map[string]interface{}{
+				"get":    map[string]interface{}{"responses": ok(ref)},
+				"delete": map[string]interface{}{"responses": ok(nil)},
+			},
+			"/internal/metrics": map[string]interface{}{"get": map[string]interface{}{"responses": ok(nil)}},
+		},
+		"components": map[string]interface{}{"schemas": map[string]interface{}{"Customer": customer}},
+	})
+	accounts := specServer(map[string]interface{}{
+		"openapi": "3.0.3",
+		"paths": map[string]interface{}{
+			"/api/accounts": map[string]interface{}{
+				"get": map[string]interface{}{
+					"parameters": []interface{}{map[string]interface{}{"name": "owner_id", "in": "query"}},
+					"responses":  ok(map[string]interface{}{"$ref": "#/components/schemas/InvestAccount"}),
+				},
+			},
+		},
+		"components": map[string]interface{}{"schemas": map[string]interface{}{"InvestAccount": map[string]interface{}{"type": "object"}}},
+	})
+
+	cfg := defaultConfig()
+	cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{customers.URL}}
+	cfg.Upstreams["invest-accounts"] = UpstreamConfig{Targets: []string{accounts.URL}}
+	cfg.Routes[0].Methods = []string{"GET", "POST"}
+	cfg.Routes[0].Transform = &TransformConfig{
+		Request:  MessageTransformConfig{RenameFields: map[string]string{"phoneNumber": "phone_number"}},
+		Response: MessageTransformConfig{RenameFields: map[string]string{"phone_number": "phoneNumber"}, RemoveFields: []string{"credit_card"}},
+	}
+	cfg.Routes[1].Transform = &TransformConfig{
+		PathRewrite: &PathRewriteConfig{Pattern: "^/invest-account", Replacement: "/api/accounts"},
+		Query:       QueryTransformConfig{Rename: map[string]string{"ownerId": "owner_id"}},
+	}
+	useTestGateway(t, cfg)
+
+	// The document and docs page need no token.
+	rr := httptest.NewRecorder()
+	serveGateway(rr, httptest.NewRequest("GET", "/openapi.json", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET /openapi.json returned %d: %s", rr.Code, rr.Body.String())
+	}
+	var doc struct {
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas         map[string]json.RawMessage `json:"schemas"`
+			SecuritySchemes map[string]json.RawMessage `json:"securitySchemes"`
+		} `json:"components"`
+		Unavailable json.RawMessage `json:"x-unavailable-routes"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/login", "/customer", "/customer/{id}", "/invest-account", "/customer/{id}/overview", "/graphql"} {
+		if doc.Paths[path] == nil {
+			t.Errorf("path %s missing", path)
+		}
+	}
+	for _, path := range []string{"/internal/metrics", "/api/accounts"} {
+		if doc.Paths[path] != nil {
+			t.Errorf("path %s is not exposed by the gateway but is documented", path)
+		}
+	}
+	if _, ok := doc.Paths["/customer/{id}"]["delete"]; ok {
+		t.Error("DELETE is documented although the route does not allow it")
+	}
+	if doc.Components.SecuritySchemes["bearerAuth"] == nil || doc.Unavailable != nil {
+		t.Errorf("security schemes %v, unavailable %s", doc.Components.SecuritySchemes, doc.Unavailable)
+	}
+	// The customer schemas are inlined with the route's field transforms.
+	if _, ok := doc.Components.Schemas["Customer"]; ok {
+		t.Error("transformed Customer schema kept as a shared component")
+	}
+	if doc.Components.Schemas["InvestAccount"] == nil {
+		t.Error("InvestAccount schema missing")
+	}
+	response := string(doc.Paths["/customer/{id}"]["get"])
+	if !strings.Contains(response, `"phoneNumber"`) || strings.Contains(response, "phone_number") || strings.Contains(response, "credit_card") {
+		t.Errorf("GET /customer/{id} = %s", response)
+	}
+	request := string(doc.Paths["/customer"]["post"])
+	if !strings.Contains(request, `"phoneNumber"`) || !strings.Contains(request, `"401"`) {
+		t.Errorf("POST /customer = %s", request)
+	}
+	if list := string(doc.Paths["/invest-account"]["get"]); !strings.Contains(list, `"ownerId"`) {
+		t.Errorf("GET /invest-account = %s", list)
+	}
+
+	rr = httptest.NewRecorder()
+	serveGateway(rr, httptest.NewRequest("GET", "/docs", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"/openapi.json"`) {
+		t.Errorf("GET /docs returned %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	spec := map[string]interface{}{
+		"openapi": "3.0.3",
+		"paths": map[string]interface{}{
+			"/invest-account": map[string]interface{}{
+				"get": map[string]interface{}{
+					"parameters": []interface{}{map[string]interface{}{
+						"name": "owner_id", "in": "query",
+						"schema": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "integer"}},
+					}},
+				},
+				"post": map[string]interface{}{
+					"requestBody": map[string]interface{}{
+						"required": true,
+						"content": map[string]interface{}{"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{"$ref": "#/components/schemas/InvestAccount"},
+						}},
+					},
+				},
+			},
+			"/invest-account/{id}": map[string]interface{}{
+				"parameters": []interface{}{map[string]interface{}{
+					"name": "id", "in": "path", "required": true, "schema": map[string]interface{}{"type": "integer"},
+				}},
+				"get": map[string]interface{}{},
+			},
+		},
+		"components": map[string]interface{}{"schemas": map[string]interface{}{
+			"InvestAccount": map[string]interface{}{
+				"type":     "object",
+				"required": []interface{}{"id", "owner_id"},
+				"properties": map[string]interface{}{
+					"id":       map[string]interface{}{"type": "integer", "readOnly": true},
+					"owner_id": map[string]interface{}{"type": "integer"},
+					"share":    map[string]interface{}{"type": "string"},
+				},
+			},
+		}},
+	}
+	var proxied int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/openapi.json" {
+			json.NewEncoder(w).Encode(spec)
+			return
+		}
+		atomic.AddInt32(&proxied, 1)
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(backend.Close)
+
+	cfg := defaultConfig()
+	cfg.Upstreams["invest-accounts"] = UpstreamConfig{Targets: []string{backend.URL}}
+	cfg.Routes[1].Validation = &ValidationConfig{Strict: true}
+	gw := useTestGateway(t, cfg)
+	waitFor(t, func() bool {
+		spec, _ := gw.openapi.routeSpec(gw.routes["invest-account"], false)
+		return spec != nil
+	})
+	token := testToken(t, "alice")
+
+	send := func(method, target, body string) *httptest.ResponseRecorder {
+		var req *http.Request
+		if body == "" {
+			req = httptest.NewRequest(method, target, nil)
+		} else {
+			req = httptest.NewRequest(method, target, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		serveGateway(rr, req)
+		return rr
+	}
+
+	invalid := []struct {
+		method, target, body string
+		want                 []violation
+	}{
+		{"POST", "/invest-account", `{"owner_id": "1", "share": 100}`, []violation{
+			{In: "body", Name: "owner_id", Error: "must be an integer, not a string"},
+			{In: "body", Name: "share", Error: "must be a string, not a number"},
+		}},
+		{"POST", "/invest-account", `{"share": "1", "extra": true}`, []violation{
+			{In: "body", Name: "owner_id", Error: "is required"},
+			{In: "body", Name: "extra", Error: "is not a known field"},
+		}},
+		{"POST", "/invest-account", `{"owner_id": 1.5}`, []violation{
+			{In: "body", Name: "owner_id", Error: "must be an integer, not a number"},
+		}},
+		{"POST", "/invest-account", "", []violation{{In: "body", Error: "is required"}}},
+		{"GET", "/invest-account/abc", "", []violation{{In: "path", Name: "id", Error: "must be an integer, not a string"}}},
+		{"GET", "/invest-account?owner_id=1&owner_id=x&page=2", "", []violation{
+			{In: "query", Name: "owner_id[1]", Error: "must be an integer, not a string"},
+			{In: "query", Name: "page", Error: "is not a parameter of this operation"},
+		}},
+	}
+	for _, tc := range invalid {
+		rr := send(tc.method, tc.target, tc.body)
+		var got struct {
+			Violations []violation `json:"violations"`
+		}
+		if rr.Code != http.StatusBadRequest || json.Unmarshal(rr.Body.Bytes(), &got) != nil {
+			t.Errorf("%s %s %s: %d %s", tc.method, tc.target, tc.body, rr.Code, rr.Body.String())
+			continue
+		}
+		if fmt.Sprint(got.Violations) != fmt.Sprint(tc.want) {
+			t.Errorf("%s %s %s: violations %v, want %v", tc.method, tc.target, tc.body, got.Violations, tc.want)
+		}
+	}
+	if n := atomic.LoadInt32(&proxied); n != 0 {
+		t.Fatalf("%d invalid requests reached the upstream", n)
+	}
+
+	for _, tc := range []struct{ method, target, body string }{
+		{"POST", "/invest-account", `{"owner_id": 1, "share": "100"}`},
+		{"GET", "/invest-account/1", ""},
+		{"GET", "/invest-account?owner_id=1&owner_id=2", ""},
+		// Paths the spec does not describe are left to the upstream.
+		{"GET", "/invest-account/1/history", ""},
+	} {
+		if rr := send(tc.method, tc.target, tc.body); rr.Code != http.StatusOK {
+			t.Errorf("%s %s: %d %s", tc.method, tc.target, rr.Code, rr.Body.String())
+		}
+	}
+	if n := atomic.LoadInt32(&proxied); n != 4 {
+		t.Errorf("upstream got %d valid requests, want 4", n)
+	}
+}
+
+func TestRequestValidationSpecRefresh(t *testing.T) {
+	spec := map[string]interface{}{
+		"openapi": "3.0.3",
+		"paths": map[string]interface{}{
+			"/invest-account/{id}": map[string]interface{}{
+				"parameters": []interface{}{map[string]interface{}{
+					"name": "id", "in": "path", "required": true, "schema": map[string]interface{}{"type": "integer"},
+				}},
+				"get": map[string]interface{}{},
+			},
+		},
+	}
+	var fetches int32
+	unblock := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/openapi.json" {
+			w.Write([]byte("{}"))
+			return
+		}
+		switch atomic.AddInt32(&fetches, 1) {
+		case 1:
+			json.NewEncoder(w).Encode(spec)
+		case 2:
+			// The first refresh hangs, the ones after it fail.
+			<-unblock
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(backend.Close)
+	t.Cleanup(func() { close(unblock) })
+
+	cfg := defaultConfig()
+	cfg.Upstreams["invest-accounts"] = UpstreamConfig{Targets: []string{backend.URL}}
+	cfg.Routes[1].Validation = &ValidationConfig{}
+	cfg.OpenAPI = &OpenAPIConfig{Refresh: Duration{10 * time.Millisecond}}
+	gw := useTestGateway(t, cfg)
+	rt := gw.routes["invest-account"]
+	waitFor(t, func() bool {
+		spec, _ := gw.openapi.routeSpec(rt, false)
+		return spec != nil
+	})
+	time.Sleep(20 * time.Millisecond)
+	token := testToken(t, "alice")
+
+	// Requests go on being checked against the last spec while a refresh
+	// hangs, and without waiting for it.
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/invest-account/abc", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		start := time.Now()
+		serveGateway(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("GET /invest-account/abc during a refresh: %d %s", rr.Code, rr.Body.String())
+		}
+		if d := time.Since(start); d > 500*time.Millisecond {
+			t.Fatalf("request waited %s for the spec refresh", d)
+		}
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&fetches) == 2 })
+	time.Sleep(20 * time.Millisecond)
+	gw.openapi.routeSpec(rt, false)
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Fatalf("spec fetched %d times, want 2: refreshes should not pile up", n)
+	}
+
+	// Failed refreshes keep the last good spec as well.
+	unblock <- struct{}{}
+	waitFor(t, func() bool {
+		gw.openapi.routeSpec(rt, false)
+		return atomic.LoadInt32(&fetches) >= 3
+	})
+	waitFor(t, func() bool {
+		_, err := gw.openapi.routeSpec(rt, false)
+		return err != nil
+	})
+	req := httptest.NewRequest("GET", "/invest-account/abc", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	serveGateway(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("GET /invest-account/abc after a failed refresh: %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func init() {
+	// test_trace passes its tag and the user it sees on to the upstream.
+	RegisterMiddleware("test_trace", func(route RouteConfig, config json.RawMessage) (Middleware, error) {
+		var cfg struct {
+			Tag string `json:"tag"`
+		}
+		if err := json.Unmarshal(config, &cfg); err != nil {
+			return nil, err
+		}
+		return MiddlewareFunc(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				user := "-"
+				if claims := claimsFromRequest(r); claims != nil {
+					user = claims.Username
+				}
+				r.Header.Set("X-Trace", route.Service+":"+cfg.Tag+":"+user)
+				next.ServeHTTP(w, r)
+			})
+		}), nil
+	})
+}
+
+func TestMiddlewareChain(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Trace")))
+	}))
+	t.Cleanup(backend.Close)
+
+	cfg := defaultConfig()
+	cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{backend.URL}}
+	cfg.Upstreams["invest-accounts"] = UpstreamConfig{Targets: []string{backend.URL}}
+	cfg.Routes[0].Middleware = []MiddlewareConfig{
+		{Name: "jwt"},
+		{Name: "test_trace", Config: json.RawMessage(`{"tag": "a"}`)},
+		{Name: "require_headers", Config: json.RawMessage(`{"headers": {"X-Tenant": "^acme$"}}`)},
+		{Name: "body"},
+	}
+	// An empty chain leaves out every built-in step, jwt included.
+	cfg.Routes[1].Middleware = []MiddlewareConfig{}
+	useTestGateway(t, cfg)
+
+	get := func(target, tenant string, auth bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		if auth {
+			req.Header.Set("Authorization", "Bearer "+testToken(t, "alice"))
+		}
+		if tenant != "" {
+			req.Header.Set("X-Tenant", tenant)
+		}
+		rr := httptest.NewRecorder()
+		serveGateway(rr, req)
+		return rr
+	}
+
+	if rr := get("/customer/1", "acme", false); rr.Code != http.StatusUnauthorized {
+		t.Errorf("without token: %d", rr.Code)
+	}
+	if rr := get("/customer/1", "other", true); rr.Code != http.StatusBadRequest {
+		t.Errorf("with wrong tenant: %d %s", rr.Code, rr.Body.String())
+	}
+	// test_trace runs after jwt, so it sees the user.
+	if rr := get("/customer/1", "acme", true); rr.Code != http.StatusOK || rr.Body.String() != "customer:a:alice" {
+		t.Errorf("valid request: %d %q", rr.Code, rr.Body.String())
+	}
+	if rr := get("/invest-account/1", "", false); rr.Code != http.StatusOK {
+		t.Errorf("route without jwt: %d %s", rr.Code, rr.Body.String())
+	}
+
+	for _, chain := range [][]MiddlewareConfig{
+		{{Name: "jwt"}, {Name: "no_such_middleware"}},
+		{{Name: "jwt"}, {Name: "cache"}, {Name: "jwt"}},
+	} {
+		bad := defaultConfig()
+		bad.Routes[0].Middleware = chain
+		if err := bad.validate(); err == nil {
+			t.Errorf("chain %v validated", chain)
+		}
+	}
+	bad := defaultConfig()
+	bad.Routes[0].Middleware = []MiddlewareConfig{{Name: "require_headers"}}
+	if _, err := buildGateway(bad, nil); err == nil {
+		t.Error("require_headers without headers built")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a built-in name did not panic")
+		}
+	}()
+	RegisterMiddleware("jwt", nil)
+}
+
+func TestLuaPlugin(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"path": %q, "tenant": %q, "secret": "x"}`, r.URL.Path, r.Header.Get("X-Tenant"))
+	}))
+	t.Cleanup(backend.Close)
+
+	dir := t.TempDir()
+	script := filepath.Join(dir, "tenant.lua")
+	os.WriteFile(script, []byte(`
+function on_request(req)
+  if req.query.block then
+    return {status = 403, headers = {["Content-Type"] = "text/plain"}, body = "blocked by " .. config.name}
+  end
+  if req.query.spin then
+    while true do end
+  end
+  req.headers["X-Tenant"] = req.user
+  req.path = string.gsub(req.path, "^/customer/v1", "/customer")
+end
+
+function on_response(req, resp)
+  local doc = gateway.json_decode(resp.body)
+  doc.secret = nil
+  resp.body = gateway.json_encode(doc)
+  resp.headers["X-Plugin"] = "tenant"
+end
+`), 0o644)
+
+	newConfig := func(failOpen bool) *Config {
+		cfg := defaultConfig()
+		cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{backend.URL}}
+		cfg.Plugins = map[string]PluginConfig{"tenant": {
+			File:     script,
+			Config:   json.RawMessage(`{"name": "tenant"}`),
+			Timeout:  Duration{50 * time.Millisecond},
+			FailOpen: failOpen,
+		}}
+		cfg.Routes[0].Middleware = []MiddlewareConfig{{Name: "jwt"}, {Name: "tenant"}}
+		return cfg
+	}
+	useTestGateway(t, newConfig(false))
+
+	get := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set("Authorization", "Bearer "+testToken(t, "alice"))
+		rr := httptest.NewRecorder()
+		serveGateway(rr, req)
+		return rr
+	}
+
+	rr := get("/customer/v1/7")
+	var doc map[string]string
+	json.Unmarshal(rr.Body.Bytes(), &doc)
+	if rr.Code != http.StatusOK || doc["path"] != "/customer/7" || doc["tenant"] != "alice" {
+		t.Errorf("rewritten request: %d %s", rr.Code, rr.Body.String())
+	}
+	if _, ok := doc["secret"]; ok || rr.Header().Get("X-Plugin") != "tenant" {
+		t.Errorf("edited response: %s %v", rr.Body.String(), rr.Header())
+	}
+	if rr := get("/customer/1?block=1"); rr.Code != http.StatusForbidden || rr.Body.String() != "blocked by tenant" {
+		t.Errorf("answered by plugin: %d %q", rr.Code, rr.Body.String())
+	}
+	if rr := get("/customer/1?spin=1"); rr.Code != http.StatusInternalServerError {
+		t.Errorf("runaway script: %d %s", rr.Code, rr.Body.String())
+	}
+	if st := currentGateway().pluginStatuses(); len(st) != 1 || st[0].Failures != 1 {
+		t.Errorf("plugin status: %+v", st)
+	}
+
+	useTestGateway(t, newConfig(true))
+	if rr := get("/customer/1?spin=1"); rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), "alice") {
+		t.Errorf("failing open: %d %s", rr.Code, rr.Body.String())
+	}
+
+	// The sandbox has no os or io, so this fails while loading.
+	escape := filepath.Join(dir, "escape.lua")
+	os.WriteFile(escape, []byte(`os.execute("true") function on_request(req) end`), 0o644)
+	bad := defaultConfig()
+	bad.Plugins = map[string]PluginConfig{"escape": {File: escape}}
+	if _, err := buildGateway(bad, nil); err == nil {
+		t.Error("script using os loaded")
+	}
+	bad.Plugins = map[string]PluginConfig{"cache": {File: script}}
+	if err := bad.validate(); err == nil {
+		t.Error("plugin named like a built-in validated")
+	}
+}
+
+func TestLuaPluginMemoryLimit(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "hungry.lua")
+	os.WriteFile(script, []byte(`
+local cases = {
+  double = function() local s = "x" for i = 1, 40 do s = s .. s end end,
+  rep = function() return string.rep("x", 1e12) end,
+  method = function() return ("x"):rep(2^40) end,
+  format = function() return string.format("%999999999d", 1) end,
+  gsub = function() local big = string.rep("x", 1e6) return (string.rep("a", 1e3):gsub("a", {a = big})) end,
+  concat = function() local t = {} for i = 1, 64 do t[i] = string.rep("x", 1e6) end return table.concat(t) end,
+  entries = function() local t = {} for i = 1, 1e9 do t[i] = i end end,
+  insert = function() local t = {} for i = 1, 1e9 do table.insert(t, i) end end,
+  rawset = function() local t = {} for i = 1, 1e9 do rawset(t, i, i) end end,
+  swap = function() local t, u = {}, {} for i = 1, 1e9 do t[i], u[i] = i, i end end,
+  ok = function()
+    local t, parts = setmetatable({}, {__concat = function(a, b) return "meta" end}), {}
+    parts[1], parts[2] = "a" .. 1, t .. "b"
+    local x
+    x, parts.last = 1, string.rep("-", 3)
+    return table.concat(parts, ",") .. parts.last .. x
+  end,
+}
+
+function on_request(req)
+  return cases[req.case]()
+end
+`), 0o644)
+	cfg := defaultConfig()
+	cfg.Plugins = map[string]PluginConfig{"hungry": {File: script, Timeout: Duration{10 * time.Second}, MaxMemoryBytes: 1 << 20}}
+	gw := useTestGateway(t, cfg)
+	p := gw.plugins["hungry"]
+
+	run := func(name string) (lua.LValue, error) {
+		st, err := p.state()
+		if err != nil {
+			return nil, err
+		}
+		req := st.L.NewTable()
+		req.RawSetString("case", lua.LString(name))
+		ret, err := p.call(st, "on_request", req)
+		if err == nil {
+			p.release(st)
+		}
+		return ret, err
+	}
+	for _, name := range []string{"double", "rep", "method", "format", "gsub", "concat", "entries", "insert", "rawset", "swap"} {
+		start := time.Now()
+		_, err := run(name)
+		if err == nil || !(strings.Contains(err.Error(), "memory limit exceeded") || strings.Contains(err.Error(), "invalid format")) {
+			t.Errorf("%s: %v", name, err)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("%s: stopped after %s", name, d)
+		}
+	}
+	// Each call gets a fresh budget.
+	if ret, err := run("ok"); err != nil || ret.String() != "a1,meta---1" {
+		t.Errorf("within the budget: %v %v", ret, err)
+	}
+}
+
+func TestLuaPluginIsolation(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "leaky.lua")
+	os.WriteFile(script, []byte(`
+local calls = 0
+local seen = {}
+
+function on_request(req)
+  calls = calls + 1
+  seen[#seen + 1] = req.user
+  last_user = req.user
+  config.users = (config.users or "") .. req.user
+  local body = table.concat({calls, #seen, tostring(previous), config.users, string.upper("x")}, ",")
+  string.upper = function(s) return "pwned" end
+  setmetatable(_G, {__index = function() return "leaked" end})
+  return {body = body}
+end
+
+previous = nil
+`), 0o644)
+	cfg := defaultConfig()
+	cfg.Plugins = map[string]PluginConfig{"leaky": {File: script, Config: json.RawMessage(`{}`)}}
+	gw := useTestGateway(t, cfg)
+	p := gw.plugins["leaky"]
+
+	st, err := p.state()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"alice", "bob"} {
+		req := st.L.NewTable()
+		req.RawSetString("user", lua.LString(user))
+		ret, err := p.call(st, "on_request", req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := ret.(*lua.LTable).RawGetString("body").String()
+		if want := "1,1,nil," + user + ",X"; body != want {
+			t.Errorf("call as %s saw %q, want %q", user, body, want)
+		}
+		p.release(st)
+	}
+	if v := st.L.GetGlobal("last_user"); v != lua.LNil {
+		t.Errorf("global left behind: %v", v)
+	}
+}
+
+func TestHostRouting(t *testing.T) {
+	api := testBackend(t, "api")
+	partners := testBackend(t, "partners")
+	wildcard := testBackend(t, "wildcard")
+
+	cfg := defaultConfig()
+	cfg.Upstreams["partners"] = UpstreamConfig{Targets: []string{partners.URL}}
+	cfg.Upstreams["wildcard"] = UpstreamConfig{Targets: []string{wildcard.URL}}
+	cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{api.URL}}
+	cfg.Upstreams["invest-accounts"] = UpstreamConfig{Targets: []string{api.URL}}
+	cfg.Routes = []RouteConfig{
+		{Service: "customer", Upstream: "customers", Hosts: []string{"api.example.com"}},
+		// Partners get the service without a token, and only for reading.
+		{Service: "customer", Name: "partner-customer", Upstream: "partners", Hosts: []string{"partners.example.com"},
+			Methods: []string{"GET"}, Middleware: []MiddlewareConfig{}},
+		{Service: "customer", Name: "tenant-customer", Upstream: "wildcard", Hosts: []string{"*.tenants.example.com"},
+			Middleware: []MiddlewareConfig{}},
+		{Service: "invest-account", Upstream: "invest-accounts"},
+	}
+	cfg.Composites = nil
+	cfg.GraphQL = nil
+	useTestGateway(t, cfg)
+
+	send := func(method, host string, auth bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/customer/1", nil)
+		req.Host = host
+		if auth {
+			req.Header.Set("Authorization", "Bearer "+testToken(t, "alice"))
+		}
+		rr := httptest.NewRecorder()
+		serveGateway(rr, req)
+		return rr
+	}
+
+	for _, tc := range []struct {
+		method, host string
+		auth         bool
+		status       int
+		backend      string
+	}{
+		{"GET", "api.example.com", true, http.StatusOK, "api"},
+		{"GET", "API.example.com:443", true, http.StatusOK, "api"},
+		{"GET", "api.example.com", false, http.StatusUnauthorized, ""},
+		{"GET", "partners.example.com", false, http.StatusOK, "partners"},
+		{"POST", "partners.example.com", false, http.StatusMethodNotAllowed, ""},
+		{"GET", "acme.tenants.example.com", false, http.StatusOK, "wildcard"},
+		{"GET", "tenants.example.com", false, http.StatusNotFound, ""},
+		{"GET", "other.example.com", true, http.StatusNotFound, ""},
+	} {
+		rr := send(tc.method, tc.host, tc.auth)
+		if rr.Code != tc.status || rr.Header().Get("X-Backend") != tc.backend {
+			t.Errorf("%s %s: %d %q", tc.method, tc.host, rr.Code, rr.Body.String())
+		}
+	}
+
+	// A route without hosts serves the hosts no other route claims.
+	req := httptest.NewRequest("GET", "/invest-account/1", nil)
+	req.Host = "partners.example.com"
+	req.Header.Set("Authorization", "Bearer "+testToken(t, "alice"))
+	rr := httptest.NewRecorder()
+	serveGateway(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("route without hosts: %d", rr.Code)
+	}
+
+	// Composites and GraphQL tell hosts apart as well.
+	jsonAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":1}`))
+	}))
+	defer jsonAPI.Close()
+	cfg = defaultConfig()
+	cfg.Upstreams["customers"] = UpstreamConfig{Targets: []string{jsonAPI.URL}}
+	cfg.Upstreams["invest-accounts"] = UpstreamConfig{Targets: []string{jsonAPI.URL}}
+	overview := cfg.Composites[0]
+	overview.Hosts = []string{"api.example.com"}
+	partnerOverview := overview
+	partnerOverview.Name = "partner-overview"
+	partnerOverview.Hosts = []string{"partners.example.com"}
+	partnerOverview.Sections = overview.Sections[:1]
+	partnerOverview.RateLimit = &RateLimitConfig{RequestsPerSecond: 0.001, Burst: 1}
+	cfg.Composites = []CompositeConfig{overview, partnerOverview}
+	cfg.GraphQL.Hosts = []string{"api.example.com"}
+	useTestGateway(t, cfg)
+	for _, tc := range []struct {
+		method, path, host string
+		auth               bool
+		status             int
+		body               string
+	}{
+		{"GET", "/customer/1/overview", "api.example.com", false, http.StatusUnauthorized, ""},
+		{"GET", "/customer/1/overview", "api.example.com", true, http.StatusOK, "invest_accounts"},
+		{"GET", "/customer/1/overview", "partners.example.com", true, http.StatusOK, "customer"},
+		{"GET", "/customer/1/overview", "partners.example.com", true, http.StatusTooManyRequests, ""},
+		{"GET", "/customer/1/overview", "api.example.com", true, http.StatusOK, "invest_accounts"},
+		{"POST", "/graphql", "api.example.com", true, http.StatusBadRequest, ""},
+		{"POST", "/graphql", "partners.example.com", true, http.StatusNotFound, ""},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		req.Host = tc.host
+		if tc.auth {
+			req.Header.Set("Authorization", "Bearer "+testToken(t, "alice"))
+		}
+		rr := httptest.NewRecorder()
+		serveGateway(rr, req)
+		if rr.Code != tc.status || !strings.Contains(rr.Body.String(), tc.body) {
+			t.Errorf("%s %s on %s: %d %q", tc.method, tc.path, tc.host, rr.Code, rr.Body.String())
+		}
+		if tc.host == "partners.example.com" && strings.Contains(rr.Body.String(), "invest_accounts") {
+			t.Errorf("partners got the api overview: %s", rr.Body.String())
+		}
+	}
+
+	twice := defaultConfig()
+	twice.Composites = append(twice.Composites, twice.Composites[0])
+	twice.Composites[1].Name = "again"
+	if err := twice.validate(); err == nil {
+		t.Error("two composites on the same path and hosts validated")
+	}
+
+	for _, routes := range [][]RouteConfig{
+		{{Service: "customer", Upstream: "customers"}, {Service: "customer", Name: "b", Upstream: "customers"}},
+		{{Service: "customer", Upstream: "customers", Hosts: []string{"a.example.com"}},
+			{Service: "customer", Name: "b", Upstream: "customers", Hosts: []string{"A.example.com"}}},
+		{{Service: "customer", Upstream: "customers", Hosts: []string{"*example.com"}}},
+		{{Service: "customer", Upstream: "customers", Hosts: []string{"api.example.com:8080"}}},
+	} {
+		bad := defaultConfig()
+		bad.Routes = routes
+		bad.Composites = nil
+		bad.GraphQL = nil
+		if err := bad.validate(); err == nil {
+			t.Errorf("routes %+v validated", routes)
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+// gqlObject is a customer or invest account as the route returns it to
+// clients, after its transform.
+type gqlObject map[string]interface{}
+
+// gqlField maps a GraphQL field to the JSON field the service returns.
+type gqlField struct {
+	name     string
+	upstream string
+	typ      graphql.Output
+}
+
+// Card numbers are never published through GraphQL.
+var gqlCustomerFields = []gqlField{
+	{"id", "id", graphql.NewNonNull(graphql.Int)},
+	{"name", "name", graphql.String},
+	{"surname", "surname", graphql.String},
+	{"age", "age", graphql.Int},
+	{"phoneNumber", "phone_number", graphql.String},
+	{"dateOfBirth", "date_of_birth", graphql.String},
+	{"dateOfIssue", "date_of_issue", graphql.String},
+	{"issuingAuthority", "issuing_authority", graphql.String},
+	{"hasForeignCountryTaxLiability", "has_foreign_country_tax_liability", graphql.Boolean},
+}
+
+var gqlInvestAccountFields = []gqlField{
+	{"id", "id", graphql.NewNonNull(graphql.Int)},
+	{"ownerId", "owner_id", graphql.Int},
+	{"clientSurveyNumber", "client_survey_number", graphql.Int},
+	{"share", "share", graphql.String},
+	{"investedAmountOfMoney", "invested_amount_of_money", graphql.Float},
+	{"freeAmountOfMoney", "free_amount_of_money", graphql.Float},
+}
+
+// gqlFields builds the object fields the route lets clients see: fields its
+// transform removes are left out, renamed ones are read under their new name.
+func gqlFields(rt *route, fields []gqlField) graphql.Fields {
+	out := graphql.Fields{}
+	for _, f := range fields {
+		key := clientField(rt, f.upstream)
+		if key == "" {
+			continue
+		}
+		out[f.name] = &graphql.Field{
+			Type: f.typ,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(gqlObject)[key], nil
+			},
+		}
+	}
+	return out
+}
+
+// clientField returns the name a top-level response field has after the
+// route's transform, or "" when the transform removes it.
+func clientField(rt *route, upstream string) string {
+	if rt.transform == nil {
+		return upstream
+	}
+	resp := rt.transform.cfg.Response
+	if containsString(resp.RemoveFields, upstream) {
+		return ""
+	}
+	if to, ok := resp.RenameFields[upstream]; ok {
+		return to
+	}
+	return upstream
+}
+
+// clientQueryParam returns the name clients use for an upstream query
+// parameter, undoing the route's query renames.
+func clientQueryParam(rt *route, upstream string) string {
+	if rt.transform != nil {
+		for from, to := range rt.transform.cfg.Query.Rename {
+			if to == upstream {
+				return from
+			}
+		}
+	}
+	return upstream
+}
+
+// intField reads a numeric field as decoded from JSON.
+func intField(obj gqlObject, key string) (int, bool) {
+	n, ok := obj[key].(float64)
+	return int(n), ok
+}
+
+type graphqlAPI struct {
+	cfg       *GraphQLConfig
+	customers *route
+	accounts  *route
+	schema    graphql.Schema
+}
+
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+type gqlLoadersKey struct{}
+
+// gqlLoaders batch backend lookups made while resolving one query.
+type gqlLoaders struct {
+	customers *loader
+	accounts  *loader
+}
+
+func newGraphQLAPI(cfg *GraphQLConfig, customers, accounts *route) (*graphqlAPI, error) {
+	api := &graphqlAPI{cfg: cfg, customers: customers, accounts: accounts}
+
+	customerType := graphql.NewObject(graphql.ObjectConfig{
+		Name:   "Customer",
+		Fields: gqlFields(customers, gqlCustomerFields),
+	})
+	accountType := graphql.NewObject(graphql.ObjectConfig{
+		Name:   "InvestAccount",
+		Fields: gqlFields(accounts, gqlInvestAccountFields),
+	})
+	ownerKey := clientField(accounts, "owner_id")
+	customerKey := clientField(customers, "id")
+	accountType.AddFieldConfig("owner", &graphql.Field{
+		Type: customerType,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			ownerID, ok := intField(p.Source.(gqlObject), ownerKey)
+			if !ok {
+				return nil, nil
+			}
+			return loadersFrom(p.Context).customers.load(ownerID), nil
+		},
+	})
+	customerType.AddFieldConfig("investAccounts", &graphql.Field{
+		Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(accountType))),
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			id, ok := intField(p.Source.(gqlObject), customerKey)
+			if !ok {
+				return []gqlObject{}, nil
+			}
+			return loadersFrom(p.Context).accounts.load(id), nil
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"customers": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(customerType))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					var customers []gqlObject
+					err := api.getJSON(p.Context, api.customers, "", &customers)
+					return customers, err
+				},
+			},
+			"customer": &graphql.Field{
+				Type: customerType,
+				Args: graphql.FieldConfigArgument{"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return loadersFrom(p.Context).customers.load(p.Args["id"].(int)), nil
+				},
+			},
+			"investAccounts": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(accountType))),
+				Args: graphql.FieldConfigArgument{"ownerId": &graphql.ArgumentConfig{Type: graphql.Int}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if ownerID, ok := p.Args["ownerId"].(int); ok {
+						return loadersFrom(p.Context).accounts.load(ownerID), nil
+					}
+					var accounts []gqlObject
+					err := api.getJSON(p.Context, api.accounts, "", &accounts)
+					return accounts, err
+				},
+			},
+			"investAccount": &graphql.Field{
+				Type: accountType,
+				Args: graphql.FieldConfigArgument{"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					var acc gqlObject
+					err := api.getJSON(p.Context, api.accounts, "/"+strconv.Itoa(p.Args["id"].(int)), &acc)
+					if err == errNotFound {
+						return nil, nil
+					}
+					return acc, err
+				},
+			},
+		},
+	})
+
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{Query: query})
+	if err != nil {
+		return nil, err
+	}
+	api.schema = schema
+	return api, nil
+}
+
+// newLoaders creates the per-request loaders. Customers are fetched with
+// GET /customer?id=..&id=.. and accounts with GET /invest-account?owner_id=..,
+// one backend call per level of the query rather than one per object.
+func (api *graphqlAPI) newLoaders(ctx context.Context) *gqlLoaders {
+	customerKey := clientField(api.customers, "id")
+	ownerKey := clientField(api.accounts, "owner_id")
+	return &gqlLoaders{
+		customers: newLoader(func(ids []int) (map[int]interface{}, error) {
+			var customers []gqlObject
+			if err := api.getJSON(ctx, api.customers, "?"+intQuery(clientQueryParam(api.customers, "id"), ids), &customers); err != nil {
+				return nil, err
+			}
+			out := make(map[int]interface{}, len(customers))
+			for _, c := range customers {
+				if id, ok := intField(c, customerKey); ok {
+					out[id] = c
+				}
+			}
+			return out, nil
+		}),
+		accounts: newLoader(func(ownerIDs []int) (map[int]interface{}, error) {
+			var accounts []gqlObject
+			if err := api.getJSON(ctx, api.accounts, "?"+intQuery(clientQueryParam(api.accounts, "owner_id"), ownerIDs), &accounts); err != nil {
+				return nil, err
+			}
+			out := make(map[int]interface{}, len(ownerIDs))
+			for _, id := range ownerIDs {
+				out[id] = []gqlObject{}
+			}
+			for _, acc := range accounts {
+				if id, ok := intField(acc, ownerKey); ok {
+					if list, ok := out[id].([]gqlObject); ok {
+						out[id] = append(list, acc)
+					}
+				}
+			}
+			return out, nil
+		}),
+	}
+}
+
+func loadersFrom(ctx context.Context) *gqlLoaders {
+	return ctx.Value(gqlLoadersKey{}).(*gqlLoaders)
+}
+
+func intQuery(name string, values []int) string {
+	q := url.Values{}
+	for _, v := range values {
+		q.Add(name, strconv.Itoa(v))
+	}
+	return q.Encode()
+}
+
+var errNotFound = fmt.Errorf("not found")
+
+// gqlRequestKey holds the client's request, whose headers and address the
+// resolvers' calls carry.
+type gqlRequestKey struct{}
+
+// getJSON GETs the route's path plus suffix through the route's own
+// handler, so the call passes the same chain as the client's own requests
+// would: authentication, filters, quotas, faults, splits, mocks, the cache
+// and the transform that hides fields.
+func (api *graphqlAPI) getJSON(ctx context.Context, rt *route, suffix string, dst interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/"+rt.Service+suffix, nil)
+	if err != nil {
+		return err
+	}
+	if orig, ok := ctx.Value(gqlRequestKey{}).(*http.Request); ok {
+		req.Host = orig.Host
+		req.RemoteAddr = orig.RemoteAddr
+		copyHeaders(req.Header, orig.Header)
+	}
+	// The query's own body headers do not apply, and responses are decoded
+	// here, so they must not come back encoded.
+	for _, name := range []string{"Content-Type", "Content-Length", "Accept-Encoding", "If-None-Match", "Idempotency-Key"} {
+		req.Header.Del(name)
+	}
+
+	capture := newResponseCapture()
+	rt.handler.ServeHTTP(capture, req)
+	switch {
+	case capture.status == http.StatusNotFound:
+		return errNotFound
+	case capture.status != http.StatusOK:
+		return fmt.Errorf("%s returned %d %s", rt.name(), capture.status, http.StatusText(capture.status))
+	}
+	return json.Unmarshal(capture.body.Bytes(), dst)
+}
+
+// ServeHTTP accepts queries as GET ?query= or as a JSON POST body, checks
+// depth and complexity limits, and executes them.
+func (api *graphqlAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req graphqlRequest
+	switch r.Method {
+	case http.MethodGet:
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if v := r.URL.Query().Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				writeGraphQLError(w, http.StatusBadRequest, "invalid variables")
+				return
+			}
+		}
+	default:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeGraphQLError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+	}
+	if req.Query == "" {
+		writeGraphQLError(w, http.StatusBadRequest, "query is required")
+		return
+	}
+
+	doc, err := parser.Parse(parser.ParseParams{Source: req.Query})
+	if err != nil {
+		writeGraphQLError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	depth, complexity := measureQuery(doc)
+	if depth > api.cfg.MaxDepth {
+		writeGraphQLError(w, http.StatusBadRequest, fmt.Sprintf("query depth %d exceeds limit %d", depth, api.cfg.MaxDepth))
+		return
+	}
+	if complexity > api.cfg.MaxComplexity {
+		writeGraphQLError(w, http.StatusBadRequest, fmt.Sprintf("query complexity %d exceeds limit %d", complexity, api.cfg.MaxComplexity))
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), gqlRequestKey{}, r)
+	ctx = context.WithValue(ctx, gqlLoadersKey{}, api.newLoaders(ctx))
+	result := graphql.Do(graphql.Params{
+		Schema:         api.schema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        ctx,
+	})
+	writeJSON(w, http.StatusOK, result)
+}
+
+func writeGraphQLError(w http.ResponseWriter, statusCode int, message string) {
+	writeJSON(w, statusCode, map[string]interface{}{
+		"errors": []map[string]string{{"message": message}},
+	})
+}
+
+// gqlListFactor is the assumed size of a list when estimating complexity.
+const gqlListFactor = 10
+
+var gqlListFields = map[string]bool{"customers": true, "investAccounts": true}
+
+// measureQuery returns the deepest selection nesting and an estimated cost
+// for the document: one per field, with fields under a list multiplied by
+// gqlListFactor. Fragments are expanded where they are spread.
+func measureQuery(doc *ast.Document) (depth, complexity int) {
+	fragments := make(map[string]*ast.FragmentDefinition)
+	for _, def := range doc.Definitions {
+		if frag, ok := def.(*ast.FragmentDefinition); ok {
+			fragments[frag.Name.Value] = frag
+		}
+	}
+
+	var walk func(set *ast.SelectionSet, level, multiplier int, seen map[string]bool)
+	walk = func(set *ast.SelectionSet, level, multiplier int, seen map[string]bool) {
+		if set == nil {
+			return
+		}
+		for _, sel := range set.Selections {
+			switch sel := sel.(type) {
+			case *ast.Field:
+				if level > depth {
+					depth = level
+				}
+				complexity += multiplier
+				childMultiplier := multiplier
+				if gqlListFields[sel.Name.Value] {
+					childMultiplier *= gqlListFactor
+				}
+				walk(sel.SelectionSet, level+1, childMultiplier, seen)
+			case *ast.InlineFragment:
+				walk(sel.SelectionSet, level, multiplier, seen)
+			case *ast.FragmentSpread:
+				name := sel.Name.Value
+				if frag, ok := fragments[name]; ok && !seen[name] {
+					seen[name] = true
+					walk(frag.SelectionSet, level, multiplier, seen)
+					delete(seen, name)
+				}
+			}
+		}
+	}
+
+	for _, def := range doc.Definitions {
+		if op, ok := def.(*ast.OperationDefinition); ok {
+			walk(op.SelectionSet, 1, 1, map[string]bool{})
+		}
+	}
+	return depth, complexity
+}
+
+// loader collects keys requested while one level of a query resolves and
+// fetches them in a single batch the first time any of them is needed.
+type loader struct {
+	fetch func(keys []int) (map[int]interface{}, error)
+
+	mu      sync.Mutex
+	pending *loaderBatch
+	done    map[int]*loaderBatch
+}
+
+type loaderBatch struct {
+	keys    []int
+	once    sync.Once
+	results map[int]interface{}
+	err     error
+}
+
+func newLoader(fetch func(keys []int) (map[int]interface{}, error)) *loader {
+	return &loader{fetch: fetch, done: make(map[int]*loaderBatch)}
+}
+
+// load returns a thunk, which graphql-go resolves only after collecting the
+// thunks of sibling objects.
+func (l *loader) load(key int) func() (interface{}, error) {
+	l.mu.Lock()
+	b, ok := l.done[key]
+	if !ok {
+		if l.pending == nil {
+			l.pending = &loaderBatch{}
+		}
+		b = l.pending
+		b.keys = append(b.keys, key)
+		l.done[key] = b
+	}
+	l.mu.Unlock()
+
+	return func() (interface{}, error) {
+		b.once.Do(func() {
+			l.mu.Lock()
+			if l.pending == b {
+				l.pending = nil
+			}
+			l.mu.Unlock()
+			b.results, b.err = l.fetch(b.keys)
+		})
+		if b.err != nil {
+			return nil, b.err
+		}
+		return b.results[key], nil
+	}
+}
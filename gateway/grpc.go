@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// grpcService maps a service's REST resource onto its gRPC methods:
+//
+//	GET    /<resource>       List (streamed; ?<listParam>= filters)
+//	GET    /<resource>/{id}  Get
+//	POST   /<resource>       Create
+//	PUT    /<resource>/{id}  Update
+//	DELETE /<resource>/{id}  Delete
+type grpcService struct {
+	resource  string
+	listParam string
+	newRecord func() proto.Message
+
+	list   func(ctx context.Context, conn *grpc.ClientConn, ids []int32) ([]proto.Message, error)
+	get    func(ctx context.Context, conn *grpc.ClientConn, id int32) (proto.Message, error)
+	create func(ctx context.Context, conn *grpc.ClientConn, rec proto.Message) (proto.Message, error)
+	update func(ctx context.Context, conn *grpc.ClientConn, id int32, rec proto.Message) error
+	delete func(ctx context.Context, conn *grpc.ClientConn, id int32) error
+}
+
+// grpcServices are the gRPC services routes can transcode to, by full name.
+var grpcServices = map[string]*grpcService{
+	"customers.v1.Customers": {
+		resource:  "customer",
+		listParam: "id",
+		newRecord: func() proto.Message { return &CustomerRecord{} },
+		list: func(ctx context.Context, conn *grpc.ClientConn, ids []int32) ([]proto.Message, error) {
+			stream, err := NewCustomersClient(conn).ListCustomers(ctx, &ListCustomersRequest{Ids: ids})
+			if err != nil {
+				return nil, err
+			}
+			var out []proto.Message
+			for {
+				rec, err := stream.Recv()
+				if err == io.EOF {
+					return out, nil
+				}
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, rec)
+			}
+		},
+		get: func(ctx context.Context, conn *grpc.ClientConn, id int32) (proto.Message, error) {
+			return NewCustomersClient(conn).GetCustomer(ctx, &GetCustomerRequest{Id: id})
+		},
+		create: func(ctx context.Context, conn *grpc.ClientConn, rec proto.Message) (proto.Message, error) {
+			return NewCustomersClient(conn).CreateCustomer(ctx, &CreateCustomerRequest{Customer: rec.(*CustomerRecord)})
+		},
+		update: func(ctx context.Context, conn *grpc.ClientConn, id int32, rec proto.Message) error {
+			_, err := NewCustomersClient(conn).UpdateCustomer(ctx, &UpdateCustomerRequest{Id: id, Customer: rec.(*CustomerRecord)})
+			return err
+		},
+		delete: func(ctx context.Context, conn *grpc.ClientConn, id int32) error {
+			_, err := NewCustomersClient(conn).DeleteCustomer(ctx, &DeleteCustomerRequest{Id: id})
+			return err
+		},
+	},
+	"investaccounts.v1.InvestAccounts": {
+		resource:  "invest-account",
+		listParam: "owner_id",
+		newRecord: func() proto.Message { return &InvestAccountRecord{} },
+		list: func(ctx context.Context, conn *grpc.ClientConn, ownerIDs []int32) ([]proto.Message, error) {
+			stream, err := NewInvestAccountsClient(conn).ListInvestAccounts(ctx, &ListInvestAccountsRequest{OwnerIds: ownerIDs})
+			if err != nil {
+				return nil, err
+			}
+			var out []proto.Message
+			for {
+				rec, err := stream.Recv()
+				if err == io.EOF {
+					return out, nil
+				}
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, rec)
+			}
+		},
+		get: func(ctx context.Context, conn *grpc.ClientConn, id int32) (proto.Message, error) {
+			return NewInvestAccountsClient(conn).GetInvestAccount(ctx, &GetInvestAccountRequest{Id: id})
+		},
+		create: func(ctx context.Context, conn *grpc.ClientConn, rec proto.Message) (proto.Message, error) {
+			return NewInvestAccountsClient(conn).CreateInvestAccount(ctx, &CreateInvestAccountRequest{InvestAccount: rec.(*InvestAccountRecord)})
+		},
+		update: func(ctx context.Context, conn *grpc.ClientConn, id int32, rec proto.Message) error {
+			_, err := NewInvestAccountsClient(conn).UpdateInvestAccount(ctx, &UpdateInvestAccountRequest{Id: id, InvestAccount: rec.(*InvestAccountRecord)})
+			return err
+		},
+		delete: func(ctx context.Context, conn *grpc.ClientConn, id int32) error {
+			_, err := NewInvestAccountsClient(conn).DeleteInvestAccount(ctx, &DeleteInvestAccountRequest{Id: id})
+			return err
+		},
+	},
+}
+
+// The JSON produced for records matches the services' REST responses:
+// snake_case names and zero values included.
+var (
+	grpcMarshal   = protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true}
+	grpcUnmarshal = protojson.UnmarshalOptions{}
+)
+
+// grpcConnCache holds one client connection per upstream target. It is
+// carried over on reload so in-flight calls keep their connections.
+type grpcConnCache struct {
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+func newGRPCConnCache() *grpcConnCache {
+	return &grpcConnCache{conns: make(map[string]*grpc.ClientConn)}
+}
+
+// conn returns the connection for an upstream target URL. An https target
+// uses TLS, anything else plaintext.
+func (c *grpcConnCache) conn(target string) (*grpc.ClientConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if conn, ok := c.conns[target]; ok {
+		return conn, nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	creds := insecure.NewCredentials()
+	if u.Scheme == "https" {
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+	conn, err := grpc.NewClient(u.Host, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	c.conns[target] = conn
+	return conn, nil
+}
+
+// retain closes the connections to targets no longer in use.
+func (c *grpcConnCache) retain(targets map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for target, conn := range c.conns {
+		if !targets[target] {
+			conn.Close()
+			delete(c.conns, target)
+		}
+	}
+}
+
+// grpcProxy transcodes the request to a call on the route's gRPC upstream and
+// writes the result back as the JSON the REST service would have returned.
+func (gw *gatewayState) grpcProxy(rt *route, svc *grpcService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil && r.Body != http.NoBody {
+			if _, ok := bufferBody(w, r, rt.maxBodyBytes()); !ok {
+				return
+			}
+		}
+		inst, err := rt.upstreamFor(r).pick()
+		if err != nil {
+			log.Printf("Error proxying request for %s: %s", rt.name(), err)
+			http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		atomic.AddInt64(&inst.inFlight, 1)
+		defer atomic.AddInt64(&inst.inFlight, -1)
+
+		conn, err := gw.grpcConns.conn(inst.URL)
+		if err != nil {
+			log.Printf("Error connecting to %s: %s", inst.URL, err)
+			http.Error(w, "Error proxying request", http.StatusBadGateway)
+			return
+		}
+
+		statusCode, body, err := svc.transcode(r, conn)
+		if err != nil {
+			writeGRPCError(w, err)
+			return
+		}
+		if body != nil {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.WriteHeader(statusCode)
+		w.Write(body)
+	}
+}
+
+func (svc *grpcService) transcode(r *http.Request, conn *grpc.ClientConn) (int, []byte, error) {
+	ctx := r.Context()
+	rest := strings.TrimPrefix(r.URL.Path, "/"+svc.resource)
+	if rest == r.URL.Path {
+		return 0, nil, status.Error(codes.NotFound, "Path not supported")
+	}
+
+	if rest == "" || rest == "/" {
+		switch r.Method {
+		case http.MethodGet:
+			ids, err := intParams(r.URL.Query()[svc.listParam])
+			if err != nil {
+				return 0, nil, status.Errorf(codes.InvalidArgument, "Invalid %s", svc.listParam)
+			}
+			records, err := svc.list(ctx, conn, ids)
+			if err != nil {
+				return 0, nil, err
+			}
+			body, err := marshalRecords(records)
+			return http.StatusOK, body, err
+		case http.MethodPost:
+			rec, err := svc.decodeBody(r)
+			if err != nil {
+				return 0, nil, err
+			}
+			created, err := svc.create(ctx, conn, rec)
+			if err != nil {
+				return 0, nil, err
+			}
+			body, err := grpcMarshal.Marshal(created)
+			return http.StatusCreated, body, err
+		}
+		return 0, nil, status.Error(codes.Unimplemented, "Method not allowed")
+	}
+
+	id, err := strconv.ParseInt(strings.TrimPrefix(rest, "/"), 10, 32)
+	if err != nil {
+		return 0, nil, status.Error(codes.InvalidArgument, "Invalid ID")
+	}
+	switch r.Method {
+	case http.MethodGet:
+		rec, err := svc.get(ctx, conn, int32(id))
+		if err != nil {
+			return 0, nil, err
+		}
+		body, err := grpcMarshal.Marshal(rec)
+		return http.StatusOK, body, err
+	case http.MethodPut:
+		rec, err := svc.decodeBody(r)
+		if err != nil {
+			return 0, nil, err
+		}
+		return http.StatusOK, nil, svc.update(ctx, conn, int32(id), rec)
+	case http.MethodDelete:
+		return http.StatusOK, nil, svc.delete(ctx, conn, int32(id))
+	}
+	return 0, nil, status.Error(codes.Unimplemented, "Method not allowed")
+}
+
+func (svc *grpcService) decodeBody(r *http.Request) (proto.Message, error) {
+	if r.Body == nil {
+		return nil, status.Error(codes.InvalidArgument, "Bad request")
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Bad request")
+	}
+	rec := svc.newRecord()
+	if err := grpcUnmarshal.Unmarshal(data, rec); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Bad request: "+err.Error())
+	}
+	return rec, nil
+}
+
+func intParams(values []string) ([]int32, error) {
+	ids := make([]int32, 0, len(values))
+	for _, v := range values {
+		id, err := strconv.ParseInt(strings.TrimSpace(v), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, int32(id))
+	}
+	return ids, nil
+}
+
+func marshalRecords(records []proto.Message) ([]byte, error) {
+	out := []byte{'['}
+	for i, rec := range records {
+		if i > 0 {
+			out = append(out, ',')
+		}
+		b, err := grpcMarshal.Marshal(rec)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, b...)
+	}
+	return append(out, ']'), nil
+}
+
+// writeGRPCError answers with the HTTP status closest to the gRPC code, in
+// the services' {"error": "..."} shape.
+func writeGRPCError(w http.ResponseWriter, err error) {
+	st, ok := status.FromError(err)
+	if !ok {
+		log.Printf("gRPC transcoding error: %s", err)
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "Error proxying request"})
+		return
+	}
+	writeJSON(w, grpcHTTPStatus(st.Code()), map[string]string{"error": st.Message()})
+}
+
+func grpcHTTPStatus(code codes.Code) int {
+	switch code {
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusMethodNotAllowed
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func (c *GRPCRouteConfig) validate() error {
+	if _, ok := grpcServices[c.Service]; !ok {
+		return fmt.Errorf("unknown grpc service %q", c.Service)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// require_headers rejects requests that lack a header, or whose header does
+// not match a pattern, with a 400:
+//
+//	{"name": "require_headers", "config": {"headers": {"X-Tenant": "^[a-z0-9-]+$", "X-Request-Id": ""}}}
+//
+// An empty pattern only requires the header to be present.
+func init() {
+	RegisterMiddleware("require_headers", newHeaderCheck)
+}
+
+func newHeaderCheck(route RouteConfig, config json.RawMessage) (Middleware, error) {
+	var cfg struct {
+		Headers map[string]string `json:"headers"`
+	}
+	if err := json.Unmarshal(config, &cfg); err != nil || len(cfg.Headers) == 0 {
+		return nil, fmt.Errorf("needs a headers object")
+	}
+	patterns := make(map[string]*regexp.Regexp, len(cfg.Headers))
+	for name, pattern := range cfg.Headers {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %w", name, err)
+		}
+		patterns[name] = re
+	}
+
+	return MiddlewareFunc(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for name, re := range patterns {
+				if v := r.Header.Get(name); v == "" || !re.MatchString(v) {
+					writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Missing or invalid header " + http.CanonicalHeaderKey(name)})
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}), nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// hostPatternRegexp accepts a host name, optionally starting with "*." for
+// any of its subdomains. Ports are not part of patterns.
+var hostPatternRegexp = regexp.MustCompile(`^(\*\.)?[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*$`)
+
+func validHostPattern(pattern string) bool {
+	return hostPatternRegexp.MatchString(pattern)
+}
+
+// requestHost returns the host the request was sent to, lower-cased and
+// without port or trailing dot.
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// hostScore ranks how closely the route's hosts match host: exact hosts
+// before wildcards, longer wildcards before shorter ones, and routes without
+// hosts last. It is -1 when the route does not serve host.
+func (rc *RouteConfig) hostScore(host string) int {
+	if len(rc.Hosts) == 0 {
+		return 0
+	}
+	best := -1
+	for _, pattern := range rc.Hosts {
+		pattern = strings.ToLower(pattern)
+		switch {
+		case pattern == host:
+			return len(pattern) + 2
+		case strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]):
+			if score := len(pattern) - 1; score > best {
+				best = score
+			}
+		}
+	}
+	return best
+}
+
+// routeFor picks the route that serves service on the request's host, or nil
+// when none does.
+func (gw *gatewayState) routeFor(service string, r *http.Request) *route {
+	return closestHost(gw.services[service], r)
+}
+
+// closestHost picks the route that serves the request's host best, or nil
+// when none does. Composites and GraphQL use it too.
+func closestHost(routes []*route, r *http.Request) *route {
+	host := requestHost(r)
+	var best *route
+	bestScore := -1
+	for _, rt := range routes {
+		if score := rt.hostScore(host); score > bestScore {
+			best, bestScore = rt, score
+		}
+	}
+	return best
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotencyStore remembers the responses to requests sent with an
+// Idempotency-Key. The gateway ships an in-memory store; anything shared
+// between gateway replicas can implement the same interface and be installed
+// with SetIdempotencyStore.
+type IdempotencyStore interface {
+	// Reserve claims key for a new request for the length of lease. If the
+	// key is already known it returns the existing record and false instead.
+	Reserve(key, fingerprint string, lease time.Duration) (*idempotencyRecord, bool)
+	// Complete stores the response for a reserved key for ttl.
+	Complete(key string, resp *cachedResponse, ttl time.Duration)
+	// Release forgets a reserved key so the request can be retried.
+	Release(key string)
+}
+
+// idempotencyRecord is a key's request fingerprint and, once the first
+// request finished, its response.
+type idempotencyRecord struct {
+	Fingerprint string
+	Response    *cachedResponse
+	Expires     time.Time
+}
+
+type memoryIdempotencyStore struct {
+	mu        sync.Mutex
+	records   map[string]*idempotencyRecord
+	lastSweep time.Time
+}
+
+func newMemoryIdempotencyStore() *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{records: make(map[string]*idempotencyRecord)}
+}
+
+func (s *memoryIdempotencyStore) Reserve(key, fingerprint string, lease time.Duration) (*idempotencyRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.sweep(now)
+	if rec, ok := s.records[key]; ok && now.Before(rec.Expires) {
+		copied := *rec
+		return &copied, false
+	}
+	s.records[key] = &idempotencyRecord{Fingerprint: fingerprint, Expires: now.Add(lease)}
+	return nil, true
+}
+
+func (s *memoryIdempotencyStore) Complete(key string, resp *cachedResponse, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rec, ok := s.records[key]; ok {
+		rec.Response = resp
+		rec.Expires = time.Now().Add(ttl)
+	}
+}
+
+func (s *memoryIdempotencyStore) Release(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+}
+
+// sweep drops expired records, at most once a minute.
+func (s *memoryIdempotencyStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for key, rec := range s.records {
+		if !now.Before(rec.Expires) {
+			delete(s.records, key)
+		}
+	}
+}
+
+// idempotencyMiddleware makes POSTs carrying an Idempotency-Key safe to
+// retry. The first response is stored under the key, scoped to the route and
+// user, and repeats of the same request get it back with
+// Idempotent-Replayed: true. Reusing the key for a different request is a 422
+// and repeating it while the first is still running is a 409. Failed requests
+// (5xx), and ones that panic, are not stored, so they can be retried; a key
+// whose request never finishes is free again after the lease.
+func idempotencyMiddleware(store IdempotencyStore, rt *route, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+		idemKey := r.Header.Get("Idempotency-Key")
+		if idemKey == "" {
+			if rt.Idempotency.Required {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Idempotency-Key header is required"})
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, ok := bufferBody(w, r, rt.maxBodyBytes())
+		if !ok {
+			return
+		}
+
+		key := "/" + rt.name() + "\x00" + idemKey
+		if claims := claimsFromRequest(r); claims != nil {
+			key += "\x00user=" + claims.Username
+		}
+		h := sha256.New()
+		h.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n"))
+		h.Write(body)
+		fingerprint := hex.EncodeToString(h.Sum(nil))
+
+		rec, reserved := store.Reserve(key, fingerprint, rt.Idempotency.lease())
+		switch {
+		case reserved:
+		case rec.Fingerprint != fingerprint:
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": "Idempotency-Key was already used for a different request"})
+			return
+		case rec.Response == nil:
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "A request with this Idempotency-Key is still in progress"})
+			return
+		default:
+			copyHeaders(w.Header(), rec.Response.Header)
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(rec.Response.StatusCode)
+			w.Write(rec.Response.Body)
+			return
+		}
+
+		completed := false
+		defer func() {
+			if !completed {
+				store.Release(key)
+			}
+		}()
+		capture := newResponseCapture()
+		next.ServeHTTP(capture, r)
+		if capture.status < http.StatusInternalServerError {
+			store.Complete(key, &cachedResponse{
+				StatusCode: capture.status,
+				Header:     capture.header.Clone(),
+				Body:       capture.body.Bytes(),
+				StoredAt:   time.Now(),
+			}, rt.Idempotency.ttl())
+			completed = true
+		}
+
+		copyHeaders(w.Header(), capture.header)
+		w.WriteHeader(capture.status)
+		w.Write(capture.body.Bytes())
+	})
+}
+
+func (c *IdempotencyConfig) ttl() time.Duration {
+	if c.TTL.Duration > 0 {
+		return c.TTL.Duration
+	}
+	return 24 * time.Hour
+}
+
+func (c *IdempotencyConfig) lease() time.Duration {
+	if c.Lease.Duration > 0 {
+		return c.Lease.Duration
+	}
+	return time.Minute
+}
@@ -0,0 +1,578 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.28.1
+// 	protoc        (unknown)
+// source: invest_accounts.proto
+
+package main
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// InvestAccountRecord carries the same fields as the REST API's invest account
+// JSON.
+type InvestAccountRecord struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id                    int32   `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	OwnerId               int32   `protobuf:"varint,2,opt,name=owner_id,json=ownerId,proto3" json:"owner_id,omitempty"`
+	ClientSurveyNumber    int32   `protobuf:"varint,3,opt,name=client_survey_number,json=clientSurveyNumber,proto3" json:"client_survey_number,omitempty"`
+	Share                 string  `protobuf:"bytes,4,opt,name=share,proto3" json:"share,omitempty"`
+	InvestedAmountOfMoney float64 `protobuf:"fixed64,5,opt,name=invested_amount_of_money,json=investedAmountOfMoney,proto3" json:"invested_amount_of_money,omitempty"`
+	FreeAmountOfMoney     float64 `protobuf:"fixed64,6,opt,name=free_amount_of_money,json=freeAmountOfMoney,proto3" json:"free_amount_of_money,omitempty"`
+}
+
+func (x *InvestAccountRecord) Reset() {
+	*x = InvestAccountRecord{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_invest_accounts_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *InvestAccountRecord) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*InvestAccountRecord) ProtoMessage() {}
+
+func (x *InvestAccountRecord) ProtoReflect() protoreflect.Message {
+	mi := &file_invest_accounts_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use InvestAccountRecord.ProtoReflect.Descriptor instead.
+func (*InvestAccountRecord) Descriptor() ([]byte, []int) {
+	return file_invest_accounts_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *InvestAccountRecord) GetId() int32 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *InvestAccountRecord) GetOwnerId() int32 {
+	if x != nil {
+		return x.OwnerId
+	}
+	return 0
+}
+
+func (x *InvestAccountRecord) GetClientSurveyNumber() int32 {
+	if x != nil {
+		return x.ClientSurveyNumber
+	}
+	return 0
+}
+
+func (x *InvestAccountRecord) GetShare() string {
+	if x != nil {
+		return x.Share
+	}
+	return ""
+}
+
+func (x *InvestAccountRecord) GetInvestedAmountOfMoney() float64 {
+	if x != nil {
+		return x.InvestedAmountOfMoney
+	}
+	return 0
+}
+
+func (x *InvestAccountRecord) GetFreeAmountOfMoney() float64 {
+	if x != nil {
+		return x.FreeAmountOfMoney
+	}
+	return 0
+}
+
+type ListInvestAccountsRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	OwnerIds []int32 `protobuf:"varint,1,rep,packed,name=owner_ids,json=ownerIds,proto3" json:"owner_ids,omitempty"`
+}
+
+func (x *ListInvestAccountsRequest) Reset() {
+	*x = ListInvestAccountsRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_invest_accounts_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ListInvestAccountsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListInvestAccountsRequest) ProtoMessage() {}
+
+func (x *ListInvestAccountsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_invest_accounts_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListInvestAccountsRequest.ProtoReflect.Descriptor instead.
+func (*ListInvestAccountsRequest) Descriptor() ([]byte, []int) {
+	return file_invest_accounts_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ListInvestAccountsRequest) GetOwnerIds() []int32 {
+	if x != nil {
+		return x.OwnerIds
+	}
+	return nil
+}
+
+type GetInvestAccountRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id int32 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+}
+
+func (x *GetInvestAccountRequest) Reset() {
+	*x = GetInvestAccountRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_invest_accounts_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *GetInvestAccountRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetInvestAccountRequest) ProtoMessage() {}
+
+func (x *GetInvestAccountRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_invest_accounts_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetInvestAccountRequest.ProtoReflect.Descriptor instead.
+func (*GetInvestAccountRequest) Descriptor() ([]byte, []int) {
+	return file_invest_accounts_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *GetInvestAccountRequest) GetId() int32 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+type CreateInvestAccountRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	InvestAccount *InvestAccountRecord `protobuf:"bytes,1,opt,name=invest_account,json=investAccount,proto3" json:"invest_account,omitempty"`
+}
+
+func (x *CreateInvestAccountRequest) Reset() {
+	*x = CreateInvestAccountRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_invest_accounts_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CreateInvestAccountRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateInvestAccountRequest) ProtoMessage() {}
+
+func (x *CreateInvestAccountRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_invest_accounts_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateInvestAccountRequest.ProtoReflect.Descriptor instead.
+func (*CreateInvestAccountRequest) Descriptor() ([]byte, []int) {
+	return file_invest_accounts_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *CreateInvestAccountRequest) GetInvestAccount() *InvestAccountRecord {
+	if x != nil {
+		return x.InvestAccount
+	}
+	return nil
+}
+
+type UpdateInvestAccountRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id            int32                `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	InvestAccount *InvestAccountRecord `protobuf:"bytes,2,opt,name=invest_account,json=investAccount,proto3" json:"invest_account,omitempty"`
+}
+
+func (x *UpdateInvestAccountRequest) Reset() {
+	*x = UpdateInvestAccountRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_invest_accounts_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *UpdateInvestAccountRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UpdateInvestAccountRequest) ProtoMessage() {}
+
+func (x *UpdateInvestAccountRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_invest_accounts_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UpdateInvestAccountRequest.ProtoReflect.Descriptor instead.
+func (*UpdateInvestAccountRequest) Descriptor() ([]byte, []int) {
+	return file_invest_accounts_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *UpdateInvestAccountRequest) GetId() int32 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *UpdateInvestAccountRequest) GetInvestAccount() *InvestAccountRecord {
+	if x != nil {
+		return x.InvestAccount
+	}
+	return nil
+}
+
+type DeleteInvestAccountRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id int32 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+}
+
+func (x *DeleteInvestAccountRequest) Reset() {
+	*x = DeleteInvestAccountRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_invest_accounts_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *DeleteInvestAccountRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteInvestAccountRequest) ProtoMessage() {}
+
+func (x *DeleteInvestAccountRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_invest_accounts_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteInvestAccountRequest.ProtoReflect.Descriptor instead.
+func (*DeleteInvestAccountRequest) Descriptor() ([]byte, []int) {
+	return file_invest_accounts_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *DeleteInvestAccountRequest) GetId() int32 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+var File_invest_accounts_proto protoreflect.FileDescriptor
+
+var file_invest_accounts_proto_rawDesc = []byte{
+	0x0a, 0x15, 0x69, 0x6e, 0x76, 0x65, 0x73, 0x74, 0x5f, 0x61, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74,
+	0x73, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x11, 0x69, 0x6e, 0x76, 0x65, 0x73, 0x74, 0x61,
+	0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x73, 0x2e, 0x76, 0x31, 0x1a, 0x1b, 0x67, 0x6f, 0x6f, 0x67,
+	0x6c, 0x65, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2f, 0x65, 0x6d, 0x70, 0x74,
+	0x79, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0xf2, 0x01, 0x0a, 0x13, 0x49, 0x6e, 0x76, 0x65,
+	0x73, 0x74, 0x41, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x52, 0x65, 0x63, 0x6f, 0x72, 0x64, 0x12,
+	0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x02, 0x69, 0x64, 0x12,
+	0x19, 0x0a, 0x08, 0x6f, 0x77, 0x6e, 0x65, 0x72, 0x5f, 0x69, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x05, 0x52, 0x07, 0x6f, 0x77, 0x6e, 0x65, 0x72, 0x49, 0x64, 0x12, 0x30, 0x0a, 0x14, 0x63, 0x6c,
+	0x69, 0x65, 0x6e, 0x74, 0x5f, 0x73, 0x75, 0x72, 0x76, 0x65, 0x79, 0x5f, 0x6e, 0x75, 0x6d, 0x62,
+	0x65, 0x72, 0x18, 0x03, 0x20, 0x01, 0x28, 0x05, 0x52, 0x12, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74,
+	0x53, 0x75, 0x72, 0x76, 0x65, 0x79, 0x4e, 0x75, 0x6d, 0x62, 0x65, 0x72, 0x12, 0x14, 0x0a, 0x05,
+	0x73, 0x68, 0x61, 0x72, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x73, 0x68, 0x61,
+	0x72, 0x65, 0x12, 0x37, 0x0a, 0x18, 0x69, 0x6e, 0x76, 0x65, 0x73, 0x74, 0x65, 0x64, 0x5f, 0x61,
+	0x6d, 0x6f, 0x75, 0x6e, 0x74, 0x5f, 0x6f, 0x66, 0x5f, 0x6d, 0x6f, 0x6e, 0x65, 0x79, 0x18, 0x05,
+	0x20, 0x01, 0x28, 0x01, 0x52, 0x15, 0x69, 0x6e, 0x76, 0x65, 0x73, 0x74, 0x65, 0x64, 0x41, 0x6d,
+	0x6f, 0x75, 0x6e, 0x74, 0x4f, 0x66, 0x4d, 0x6f, 0x6e, 0x65, 0x79, 0x12, 0x2f, 0x0a, 0x14, 0x66,
+	0x72, 0x65, 0x65, 0x5f, 0x61, 0x6d, 0x6f, 0x75, 0x6e, 0x74, 0x5f, 0x6f, 0x66, 0x5f, 0x6d, 0x6f,
+	0x6e, 0x65, 0x79, 0x18, 0x06, 0x20, 0x01, 0x28, 0x01, 0x52, 0x11, 0x66, 0x72, 0x65, 0x65, 0x41,
+	0x6d, 0x6f, 0x75, 0x6e, 0x74, 0x4f, 0x66, 0x4d, 0x6f, 0x6e, 0x65, 0x79, 0x22, 0x38, 0x0a, 0x19,
+	0x4c, 0x69, 0x73, 0x74, 0x49, 0x6e, 0x76, 0x65, 0x73, 0x74, 0x41, 0x63, 0x63, 0x6f, 0x75, 0x6e,
+	0x74, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x1b, 0x0a, 0x09, 0x6f, 0x77, 0x6e,
+	0x65, 0x72, 0x5f, 0x69, 0x64, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x05, 0x52, 0x08, 0x6f, 0x77,
+	0x6e, 0x65, 0x72, 0x49, 0x64, 0x73, 0x22, 0x29, 0x0a, 0x17, 0x47, 0x65, 0x74, 0x49, 0x6e, 0x76,
+	0x65, 0x73, 0x74, 0x41, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x02, 0x69,
+	0x64, 0x22, 0x6b, 0x0a, 0x1a, 0x43, 0x72, 0x65, 0x61, 0x74, 0x65, 0x49, 0x6e, 0x76, 0x65, 0x73,
+	0x74, 0x41, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12,
+	0x4d, 0x0a, 0x0e, 0x69, 0x6e, 0x76, 0x65, 0x73, 0x74, 0x5f, 0x61, 0x63, 0x63, 0x6f, 0x75, 0x6e,
+	0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x26, 0x2e, 0x69, 0x6e, 0x76, 0x65, 0x73, 0x74,
+	0x61, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x73, 0x2e, 0x76, 0x31, 0x2e, 0x49, 0x6e, 0x76, 0x65,
+	0x73, 0x74, 0x41, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x52, 0x65, 0x63, 0x6f, 0x72, 0x64, 0x52,
+	0x0d, 0x69, 0x6e, 0x76, 0x65, 0x73, 0x74, 0x41, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x22, 0x7b,
+	0x0a, 0x1a, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x49, 0x6e, 0x76, 0x65, 0x73, 0x74, 0x41, 0x63,
+	0x63, 0x6f, 0x75, 0x6e, 0x74, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x0e, 0x0a, 0x02,
+	0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x02, 0x69, 0x64, 0x12, 0x4d, 0x0a, 0x0e,
+	0x69, 0x6e, 0x76, 0x65, 0x73, 0x74, 0x5f, 0x61, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x18, 0x02,
+	0x20, 0x01, 0x28, 0x0b, 0x32, 0x26, 0x2e, 0x69, 0x6e, 0x76, 0x65, 0x73, 0x74, 0x61, 0x63, 0x63,
+	0x6f, 0x75, 0x6e, 0x74, 0x73, 0x2e, 0x76, 0x31, 0x2e, 0x49, 0x6e, 0x76, 0x65, 0x73, 0x74, 0x41,
+	0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x52, 0x65, 0x63, 0x6f, 0x72, 0x64, 0x52, 0x0d, 0x69, 0x6e,
+	0x76, 0x65, 0x73, 0x74, 0x41, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x22, 0x2c, 0x0a, 0x1a, 0x44,
+	0x65, 0x6c, 0x65, 0x74, 0x65, 0x49, 0x6e, 0x76, 0x65, 0x73, 0x74, 0x41, 0x63, 0x63, 0x6f, 0x75,
+	0x6e, 0x74, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x02, 0x69, 0x64, 0x32, 0x90, 0x04, 0x0a, 0x0e, 0x49, 0x6e,
+	0x76, 0x65, 0x73, 0x74, 0x41, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x73, 0x12, 0x6c, 0x0a, 0x12,
+	0x4c, 0x69, 0x73, 0x74, 0x49, 0x6e, 0x76, 0x65, 0x73, 0x74, 0x41, 0x63, 0x63, 0x6f, 0x75, 0x6e,
+	0x74, 0x73, 0x12, 0x2c, 0x2e, 0x69, 0x6e, 0x76, 0x65, 0x73, 0x74, 0x61, 0x63, 0x63, 0x6f, 0x75,
+	0x6e, 0x74, 0x73, 0x2e, 0x76, 0x31, 0x2e, 0x4c, 0x69, 0x73, 0x74, 0x49, 0x6e, 0x76, 0x65, 0x73,
+	0x74, 0x41, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
+	0x1a, 0x26, 0x2e, 0x69, 0x6e, 0x76, 0x65, 0x73, 0x74, 0x61, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74,
+	0x73, 0x2e, 0x76, 0x31, 0x2e, 0x49, 0x6e, 0x76, 0x65, 0x73, 0x74, 0x41, 0x63, 0x63, 0x6f, 0x75,
+	0x6e, 0x74, 0x52, 0x65, 0x63, 0x6f, 0x72, 0x64, 0x30, 0x01, 0x12, 0x66, 0x0a, 0x10, 0x47, 0x65,
+	0x74, 0x49, 0x6e, 0x76, 0x65, 0x73, 0x74, 0x41, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x12, 0x2a,
+	0x2e, 0x69, 0x6e, 0x76, 0x65, 0x73, 0x74, 0x61, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x73, 0x2e,
+	0x76, 0x31, 0x2e, 0x47, 0x65, 0x74, 0x49, 0x6e, 0x76, 0x65, 0x73, 0x74, 0x41, 0x63, 0x63, 0x6f,
+	0x75, 0x6e, 0x74, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x26, 0x2e, 0x69, 0x6e, 0x76,
+	0x65, 0x73, 0x74, 0x61, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x73, 0x2e, 0x76, 0x31, 0x2e, 0x49,
+	0x6e, 0x76, 0x65, 0x73, 0x74, 0x41, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x52, 0x65, 0x63, 0x6f,
+	0x72, 0x64, 0x12, 0x6c, 0x0a, 0x13, 0x43, 0x72, 0x65, 0x61, 0x74, 0x65, 0x49, 0x6e, 0x76, 0x65,
+	0x73, 0x74, 0x41, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x12, 0x2d, 0x2e, 0x69, 0x6e, 0x76, 0x65,
+	0x73, 0x74, 0x61, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x73, 0x2e, 0x76, 0x31, 0x2e, 0x43, 0x72,
+	0x65, 0x61, 0x74, 0x65, 0x49, 0x6e, 0x76, 0x65, 0x73, 0x74, 0x41, 0x63, 0x63, 0x6f, 0x75, 0x6e,
+	0x74, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x26, 0x2e, 0x69, 0x6e, 0x76, 0x65, 0x73,
+	0x74, 0x61, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x73, 0x2e, 0x76, 0x31, 0x2e, 0x49, 0x6e, 0x76,
+	0x65, 0x73, 0x74, 0x41, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x52, 0x65, 0x63, 0x6f, 0x72, 0x64,
+	0x12, 0x5c, 0x0a, 0x13, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x49, 0x6e, 0x76, 0x65, 0x73, 0x74,
+	0x41, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x12, 0x2d, 0x2e, 0x69, 0x6e, 0x76, 0x65, 0x73, 0x74,
+	0x61, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x73, 0x2e, 0x76, 0x31, 0x2e, 0x55, 0x70, 0x64, 0x61,
+	0x74, 0x65, 0x49, 0x6e, 0x76, 0x65, 0x73, 0x74, 0x41, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x12, 0x5c,
+	0x0a, 0x13, 0x44, 0x65, 0x6c, 0x65, 0x74, 0x65, 0x49, 0x6e, 0x76, 0x65, 0x73, 0x74, 0x41, 0x63,
+	0x63, 0x6f, 0x75, 0x6e, 0x74, 0x12, 0x2d, 0x2e, 0x69, 0x6e, 0x76, 0x65, 0x73, 0x74, 0x61, 0x63,
+	0x63, 0x6f, 0x75, 0x6e, 0x74, 0x73, 0x2e, 0x76, 0x31, 0x2e, 0x44, 0x65, 0x6c, 0x65, 0x74, 0x65,
+	0x49, 0x6e, 0x76, 0x65, 0x73, 0x74, 0x41, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x52, 0x65, 0x71,
+	0x75, 0x65, 0x73, 0x74, 0x1a, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x62, 0x06, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_invest_accounts_proto_rawDescOnce sync.Once
+	file_invest_accounts_proto_rawDescData = file_invest_accounts_proto_rawDesc
+)
+
+func file_invest_accounts_proto_rawDescGZIP() []byte {
+	file_invest_accounts_proto_rawDescOnce.Do(func() {
+		file_invest_accounts_proto_rawDescData = protoimpl.X.CompressGZIP(file_invest_accounts_proto_rawDescData)
+	})
+	return file_invest_accounts_proto_rawDescData
+}
+
+var file_invest_accounts_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
+var file_invest_accounts_proto_goTypes = []interface{}{
+	(*InvestAccountRecord)(nil),        // 0: investaccounts.v1.InvestAccountRecord
+	(*ListInvestAccountsRequest)(nil),  // 1: investaccounts.v1.ListInvestAccountsRequest
+	(*GetInvestAccountRequest)(nil),    // 2: investaccounts.v1.GetInvestAccountRequest
+	(*CreateInvestAccountRequest)(nil), // 3: investaccounts.v1.CreateInvestAccountRequest
+	(*UpdateInvestAccountRequest)(nil), // 4: investaccounts.v1.UpdateInvestAccountRequest
+	(*DeleteInvestAccountRequest)(nil), // 5: investaccounts.v1.DeleteInvestAccountRequest
+	(*emptypb.Empty)(nil),              // 6: google.protobuf.Empty
+}
+var file_invest_accounts_proto_depIdxs = []int32{
+	0, // 0: investaccounts.v1.CreateInvestAccountRequest.invest_account:type_name -> investaccounts.v1.InvestAccountRecord
+	0, // 1: investaccounts.v1.UpdateInvestAccountRequest.invest_account:type_name -> investaccounts.v1.InvestAccountRecord
+	1, // 2: investaccounts.v1.InvestAccounts.ListInvestAccounts:input_type -> investaccounts.v1.ListInvestAccountsRequest
+	2, // 3: investaccounts.v1.InvestAccounts.GetInvestAccount:input_type -> investaccounts.v1.GetInvestAccountRequest
+	3, // 4: investaccounts.v1.InvestAccounts.CreateInvestAccount:input_type -> investaccounts.v1.CreateInvestAccountRequest
+	4, // 5: investaccounts.v1.InvestAccounts.UpdateInvestAccount:input_type -> investaccounts.v1.UpdateInvestAccountRequest
+	5, // 6: investaccounts.v1.InvestAccounts.DeleteInvestAccount:input_type -> investaccounts.v1.DeleteInvestAccountRequest
+	0, // 7: investaccounts.v1.InvestAccounts.ListInvestAccounts:output_type -> investaccounts.v1.InvestAccountRecord
+	0, // 8: investaccounts.v1.InvestAccounts.GetInvestAccount:output_type -> investaccounts.v1.InvestAccountRecord
+	0, // 9: investaccounts.v1.InvestAccounts.CreateInvestAccount:output_type -> investaccounts.v1.InvestAccountRecord
+	6, // 10: investaccounts.v1.InvestAccounts.UpdateInvestAccount:output_type -> google.protobuf.Empty
+	6, // 11: investaccounts.v1.InvestAccounts.DeleteInvestAccount:output_type -> google.protobuf.Empty
+	7, // [7:12] is the sub-list for method output_type
+	2, // [2:7] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
+}
+
+func init() { file_invest_accounts_proto_init() }
+func file_invest_accounts_proto_init() {
+	if File_invest_accounts_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_invest_accounts_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*InvestAccountRecord); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_invest_accounts_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ListInvestAccountsRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_invest_accounts_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GetInvestAccountRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_invest_accounts_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CreateInvestAccountRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_invest_accounts_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*UpdateInvestAccountRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_invest_accounts_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*DeleteInvestAccountRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_invest_accounts_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   6,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_invest_accounts_proto_goTypes,
+		DependencyIndexes: file_invest_accounts_proto_depIdxs,
+		MessageInfos:      file_invest_accounts_proto_msgTypes,
+	}.Build()
+	File_invest_accounts_proto = out.File
+	file_invest_accounts_proto_rawDesc = nil
+	file_invest_accounts_proto_goTypes = nil
+	file_invest_accounts_proto_depIdxs = nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+type ipFilter struct {
+	IPFilterConfig
+	allow   []*net.IPNet
+	deny    []*net.IPNet
+	methods map[string]bool
+	path    *regexp.Regexp
+
+	allowed int64
+	denied  int64
+}
+
+type ipFilterStatus struct {
+	Route   string   `json:"route"`
+	Methods []string `json:"methods,omitempty"`
+	Path    string   `json:"path,omitempty"`
+	Allow   []string `json:"allow,omitempty"`
+	Deny    []string `json:"deny,omitempty"`
+	Allowed int64    `json:"allowed"`
+	Denied  int64    `json:"denied"`
+}
+
+func newIPFilter(cfg IPFilterConfig) (*ipFilter, error) {
+	f := &ipFilter{IPFilterConfig: cfg, methods: make(map[string]bool)}
+	var err error
+	if f.allow, err = parseCIDRs(cfg.Allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseCIDRs(cfg.Deny); err != nil {
+		return nil, err
+	}
+	for _, m := range cfg.Methods {
+		f.methods[strings.ToUpper(m)] = true
+	}
+	if cfg.Path != "" {
+		if f.path, err = regexp.Compile(cfg.Path); err != nil {
+			return nil, fmt.Errorf("invalid ip filter path %q: %w", cfg.Path, err)
+		}
+	}
+	return f, nil
+}
+
+// parseCIDRs accepts CIDR blocks and bare addresses.
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", v)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", v)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *ipFilter) applies(r *http.Request) bool {
+	if len(f.methods) > 0 && !f.methods[r.Method] {
+		return false
+	}
+	return f.path == nil || f.path.MatchString(r.URL.Path)
+}
+
+// permits reports whether ip passes the filter. Deny entries win over allow
+// entries; an empty allow list allows everything not denied.
+func (f *ipFilter) permits(ip net.IP) bool {
+	if ip == nil {
+		return len(f.allow) == 0 && len(f.deny) == 0
+	}
+	if containsIP(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || containsIP(f.allow, ip)
+}
+
+func (f *ipFilter) status(route string) ipFilterStatus {
+	return ipFilterStatus{
+		Route:   route,
+		Methods: f.Methods,
+		Path:    f.Path,
+		Allow:   f.Allow,
+		Deny:    f.Deny,
+		Allowed: atomic.LoadInt64(&f.allowed),
+		Denied:  atomic.LoadInt64(&f.denied),
+	}
+}
+
+// ipFilterMiddleware rejects requests whose client address fails any filter
+// that applies to the request's method and path.
+func ipFilterMiddleware(rt *route, filters []*ipFilter, trusted []*net.IPNet, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r, trusted)
+		for _, f := range filters {
+			if !f.applies(r) {
+				continue
+			}
+			if !f.permits(ip) {
+				atomic.AddInt64(&f.denied, 1)
+				log.Printf("IP filter: denied %s %s %s on route %s", ip, r.Method, r.URL.Path, rt.name())
+				writeJSON(w, http.StatusForbidden, map[string]string{"error": "Forbidden"})
+				return
+			}
+			atomic.AddInt64(&f.allowed, 1)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the address of the client that sent r. X-Forwarded-For is
+// only believed for hops added by trusted proxies: the chain is walked from
+// the right and the first untrusted address is the client.
+func clientIP(r *http.Request, trusted []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(trusted, ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, line := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(line, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			return ip
+		}
+		ip = hop
+		if !containsIP(trusted, hop) {
+			return hop
+		}
+	}
+	return ip
+}
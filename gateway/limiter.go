@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errShed         = errors.New("upstream overloaded, request shed")
+	errQueueTimeout = errors.New("upstream overloaded, timed out waiting")
+)
+
+// priority orders requests for shedding: low requests are refused first.
+type priority int
+
+const (
+	priorityLow priority = iota
+	priorityNormal
+	priorityHigh
+	numPriorities
+)
+
+var priorityNames = [numPriorities]string{"low", "normal", "high"}
+
+// priorityShare is the part of the concurrency limit each priority may fill,
+// so that writes still get through while reads are being shed.
+var priorityShare = [numPriorities]float64{0.5, 0.8, 1}
+
+// requestPriority makes writes high priority and reads normal. Clients such as
+// dashboards can lower, but never raise, their requests' priority with
+// X-Priority: low.
+func requestPriority(r *http.Request) priority {
+	base := priorityNormal
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		base = priorityHigh
+	}
+	return lowerPriority(r, base)
+}
+
+func lowerPriority(r *http.Request, base priority) priority {
+	for p := priorityLow; p < base; p++ {
+		if strings.EqualFold(r.Header.Get("X-Priority"), priorityNames[p]) {
+			return p
+		}
+	}
+	return base
+}
+
+// concurrencyLimiter is a bulkhead in front of one upstream. It admits up to
+// its limit of requests at once and queues a bounded number of others,
+// highest priority first. With adaptive limiting the limit follows the
+// upstream: it grows by one for every limit's worth of fast, successful
+// requests and is cut by a tenth on a slow or failed one (AIMD).
+type concurrencyLimiter struct {
+	cfg *ConcurrencyConfig
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	waiting  [numPriorities][]*limiterWaiter
+	queued   int
+
+	admitted int64
+	shed     [numPriorities]int64
+	timeouts int64
+}
+
+type limiterWaiter struct {
+	ready chan struct{}
+	err   error
+}
+
+type limiterStatus struct {
+	Limit    int              `json:"limit"`
+	InFlight int              `json:"in_flight"`
+	Queued   int              `json:"queued"`
+	Admitted int64            `json:"admitted"`
+	Shed     map[string]int64 `json:"shed"`
+	Timeouts int64            `json:"timeouts"`
+}
+
+func newConcurrencyLimiter(cfg *ConcurrencyConfig) *concurrencyLimiter {
+	return &concurrencyLimiter{cfg: cfg, limit: float64(cfg.MaxInFlight)}
+}
+
+// fits reports whether a request of priority p can start now. The caller
+// holds l.mu.
+func (l *concurrencyLimiter) fits(p priority) bool {
+	allowed := int(l.limit * priorityShare[p])
+	if allowed < 1 {
+		allowed = 1
+	}
+	return l.inFlight < allowed
+}
+
+// acquire waits for a slot for a request of priority p. A full queue sheds
+// the lowest priority waiter below p, or the new request if there is none.
+// The returned release must be called with the response status.
+func (l *concurrencyLimiter) acquire(ctx context.Context, p priority) (func(status int), error) {
+	l.mu.Lock()
+	if l.fits(p) && !l.waitingFrom(p) {
+		l.inFlight++
+		l.admitted++
+		l.mu.Unlock()
+		return l.releaser(), nil
+	}
+	if l.queued >= l.cfg.maxQueue() && !l.shedBelow(p) {
+		l.shed[p]++
+		l.mu.Unlock()
+		return nil, errShed
+	}
+	w := &limiterWaiter{ready: make(chan struct{})}
+	l.waiting[p] = append(l.waiting[p], w)
+	l.queued++
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.cfg.queueTimeout())
+	defer timer.Stop()
+	select {
+	case <-w.ready:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-w.ready:
+		if w.err != nil {
+			return nil, w.err
+		}
+		return l.releaser(), nil
+	default:
+	}
+	l.remove(p, w)
+	l.timeouts++
+	return nil, errQueueTimeout
+}
+
+// waitingFrom reports whether requests of priority p or higher are queued,
+// which keep their place ahead of a new arrival. The caller holds l.mu.
+func (l *concurrencyLimiter) waitingFrom(p priority) bool {
+	for ; p < numPriorities; p++ {
+		if len(l.waiting[p]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// shedBelow drops the newest waiter of the lowest priority under p to make
+// room in the queue. The caller holds l.mu.
+func (l *concurrencyLimiter) shedBelow(p priority) bool {
+	for q := priorityLow; q < p; q++ {
+		if n := len(l.waiting[q]); n > 0 {
+			w := l.waiting[q][n-1]
+			l.waiting[q] = l.waiting[q][:n-1]
+			l.queued--
+			l.shed[q]++
+			w.err = errShed
+			close(w.ready)
+			return true
+		}
+	}
+	return false
+}
+
+func (l *concurrencyLimiter) remove(p priority, w *limiterWaiter) {
+	for i, other := range l.waiting[p] {
+		if other == w {
+			l.waiting[p] = append(l.waiting[p][:i], l.waiting[p][i+1:]...)
+			l.queued--
+			return
+		}
+	}
+}
+
+func (l *concurrencyLimiter) releaser() func(status int) {
+	start := time.Now()
+	return func(status int) {
+		l.release(time.Since(start), status)
+	}
+}
+
+func (l *concurrencyLimiter) release(latency time.Duration, status int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	if a := l.cfg.Adaptive; a != nil {
+		if status >= http.StatusInternalServerError || latency > a.latencyThreshold() {
+			l.limit *= 0.9
+		} else {
+			l.limit += 1 / l.limit
+		}
+		if min := float64(a.minLimit()); l.limit < min {
+			l.limit = min
+		}
+		if max := float64(l.cfg.MaxInFlight); l.limit > max {
+			l.limit = max
+		}
+	}
+
+	// Admit waiters, highest priority first, while they fit.
+	for p := numPriorities - 1; p >= priorityLow; p-- {
+		for len(l.waiting[p]) > 0 && l.fits(p) {
+			w := l.waiting[p][0]
+			l.waiting[p] = l.waiting[p][1:]
+			l.queued--
+			l.inFlight++
+			l.admitted++
+			close(w.ready)
+		}
+	}
+}
+
+func (l *concurrencyLimiter) status() *limiterStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := &limiterStatus{
+		Limit:    int(l.limit),
+		InFlight: l.inFlight,
+		Queued:   l.queued,
+		Admitted: l.admitted,
+		Shed:     make(map[string]int64),
+		Timeouts: l.timeouts,
+	}
+	for p, n := range l.shed {
+		s.Shed[priorityNames[p]] = n
+	}
+	return s
+}
+
+// concurrencyMiddleware holds the request until the upstream it is sent to
+// has room for it, and answers 503 when it is shed or waits too long.
+func concurrencyMiddleware(rt *route, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := rt.upstreamFor(r).limiter
+		if l == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		release, err := l.acquire(r.Context(), requestPriority(r))
+		if err != nil {
+			w.Header().Set("Retry-After", "1")
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() { release(sw.status) }()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+func (c *ConcurrencyConfig) maxQueue() int {
+	if c.MaxQueue > 0 {
+		return c.MaxQueue
+	}
+	return c.MaxInFlight
+}
+
+func (c *ConcurrencyConfig) queueTimeout() time.Duration {
+	if c.QueueTimeout.Duration > 0 {
+		return c.QueueTimeout.Duration
+	}
+	return time.Second
+}
+
+func (c *AdaptiveConcurrencyConfig) latencyThreshold() time.Duration {
+	if c.LatencyThreshold.Duration > 0 {
+		return c.LatencyThreshold.Duration
+	}
+	return 500 * time.Millisecond
+}
+
+func (c *AdaptiveConcurrencyConfig) minLimit() int {
+	if c.MinLimit > 0 {
+		return c.MinLimit
+	}
+	return 1
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Middleware is one step of a route's handler chain.
+type Middleware interface {
+	Wrap(next http.Handler) http.Handler
+}
+
+// MiddlewareFunc adapts a function to Middleware.
+type MiddlewareFunc func(next http.Handler) http.Handler
+
+func (f MiddlewareFunc) Wrap(next http.Handler) http.Handler {
+	return f(next)
+}
+
+// MiddlewareFactory creates a middleware for a route from the settings of
+// its entry in the route's chain. It runs on every config load, so bad
+// settings fail the load rather than requests.
+type MiddlewareFactory func(route RouteConfig, config json.RawMessage) (Middleware, error)
+
+var (
+	middlewareMu       sync.RWMutex
+	middlewareRegistry = make(map[string]MiddlewareFactory)
+)
+
+// RegisterMiddleware makes a middleware available to route chains under
+// name. Custom middleware is compiled in by adding a file to the gateway
+// that registers it from init. It panics if the name is taken.
+func RegisterMiddleware(name string, factory MiddlewareFactory) {
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+	if _, ok := builtinMiddleware[name]; ok {
+		panic("gateway: middleware " + name + " is built in")
+	}
+	if _, ok := middlewareRegistry[name]; ok {
+		panic("gateway: middleware " + name + " registered twice")
+	}
+	middlewareRegistry[name] = factory
+}
+
+func registeredMiddleware(name string) (MiddlewareFactory, bool) {
+	middlewareMu.RLock()
+	defer middlewareMu.RUnlock()
+	f, ok := middlewareRegistry[name]
+	return f, ok
+}
+
+// middlewareNames lists the built-in and registered middleware.
+func middlewareNames() []string {
+	middlewareMu.RLock()
+	defer middlewareMu.RUnlock()
+	names := append([]string(nil), defaultChain...)
+	for name := range middlewareRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names[len(defaultChain):])
+	return names
+}
+
+// builtinMiddleware are the gateway's own steps, named after their config
+// keys. Each passes requests straight through on routes that do not
+// configure it.
+var builtinMiddleware = map[string]func(gw *gatewayState, rt *route, next http.Handler) http.Handler{
+	"ip_filters": func(gw *gatewayState, rt *route, h http.Handler) http.Handler {
+		if len(rt.ipFilters) == 0 {
+			return h
+		}
+		return ipFilterMiddleware(rt, rt.ipFilters, gw.trusted, h)
+	},
+	"cors": func(gw *gatewayState, rt *route, h http.Handler) http.Handler {
+		if rt.CORS == nil {
+			return h
+		}
+		return corsMiddleware(rt, h)
+	},
+	"jwt": func(gw *gatewayState, rt *route, h http.Handler) http.Handler {
+		return JWTMiddleware(h.ServeHTTP)
+	},
+	"rate_limit": func(gw *gatewayState, rt *route, h http.Handler) http.Handler {
+		if rt.rateLimiter == nil {
+			return h
+		}
+		return rateLimitMiddleware(rt.rateLimiter, gw.trusted, h)
+	},
+	"quotas": func(gw *gatewayState, rt *route, h http.Handler) http.Handler {
+		return gw.withQuotas(h)
+	},
+	"fault": func(gw *gatewayState, rt *route, h http.Handler) http.Handler {
+		return faultMiddleware(rt.faults, h)
+	},
+	"record": func(gw *gatewayState, rt *route, h http.Handler) http.Handler {
+		if gw.recorder == nil {
+			return h
+		}
+		return recordMiddleware(gw.recorder, rt, h)
+	},
+	"split": func(gw *gatewayState, rt *route, h http.Handler) http.Handler {
+		if rt.split == nil {
+			return h
+		}
+		return splitMiddleware(rt.split, h)
+	},
+	"body": func(gw *gatewayState, rt *route, h http.Handler) http.Handler {
+		if rt.Body == nil {
+			return h
+		}
+		return bodyLimitMiddleware(rt, h)
+	},
+	"waf": func(gw *gatewayState, rt *route, h http.Handler) http.Handler {
+		if rt.WAF == nil {
+			return h
+		}
+		return wafMiddleware(rt, gw.waf, rt.wafRules, h)
+	},
+	"validation": func(gw *gatewayState, rt *route, h http.Handler) http.Handler {
+		if rt.Validation == nil {
+			return h
+		}
+		return validateMiddleware(gw.openapi, rt, h)
+	},
+	"compression": func(gw *gatewayState, rt *route, h http.Handler) http.Handler {
+		if rt.Compression == nil {
+			return h
+		}
+		return compressMiddleware(rt, h)
+	},
+	"idempotency": func(gw *gatewayState, rt *route, h http.Handler) http.Handler {
+		if rt.Idempotency == nil {
+			return h
+		}
+		return idempotencyMiddleware(gw.idempotency, rt, h)
+	},
+	"cache": func(gw *gatewayState, rt *route, h http.Handler) http.Handler {
+		if rt.Cache == nil {
+			return h
+		}
+		return cacheMiddleware(gw.cache, rt, h)
+	},
+	"coalesce": func(gw *gatewayState, rt *route, h http.Handler) http.Handler {
+		if rt.Coalesce == nil {
+			return h
+		}
+		return coalesceMiddleware(rt, h)
+	},
+	"transform": func(gw *gatewayState, rt *route, h http.Handler) http.Handler {
+		if rt.transform == nil {
+			return h
+		}
+		return transformMiddleware(rt.transform, rt.maxBodyBytes(), h)
+	},
+	"mirror": func(gw *gatewayState, rt *route, h http.Handler) http.Handler {
+		if rt.mirror == nil {
+			return h
+		}
+		return mirrorMiddleware(rt.mirror, h)
+	},
+	"mock": func(gw *gatewayState, rt *route, h http.Handler) http.Handler {
+		if rt.mock == nil {
+			return h
+		}
+		return mockHandler(rt.mock, h)
+	},
+	"concurrency": func(gw *gatewayState, rt *route, h http.Handler) http.Handler {
+		return concurrencyMiddleware(rt, h)
+	},
+	"circuit_breaker": func(gw *gatewayState, rt *route, h http.Handler) http.Handler {
+		return breakerMiddleware(rt, h)
+	},
+}
+
+// defaultChain is the order of the built-in steps, outermost first, for
+// routes that do not declare their own chain.
+var defaultChain = []string{
+	"ip_filters", "cors", "jwt", "rate_limit", "quotas", "fault", "record", "split", "body", "waf", "validation",
+	"compression", "idempotency", "cache", "coalesce", "transform", "mirror", "mock", "concurrency", "circuit_breaker",
+}
+
+// endpointChain is the default chain of composites and GraphQL, which only
+// call other routes; endpointSteps are the built-in steps they may use.
+var endpointChain = []string{"ip_filters", "cors", "jwt", "rate_limit", "quotas", "waf"}
+
+var endpointSteps = map[string]bool{
+	"ip_filters": true, "cors": true, "jwt": true, "rate_limit": true, "quotas": true, "waf": true,
+}
+
+// chainStep is one resolved entry of a route's chain.
+type chainStep func(next http.Handler) http.Handler
+
+// buildChain resolves the route's chain, or the default one, outermost
+// first. Custom middleware is created here from its settings.
+func (gw *gatewayState) buildChain(rt *route) ([]chainStep, error) {
+	entries := rt.Middleware
+	if entries == nil {
+		for _, name := range defaultChain {
+			entries = append(entries, MiddlewareConfig{Name: name})
+		}
+	}
+	steps := make([]chainStep, 0, len(entries))
+	for _, e := range entries {
+		if builtin, ok := builtinMiddleware[e.Name]; ok {
+			steps = append(steps, func(next http.Handler) http.Handler { return builtin(gw, rt, next) })
+			continue
+		}
+		if p, ok := gw.plugins[e.Name]; ok {
+			steps = append(steps, func(next http.Handler) http.Handler { return pluginMiddleware(p, rt, next) })
+			continue
+		}
+		factory, ok := registeredMiddleware(e.Name)
+		if !ok {
+			return nil, fmt.Errorf("unknown middleware %q", e.Name)
+		}
+		m, err := factory(rt.RouteConfig, e.Config)
+		if err != nil {
+			return nil, fmt.Errorf("middleware %q: %w", e.Name, err)
+		}
+		steps = append(steps, m.Wrap)
+	}
+	return steps, nil
+}
+
+// validateChain checks that a route's chain only names known middleware and
+// plugins, once each.
+func validateChain(entries []MiddlewareConfig, plugins map[string]PluginConfig) error {
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		if _, ok := builtinMiddleware[e.Name]; !ok {
+			if _, ok := registeredMiddleware(e.Name); !ok && plugins[e.Name].File == "" {
+				return fmt.Errorf("unknown middleware %q", e.Name)
+			}
+		}
+		if seen[e.Name] {
+			return fmt.Errorf("middleware %q is listed twice", e.Name)
+		}
+		seen[e.Name] = true
+	}
+	return nil
+}
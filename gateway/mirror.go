@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// mirrorDiffHistory is how many recent mismatches a route keeps for the
+// admin API.
+const mirrorDiffHistory = 50
+
+type mirrorResult struct {
+	Status     int     `json:"status"`
+	BodySHA256 string  `json:"body_sha256"`
+	LatencyMs  float64 `json:"latency_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+type mirrorDiff struct {
+	Time    time.Time    `json:"time"`
+	Method  string       `json:"method"`
+	Path    string       `json:"path"`
+	Primary mirrorResult `json:"primary"`
+	Shadow  mirrorResult `json:"shadow"`
+}
+
+type mirrorStatus struct {
+	Route          string       `json:"route"`
+	Upstream       string       `json:"upstream"`
+	Percent        int          `json:"percent"`
+	Mirrored       int64        `json:"mirrored"`
+	Matched        int64        `json:"matched"`
+	StatusMismatch int64        `json:"status_mismatch"`
+	BodyMismatch   int64        `json:"body_mismatch"`
+	Errors         int64        `json:"errors"`
+	Dropped        int64        `json:"dropped"`
+	RecentDiffs    []mirrorDiff `json:"recent_diffs"`
+}
+
+// mirror copies a sample of a route's requests to a shadow upstream and
+// compares the shadow's responses with the primary's. Shadow responses never
+// reach the client.
+type mirror struct {
+	cfg     *MirrorConfig
+	pool    *upstreamPool
+	methods map[string]bool
+	slots   chan struct{}
+
+	mirrored       int64
+	matched        int64
+	statusMismatch int64
+	bodyMismatch   int64
+	errors         int64
+	dropped        int64
+
+	mu    sync.Mutex
+	diffs []mirrorDiff
+}
+
+func newMirror(cfg *MirrorConfig, pool *upstreamPool) *mirror {
+	m := &mirror{cfg: cfg, pool: pool, methods: make(map[string]bool), slots: make(chan struct{}, cfg.maxInFlight())}
+	methods := cfg.Methods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodHead}
+	}
+	for _, method := range methods {
+		m.methods[strings.ToUpper(method)] = true
+	}
+	return m
+}
+
+func (m *mirror) status(route string) mirrorStatus {
+	m.mu.Lock()
+	diffs := append([]mirrorDiff{}, m.diffs...)
+	m.mu.Unlock()
+	return mirrorStatus{
+		Route:          route,
+		Upstream:       m.pool.name,
+		Percent:        m.cfg.Percent,
+		Mirrored:       atomic.LoadInt64(&m.mirrored),
+		Matched:        atomic.LoadInt64(&m.matched),
+		StatusMismatch: atomic.LoadInt64(&m.statusMismatch),
+		BodyMismatch:   atomic.LoadInt64(&m.bodyMismatch),
+		Errors:         atomic.LoadInt64(&m.errors),
+		Dropped:        atomic.LoadInt64(&m.dropped),
+		RecentDiffs:    diffs,
+	}
+}
+
+// mirrorMiddleware sends sampled requests to the shadow upstream in the
+// background while the primary serves the client. Once both have answered
+// their status and body hash are compared. When too many shadow requests
+// are in flight, or the body is too large to copy, the request is not
+// mirrored.
+func mirrorMiddleware(m *mirror, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.methods[r.Method] || rand.Intn(100) >= m.cfg.Percent {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var body []byte
+		if r.Body != nil && r.Body != http.NoBody {
+			limit := m.cfg.maxBodyBytes()
+			head, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+			r.Body = readCloser{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+			if err != nil || int64(len(head)) > limit {
+				atomic.AddInt64(&m.dropped, 1)
+				next.ServeHTTP(w, r)
+				return
+			}
+			body = head
+		}
+
+		select {
+		case m.slots <- struct{}{}:
+		default:
+			atomic.AddInt64(&m.dropped, 1)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		primary := make(chan mirrorResult, 1)
+		go func() {
+			defer func() { <-m.slots }()
+			shadow := m.send(r, body)
+			m.compare(r, <-primary, shadow)
+		}()
+
+		// The result is sent even if the primary panics, so the shadow
+		// goroutine and its slot are never left waiting.
+		result := mirrorResult{Error: "primary did not answer"}
+		defer func() { primary <- result }()
+		start := time.Now()
+		tw := &hashingWriter{ResponseWriter: w, hash: sha256.New()}
+		next.ServeHTTP(tw, r)
+		if tw.status == 0 {
+			tw.status = http.StatusOK
+		}
+		result = mirrorResult{
+			Status:     tw.status,
+			BodySHA256: hex.EncodeToString(tw.hash.Sum(nil)),
+			LatencyMs:  float64(time.Since(start)) / float64(time.Millisecond),
+		}
+	})
+}
+
+// send replays the request against the shadow upstream and hashes the
+// response, which is then discarded.
+func (m *mirror) send(r *http.Request, body []byte) mirrorResult {
+	start := time.Now()
+	result := func(err error) mirrorResult {
+		return mirrorResult{Error: err.Error(), LatencyMs: float64(time.Since(start)) / float64(time.Millisecond)}
+	}
+
+	inst, err := m.pool.pick()
+	if err != nil {
+		return result(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), m.cfg.timeout())
+	defer cancel()
+
+	targetURL := inst.URL + r.URL.EscapedPath()
+	if r.URL.RawQuery != "" {
+		targetURL += "?" + r.URL.RawQuery
+	}
+	req, err := http.NewRequestWithContext(ctx, r.Method, targetURL, bytes.NewReader(body))
+	if err != nil {
+		return result(err)
+	}
+	copyHeaders(req.Header, r.Header)
+	req.Header.Set("X-Shadow-Request", "true")
+
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return result(err)
+	}
+	defer resp.Body.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		return result(err)
+	}
+	return mirrorResult{
+		Status:     resp.StatusCode,
+		BodySHA256: hex.EncodeToString(h.Sum(nil)),
+		LatencyMs:  float64(time.Since(start)) / float64(time.Millisecond),
+	}
+}
+
+func (m *mirror) compare(r *http.Request, primary, shadow mirrorResult) {
+	atomic.AddInt64(&m.mirrored, 1)
+	switch {
+	case shadow.Error != "" || primary.Error != "":
+		atomic.AddInt64(&m.errors, 1)
+	case shadow.Status != primary.Status:
+		atomic.AddInt64(&m.statusMismatch, 1)
+	case shadow.BodySHA256 != primary.BodySHA256:
+		atomic.AddInt64(&m.bodyMismatch, 1)
+	default:
+		atomic.AddInt64(&m.matched, 1)
+		return
+	}
+
+	log.Printf("Mirror: %s %s differs on %s: primary %d %s, shadow %d %s", r.Method, r.URL.Path, m.pool.name, primary.Status, primary.Error, shadow.Status, shadow.Error)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.diffs = append(m.diffs, mirrorDiff{Time: time.Now(), Method: r.Method, Path: r.URL.RequestURI(), Primary: primary, Shadow: shadow})
+	if len(m.diffs) > mirrorDiffHistory {
+		m.diffs = m.diffs[len(m.diffs)-mirrorDiffHistory:]
+	}
+}
+
+// hashingWriter passes the response through while hashing its body.
+type hashingWriter struct {
+	http.ResponseWriter
+	status int
+	hash   hash.Hash
+}
+
+func (w *hashingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *hashingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.hash.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (c *MirrorConfig) timeout() time.Duration {
+	if c.Timeout.Duration > 0 {
+		return c.Timeout.Duration
+	}
+	return 10 * time.Second
+}
+
+func (c *MirrorConfig) maxBodyBytes() int64 {
+	if c.MaxBodyBytes > 0 {
+		return c.MaxBodyBytes
+	}
+	return 1 << 20
+}
+
+func (c *MirrorConfig) maxInFlight() int {
+	if c.MaxInFlight > 0 {
+		return c.MaxInFlight
+	}
+	return 100
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var mockParamRe = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+type mockResponse struct {
+	MockResponseConfig
+	path *regexp.Regexp
+	body *template.Template
+}
+
+// mockData is what response templates can use: {{.Params.id}},
+// {{.Query.Get "owner_id"}}, {{.Method}} and {{.Path}}.
+type mockData struct {
+	Params map[string]string
+	Query  url.Values
+	Method string
+	Path   string
+}
+
+type mockUpstream struct {
+	cfg       *MockConfig
+	responses []*mockResponse
+}
+
+// newMockUpstream compiles a route's mock responses. Body files are read
+// once here, relative to the config file's directory.
+func newMockUpstream(cfg *MockConfig, baseDir string) (*mockUpstream, error) {
+	m := &mockUpstream{cfg: cfg}
+	for i, rc := range cfg.Responses {
+		resp := &mockResponse{MockResponseConfig: rc}
+		re, err := pathTemplateRegexp(rc.Path)
+		if err != nil {
+			return nil, fmt.Errorf("mock response %d: invalid path %q", i, rc.Path)
+		}
+		resp.path = re
+
+		body := rc.Body
+		if rc.File != "" {
+			file := rc.File
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(baseDir, file)
+			}
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("mock response %d: %w", i, err)
+			}
+			body = string(data)
+		}
+		if resp.body, err = template.New(rc.Path).Option("missingkey=zero").Parse(body); err != nil {
+			return nil, fmt.Errorf("mock response %d: %w", i, err)
+		}
+		m.responses = append(m.responses, resp)
+	}
+	return m, nil
+}
+
+// pathTemplateRegexp compiles a path template such as /customer/{id} into a
+// regexp with a named group per parameter.
+func pathTemplateRegexp(path string) (*regexp.Regexp, error) {
+	// QuoteMeta escapes the braces of the parameters, so they are put back
+	// before the parameters become named groups.
+	pattern := strings.NewReplacer(`\{`, "{", `\}`, "}").Replace(regexp.QuoteMeta(path))
+	return regexp.Compile("^" + mockParamRe.ReplaceAllString(pattern, `(?P<$1>[^/]+)`) + "/?$")
+}
+
+func (m *mockUpstream) match(r *http.Request) (*mockResponse, map[string]string) {
+	for _, resp := range m.responses {
+		if resp.Method != "" && !strings.EqualFold(resp.Method, r.Method) {
+			continue
+		}
+		match := resp.path.FindStringSubmatch(r.URL.Path)
+		if match == nil {
+			continue
+		}
+		params := make(map[string]string)
+		for i, name := range resp.path.SubexpNames() {
+			if name != "" {
+				params[name] = match[i]
+			}
+		}
+		return resp, params
+	}
+	return nil, nil
+}
+
+// mockHandler answers from the route's canned responses instead of the
+// upstream. Unmatched requests get a 404, or go to the upstream when the
+// mock is set to pass through.
+func mockHandler(m *mockUpstream, upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, params := m.match(r)
+		if resp == nil {
+			if m.cfg.Passthrough {
+				upstream.ServeHTTP(w, r)
+				return
+			}
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "No mock response for " + r.Method + " " + r.URL.Path})
+			return
+		}
+
+		if d := resp.Latency.Duration; d > 0 {
+			select {
+			case <-time.After(d):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if resp.ErrorPercent > 0 && rand.Intn(100) < resp.ErrorPercent {
+			status := resp.ErrorStatus
+			if status == 0 {
+				status = http.StatusInternalServerError
+			}
+			writeJSON(w, status, map[string]string{"error": "Injected mock error"})
+			return
+		}
+
+		var body bytes.Buffer
+		data := mockData{Params: params, Query: r.URL.Query(), Method: r.Method, Path: r.URL.Path}
+		if err := resp.body.Execute(&body, data); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Mock template failed: " + err.Error()})
+			return
+		}
+
+		for name, value := range resp.Headers {
+			w.Header().Set(name, value)
+		}
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.Header().Set("X-Mock", "true")
+		status := resp.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		w.WriteHeader(status)
+		w.Write(body.Bytes())
+	})
+}
+
+// configDir is the directory relative mock files are read from.
+func configDir() string {
+	if configPath == "" {
+		return "."
+	}
+	return filepath.Dir(configPath)
+}
+
+func (c *MockConfig) validate() error {
+	for i, rc := range c.Responses {
+		if !strings.HasPrefix(rc.Path, "/") {
+			return fmt.Errorf("mock response %d needs an absolute path", i)
+		}
+		if rc.Body != "" && rc.File != "" {
+			return fmt.Errorf("mock response %d has both a body and a file", i)
+		}
+		if rc.ErrorPercent < 0 || rc.ErrorPercent > 100 {
+			return fmt.Errorf("mock response %d has error percent %d outside 0-100", i, rc.ErrorPercent)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,732 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// openAPIDocs merges the OpenAPI documents the upstreams publish into one
+// that describes the gateway's public API: only what the route table exposes,
+// under the paths, parameters and field names clients use. The merged
+// document and each route's part of it are reused for the refresh interval.
+type openAPIDocs struct {
+	gw  *gatewayState
+	cfg *OpenAPIConfig
+
+	mu       sync.Mutex
+	doc      []byte
+	builtAt  time.Time
+	complete bool
+
+	specMu sync.Mutex
+	specs  map[string]*routeSpecEntry
+}
+
+// routeSpec is a route's part of the document. It is not modified once
+// built, so the document and request validation can share it.
+type routeSpec struct {
+	paths   map[string]interface{}
+	schemas map[string]interface{}
+	ops     []*specOperation
+}
+
+// specOperation is an operation compiled for matching requests.
+type specOperation struct {
+	method string
+	path   *regexp.Regexp
+	params []map[string]interface{}
+	body   map[string]interface{}
+}
+
+type routeSpecEntry struct {
+	mu        sync.Mutex
+	spec      *routeSpec
+	err       error
+	fetchedAt time.Time
+	// refreshing is closed when the fetch in progress, if any, is done.
+	refreshing chan struct{}
+}
+
+// openAPIRetry is how soon a document missing some routes is rebuilt, so
+// services that start after the gateway show up quickly.
+const openAPIRetry = 5 * time.Second
+
+var openAPIMethods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+func (d *openAPIDocs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	doc, err := d.document()
+	if err != nil {
+		log.Printf("OpenAPI: encoding document: %s", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Error building OpenAPI document"})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(doc)
+}
+
+var openAPIDocsPage = template.Must(template.New("docs").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({url: {{.Path}}, dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`))
+
+// page serves Swagger UI for the merged document.
+func (d *openAPIDocs) page(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := openAPIDocsPage.Execute(w, d.cfg); err != nil {
+		log.Printf("OpenAPI: rendering docs page: %s", err)
+	}
+}
+
+func (d *openAPIDocs) document() ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	maxAge := d.cfg.refresh()
+	if !d.complete && openAPIRetry < maxAge {
+		maxAge = openAPIRetry
+	}
+	if d.doc != nil && time.Since(d.builtAt) < maxAge {
+		return d.doc, nil
+	}
+
+	doc, complete := d.build()
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	d.doc, d.builtAt, d.complete = data, time.Now(), complete
+	return data, nil
+}
+
+// build assembles the document. Routes whose spec cannot be fetched are
+// listed under x-unavailable-routes rather than failing the whole document.
+func (d *openAPIDocs) build() (map[string]interface{}, bool) {
+	cfg := d.gw.config
+	paths := map[string]interface{}{"/login": loginPathItem()}
+	schemas := make(map[string]interface{})
+	var unavailable []interface{}
+
+	complete := true
+	for _, rc := range cfg.Routes {
+		spec, err := d.routeSpec(d.gw.routes[rc.name()], true)
+		if err != nil {
+			complete = false
+		}
+		if spec == nil {
+			unavailable = append(unavailable, map[string]interface{}{"route": rc.name(), "error": err.Error()})
+			continue
+		}
+		// Routes serving the same service on other hosts document the same
+		// paths; the first route's are kept.
+		for path, item := range spec.paths {
+			if _, ok := paths[path]; !ok {
+				paths[path] = item
+			}
+		}
+		for name, schema := range spec.schemas {
+			if have, ok := schemas[name]; ok && !reflect.DeepEqual(have, schema) {
+				log.Printf("OpenAPI: route %s: schema %s differs from another route's, keeping the first", rc.name(), name)
+				continue
+			}
+			schemas[name] = schema
+		}
+	}
+	for _, comp := range cfg.Composites {
+		paths[openAPIPath(comp.Path)] = d.compositePathItem(comp, paths)
+	}
+	if cfg.GraphQL != nil {
+		paths[cfg.GraphQL.Path] = d.graphqlPathItem()
+	}
+
+	doc := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info":    map[string]interface{}{"title": d.cfg.Title, "version": cfg.Version},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+		"security": []interface{}{map[string]interface{}{"bearerAuth": []interface{}{}}},
+	}
+	if len(unavailable) > 0 {
+		doc["x-unavailable-routes"] = unavailable
+	}
+	return doc, complete
+}
+
+// routeSpec returns the route's part of the document and starts fetching
+// the upstream's spec again in the background once it is older than the
+// refresh interval. Callers never wait on a refresh: they get the last spec
+// that could be fetched, and the last error if the latest fetch failed. With
+// wait, a caller that finds no spec yet waits for the first fetch.
+func (d *openAPIDocs) routeSpec(rt *route, wait bool) (*routeSpec, error) {
+	d.specMu.Lock()
+	if d.specs == nil {
+		d.specs = make(map[string]*routeSpecEntry)
+	}
+	e := d.specs[rt.name()]
+	if e == nil {
+		e = &routeSpecEntry{}
+		d.specs[rt.name()] = e
+	}
+	d.specMu.Unlock()
+
+	e.mu.Lock()
+	maxAge := d.cfg.refresh()
+	if e.err != nil && openAPIRetry < maxAge {
+		maxAge = openAPIRetry
+	}
+	if e.refreshing == nil && (e.fetchedAt.IsZero() || time.Since(e.fetchedAt) >= maxAge) {
+		e.refreshing = make(chan struct{})
+		go d.refresh(rt, e)
+	}
+	spec, err, done, first := e.spec, e.err, e.refreshing, e.fetchedAt.IsZero()
+	e.mu.Unlock()
+
+	if wait && first && done != nil {
+		<-done
+		e.mu.Lock()
+		spec, err = e.spec, e.err
+		e.mu.Unlock()
+	}
+	return spec, err
+}
+
+// refresh fetches the route's spec, keeping the previous one if that fails.
+func (d *openAPIDocs) refresh(rt *route, e *routeSpecEntry) {
+	raw, err := d.fetch(rt)
+	var spec *routeSpec
+	if err != nil {
+		log.Printf("OpenAPI: route %s: %s", rt.name(), err)
+	} else {
+		spec = d.newRouteSpec(rt, raw)
+	}
+
+	e.mu.Lock()
+	e.fetchedAt, e.err = time.Now(), err
+	if spec != nil {
+		e.spec = spec
+	}
+	done := e.refreshing
+	e.refreshing = nil
+	e.mu.Unlock()
+	close(done)
+}
+
+// fetch gets a route's spec from its configured source or, by default, from
+// SpecPath on one of its upstream's instances. It does not use the client's
+// context: the result is shared by every caller until the next refresh.
+func (d *openAPIDocs) fetch(rt *route) (map[string]interface{}, error) {
+	url := d.cfg.Sources[rt.name()]
+	if url == "" {
+		if rt.grpc != nil {
+			return nil, fmt.Errorf("gRPC routes need an openapi source")
+		}
+		inst, err := rt.pool.pick()
+		if err != nil {
+			return nil, err
+		}
+		url = inst.URL + d.cfg.SpecPath
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	var spec map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&spec); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", url, err)
+	}
+	return spec, nil
+}
+
+// newRouteSpec turns the operations of a route's upstream spec into what
+// clients see: under the gateway path that is rewritten to the upstream's,
+// limited to the route's methods, with query parameters renamed and, when the
+// route renames or removes body fields, with its schemas inlined and edited
+// to match.
+func (d *openAPIDocs) newRouteSpec(rt *route, spec map[string]interface{}) *routeSpec {
+	specSchemas := jsonObject(jsonObject(spec["components"])["schemas"])
+	var tc *TransformConfig
+	if rt.transform != nil {
+		tc = rt.transform.cfg
+	}
+	inline := tc != nil && (tc.Request.changesBody() || tc.Response.changesBody())
+	out := &routeSpec{paths: make(map[string]interface{})}
+	if !inline {
+		out.schemas = specSchemas
+	}
+
+	for upstreamPath, v := range jsonObject(spec["paths"]) {
+		path := gatewayPath(rt, upstreamPath)
+		if path == "" {
+			continue
+		}
+		item := jsonObject(v)
+		clientItem := make(map[string]interface{})
+		var pathParams interface{}
+		if params, ok := item["parameters"]; ok {
+			pathParams = clientParams(tc, params)
+			clientItem["parameters"] = pathParams
+		}
+		re, err := pathTemplateRegexp(path)
+		for _, method := range openAPIMethods {
+			op := jsonObject(item[method])
+			if op == nil || !routeAllows(rt, method) {
+				continue
+			}
+			if inline {
+				op = jsonObject(resolveRefs(op, specSchemas, 0))
+				editBodySchemas(jsonObject(op["requestBody"]), func(s interface{}) { clientRequestSchema(s, tc.Request) })
+				for _, resp := range jsonObject(op["responses"]) {
+					editBodySchemas(jsonObject(resp), func(s interface{}) { clientResponseSchema(s, tc.Response) })
+				}
+			}
+			if params, ok := op["parameters"]; ok {
+				op["parameters"] = clientParams(tc, params)
+			}
+			op["tags"] = []interface{}{rt.Service}
+			d.addGatewayResponses(op)
+			clientItem[method] = op
+			out.paths[path] = clientItem
+			if err == nil {
+				out.ops = append(out.ops, &specOperation{
+					method: strings.ToUpper(method),
+					path:   re,
+					params: operationParams(pathParams, op["parameters"]),
+					body:   jsonObject(op["requestBody"]),
+				})
+			}
+		}
+	}
+	// Literal paths are tried before templated ones, so /customer/search is
+	// not taken for /customer/{id}.
+	sort.SliceStable(out.ops, func(i, j int) bool {
+		return out.ops[i].path.NumSubexp() < out.ops[j].path.NumSubexp()
+	})
+	return out
+}
+
+// operationParams lists the parameters of an operation, where those of the
+// operation replace the path's with the same name and location.
+func operationParams(pathParams, opParams interface{}) []map[string]interface{} {
+	var out []map[string]interface{}
+	seen := make(map[string]bool)
+	for _, list := range []interface{}{opParams, pathParams} {
+		items, _ := list.([]interface{})
+		for _, p := range items {
+			param := jsonObject(p)
+			if param == nil {
+				continue
+			}
+			key := fmt.Sprint(param["in"], " ", param["name"])
+			if !seen[key] {
+				seen[key] = true
+				out = append(out, param)
+			}
+		}
+	}
+	return out
+}
+
+// addGatewayResponses documents the responses the gateway itself gives to
+// authenticated requests.
+func (d *openAPIDocs) addGatewayResponses(op map[string]interface{}) {
+	responses := jsonObject(op["responses"])
+	if responses == nil {
+		responses = make(map[string]interface{})
+		op["responses"] = responses
+	}
+	if _, ok := responses["401"]; !ok {
+		responses["401"] = map[string]interface{}{"description": "Missing or invalid token"}
+	}
+	if _, ok := responses["429"]; !ok && d.gw.quotas != nil {
+		responses["429"] = map[string]interface{}{"description": "Daily or monthly quota used up"}
+	}
+}
+
+// gatewayPath returns the gateway path that the route rewrites to upstream,
+// or "" when no client path reaches it. Regexp rewrites cannot be inverted in
+// general; a pattern with a literal prefix and a replacement without
+// captures, such as "^/customer" to "/api/customers", is swapped back.
+func gatewayPath(rt *route, upstream string) string {
+	candidates := []string{upstream}
+	if t := rt.transform; t != nil && t.pathRe != nil {
+		prefix, _ := t.pathRe.LiteralPrefix()
+		repl := t.cfg.PathRewrite.Replacement
+		if prefix != "" && !strings.Contains(repl, "$") && strings.HasPrefix(upstream, repl) {
+			candidates = append(candidates, prefix+strings.TrimPrefix(upstream, repl))
+		}
+	}
+	service := "/" + rt.Service
+	for _, c := range candidates {
+		if c != service && !strings.HasPrefix(c, service+"/") {
+			continue
+		}
+		if rt.transform == nil || rt.transform.rewritePath(c) == upstream {
+			return c
+		}
+	}
+	return ""
+}
+
+func routeAllows(rt *route, method string) bool {
+	if len(rt.Methods) == 0 {
+		return true
+	}
+	for _, m := range rt.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientParams shows query parameters under the names clients send. Those
+// the gateway removes or sets itself cannot be sent and are left out.
+func clientParams(tc *TransformConfig, params interface{}) []interface{} {
+	list, _ := params.([]interface{})
+	if tc == nil || !tc.Query.changes() {
+		return list
+	}
+	out := []interface{}{}
+	for _, p := range list {
+		param := jsonObject(p)
+		if param == nil || param["in"] != "query" {
+			out = append(out, p)
+			continue
+		}
+		name, _ := param["name"].(string)
+		if _, ok := tc.Query.Add[name]; ok || containsString(tc.Query.Remove, name) {
+			continue
+		}
+		for from, to := range tc.Query.Rename {
+			if to == name {
+				param["name"] = from
+			}
+		}
+		out = append(out, param)
+	}
+	return out
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// editBodySchemas calls edit on the schema of every JSON media type of a
+// request body or response.
+func editBodySchemas(body map[string]interface{}, edit func(schema interface{})) {
+	for mediaType, v := range jsonObject(body["content"]) {
+		if isJSON(mediaType) {
+			edit(jsonObject(v)["schema"])
+		}
+	}
+}
+
+// clientResponseSchema applies a response transform to a schema the way
+// transformJSON applies it to bodies: removals first, then renames.
+func clientResponseSchema(schema interface{}, m MessageTransformConfig) {
+	for _, field := range m.RemoveFields {
+		editSchemaField(schema, strings.Split(field, "."), removeProperty)
+	}
+	for from, to := range m.RenameFields {
+		editSchemaField(schema, strings.Split(from, "."), func(s map[string]interface{}, key string) {
+			renameProperty(s, key, to)
+		})
+	}
+}
+
+// clientRequestSchema turns the upstream's request schema into the one
+// clients send: the request renames map client fields to upstream ones, so
+// they are undone, and removed fields are ignored by the gateway.
+func clientRequestSchema(schema interface{}, m MessageTransformConfig) {
+	for from, to := range m.RenameFields {
+		path := strings.Split(from, ".")
+		clientName := path[len(path)-1]
+		path[len(path)-1] = to
+		editSchemaField(schema, path, func(s map[string]interface{}, key string) {
+			renameProperty(s, key, clientName)
+		})
+	}
+	for _, field := range m.RemoveFields {
+		editSchemaField(schema, strings.Split(field, "."), removeProperty)
+	}
+}
+
+// editSchemaField finds the object schema holding the last field of path,
+// walking into array items like editField does for documents.
+func editSchemaField(schema interface{}, path []string, edit func(s map[string]interface{}, key string)) {
+	s := jsonObject(schema)
+	if s == nil {
+		return
+	}
+	if items, ok := s["items"]; ok {
+		editSchemaField(items, path, edit)
+		return
+	}
+	props := jsonObject(s["properties"])
+	if props == nil {
+		return
+	}
+	if len(path) == 1 {
+		edit(s, path[0])
+		return
+	}
+	editSchemaField(props[path[0]], path[1:], edit)
+}
+
+func renameProperty(s map[string]interface{}, from, to string) {
+	props := jsonObject(s["properties"])
+	v, ok := props[from]
+	if !ok {
+		return
+	}
+	delete(props, from)
+	props[to] = v
+	if required, ok := s["required"].([]interface{}); ok {
+		for i, name := range required {
+			if name == from {
+				required[i] = to
+			}
+		}
+	}
+}
+
+func removeProperty(s map[string]interface{}, key string) {
+	delete(jsonObject(s["properties"]), key)
+	if required, ok := s["required"].([]interface{}); ok {
+		kept := []interface{}{}
+		for _, name := range required {
+			if name != key {
+				kept = append(kept, name)
+			}
+		}
+		s["required"] = kept
+	}
+}
+
+// resolveRefs returns a copy of v with references to component schemas
+// replaced by the schemas, so each use can be edited on its own. Recursive
+// schemas are cut off after a few levels.
+func resolveRefs(v interface{}, schemas map[string]interface{}, depth int) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if ref, ok := v["$ref"].(string); ok && strings.HasPrefix(ref, "#/components/schemas/") {
+			target, ok := schemas[strings.TrimPrefix(ref, "#/components/schemas/")]
+			if !ok || depth >= 8 {
+				return map[string]interface{}{}
+			}
+			return resolveRefs(target, schemas, depth+1)
+		}
+		out := make(map[string]interface{}, len(v))
+		for k, child := range v {
+			out[k] = resolveRefs(child, schemas, depth)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, child := range v {
+			out[i] = resolveRefs(child, schemas, depth)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+func jsonObject(v interface{}) map[string]interface{} {
+	m, _ := v.(map[string]interface{})
+	return m
+}
+
+var muxVarPattern = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// openAPIPath turns a mux path template into an OpenAPI one by dropping the
+// variables' patterns.
+func openAPIPath(path string) string {
+	return muxVarPattern.ReplaceAllString(path, "{$1}")
+}
+
+func pathParams(path string) []interface{} {
+	params := []interface{}{}
+	for _, m := range muxVarPattern.FindAllStringSubmatch(path, -1) {
+		params = append(params, map[string]interface{}{
+			"name": m[1], "in": "path", "required": true,
+			"schema": map[string]interface{}{"type": "string"},
+		})
+	}
+	return params
+}
+
+func jsonBody(description string, schema interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"description": description,
+		"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}},
+	}
+}
+
+func loginPathItem() map[string]interface{} {
+	str := map[string]interface{}{"type": "string"}
+	return map[string]interface{}{
+		"post": map[string]interface{}{
+			"operationId": "login",
+			"summary":     "Get a token for the other operations",
+			"tags":        []interface{}{"auth"},
+			"security":    []interface{}{},
+			"requestBody": map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{"application/json": map[string]interface{}{"schema": map[string]interface{}{
+					"type":       "object",
+					"required":   []interface{}{"username", "password"},
+					"properties": map[string]interface{}{"username": str, "password": str},
+				}}},
+			},
+			"responses": map[string]interface{}{
+				"200": jsonBody("A JWT valid for five minutes", map[string]interface{}{
+					"type":       "object",
+					"properties": map[string]interface{}{"token": str},
+				}),
+				"400": map[string]interface{}{"description": "Malformed body"},
+				"401": map[string]interface{}{"description": "Wrong username or password"},
+			},
+		},
+	}
+}
+
+// compositePathItem describes a composite route. Each section has the schema
+// of the GET response of its gateway path, where the document has one.
+func (d *openAPIDocs) compositePathItem(comp CompositeConfig, paths map[string]interface{}) map[string]interface{} {
+	sectionError := map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"status": map[string]interface{}{"type": "integer"},
+			"error":  map[string]interface{}{"type": "string"},
+		},
+	}
+	props := map[string]interface{}{
+		"errors": map[string]interface{}{
+			"type":                 "object",
+			"description":          "Optional sections that failed, by name",
+			"additionalProperties": sectionError,
+		},
+	}
+	var names []string
+	for _, s := range comp.Sections {
+		names = append(names, s.Name)
+		path := strings.SplitN(s.Path, "?", 2)[0]
+		get := jsonObject(jsonObject(paths[path])["get"])
+		ok := jsonObject(jsonObject(get["responses"])["200"])
+		schema := jsonObject(jsonObject(ok["content"])["application/json"])["schema"]
+		if schema == nil {
+			schema = map[string]interface{}{}
+		}
+		props[s.Name] = schema
+	}
+
+	op := map[string]interface{}{
+		"summary":    "Combined " + strings.Join(names, ", "),
+		"tags":       []interface{}{"composite"},
+		"parameters": pathParams(comp.Path),
+		"responses": map[string]interface{}{
+			"200": jsonBody("Every section's response; failed optional sections are null", map[string]interface{}{
+				"type":       "object",
+				"properties": props,
+			}),
+			"502": map[string]interface{}{"description": "A required section failed"},
+		},
+	}
+	d.addGatewayResponses(op)
+	return map[string]interface{}{"get": op}
+}
+
+func (d *openAPIDocs) graphqlPathItem() map[string]interface{} {
+	str := map[string]interface{}{"type": "string"}
+	result := jsonBody("The query result", map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"data":   map[string]interface{}{"type": "object"},
+			"errors": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "object"}},
+		},
+	})
+	param := func(name, description string, required bool) map[string]interface{} {
+		return map[string]interface{}{"name": name, "in": "query", "description": description, "required": required, "schema": str}
+	}
+
+	get := map[string]interface{}{
+		"summary": "Run a GraphQL query",
+		"tags":    []interface{}{"graphql"},
+		"parameters": []interface{}{
+			param("query", "The query document", true),
+			param("operationName", "The operation to run", false),
+			param("variables", "Variables as a JSON object", false),
+		},
+		"responses": map[string]interface{}{
+			"200": result,
+			"400": map[string]interface{}{"description": "Invalid, too deep or too complex query"},
+		},
+	}
+	post := map[string]interface{}{
+		"summary": "Run a GraphQL query",
+		"tags":    []interface{}{"graphql"},
+		"requestBody": jsonBody("The query", map[string]interface{}{
+			"type":     "object",
+			"required": []interface{}{"query"},
+			"properties": map[string]interface{}{
+				"query":         str,
+				"operationName": str,
+				"variables":     map[string]interface{}{"type": "object"},
+			},
+		}),
+		"responses": map[string]interface{}{
+			"200": result,
+			"400": map[string]interface{}{"description": "Invalid, too deep or too complex query"},
+		},
+	}
+	d.addGatewayResponses(get)
+	d.addGatewayResponses(post)
+	return map[string]interface{}{"get": get, "post": post}
+}
+
+func (c *OpenAPIConfig) refresh() time.Duration {
+	if c.Refresh.Duration > 0 {
+		return c.Refresh.Duration
+	}
+	return time.Minute
+}
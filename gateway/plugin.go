@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// luaPlugin is a Lua script that can inspect and change a route's requests
+// and responses. Scripts are loaded with the config, so they are deployed and
+// updated without rebuilding the gateway. They run sandboxed: only the base,
+// string, table and math libraries and the gateway host API are available,
+// and every call is bounded by a timeout, a memory budget (see pluginmem.go)
+// and a limit on the Lua stack.
+//
+// A script defines either or both of
+//
+//	function on_request(req)        -- return a response table to answer directly
+//	function on_response(req, resp) -- change resp in place
+//
+// req has method, path, query, headers, body (nil when larger than
+// max_body_bytes), user and route; resp has status, headers and body.
+// Header names are canonical, e.g. "Content-Type". The host API is the
+// "gateway" table: log, json_encode and json_decode. The plugin's settings are
+// the global "config".
+type luaPlugin struct {
+	name  string
+	cfg   *PluginConfig
+	proto *lua.FunctionProto
+
+	hasRequest  bool
+	hasResponse bool
+	// states holds idle interpreters as *pluginState. An LState is not safe
+	// for concurrent use, so each call takes its own.
+	states sync.Pool
+
+	calls    int64
+	failures int64
+}
+
+// pluginState is an interpreter with the script loaded, and the state the
+// script left it in, which each call's changes are undone to.
+type pluginState struct {
+	L     *lua.LState
+	clean *luaSnapshot
+}
+
+type pluginStatus struct {
+	Name     string `json:"name"`
+	File     string `json:"file"`
+	Calls    int64  `json:"calls"`
+	Failures int64  `json:"failures"`
+}
+
+// newLuaPlugin compiles the script and runs it once, so syntax errors, errors
+// at load time and scripts without hooks fail the config load.
+func newLuaPlugin(name string, cfg *PluginConfig, baseDir string) (*luaPlugin, error) {
+	file := cfg.File
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(baseDir, file)
+	}
+	src, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := parse.Parse(bytes.NewReader(src), cfg.File)
+	if err != nil {
+		return nil, err
+	}
+	meterChunk(chunk)
+	p := &luaPlugin{name: name, cfg: cfg}
+	if p.proto, err = lua.Compile(chunk, cfg.File); err != nil {
+		return nil, err
+	}
+
+	st, err := p.newState()
+	if err != nil {
+		return nil, err
+	}
+	p.hasRequest = st.L.GetGlobal("on_request").Type() == lua.LTFunction
+	p.hasResponse = st.L.GetGlobal("on_response").Type() == lua.LTFunction
+	if !p.hasRequest && !p.hasResponse {
+		st.L.Close()
+		return nil, fmt.Errorf("%s defines neither on_request nor on_response", cfg.File)
+	}
+	p.states.Put(st)
+	return p, nil
+}
+
+// newState creates a sandboxed interpreter with the script loaded.
+func (p *luaPlugin) newState() (*pluginState, error) {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:    true,
+		CallStackSize:   200,
+		RegistrySize:    1024,
+		RegistryMaxSize: p.cfg.maxStackSlots(),
+	})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	meterLibs(L)
+	// Nothing may reach the file system or load other code.
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "collectgarbage"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	host := L.NewTable()
+	host.RawSetString("log", L.NewFunction(func(L *lua.LState) int {
+		parts := make([]string, L.GetTop())
+		for i := range parts {
+			parts[i] = L.ToStringMeta(L.Get(i + 1)).String()
+		}
+		log.Printf("Plugin: %s: %s", p.name, strings.Join(parts, " "))
+		return 0
+	}))
+	host.RawSetString("json_encode", L.NewFunction(func(L *lua.LState) int {
+		data, err := json.Marshal(luaToGo(L.Get(1), 0))
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		budgetOf(L).charge(L, int64(len(data)))
+		L.Push(lua.LString(data))
+		return 1
+	}))
+	host.RawSetString("json_decode", L.NewFunction(func(L *lua.LState) int {
+		var v interface{}
+		if err := json.Unmarshal([]byte(L.CheckString(1)), &v); err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		budgetOf(L).charge(L, jsonSize(v))
+		L.Push(goToLua(L, v))
+		return 1
+	}))
+	L.SetGlobal("gateway", host)
+	L.SetGlobal("print", host.RawGetString("log"))
+
+	var settings interface{}
+	if len(p.cfg.Config) > 0 {
+		if err := json.Unmarshal(p.cfg.Config, &settings); err != nil {
+			L.Close()
+			return nil, fmt.Errorf("config: %w", err)
+		}
+	}
+	L.SetGlobal("config", goToLua(L, settings))
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.cfg.timeout())
+	defer cancel()
+	L.SetContext(withLuaBudget(ctx, p.cfg.maxMemoryBytes()))
+	defer L.RemoveContext()
+	L.Push(L.NewFunctionFromProto(p.proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		L.Close()
+		return nil, err
+	}
+	return &pluginState{L: L, clean: snapshotLua(L)}, nil
+}
+
+func (p *luaPlugin) state() (*pluginState, error) {
+	if st, ok := p.states.Get().(*pluginState); ok {
+		return st, nil
+	}
+	return p.newState()
+}
+
+// release undoes what the call changed, so no request sees another's
+// globals or upvalues, and returns the interpreter to the pool.
+func (p *luaPlugin) release(st *pluginState) {
+	st.clean.restore()
+	p.states.Put(st)
+}
+
+// call runs a hook with the timeout and a fresh memory budget. An
+// interpreter that failed may be left in any state, so it is closed;
+// otherwise the caller releases it once done with the tables it passed and
+// got back.
+func (p *luaPlugin) call(st *pluginState, hook string, args ...lua.LValue) (lua.LValue, error) {
+	L := st.L
+	atomic.AddInt64(&p.calls, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), p.cfg.timeout())
+	defer cancel()
+	L.SetContext(withLuaBudget(ctx, p.cfg.maxMemoryBytes()))
+	defer L.RemoveContext()
+	if err := L.CallByParam(lua.P{Fn: L.GetGlobal(hook), NRet: 1, Protect: true}, args...); err != nil {
+		atomic.AddInt64(&p.failures, 1)
+		L.Close()
+		return nil, err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	return ret, nil
+}
+
+func (p *luaPlugin) status() pluginStatus {
+	return pluginStatus{
+		Name:     p.name,
+		File:     p.cfg.File,
+		Calls:    atomic.LoadInt64(&p.calls),
+		Failures: atomic.LoadInt64(&p.failures),
+	}
+}
+
+// pluginMiddleware runs the plugin's hooks around the rest of the chain. A
+// failing script answers 500, or with fail_open lets the request or
+// response through unchanged.
+func pluginMiddleware(p *luaPlugin, rt *route, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := peekBody(r, p.cfg.maxBodyBytes())
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Error reading request body"})
+			return
+		}
+
+		if p.hasRequest {
+			st, err := p.state()
+			var ret lua.LValue
+			var req *lua.LTable
+			if err == nil {
+				req = requestTable(st.L, r, rt, body)
+				ret, err = p.call(st, "on_request", req)
+			}
+			if err != nil {
+				log.Printf("Plugin: %s: on_request: %s", p.name, err)
+				if !p.cfg.FailOpen {
+					writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Plugin failed"})
+					return
+				}
+			} else {
+				t, answered := ret.(*lua.LTable)
+				if answered {
+					writeLuaResponse(w, t, nil)
+				} else {
+					r, body = applyRequestTable(r, req, body)
+				}
+				p.release(st)
+				if answered {
+					return
+				}
+			}
+		}
+		if !p.hasResponse {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		capture := newResponseCapture()
+		next.ServeHTTP(capture, r)
+		respBody := capture.body.Bytes()
+		st, err := p.state()
+		var resp *lua.LTable
+		if err == nil {
+			resp = st.L.NewTable()
+			resp.RawSetString("status", lua.LNumber(capture.status))
+			resp.RawSetString("headers", headerTable(st.L, capture.header))
+			if int64(len(respBody)) <= p.cfg.maxBodyBytes() && capture.header.Get("Content-Encoding") == "" {
+				resp.RawSetString("body", lua.LString(respBody))
+			}
+			_, err = p.call(st, "on_response", requestTable(st.L, r, rt, body), resp)
+		}
+		if err != nil {
+			log.Printf("Plugin: %s: on_response: %s", p.name, err)
+			if !p.cfg.FailOpen {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Plugin failed"})
+				return
+			}
+			copyHeaders(w.Header(), capture.header)
+			w.WriteHeader(capture.status)
+			w.Write(respBody)
+			return
+		}
+		writeLuaResponse(w, resp, capture)
+		p.release(st)
+	})
+}
+
+// peekBody returns the request body when it is at most max bytes and
+// leaves r.Body readable either way; larger bodies yield nil.
+func peekBody(r *http.Request, max int64) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	head, err := io.ReadAll(io.LimitReader(r.Body, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(head)) > max {
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+		return nil, nil
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(head))
+	return head, nil
+}
+
+func requestTable(L *lua.LState, r *http.Request, rt *route, body []byte) *lua.LTable {
+	req := L.NewTable()
+	req.RawSetString("method", lua.LString(r.Method))
+	req.RawSetString("path", lua.LString(r.URL.Path))
+	req.RawSetString("route", lua.LString(rt.name()))
+	query := L.NewTable()
+	for name, values := range r.URL.Query() {
+		query.RawSetString(name, lua.LString(values[0]))
+	}
+	req.RawSetString("query", query)
+	req.RawSetString("headers", headerTable(L, r.Header))
+	if body != nil {
+		req.RawSetString("body", lua.LString(body))
+	}
+	if claims := claimsFromRequest(r); claims != nil {
+		req.RawSetString("user", lua.LString(claims.Username))
+	}
+	return req
+}
+
+func headerTable(L *lua.LState, h http.Header) *lua.LTable {
+	t := L.NewTable()
+	for name, values := range h {
+		t.RawSetString(name, lua.LString(values[0]))
+	}
+	return t
+}
+
+// applyHeaderTable makes h match the table the script changed. Headers whose
+// first value is unchanged keep all their values.
+func applyHeaderTable(h http.Header, t *lua.LTable) {
+	kept := make(map[string]bool)
+	t.ForEach(func(k, v lua.LValue) {
+		name := http.CanonicalHeaderKey(k.String())
+		kept[name] = true
+		if value := v.String(); h.Get(name) != value {
+			h.Set(name, value)
+		}
+	})
+	for name := range h {
+		if !kept[name] {
+			h.Del(name)
+		}
+	}
+}
+
+// applyRequestTable carries the script's changes to the path, query,
+// headers and body over to a copy of the request.
+func applyRequestTable(r *http.Request, req *lua.LTable, body []byte) (*http.Request, []byte) {
+	r = r.Clone(r.Context())
+	if path := req.RawGetString("path").String(); path != r.URL.Path {
+		r.URL.Path = path
+		r.URL.RawPath = ""
+	}
+	if query, ok := req.RawGetString("query").(*lua.LTable); ok {
+		q := r.URL.Query()
+		changed := url.Values{}
+		query.ForEach(func(k, v lua.LValue) {
+			name := k.String()
+			if values := q[name]; len(values) > 0 && values[0] == v.String() {
+				changed[name] = values
+			} else {
+				changed.Set(name, v.String())
+			}
+		})
+		if changed.Encode() != q.Encode() {
+			r.URL.RawQuery = changed.Encode()
+		}
+	}
+	if headers, ok := req.RawGetString("headers").(*lua.LTable); ok {
+		applyHeaderTable(r.Header, headers)
+	}
+	if s, ok := req.RawGetString("body").(lua.LString); ok && body != nil && string(s) != string(body) {
+		body = []byte(s)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.Header.Del("Content-Length")
+	}
+	return r, body
+}
+
+// writeLuaResponse writes a response table, either one the script built or
+// the captured upstream response it may have changed.
+func writeLuaResponse(w http.ResponseWriter, t *lua.LTable, capture *responseCapture) {
+	status := http.StatusOK
+	header := http.Header{}
+	var body []byte
+	if capture != nil {
+		status, header, body = capture.status, capture.header, capture.body.Bytes()
+	}
+	if n, ok := t.RawGetString("status").(lua.LNumber); ok {
+		status = int(n)
+	}
+	if h, ok := t.RawGetString("headers").(*lua.LTable); ok {
+		applyHeaderTable(header, h)
+	}
+	if s, ok := t.RawGetString("body").(lua.LString); ok && string(s) != string(body) {
+		body = []byte(s)
+		header.Del("Content-Length")
+	}
+	copyHeaders(w.Header(), header)
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// goToLua converts decoded JSON to Lua values; arrays become tables indexed
+// from 1.
+func goToLua(L *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		t := L.CreateTable(len(v), 0)
+		for _, elem := range v {
+			t.Append(goToLua(L, elem))
+		}
+		return t
+	case map[string]interface{}:
+		t := L.CreateTable(0, len(v))
+		for key, elem := range v {
+			t.RawSetString(key, goToLua(L, elem))
+		}
+		return t
+	}
+	return lua.LNil
+}
+
+// luaToGo converts Lua values for JSON encoding. Tables with keys 1..n only
+// are arrays, other tables objects; functions and deep nesting become null.
+func luaToGo(v lua.LValue, depth int) interface{} {
+	switch v := v.(type) {
+	case lua.LBool:
+		return bool(v)
+	case lua.LNumber:
+		return float64(v)
+	case lua.LString:
+		return string(v)
+	case *lua.LTable:
+		if depth > 32 {
+			return nil
+		}
+		if n := v.MaxN(); n > 0 && n == v.Len() {
+			arr := make([]interface{}, 0, n)
+			for i := 1; i <= n; i++ {
+				arr = append(arr, luaToGo(v.RawGetInt(i), depth+1))
+			}
+			return arr
+		}
+		obj := make(map[string]interface{})
+		v.ForEach(func(k, elem lua.LValue) {
+			obj[k.String()] = luaToGo(elem, depth+1)
+		})
+		return obj
+	}
+	return nil
+}
+
+func (c *PluginConfig) timeout() time.Duration {
+	if c.Timeout.Duration > 0 {
+		return c.Timeout.Duration
+	}
+	return 100 * time.Millisecond
+}
+
+func (c *PluginConfig) maxStackSlots() int {
+	if c.MaxStackSlots > 0 {
+		return c.MaxStackSlots
+	}
+	return 65536
+}
+
+func (c *PluginConfig) maxMemoryBytes() int64 {
+	if c.MaxMemoryBytes > 0 {
+		return c.MaxMemoryBytes
+	}
+	return 16 << 20
+}
+
+func (c *PluginConfig) maxBodyBytes() int64 {
+	if c.MaxBodyBytes > 0 {
+		return c.MaxBodyBytes
+	}
+	return 64 << 10
+}
+
+// pluginStatuses reports every plugin, sorted by name.
+func (gw *gatewayState) pluginStatuses() []pluginStatus {
+	out := []pluginStatus{}
+	for _, p := range gw.plugins {
+		out = append(out, p.status())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// luaSnapshot is what a script left after loading: the contents of every
+// table, and the environment and upvalues of every function, reachable from
+// the globals and the string metatable.
+type luaSnapshot struct {
+	tables []tableSnapshot
+	funcs  []funcSnapshot
+}
+
+type tableSnapshot struct {
+	t            *lua.LTable
+	meta         lua.LValue
+	keys, values []lua.LValue
+}
+
+type funcSnapshot struct {
+	fn       *lua.LFunction
+	env      *lua.LTable
+	upvalues []lua.LValue
+}
+
+func snapshotLua(L *lua.LState) *luaSnapshot {
+	s := &luaSnapshot{}
+	seen := make(map[lua.LValue]bool)
+	var visit func(v lua.LValue)
+	visit = func(v lua.LValue) {
+		switch v := v.(type) {
+		case *lua.LTable:
+			if seen[v] {
+				return
+			}
+			seen[v] = true
+			ts := tableSnapshot{t: v, meta: v.Metatable}
+			v.ForEach(func(key, value lua.LValue) {
+				ts.keys = append(ts.keys, key)
+				ts.values = append(ts.values, value)
+			})
+			s.tables = append(s.tables, ts)
+			for i := range ts.keys {
+				visit(ts.keys[i])
+				visit(ts.values[i])
+			}
+			visit(v.Metatable)
+		case *lua.LFunction:
+			if seen[v] {
+				return
+			}
+			seen[v] = true
+			fs := funcSnapshot{fn: v, env: v.Env}
+			for _, uv := range v.Upvalues {
+				fs.upvalues = append(fs.upvalues, uv.Value())
+			}
+			s.funcs = append(s.funcs, fs)
+			visit(v.Env)
+			for _, value := range fs.upvalues {
+				visit(value)
+			}
+		}
+	}
+	visit(L.Get(lua.GlobalsIndex))
+	visit(L.GetMetatable(lua.LString("")))
+	return s
+}
+
+// restore puts every table and function back the way it was. Tables and
+// values the call created are dropped with the references to them.
+func (s *luaSnapshot) restore() {
+	for _, ts := range s.tables {
+		var keys []lua.LValue
+		ts.t.ForEach(func(key, _ lua.LValue) { keys = append(keys, key) })
+		for _, key := range keys {
+			ts.t.RawSet(key, lua.LNil)
+		}
+		for i, key := range ts.keys {
+			ts.t.RawSet(key, ts.values[i])
+		}
+		ts.t.Metatable = ts.meta
+	}
+	for _, fs := range s.funcs {
+		fs.fn.Env = fs.env
+		for i, uv := range fs.fn.Upvalues {
+			uv.SetValue(fs.upvalues[i])
+		}
+	}
+}
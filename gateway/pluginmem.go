@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/ast"
+)
+
+// Lua has no allocator hook in gopher-lua, so plugin memory is metered where
+// it is allocated: the ".." operator and assignments to table fields are
+// compiled into calls of the functions below, and the library functions that
+// build strings or add entries are wrapped. Each call into a script gets a
+// budget of max_memory_bytes; strings count their length and new table
+// entries luaEntryBytes. Sizes known in advance, like string.rep's, are
+// checked before anything is allocated.
+
+// luaEntryBytes is what a new table entry counts against the budget.
+const luaEntryBytes = 40
+
+// The metering functions are globals whose names scripts cannot write as
+// identifiers, so they cannot be shadowed by locals.
+const (
+	luaConcatFunc = "(concat)"
+	luaSetFunc    = "(set)"
+)
+
+type luaBudgetKey struct{}
+
+// luaBudget is the memory one call may still allocate. A state runs one
+// call at a time, so it needs no locking.
+type luaBudget struct {
+	left int64
+}
+
+func withLuaBudget(ctx context.Context, bytes int64) context.Context {
+	return context.WithValue(ctx, luaBudgetKey{}, &luaBudget{left: bytes})
+}
+
+func budgetOf(L *lua.LState) *luaBudget {
+	ctx := L.Context()
+	if ctx == nil {
+		return nil
+	}
+	b, _ := ctx.Value(luaBudgetKey{}).(*luaBudget)
+	return b
+}
+
+// check stops the script when n more bytes would go over the budget.
+func (b *luaBudget) check(L *lua.LState, n int64) {
+	if b != nil && (n < 0 || n > b.left) {
+		L.RaiseError("memory limit exceeded")
+	}
+}
+
+func (b *luaBudget) charge(L *lua.LState, n int64) {
+	b.check(L, n)
+	if b != nil {
+		b.left -= n
+	}
+}
+
+// meterChunk rewrites a parsed script so that concatenations and field
+// assignments go through the metering functions.
+func meterChunk(stmts []ast.Stmt) {
+	for i, s := range stmts {
+		stmts[i] = meterStmt(s)
+	}
+}
+
+func meterStmt(s ast.Stmt) ast.Stmt {
+	switch s := s.(type) {
+	case *ast.AssignStmt:
+		meterExprs(s.Lhs)
+		meterExprs(s.Rhs)
+		return meterAssign(s)
+	case *ast.LocalAssignStmt:
+		meterExprs(s.Exprs)
+	case *ast.FuncCallStmt:
+		s.Expr = meterExpr(s.Expr)
+	case *ast.DoBlockStmt:
+		meterChunk(s.Stmts)
+	case *ast.WhileStmt:
+		s.Condition = meterExpr(s.Condition)
+		meterChunk(s.Stmts)
+	case *ast.RepeatStmt:
+		s.Condition = meterExpr(s.Condition)
+		meterChunk(s.Stmts)
+	case *ast.IfStmt:
+		s.Condition = meterExpr(s.Condition)
+		meterChunk(s.Then)
+		meterChunk(s.Else)
+	case *ast.NumberForStmt:
+		s.Init = meterExpr(s.Init)
+		s.Limit = meterExpr(s.Limit)
+		s.Step = meterExpr(s.Step)
+		meterChunk(s.Stmts)
+	case *ast.GenericForStmt:
+		meterExprs(s.Exprs)
+		meterChunk(s.Stmts)
+	case *ast.FuncDefStmt:
+		meterChunk(s.Func.Stmts)
+	case *ast.ReturnStmt:
+		meterExprs(s.Exprs)
+	}
+	return s
+}
+
+func meterExprs(exprs []ast.Expr) {
+	for i, e := range exprs {
+		exprs[i] = meterExpr(e)
+	}
+}
+
+func meterExpr(e ast.Expr) ast.Expr {
+	switch e := e.(type) {
+	case *ast.StringConcatOpExpr:
+		return luaCall(e, luaConcatFunc, meterExpr(e.Lhs), meterExpr(e.Rhs))
+	case *ast.AttrGetExpr:
+		e.Object = meterExpr(e.Object)
+		e.Key = meterExpr(e.Key)
+	case *ast.TableExpr:
+		for _, f := range e.Fields {
+			f.Key = meterExpr(f.Key)
+			f.Value = meterExpr(f.Value)
+		}
+	case *ast.FuncCallExpr:
+		e.Func = meterExpr(e.Func)
+		e.Receiver = meterExpr(e.Receiver)
+		meterExprs(e.Args)
+	case *ast.LogicalOpExpr:
+		e.Lhs, e.Rhs = meterExpr(e.Lhs), meterExpr(e.Rhs)
+	case *ast.RelationalOpExpr:
+		e.Lhs, e.Rhs = meterExpr(e.Lhs), meterExpr(e.Rhs)
+	case *ast.ArithmeticOpExpr:
+		e.Lhs, e.Rhs = meterExpr(e.Lhs), meterExpr(e.Rhs)
+	case *ast.UnaryMinusOpExpr:
+		e.Expr = meterExpr(e.Expr)
+	case *ast.UnaryNotOpExpr:
+		e.Expr = meterExpr(e.Expr)
+	case *ast.UnaryLenOpExpr:
+		e.Expr = meterExpr(e.Expr)
+	case *ast.FunctionExpr:
+		meterChunk(e.Stmts)
+	}
+	return e
+}
+
+// meterAssign turns assignments to table fields into calls of (set). With
+// several targets the values are evaluated first, as Lua does:
+//
+//	t[k], x = v, w
+//
+// becomes
+//
+//	do
+//	  local (o1), (k1) = t, k
+//	  local (v1), (v2) = v, w
+//	  (set)((o1), (k1), (v1))
+//	  x = (v2)
+//	end
+func meterAssign(s *ast.AssignStmt) ast.Stmt {
+	fields := false
+	for _, lhs := range s.Lhs {
+		if _, ok := lhs.(*ast.AttrGetExpr); ok {
+			fields = true
+		}
+	}
+	if !fields {
+		return s
+	}
+	if len(s.Lhs) == 1 && len(s.Rhs) == 1 {
+		a := s.Lhs[0].(*ast.AttrGetExpr)
+		return luaCallStmt(s, luaSetFunc, a.Object, a.Key, s.Rhs[0])
+	}
+
+	targets := &ast.LocalAssignStmt{}
+	values := &ast.LocalAssignStmt{Exprs: s.Rhs}
+	var assigns []ast.Stmt
+	for i, lhs := range s.Lhs {
+		value := fmt.Sprintf("(v%d)", i)
+		values.Names = append(values.Names, value)
+		if a, ok := lhs.(*ast.AttrGetExpr); ok {
+			obj, key := fmt.Sprintf("(o%d)", i), fmt.Sprintf("(k%d)", i)
+			targets.Names = append(targets.Names, obj, key)
+			targets.Exprs = append(targets.Exprs, a.Object, a.Key)
+			assigns = append(assigns, luaCallStmt(s, luaSetFunc, luaIdent(s, obj), luaIdent(s, key), luaIdent(s, value)))
+		} else {
+			assign := &ast.AssignStmt{Lhs: []ast.Expr{lhs}, Rhs: []ast.Expr{luaIdent(s, value)}}
+			assign.SetLine(s.Line())
+			assigns = append(assigns, assign)
+		}
+	}
+	targets.SetLine(s.Line())
+	values.SetLine(s.Line())
+	block := &ast.DoBlockStmt{Stmts: append([]ast.Stmt{targets, values}, assigns...)}
+	block.SetLine(s.Line())
+	block.SetLastLine(s.LastLine())
+	return block
+}
+
+func luaIdent(pos ast.PositionHolder, name string) ast.Expr {
+	e := &ast.IdentExpr{Value: name}
+	e.SetLine(pos.Line())
+	e.SetLastLine(pos.LastLine())
+	return e
+}
+
+// luaCall calls a metering function with one result, like (f(...)).
+func luaCall(pos ast.PositionHolder, name string, args ...ast.Expr) *ast.FuncCallExpr {
+	e := &ast.FuncCallExpr{Func: luaIdent(pos, name), Args: args, AdjustRet: true}
+	e.SetLine(pos.Line())
+	e.SetLastLine(pos.LastLine())
+	return e
+}
+
+func luaCallStmt(pos ast.PositionHolder, name string, args ...ast.Expr) ast.Stmt {
+	s := &ast.FuncCallStmt{Expr: luaCall(pos, name, args...)}
+	s.SetLine(pos.Line())
+	s.SetLastLine(pos.LastLine())
+	return s
+}
+
+// luaConcat is the ".." operator.
+func luaConcat(L *lua.LState) int {
+	a, b := L.Get(1), L.Get(2)
+	if lua.LVCanConvToString(a) && lua.LVCanConvToString(b) {
+		sa, sb := lua.LVAsString(a), lua.LVAsString(b)
+		budgetOf(L).charge(L, int64(len(sa))+int64(len(sb)))
+		L.Push(lua.LString(sa + sb))
+		return 1
+	}
+	op := L.GetMetaField(a, "__concat")
+	if op == lua.LNil {
+		op = L.GetMetaField(b, "__concat")
+	}
+	if op.Type() != lua.LTFunction {
+		L.RaiseError("cannot perform concat operation between %s and %s", a.Type(), b.Type())
+	}
+	L.Push(op)
+	L.Push(a)
+	L.Push(b)
+	L.Call(2, 1)
+	return 1
+}
+
+// luaSet is an assignment to a table field.
+func luaSet(L *lua.LState) int {
+	obj, key, value := L.Get(1), L.Get(2), L.Get(3)
+	if t, ok := obj.(*lua.LTable); ok && value != lua.LNil && t.RawGet(key) == lua.LNil {
+		budgetOf(L).charge(L, luaEntryBytes)
+	}
+	L.SetTable(obj, key, value)
+	return 0
+}
+
+// meterLibs installs the metering functions and wraps the library functions
+// that allocate.
+func meterLibs(L *lua.LState) {
+	L.SetGlobal(luaConcatFunc, L.NewFunction(luaConcat))
+	L.SetGlobal(luaSetFunc, L.NewFunction(luaSet))
+
+	str := L.GetGlobal("string").(*lua.LTable)
+	for name, check := range map[string]func(L *lua.LState){
+		"char": nil, "lower": nil, "reverse": nil, "sub": nil, "upper": nil,
+		"format": checkLuaFormat,
+		"gsub":   checkLuaGsub,
+		"rep":    checkLuaRep,
+	} {
+		meterLibFunc(L, str, name, check)
+	}
+	tbl := L.GetGlobal("table").(*lua.LTable)
+	meterLibFunc(L, tbl, "concat", checkLuaTableConcat)
+	meterLibFunc(L, tbl, "insert", func(L *lua.LState) {
+		budgetOf(L).charge(L, luaEntryBytes)
+	})
+	L.SetGlobal("rawset", L.NewFunction(func(L *lua.LState) int {
+		t := L.CheckTable(1)
+		key, value := L.CheckAny(2), L.CheckAny(3)
+		if value != lua.LNil && t.RawGet(key) == lua.LNil {
+			budgetOf(L).charge(L, luaEntryBytes)
+		}
+		t.RawSet(key, value)
+		L.SetTop(1)
+		return 1
+	}))
+}
+
+// meterLibFunc replaces a library function with one that runs check first
+// and charges for the strings it returns.
+func meterLibFunc(L *lua.LState, lib *lua.LTable, name string, check func(L *lua.LState)) {
+	fn := lib.RawGetString(name).(*lua.LFunction).GFunction
+	lib.RawSetString(name, L.NewFunction(func(L *lua.LState) int {
+		if check != nil {
+			check(L)
+		}
+		n := fn(L)
+		b := budgetOf(L)
+		for i := L.GetTop() - n + 1; i <= L.GetTop(); i++ {
+			if s, ok := L.Get(i).(lua.LString); ok {
+				b.charge(L, int64(len(s)))
+			}
+		}
+		return n
+	}))
+}
+
+func checkLuaRep(L *lua.LState) {
+	s, n := L.CheckString(1), L.CheckInt64(2)
+	if len(s) > 0 && n > 0 {
+		b := budgetOf(L)
+		if b != nil && n > b.left/int64(len(s)) {
+			L.RaiseError("memory limit exceeded")
+		}
+	}
+}
+
+// checkLuaFormat rejects widths and precisions above 99, as Lua does.
+func checkLuaFormat(L *lua.LState) {
+	format := L.CheckString(1)
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		i++
+		for i < len(format) && (format[i] == '-' || format[i] == '+' || format[i] == ' ' || format[i] == '#' || format[i] == '0') {
+			i++
+		}
+		for _, part := range []bool{true, false} {
+			if !part {
+				if i >= len(format) || format[i] != '.' {
+					break
+				}
+				i++
+			}
+			digits := 0
+			for i < len(format) && format[i] >= '0' && format[i] <= '9' {
+				digits++
+				i++
+			}
+			if digits > 2 {
+				L.RaiseError("invalid format (width or precision too long)")
+			}
+		}
+	}
+}
+
+// checkLuaGsub bounds the result for a string replacement, and meters a
+// table or function replacement by the strings it yields.
+func checkLuaGsub(L *lua.LState) {
+	s := L.CheckString(1)
+	switch repl := L.Get(3).(type) {
+	case lua.LString:
+		// Every position may match, and each %n capture is at most s.
+		n := int64(len(s)) + 1
+		budgetOf(L).check(L, n*int64(len(repl))+n*int64(len(s))*int64(len(repl)/2)+int64(len(s)))
+	case *lua.LTable:
+		L.Replace(3, L.NewFunction(func(L *lua.LState) int {
+			v := L.GetTable(repl, L.Get(1))
+			if lua.LVCanConvToString(v) {
+				budgetOf(L).charge(L, int64(len(lua.LVAsString(v))))
+			}
+			L.Push(v)
+			return 1
+		}))
+	case *lua.LFunction:
+		L.Replace(3, L.NewFunction(func(L *lua.LState) int {
+			args := make([]lua.LValue, L.GetTop())
+			for i := range args {
+				args[i] = L.Get(i + 1)
+			}
+			L.Push(repl)
+			for _, arg := range args {
+				L.Push(arg)
+			}
+			L.Call(len(args), 1)
+			if v := L.Get(-1); lua.LVCanConvToString(v) {
+				budgetOf(L).charge(L, int64(len(lua.LVAsString(v))))
+			}
+			return 1
+		}))
+	}
+}
+
+func checkLuaTableConcat(L *lua.LState) {
+	t := L.CheckTable(1)
+	sep := int64(len(L.OptString(2, "")))
+	var need int64
+	for i := 1; i <= t.Len(); i++ {
+		if v := t.RawGetInt(i); lua.LVCanConvToString(v) {
+			need += int64(len(lua.LVAsString(v))) + sep
+		}
+	}
+	budgetOf(L).check(L, need)
+}
+
+// jsonSize is what decoded JSON counts against the budget.
+func jsonSize(v interface{}) int64 {
+	switch v := v.(type) {
+	case string:
+		return int64(len(v))
+	case []interface{}:
+		n := int64(len(v)) * luaEntryBytes
+		for _, elem := range v {
+			n += jsonSize(elem)
+		}
+		return n
+	case map[string]interface{}:
+		n := int64(len(v)) * luaEntryBytes
+		for key, elem := range v {
+			n += int64(len(key)) + jsonSize(elem)
+		}
+		return n
+	}
+	return 0
+}
@@ -0,0 +1,21 @@
+-- Passes the caller's user name upstream in a header and strips internal
+-- fields from JSON responses. List "tenant_header" after "jwt" in a route's
+-- middleware to use it.
+
+function on_request(req)
+  if not req.user then
+    return {status = 401, headers = {["Content-Type"] = "application/json"}, body = '{"error": "Unauthorized"}'}
+  end
+  req.headers[config.header] = req.user
+end
+
+function on_response(req, resp)
+  if not resp.body or resp.headers["Content-Type"] ~= "application/json" then
+    return
+  end
+  local doc = gateway.json_decode(resp.body)
+  if type(doc) == "table" then
+    doc.internal_notes = nil
+    resp.body = gateway.json_encode(doc)
+  end
+end
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// UsageStore keeps request counts per tenant and period, where a period is a
+// UTC day ("2006-01-02") or month ("2006-01"). The gateway ships an in-memory
+// store that can be saved to a file; anything shared between gateway
+// replicas can implement the same interface and be installed with
+// SetUsageStore.
+type UsageStore interface {
+	// Add adds delta to the tenant's count for each period and returns the
+	// new counts.
+	Add(tenant string, periods []string, delta int64) ([]int64, error)
+	// Usage returns every count by tenant and period.
+	Usage() (map[string]map[string]int64, error)
+	Close() error
+}
+
+// dailyUsageRetention is how long per-day counts are kept; monthly counts are
+// kept for good.
+const dailyUsageRetention = 62 * 24 * time.Hour
+
+// fileUsageStore counts in memory and, when it has a path, loads the counts
+// from the file at start and writes them back periodically and on close.
+type fileUsageStore struct {
+	path string
+
+	mu     sync.Mutex
+	counts map[string]map[string]int64
+	dirty  bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newFileUsageStore(path string, flushInterval time.Duration) (*fileUsageStore, error) {
+	s := &fileUsageStore{path: path, counts: make(map[string]map[string]int64)}
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &s.counts); err != nil {
+			return nil, err
+		}
+	}
+
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.flush(); err != nil {
+					log.Printf("Quota: saving usage to %s: %s", s.path, err)
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+	return s, nil
+}
+
+func (s *fileUsageStore) Add(tenant string, periods []string, delta int64) ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := s.counts[tenant]
+	if counts == nil {
+		counts = make(map[string]int64)
+		s.counts[tenant] = counts
+	}
+	out := make([]int64, len(periods))
+	for i, period := range periods {
+		counts[period] += delta
+		out[i] = counts[period]
+	}
+	s.dirty = true
+	return out, nil
+}
+
+func (s *fileUsageStore) Usage() (map[string]map[string]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]map[string]int64, len(s.counts))
+	for tenant, counts := range s.counts {
+		out[tenant] = make(map[string]int64, len(counts))
+		for period, n := range counts {
+			out[tenant][period] = n
+		}
+	}
+	return out, nil
+}
+
+// flush drops expired daily counts and writes the rest to the file through a
+// temporary file, so a crash never leaves it half written.
+func (s *fileUsageStore) flush() error {
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	cutoff := time.Now().UTC().Add(-dailyUsageRetention).Format("2006-01-02")
+	for _, counts := range s.counts {
+		for period := range counts {
+			if len(period) == len("2006-01-02") && period < cutoff {
+				delete(counts, period)
+			}
+		}
+	}
+	data, err := json.Marshal(s.counts)
+	s.dirty = false
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *fileUsageStore) Close() error {
+	if s.stop == nil {
+		return nil
+	}
+	close(s.stop)
+	<-s.done
+	return s.flush()
+}
+
+// quotas counts each tenant's requests and enforces their daily and monthly
+// limits. The tenant is the authenticated user.
+type quotas struct {
+	cfg   *QuotaConfig
+	store UsageStore
+}
+
+type quotaPeriod struct {
+	name    string
+	key     string
+	limit   int64
+	resetAt time.Time
+}
+
+// periods returns the tenant's current day and month with their limits.
+func (q *quotas) periods(tenant string, now time.Time) []quotaPeriod {
+	limits := q.cfg.limits(tenant)
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return []quotaPeriod{
+		{name: "daily", key: day.Format("2006-01-02"), limit: limits.Daily, resetAt: day.AddDate(0, 0, 1)},
+		{name: "monthly", key: month.Format("2006-01"), limit: limits.Monthly, resetAt: month.AddDate(0, 1, 0)},
+	}
+}
+
+type quotaCountedKey struct{}
+
+// quotaMiddleware counts the request against the user's quotas and answers
+// 429 once one of them is used up. A request is counted once even when it
+// fans out to other routes, as composites do. X-Quota-Limit,
+// X-Quota-Remaining and X-Quota-Reset describe the quota closest to running
+// out.
+func quotaMiddleware(q *quotas, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := claimsFromRequest(r)
+		if claims == nil || r.Context().Value(quotaCountedKey{}) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		periods := q.periods(claims.Username, time.Now().UTC())
+		keys := make([]string, len(periods))
+		for i, p := range periods {
+			keys[i] = p.key
+		}
+		counts, err := q.store.Add(claims.Username, keys, 1)
+		if err != nil {
+			// Losing a count is better than failing the request.
+			log.Printf("Quota: counting request for %s: %s", claims.Username, err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var tightest *quotaPeriod
+		var remaining int64
+		for i := range periods {
+			p := &periods[i]
+			if p.limit <= 0 {
+				continue
+			}
+			left := p.limit - counts[i]
+			if left < 0 {
+				// Rejected requests are not billed.
+				if _, err := q.store.Add(claims.Username, keys, -1); err != nil {
+					log.Printf("Quota: uncounting request for %s: %s", claims.Username, err)
+				}
+				setQuotaHeaders(w, p, 0)
+				writeJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+					"error": "Quota exceeded",
+					"quota": map[string]interface{}{
+						"period":    p.name,
+						"limit":     p.limit,
+						"used":      p.limit,
+						"resets_at": p.resetAt.Format(time.RFC3339),
+					},
+				})
+				return
+			}
+			if tightest == nil || left < remaining {
+				tightest, remaining = p, left
+			}
+		}
+		if tightest != nil {
+			setQuotaHeaders(w, tightest, remaining)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), quotaCountedKey{}, true)))
+	})
+}
+
+func setQuotaHeaders(w http.ResponseWriter, p *quotaPeriod, remaining int64) {
+	w.Header().Set("X-Quota-Limit", strconv.FormatInt(p.limit, 10))
+	w.Header().Set("X-Quota-Remaining", strconv.FormatInt(remaining, 10))
+	w.Header().Set("X-Quota-Reset", p.resetAt.Format(time.RFC3339))
+}
+
+type tenantUsage struct {
+	Tenant  string           `json:"tenant"`
+	Limits  QuotaLimitConfig `json:"limits"`
+	Daily   map[string]int64 `json:"daily"`
+	Monthly map[string]int64 `json:"monthly"`
+}
+
+// report returns the usage of every tenant, or only of tenant when it is
+// set, sorted by tenant.
+func (q *quotas) report(tenant string) ([]tenantUsage, error) {
+	usage, err := q.store.Usage()
+	if err != nil {
+		return nil, err
+	}
+	out := []tenantUsage{}
+	for name, counts := range usage {
+		if tenant != "" && name != tenant {
+			continue
+		}
+		u := tenantUsage{Tenant: name, Limits: q.cfg.limits(name), Daily: make(map[string]int64), Monthly: make(map[string]int64)}
+		for period, n := range counts {
+			if len(period) == len("2006-01") {
+				u.Monthly[period] = n
+			} else {
+				u.Daily[period] = n
+			}
+		}
+		out = append(out, u)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Tenant < out[j].Tenant })
+	return out, nil
+}
+
+func (c *QuotaConfig) limits(tenant string) QuotaLimitConfig {
+	if l, ok := c.Tenants[tenant]; ok {
+		return l
+	}
+	return QuotaLimitConfig{Daily: c.Daily, Monthly: c.Monthly}
+}
+
+func (c *QuotaConfig) flushInterval() time.Duration {
+	if c.FlushInterval.Duration > 0 {
+		return c.FlushInterval.Duration
+	}
+	return 10 * time.Second
+}
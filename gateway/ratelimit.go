@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter keeps a token bucket per client: each holds up to Burst
+// requests and refills at RequestsPerSecond. Clients are the authenticated
+// user, or the client address for anonymous requests.
+type rateLimiter struct {
+	cfg *RateLimitConfig
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	allowed   int64
+	limited   int64
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimitStatus struct {
+	Route             string  `json:"route"`
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+	Clients           int     `json:"clients"`
+	Allowed           int64   `json:"allowed"`
+	Limited           int64   `json:"limited"`
+}
+
+func newRateLimiter(cfg *RateLimitConfig) *rateLimiter {
+	return &rateLimiter{cfg: cfg, buckets: make(map[string]*tokenBucket), lastSweep: time.Now()}
+}
+
+// allow takes a token from the client's bucket, or reports how long until
+// one is available.
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rate, burst := l.cfg.RequestsPerSecond, float64(l.cfg.burst())
+
+	// Buckets that have filled up again are the same as new ones.
+	if now.Sub(l.lastSweep) > time.Minute {
+		for key, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*rate >= burst {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		l.limited++
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	l.allowed++
+	return true, 0
+}
+
+func (l *rateLimiter) status(route string) rateLimitStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return rateLimitStatus{
+		Route:             route,
+		RequestsPerSecond: l.cfg.RequestsPerSecond,
+		Burst:             l.cfg.burst(),
+		Clients:           len(l.buckets),
+		Allowed:           l.allowed,
+		Limited:           l.limited,
+	}
+}
+
+// rateLimitMiddleware answers 429 with Retry-After to clients that are over
+// the route's rate.
+func rateLimitMiddleware(l *rateLimiter, trusted []*net.IPNet, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := "ip:" + clientIP(r, trusted).String()
+		if claims := claimsFromRequest(r); claims != nil {
+			client = "user:" + claims.Username
+		}
+		if ok, wait := l.allow(client, time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "Rate limit exceeded"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// burst defaults to one second's worth of requests.
+func (c *RateLimitConfig) burst() int {
+	if c.Burst > 0 {
+		return c.Burst
+	}
+	return int(math.Ceil(c.RequestsPerSecond))
+}
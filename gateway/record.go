@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+const redacted = "[REDACTED]"
+
+// recordedMessage is one side of a recorded exchange. Bodies that are not
+// valid UTF-8, such as compressed responses, are kept in BodyBase64.
+// Truncated marks a body cut at the recording's max_body_bytes.
+type recordedMessage struct {
+	Method     string      `json:"method,omitempty"`
+	URI        string      `json:"uri,omitempty"`
+	Status     int         `json:"status,omitempty"`
+	Header     http.Header `json:"header"`
+	Body       string      `json:"body,omitempty"`
+	BodyBase64 string      `json:"body_base64,omitempty"`
+	Truncated  bool        `json:"truncated,omitempty"`
+}
+
+type recordedExchange struct {
+	Time       time.Time       `json:"time"`
+	Route      string          `json:"route"`
+	DurationMs float64         `json:"duration_ms"`
+	Request    recordedMessage `json:"request"`
+	Response   recordedMessage `json:"response"`
+}
+
+func (m *recordedMessage) setBody(body []byte) {
+	if utf8.Valid(body) {
+		m.Body = string(body)
+	} else {
+		m.BodyBase64 = base64.StdEncoding.EncodeToString(body)
+	}
+}
+
+func (m *recordedMessage) body() ([]byte, error) {
+	if m.BodyBase64 != "" {
+		return base64.StdEncoding.DecodeString(m.BodyBase64)
+	}
+	return []byte(m.Body), nil
+}
+
+// recorder appends exchanges to a JSONL file from a single goroutine so
+// requests never wait on the disk. Exchanges that arrive while the queue is
+// full are dropped and counted. A reload that keeps the path keeps the
+// recorder and only swaps its settings.
+type recorder struct {
+	path     string
+	settings atomic.Value
+	queue    chan *recordedExchange
+	done     chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+
+	recorded int64
+	dropped  int64
+}
+
+type recordSettings struct {
+	cfg     *RecordConfig
+	routes  map[string]bool
+	headers map[string]bool
+}
+
+func newRecorder(cfg *RecordConfig) (*recorder, error) {
+	f, err := os.OpenFile(cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	rec := &recorder{
+		path:  cfg.Path,
+		queue: make(chan *recordedExchange, 1024),
+		done:  make(chan struct{}),
+	}
+	rec.configure(cfg)
+	go rec.run(f)
+	return rec, nil
+}
+
+func (rec *recorder) configure(cfg *RecordConfig) {
+	s := &recordSettings{cfg: cfg, routes: make(map[string]bool), headers: make(map[string]bool)}
+	for _, name := range cfg.Routes {
+		s.routes[name] = true
+	}
+	for _, name := range cfg.redactHeaders() {
+		s.headers[http.CanonicalHeaderKey(name)] = true
+	}
+	rec.settings.Store(s)
+}
+
+func (rec *recorder) current() *recordSettings {
+	return rec.settings.Load().(*recordSettings)
+}
+
+func (rec *recorder) run(f *os.File) {
+	defer close(rec.done)
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	for ex := range rec.queue {
+		if err := enc.Encode(ex); err != nil {
+			log.Printf("Recorder: writing %s: %s", rec.path, err)
+		}
+		if len(rec.queue) == 0 {
+			w.Flush()
+		}
+	}
+	w.Flush()
+}
+
+// close stops the recorder after writing out what is queued. Exchanges
+// added afterwards are dropped.
+func (rec *recorder) close() {
+	rec.mu.Lock()
+	if rec.closed {
+		rec.mu.Unlock()
+		return
+	}
+	rec.closed = true
+	close(rec.queue)
+	rec.mu.Unlock()
+	<-rec.done
+}
+
+func (rec *recorder) add(ex *recordedExchange) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.closed {
+		atomic.AddInt64(&rec.dropped, 1)
+		return
+	}
+	select {
+	case rec.queue <- ex:
+		atomic.AddInt64(&rec.recorded, 1)
+	default:
+		atomic.AddInt64(&rec.dropped, 1)
+	}
+}
+
+func (s *recordSettings) enabled(route string) bool {
+	return len(s.routes) == 0 || s.routes[route]
+}
+
+func (s *recordSettings) redactHeader(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for name, values := range h {
+		if s.headers[name] {
+			out[name] = []string{redacted}
+			continue
+		}
+		out[name] = append([]string(nil), values...)
+	}
+	return out
+}
+
+// redactBody blanks the configured JSON fields; other bodies are kept as
+// they are. JSON that does not parse, such as a truncated body, cannot be
+// redacted and is left out.
+func (s *recordSettings) redactBody(h http.Header, body []byte) []byte {
+	if len(s.cfg.RedactFields) == 0 || !isJSON(h.Get("Content-Type")) || h.Get("Content-Encoding") != "" {
+		return body
+	}
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil
+	}
+	for _, field := range s.cfg.RedactFields {
+		editField(doc, strings.Split(field, "."), func(obj map[string]interface{}, key string) {
+			if _, ok := obj[key]; ok {
+				obj[key] = redacted
+			}
+		})
+	}
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// recordMiddleware records the exchange as the client saw it. Bodies longer
+// than the configured limit are truncated in the recording and marked so.
+func recordMiddleware(rec *recorder, rt *route, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		settings := rec.current()
+		if !settings.enabled(rt.name()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		limit := settings.cfg.maxBodyBytes()
+		var reqBody []byte
+		var reqTruncated bool
+		if r.Body != nil && r.Body != http.NoBody {
+			head, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Error reading request body"})
+				return
+			}
+			r.Body = readCloser{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+			reqBody = head
+			if int64(len(head)) > limit {
+				reqBody, reqTruncated = head[:limit], true
+			}
+		}
+
+		start := time.Now()
+		cw := &copyingWriter{ResponseWriter: w, limit: limit}
+		next.ServeHTTP(cw, r)
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+
+		ex := &recordedExchange{
+			Time:       start.UTC(),
+			Route:      rt.name(),
+			DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+			Request:    recordedMessage{Method: r.Method, URI: r.URL.RequestURI(), Header: settings.redactHeader(r.Header), Truncated: reqTruncated},
+			Response:   recordedMessage{Status: cw.status, Header: settings.redactHeader(w.Header()), Truncated: cw.truncated},
+		}
+		ex.Request.setBody(settings.redactBody(r.Header, reqBody))
+		ex.Response.setBody(settings.redactBody(w.Header(), cw.body.Bytes()))
+		rec.add(ex)
+	})
+}
+
+// copyingWriter passes the response through and keeps the first limit bytes
+// of the body.
+type copyingWriter struct {
+	http.ResponseWriter
+	status    int
+	limit     int64
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (w *copyingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *copyingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	room := w.limit - int64(w.body.Len())
+	if int64(len(b)) > room {
+		w.truncated = true
+		if room > 0 {
+			w.body.Write(b[:room])
+		}
+	} else {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (c *RecordConfig) redactHeaders() []string {
+	if c.RedactHeaders != nil {
+		return c.RedactHeaders
+	}
+	return []string{"Authorization", "Cookie", "Set-Cookie"}
+}
+
+func (c *RecordConfig) maxBodyBytes() int64 {
+	if c.MaxBodyBytes > 0 {
+		return c.MaxBodyBytes
+	}
+	return 64 << 10
+}
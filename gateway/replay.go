@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// replayOptions controls how a recording is replayed and compared.
+type replayOptions struct {
+	target       string
+	token        string
+	login        string
+	ignoreFields []string
+	headers      []string
+}
+
+type replayMismatch struct {
+	Line   int      `json:"line"`
+	Method string   `json:"method"`
+	URI    string   `json:"uri"`
+	Diffs  []string `json:"diffs,omitempty"`
+	// Skipped says why the exchange was not replayed.
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// runReplay implements "gateway replay": it sends every recorded request to
+// a target gateway and reports the responses that differ from the
+// recording. It returns the process exit code.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	opts := replayOptions{}
+	var ignore, headers string
+	fs.StringVar(&opts.target, "target", "http://localhost:8081", "gateway to replay against")
+	fs.StringVar(&opts.token, "token", "", "bearer token for the replayed requests")
+	fs.StringVar(&opts.login, "login", "", "username:password to obtain a token from /login instead of -token")
+	fs.StringVar(&ignore, "ignore-fields", "", "comma separated JSON fields left out of the comparison, e.g. id,date_of_issue")
+	fs.StringVar(&headers, "headers", "Content-Type", "comma separated response headers to compare")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: gateway replay [flags] recording.jsonl")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		if err == nil {
+			fs.Usage()
+		}
+		return 2
+	}
+	opts.ignoreFields = splitList(ignore)
+	opts.headers = splitList(headers)
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer f.Close()
+
+	total, mismatches, skipped, err := replay(f, opts, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	fmt.Printf("%d replayed, %d mismatched, %d skipped\n", total, mismatches, skipped)
+	if mismatches > 0 {
+		return 1
+	}
+	return 0
+}
+
+// replay sends each exchange in the recording and writes one JSON line per
+// mismatch to out. Exchanges whose request body was truncated when recorded
+// cannot be sent as they were; they are reported as skipped instead.
+func replay(recording io.Reader, opts replayOptions, out io.Writer) (total, mismatches, skipped int, err error) {
+	auth := &replayAuth{opts: opts}
+	enc := json.NewEncoder(out)
+	scanner := bufio.NewScanner(recording)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var ex recordedExchange
+		if err := json.Unmarshal(scanner.Bytes(), &ex); err != nil {
+			return total, mismatches, skipped, fmt.Errorf("line %d: %w", line, err)
+		}
+		if ex.Request.Truncated {
+			skipped++
+			enc.Encode(replayMismatch{Line: line, Method: ex.Request.Method, URI: ex.Request.URI, Skipped: "request body was truncated when recorded"})
+			continue
+		}
+		total++
+
+		diffs, err := replayExchange(&ex, opts, auth)
+		if err != nil {
+			diffs = []string{err.Error()}
+		}
+		if len(diffs) > 0 {
+			mismatches++
+			enc.Encode(replayMismatch{Line: line, Method: ex.Request.Method, URI: ex.Request.URI, Diffs: diffs})
+		}
+	}
+	return total, mismatches, skipped, scanner.Err()
+}
+
+func replayExchange(ex *recordedExchange, opts replayOptions, auth *replayAuth) ([]string, error) {
+	body, err := ex.Request.body()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(ex.Request.Method, strings.TrimRight(opts.target, "/")+ex.Request.URI, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range ex.Request.Header {
+		if len(values) == 1 && values[0] == redacted {
+			continue
+		}
+		req.Header[name] = values
+	}
+	if ex.Request.Header.Get("Authorization") != "" {
+		token, err := auth.token()
+		if err != nil {
+			return nil, err
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	want, err := ex.Response.body()
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []string
+	if resp.StatusCode != ex.Response.Status {
+		diffs = append(diffs, fmt.Sprintf("status: recorded %d, got %d", ex.Response.Status, resp.StatusCode))
+	}
+	for _, name := range opts.headers {
+		if w, g := ex.Response.Header.Get(name), resp.Header.Get(name); w != g && w != redacted {
+			diffs = append(diffs, fmt.Sprintf("header %s: recorded %q, got %q", name, w, g))
+		}
+	}
+	// Of a truncated response only the recorded start can be compared.
+	if ex.Response.Truncated {
+		if !bytes.HasPrefix(got, want) {
+			diffs = append(diffs, fmt.Sprintf("body: differs within the %d recorded bytes", len(want)))
+		}
+	} else if !sameBody(want, got, opts.ignoreFields) {
+		diffs = append(diffs, fmt.Sprintf("body: recorded %d bytes, got %d bytes", len(want), len(got)))
+	}
+	return diffs, nil
+}
+
+// sameBody compares JSON bodies by value, leaving out ignored and redacted
+// fields, and other bodies byte for byte.
+func sameBody(want, got []byte, ignore []string) bool {
+	var w, g interface{}
+	if json.Unmarshal(want, &w) != nil || json.Unmarshal(got, &g) != nil {
+		return bytes.Equal(want, got)
+	}
+	for _, doc := range []interface{}{w, g} {
+		for _, field := range ignore {
+			editField(doc, strings.Split(field, "."), func(obj map[string]interface{}, key string) {
+				delete(obj, key)
+			})
+		}
+	}
+	dropRedacted(w, g)
+	return reflect.DeepEqual(w, g)
+}
+
+// dropRedacted removes fields that were redacted in the recording from both
+// documents, since their real values cannot be compared.
+func dropRedacted(want, got interface{}) {
+	switch w := want.(type) {
+	case map[string]interface{}:
+		g, _ := got.(map[string]interface{})
+		for key, v := range w {
+			if v == redacted {
+				delete(w, key)
+				if g != nil {
+					delete(g, key)
+				}
+			} else if g != nil {
+				dropRedacted(v, g[key])
+			}
+		}
+	case []interface{}:
+		g, _ := got.([]interface{})
+		for i := range w {
+			if i < len(g) {
+				dropRedacted(w[i], g[i])
+			}
+		}
+	}
+}
+
+// replayAuth supplies the bearer token, logging in again before a token from
+// /login expires.
+type replayAuth struct {
+	opts    replayOptions
+	current string
+	expires time.Time
+}
+
+func (a *replayAuth) token() (string, error) {
+	if a.opts.login == "" {
+		return a.opts.token, nil
+	}
+	if a.current != "" && time.Now().Before(a.expires) {
+		return a.current, nil
+	}
+
+	creds := Credentials{Username: a.opts.login}
+	if i := strings.Index(a.opts.login, ":"); i >= 0 {
+		creds = Credentials{Username: a.opts.login[:i], Password: a.opts.login[i+1:]}
+	}
+	body, _ := json.Marshal(creds)
+	resp, err := upstreamClient.Post(strings.TrimRight(a.opts.target, "/")+"/login", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("login returned %s", resp.Status)
+	}
+	var out struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", err
+	}
+	// Tokens from /login last five minutes.
+	a.current, a.expires = out.Token, time.Now().Add(4*time.Minute)
+	return a.current, nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// gatewayState is everything derived from one version of the config. It is
+// rebuilt as a whole on reload and swapped in atomically.
+type gatewayState struct {
+	config   *Config
+	loadedAt time.Time
+	routes   map[string]*route
+	pools    map[string]*upstreamPool
+	cache    CacheStore
+	trusted  []*net.IPNet
+	waf      *wafEngine
+	router   *mux.Router
+	// grpcConns is shared with the previous state across reloads.
+	grpcConns *grpcConnCache
+	// recorder is shared with the previous state while its path is unchanged.
+	recorder *recorder
+	// idempotency is shared with the previous state across reloads.
+	idempotency IdempotencyStore
+	// quotas' store is shared with the previous state while its path is
+	// unchanged.
+	quotas *quotas
+	// openapi holds the routes' specs, for the merged document and for
+	// request validation.
+	openapi *openAPIDocs
+	// plugins are loaded afresh on every reload, so edited scripts take
+	// effect.
+	plugins map[string]*luaPlugin
+	// services lists the routes of each service, which tell apart by host.
+	services map[string][]*route
+	// endpoints run composites and GraphQL through their chains, by name.
+	endpoints map[string]*route
+}
+
+type route struct {
+	RouteConfig
+	pool      *upstreamPool
+	ipFilters []*ipFilter
+	wafRules  []*wafRule
+	transform *transformer
+	grpc      *grpcService
+	split     *trafficSplit
+	mirror    *mirror
+	mock      *mockUpstream
+	faults    *faultInjector
+	// rateLimiter is nil unless the route has a rate limit.
+	rateLimiter *rateLimiter
+	handler     http.Handler
+}
+
+var (
+	configPath string
+	current    atomic.Value
+	reloadMu   sync.Mutex
+)
+
+func currentGateway() *gatewayState {
+	gw, _ := current.Load().(*gatewayState)
+	return gw
+}
+
+// reloadConfig re-reads the config file and swaps in the new routes and
+// upstream pools. On error the running state is left untouched.
+func reloadConfig() (*gatewayState, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	prev := currentGateway()
+	gw, err := buildGateway(cfg, prev)
+	if err != nil {
+		return nil, err
+	}
+	current.Store(gw)
+	if prev != nil {
+		prev.close()
+		gw.grpcConns.retain(gw.grpcTargets())
+		if prev.recorder != nil && prev.recorder != gw.recorder {
+			prev.recorder.close()
+		}
+		if prev.quotas != nil && (gw.quotas == nil || prev.quotas.store != gw.quotas.store) {
+			if err := prev.quotas.store.Close(); err != nil {
+				log.Printf("Quota: closing usage store: %s", err)
+			}
+		}
+	}
+	for _, p := range gw.pools {
+		p.startHealthChecks()
+	}
+	return gw, nil
+}
+
+func buildGateway(cfg *Config, prev *gatewayState) (gw *gatewayState, err error) {
+	gw = &gatewayState{
+		config:    cfg,
+		loadedAt:  time.Now(),
+		routes:    make(map[string]*route),
+		services:  make(map[string][]*route),
+		endpoints: make(map[string]*route),
+		pools:     make(map[string]*upstreamPool),
+		router:    mux.NewRouter(),
+	}
+
+	// Cached responses survive reloads unless the store size changes.
+	// Installed stores are used instead of the in-memory ones.
+	cache, idempotency, usage := installedStores()
+	switch {
+	case cache != nil:
+		gw.cache = cache
+	case prev != nil && prev.config.Cache.MaxBytes == cfg.Cache.MaxBytes:
+		gw.cache = prev.cache
+	default:
+		gw.cache = newLRUStore(cfg.Cache.MaxBytes)
+	}
+	if prev != nil {
+		gw.grpcConns = prev.grpcConns
+		gw.idempotency = prev.idempotency
+	} else {
+		gw.grpcConns = newGRPCConnCache()
+		gw.idempotency = newMemoryIdempotencyStore()
+	}
+	if idempotency != nil {
+		gw.idempotency = idempotency
+	}
+
+	for name, upCfg := range cfg.Upstreams {
+		pool := newUpstreamPool(name, upCfg)
+		// Keep operator decisions across reloads: an instance drained through
+		// the admin API stays drained while it is still listed.
+		if prev != nil && prev.pools[name] != nil {
+			for _, inst := range pool.instances {
+				if old := prev.pools[name].instance(inst.URL); old != nil && old.isDraining() {
+					inst.setDraining(true)
+				}
+			}
+			// An unchanged limit keeps its limiter, so requests in flight
+			// across the reload still count against it.
+			if old := prev.pools[name].limiter; old != nil && reflect.DeepEqual(old.cfg, upCfg.Concurrency) {
+				pool.limiter = old
+			}
+			if old := prev.pools[name].breaker; old != nil && reflect.DeepEqual(old.cfg, upCfg.CircuitBreaker) {
+				pool.breaker = old
+			}
+		}
+		gw.pools[name] = pool
+	}
+
+	if gw.trusted, err = parseCIDRs(cfg.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("trusted_proxies: %w", err)
+	}
+	if gw.waf, err = newWAFEngine(cfg.WAF); err != nil {
+		return nil, err
+	}
+	if cfg.Record != nil {
+		if prev != nil && prev.recorder != nil && prev.recorder.path == cfg.Record.Path {
+			gw.recorder = prev.recorder
+			// Settings are swapped only once the new state is complete.
+			defer func() {
+				if err == nil {
+					gw.recorder.configure(cfg.Record)
+				}
+			}()
+		} else {
+			if gw.recorder, err = newRecorder(cfg.Record); err != nil {
+				return nil, fmt.Errorf("record: %w", err)
+			}
+			rec := gw.recorder
+			defer func() {
+				if err != nil {
+					rec.close()
+				}
+			}()
+		}
+	}
+
+	if cfg.Quotas != nil {
+		gw.quotas = &quotas{cfg: cfg.Quotas}
+		switch {
+		case usage != nil:
+			gw.quotas.store = usage
+		case prev != nil && prev.quotas != nil && prev.quotas.cfg.Path == cfg.Quotas.Path:
+			gw.quotas.store = prev.quotas.store
+		default:
+			if gw.quotas.store, err = newFileUsageStore(cfg.Quotas.Path, cfg.Quotas.flushInterval()); err != nil {
+				return nil, fmt.Errorf("quotas: %w", err)
+			}
+			store := gw.quotas.store
+			defer func() {
+				if err != nil {
+					store.Close()
+				}
+			}()
+		}
+	}
+
+	// Validation reads the routes' specs even when the document is not
+	// served.
+	if cfg.OpenAPI != nil {
+		gw.openapi = &openAPIDocs{gw: gw, cfg: cfg.OpenAPI}
+	} else {
+		gw.openapi = &openAPIDocs{gw: gw, cfg: &OpenAPIConfig{SpecPath: "/openapi.json"}}
+	}
+
+	gw.plugins = make(map[string]*luaPlugin)
+	for name := range cfg.Plugins {
+		pc := cfg.Plugins[name]
+		if gw.plugins[name], err = newLuaPlugin(name, &pc, configDir()); err != nil {
+			return nil, fmt.Errorf("plugin %q: %w", name, err)
+		}
+	}
+
+	gw.router.HandleFunc("/login", LoginHandler).Methods("POST")
+	// The API description is public, like /login.
+	if cfg.OpenAPI != nil {
+		gw.router.Handle(cfg.OpenAPI.Path, gw.openapi).Methods("GET")
+		gw.router.HandleFunc(cfg.OpenAPI.DocsPath, gw.openapi.page).Methods("GET")
+	}
+	// Composites go first: the service routes below match any path that
+	// starts with the service name. Like service routes, composites that
+	// share a path each match only the hosts they are the closest match for.
+	composites := make(map[string][]*route)
+	for _, comp := range cfg.Composites {
+		rt, err := gw.endpointRoute(comp.name(), []string{http.MethodGet}, comp.EndpointConfig, prev, compositeHandler(gw, comp))
+		if err != nil {
+			return nil, fmt.Errorf("composite %q: %w", comp.name(), err)
+		}
+		path := comp.Path
+		composites[path] = append(composites[path], rt)
+		gw.router.MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+			return closestHost(composites[path], req) == rt
+		}).Path(path).Methods(rt.allowedMethods()...).Handler(rt.handler)
+	}
+	// The GraphQL handler needs the built routes, so only its path is
+	// reserved here.
+	var graphqlRoute *mux.Route
+	var graphql *route
+	if g := cfg.GraphQL; g != nil {
+		methods := []string{http.MethodGet, http.MethodPost}
+		if g.CORS != nil {
+			methods = append(methods, http.MethodOptions)
+		}
+		graphqlRoute = gw.router.MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+			return graphql != nil && graphql.hostScore(requestHost(req)) >= 0
+		}).Path(g.Path).Methods(methods...)
+	}
+	for _, rc := range cfg.Routes {
+		rt := &route{RouteConfig: rc, pool: gw.pools[rc.Upstream]}
+		for _, fc := range rc.IPFilters {
+			f, err := newIPFilter(fc)
+			if err != nil {
+				return nil, fmt.Errorf("route %q: %w", rc.name(), err)
+			}
+			rt.ipFilters = append(rt.ipFilters, f)
+		}
+		if rc.Transform != nil {
+			if rt.transform, err = newTransformer(rc.Transform); err != nil {
+				return nil, fmt.Errorf("route %q: %w", rc.name(), err)
+			}
+		}
+		if rc.GRPC != nil {
+			rt.grpc = grpcServices[rc.GRPC.Service]
+		}
+		if rc.Split != nil {
+			rt.split = newTrafficSplit(rt, gw.pools)
+		}
+		if rc.Mock != nil {
+			if rt.mock, err = newMockUpstream(rc.Mock, configDir()); err != nil {
+				return nil, fmt.Errorf("route %q: %w", rc.name(), err)
+			}
+		}
+		rt.faults = newFaultInjector(rc.Fault)
+		// Faults changed through the admin API outlive reloads, like drains.
+		if prev != nil && prev.routes[rc.name()] != nil {
+			if old := prev.routes[rc.name()].faults.current(); old.admin {
+				rt.faults.state.Store(old)
+			}
+		}
+		if rc.Mirror != nil {
+			rt.mirror = newMirror(rc.Mirror, gw.pools[rc.Mirror.Upstream])
+		}
+		if rc.WAF != nil {
+			if rt.wafRules, err = gw.waf.forRoute(rc.WAF); err != nil {
+				return nil, fmt.Errorf("route %q: %w", rc.name(), err)
+			}
+		}
+		if prev != nil {
+			rt.rateLimiter = rateLimiterFor(&rt.RouteConfig, prev.routes[rc.name()])
+		} else {
+			rt.rateLimiter = rateLimiterFor(&rt.RouteConfig, nil)
+		}
+		if rt.handler, err = gw.routeHandler(rt); err != nil {
+			return nil, fmt.Errorf("route %q: %w", rc.name(), err)
+		}
+		gw.routes[rc.name()] = rt
+		gw.services[rc.Service] = append(gw.services[rc.Service], rt)
+
+		pattern := fmt.Sprintf("/{service:%s}{rest:.*}", regexp.QuoteMeta(rc.Service))
+		// Routes of the same service share the pattern, so each only matches
+		// the hosts it is the closest match for. The matcher checks the
+		// service prefix itself and runs first: mux forgets a method
+		// mismatch as soon as any matcher of a later route succeeds, which
+		// would turn a 405 into a 404.
+		prefix := "/" + rc.Service
+		r := gw.router.MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+			return strings.HasPrefix(req.URL.Path, prefix) && gw.routeFor(rt.Service, req) == rt
+		}).Path(pattern).HandlerFunc(Handler)
+		if len(rc.Methods) > 0 {
+			r.Methods(rt.allowedMethods()...)
+		}
+	}
+
+	if graphqlRoute != nil {
+		api, err := newGraphQLAPI(cfg.GraphQL, gw.routes[cfg.GraphQL.CustomersRoute], gw.routes[cfg.GraphQL.InvestAccountsRoute])
+		if err != nil {
+			return nil, fmt.Errorf("graphql: %w", err)
+		}
+		methods := []string{http.MethodGet, http.MethodPost}
+		if graphql, err = gw.endpointRoute("graphql", methods, cfg.GraphQL.EndpointConfig, prev, api); err != nil {
+			return nil, fmt.Errorf("graphql: %w", err)
+		}
+		graphqlRoute.Handler(graphql.handler)
+	}
+	// Validated routes fetch their specs right away, so that few requests
+	// pass unchecked.
+	for _, rt := range gw.routes {
+		if rt.Validation != nil {
+			gw.openapi.routeSpec(rt, false)
+		}
+	}
+	return gw, nil
+}
+
+// allowedMethods are the route's methods, plus OPTIONS for CORS preflights.
+func (rt *route) allowedMethods() []string {
+	if rt.CORS == nil {
+		return rt.Methods
+	}
+	return append([]string{http.MethodOptions}, rt.Methods...)
+}
+
+// rateLimiterFor returns the limiter for rc's rate limit. An unchanged limit
+// keeps the previous route's buckets, so a reload does not hand every client
+// a fresh burst.
+func rateLimiterFor(rc *RouteConfig, prev *route) *rateLimiter {
+	if rc.RateLimit == nil {
+		return nil
+	}
+	if prev != nil && prev.rateLimiter != nil && reflect.DeepEqual(prev.rateLimiter.cfg, rc.RateLimit) {
+		return prev.rateLimiter
+	}
+	return newRateLimiter(rc.RateLimit)
+}
+
+// endpointRoute builds the route that runs a composite or the GraphQL
+// handler h through the chain of its endpoint settings.
+func (gw *gatewayState) endpointRoute(name string, methods []string, ec EndpointConfig, prev *gatewayState, h http.Handler) (*route, error) {
+	rt := &route{RouteConfig: RouteConfig{
+		Name:       name,
+		Methods:    methods,
+		Hosts:      ec.Hosts,
+		IPFilters:  ec.IPFilters,
+		CORS:       ec.CORS,
+		WAF:        ec.WAF,
+		RateLimit:  ec.RateLimit,
+		Middleware: ec.Middleware,
+	}}
+	if rt.Middleware == nil {
+		for _, step := range endpointChain {
+			rt.Middleware = append(rt.Middleware, MiddlewareConfig{Name: step})
+		}
+	}
+	for _, fc := range ec.IPFilters {
+		f, err := newIPFilter(fc)
+		if err != nil {
+			return nil, err
+		}
+		rt.ipFilters = append(rt.ipFilters, f)
+	}
+	if ec.WAF != nil {
+		var err error
+		if rt.wafRules, err = gw.waf.forRoute(ec.WAF); err != nil {
+			return nil, err
+		}
+	}
+	if prev != nil {
+		rt.rateLimiter = rateLimiterFor(&rt.RouteConfig, prev.endpoints[name])
+	} else {
+		rt.rateLimiter = rateLimiterFor(&rt.RouteConfig, nil)
+	}
+
+	chain, err := gw.buildChain(rt)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		h = chain[i](h)
+	}
+	rt.handler = h
+	gw.endpoints[name] = rt
+	return rt, nil
+}
+
+// endpointList returns the composites' and GraphQL's routes in config order.
+func (gw *gatewayState) endpointList() []*route {
+	var out []*route
+	for _, comp := range gw.config.Composites {
+		out = append(out, gw.endpoints[comp.name()])
+	}
+	if gw.config.GraphQL != nil {
+		out = append(out, gw.endpoints["graphql"])
+	}
+	return out
+}
+
+// routeHandler wraps the upstream proxy in the route's middleware chain.
+func (gw *gatewayState) routeHandler(rt *route) (http.Handler, error) {
+	var h http.Handler = http.HandlerFunc(rt.proxy)
+	if rt.grpc != nil {
+		h = gw.grpcProxy(rt, rt.grpc)
+	}
+	chain, err := gw.buildChain(rt)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		h = chain[i](h)
+	}
+	return h, nil
+}
+
+// withQuotas counts requests to h against the users' quotas, if any.
+func (gw *gatewayState) withQuotas(h http.Handler) http.Handler {
+	if gw.quotas == nil {
+		return h
+	}
+	return quotaMiddleware(gw.quotas, h)
+}
+
+func (gw *gatewayState) close() {
+	for _, p := range gw.pools {
+		p.close()
+	}
+}
+
+// shutdown releases everything the gateway holds when the process exits,
+// writing out what is only kept in memory.
+func (gw *gatewayState) shutdown() {
+	gw.close()
+	if gw.recorder != nil {
+		gw.recorder.close()
+	}
+	if gw.quotas != nil {
+		if err := gw.quotas.store.Close(); err != nil {
+			log.Printf("Quota: closing usage store: %s", err)
+		}
+	}
+}
+
+// grpcTargets returns the upstream targets of the gRPC routes.
+func (gw *gatewayState) grpcTargets() map[string]bool {
+	targets := make(map[string]bool)
+	for _, rt := range gw.routes {
+		if rt.grpc == nil {
+			continue
+		}
+		pools := []*upstreamPool{rt.pool}
+		if rt.split != nil {
+			for _, v := range rt.split.variants {
+				pools = append(pools, v.pool)
+			}
+		}
+		for _, p := range pools {
+			for _, inst := range p.instances {
+				targets[inst.URL] = true
+			}
+		}
+	}
+	return targets
+}
+
+func serveGateway(w http.ResponseWriter, r *http.Request) {
+	currentGateway().router.ServeHTTP(w, r)
+}
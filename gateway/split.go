@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// splitVariant is one upstream a route's traffic can be sent to. The route's
+// own upstream is the "stable" variant and takes whatever the others leave.
+type splitVariant struct {
+	name   string
+	pool   *upstreamPool
+	weight int
+	header *SplitHeaderConfig
+
+	requests  int64
+	errors    int64
+	latencyNs int64
+}
+
+type splitVariantStatus struct {
+	Name         string  `json:"name"`
+	Upstream     string  `json:"upstream"`
+	Weight       int     `json:"weight"`
+	Requests     int64   `json:"requests"`
+	Errors       int64   `json:"errors"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+}
+
+type splitStatus struct {
+	Route    string               `json:"route"`
+	Sticky   string               `json:"sticky,omitempty"`
+	Variants []splitVariantStatus `json:"variants"`
+}
+
+type trafficSplit struct {
+	sticky   string
+	stable   *splitVariant
+	variants []*splitVariant
+}
+
+func newTrafficSplit(rt *route, pools map[string]*upstreamPool) *trafficSplit {
+	s := &trafficSplit{
+		sticky: rt.Split.Sticky,
+		stable: &splitVariant{name: "stable", pool: rt.pool},
+	}
+	for _, vc := range rt.Split.Variants {
+		s.variants = append(s.variants, &splitVariant{
+			name:   vc.Name,
+			pool:   pools[vc.Upstream],
+			weight: vc.Weight,
+			header: vc.Header,
+		})
+	}
+	return s
+}
+
+// pick chooses the variant for r. A variant whose header matches always
+// wins; otherwise the request falls into a bucket from 0 to 99 and the
+// variants' weights claim buckets in order. With sticky "user" the bucket
+// comes from the username, so a user stays on one variant.
+func (s *trafficSplit) pick(r *http.Request) *splitVariant {
+	for _, v := range s.variants {
+		if v.header != nil && strings.EqualFold(r.Header.Get(v.header.Name), v.header.Value) {
+			return v
+		}
+	}
+
+	var bucket int
+	if claims := claimsFromRequest(r); s.sticky == "user" && claims != nil {
+		h := fnv.New32a()
+		h.Write([]byte(claims.Username))
+		bucket = int(h.Sum32() % 100)
+	} else {
+		bucket = rand.Intn(100)
+	}
+	for _, v := range s.variants {
+		if bucket < v.weight {
+			return v
+		}
+		bucket -= v.weight
+	}
+	return s.stable
+}
+
+func (s *trafficSplit) status(route string) splitStatus {
+	out := splitStatus{Route: route, Sticky: s.sticky}
+	for _, v := range append([]*splitVariant{s.stable}, s.variants...) {
+		vs := splitVariantStatus{
+			Name:     v.name,
+			Upstream: v.pool.name,
+			Weight:   v.weight,
+			Requests: atomic.LoadInt64(&v.requests),
+			Errors:   atomic.LoadInt64(&v.errors),
+		}
+		if vs.Requests > 0 {
+			vs.AvgLatencyMs = float64(atomic.LoadInt64(&v.latencyNs)) / float64(vs.Requests) / 1e6
+		}
+		out.Variants = append(out.Variants, vs)
+	}
+	return out
+}
+
+type splitVariantKey struct{}
+
+// variantFromRequest returns the variant splitMiddleware chose for r, or nil.
+func variantFromRequest(r *http.Request) *splitVariant {
+	v, _ := r.Context().Value(splitVariantKey{}).(*splitVariant)
+	return v
+}
+
+// upstreamFor returns the pool r should be proxied to.
+func (rt *route) upstreamFor(r *http.Request) *upstreamPool {
+	if v := variantFromRequest(r); v != nil {
+		return v.pool
+	}
+	return rt.pool
+}
+
+// splitMiddleware assigns the request to a variant, records the variant's
+// requests, 5xx responses and latency, and tells the client which variant
+// answered in X-Variant.
+func splitMiddleware(s *trafficSplit, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := s.pick(r)
+		w.Header().Set("X-Variant", v.name)
+
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), splitVariantKey{}, v)))
+
+		atomic.AddInt64(&v.requests, 1)
+		atomic.AddInt64(&v.latencyNs, int64(time.Since(start)))
+		if sw.status >= 500 {
+			atomic.AddInt64(&v.errors, 1)
+		}
+	})
+}
+
+func (c *SplitConfig) validate(upstreams map[string]UpstreamConfig) error {
+	switch c.Sticky {
+	case "", "user":
+	default:
+		return fmt.Errorf("unknown split sticky mode %q", c.Sticky)
+	}
+	total := 0
+	names := map[string]bool{"stable": true}
+	for _, v := range c.Variants {
+		if v.Name == "" || names[v.Name] {
+			return fmt.Errorf("split variant name %q is empty or duplicated", v.Name)
+		}
+		names[v.Name] = true
+		if _, ok := upstreams[v.Upstream]; !ok {
+			return fmt.Errorf("split variant %q refers to unknown upstream %q", v.Name, v.Upstream)
+		}
+		if v.Weight < 0 {
+			return fmt.Errorf("split variant %q has a negative weight", v.Name)
+		}
+		total += v.Weight
+	}
+	if total > 100 {
+		return fmt.Errorf("split variant weights add up to %d%%, more than 100", total)
+	}
+	return nil
+}
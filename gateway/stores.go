@@ -0,0 +1,42 @@
+package main
+
+import "sync"
+
+// Stores shared between gateway replicas are compiled in like custom
+// middleware: a file added to the gateway implements the interface and
+// installs it from init. An installed store replaces the in-memory one for
+// the life of the process, across reloads; its config settings (the cache's
+// max_bytes, the quotas' path) then no longer apply.
+var (
+	storesMu          sync.Mutex
+	sharedCache       CacheStore
+	sharedIdempotency IdempotencyStore
+	sharedUsage       UsageStore
+)
+
+// SetCacheStore makes route caches use s.
+func SetCacheStore(s CacheStore) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	sharedCache = s
+}
+
+// SetIdempotencyStore makes idempotency keys use s.
+func SetIdempotencyStore(s IdempotencyStore) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	sharedIdempotency = s
+}
+
+// SetUsageStore makes quotas count in s. The gateway closes it on shutdown.
+func SetUsageStore(s UsageStore) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	sharedUsage = s
+}
+
+func installedStores() (CacheStore, IdempotencyStore, UsageStore) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	return sharedCache, sharedIdempotency, sharedUsage
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+type transformer struct {
+	cfg    *TransformConfig
+	pathRe *regexp.Regexp
+}
+
+func newTransformer(cfg *TransformConfig) (*transformer, error) {
+	t := &transformer{cfg: cfg}
+	if cfg.PathRewrite != nil {
+		re, err := regexp.Compile(cfg.PathRewrite.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path_rewrite pattern: %w", err)
+		}
+		t.pathRe = re
+	}
+	return t, nil
+}
+
+// rewritePath applies the path rewrite to path, returning it unchanged when
+// the pattern does not match.
+func (t *transformer) rewritePath(path string) string {
+	if t.pathRe == nil || !t.pathRe.MatchString(path) {
+		return path
+	}
+	return t.pathRe.ReplaceAllString(path, t.cfg.PathRewrite.Replacement)
+}
+
+// transformMiddleware rewrites the request on its way to the upstream and
+// the response on its way back, so the public API can differ from the
+// services' own paths, parameters, headers and JSON field names.
+func transformMiddleware(t *transformer, maxBody int64, next http.Handler) http.Handler {
+	cfg := t.cfg
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.Clone(r.Context())
+
+		if path := t.rewritePath(r.URL.Path); path != r.URL.Path {
+			r.URL.Path = path
+			r.URL.RawPath = ""
+		}
+		if cfg.Query.changes() {
+			q := r.URL.Query()
+			for from, to := range cfg.Query.Rename {
+				if values, ok := q[from]; ok {
+					delete(q, from)
+					q[to] = append(q[to], values...)
+				}
+			}
+			for _, name := range cfg.Query.Remove {
+				q.Del(name)
+			}
+			for name, value := range cfg.Query.Add {
+				q.Set(name, value)
+			}
+			r.URL.RawQuery = q.Encode()
+		}
+
+		transformHeaders(r.Header, cfg.Request)
+		if cfg.Request.changesBody() && isJSON(r.Header.Get("Content-Type")) && r.Body != nil && r.Body != http.NoBody {
+			body, ok := bufferBody(w, r, maxBody)
+			if !ok {
+				return
+			}
+			if out, err := transformJSON(body, cfg.Request); err == nil {
+				body = out
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+		}
+
+		if !cfg.Response.changesHeaders() && !cfg.Response.changesBody() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if cfg.Response.changesBody() {
+			// Only the proxy's own gzip, which it decodes, is wanted back.
+			r.Header.Del("Accept-Encoding")
+		}
+
+		capture := newResponseCapture()
+		next.ServeHTTP(capture, r)
+
+		body := capture.body.Bytes()
+		if cfg.Response.changesBody() && len(body) > 0 {
+			out, err := transformResponse(capture.header, body, cfg.Response)
+			switch {
+			case err == nil:
+				body = out
+			case len(cfg.Response.RemoveFields) > 0:
+				// Fields are removed to keep them from clients, so a body
+				// that cannot be edited is not passed on.
+				log.Printf("Transform: response from %s: %s", r.URL.Path, err)
+				writeJSON(w, http.StatusBadGateway, map[string]string{"error": "Upstream response could not be transformed"})
+				return
+			}
+		}
+		transformHeaders(capture.header, cfg.Response)
+
+		copyHeaders(w.Header(), capture.header)
+		w.WriteHeader(capture.status)
+		w.Write(body)
+	})
+}
+
+// transformResponse edits a JSON response body, decoding gzip first. Bodies
+// that are neither declared nor valid JSON are left alone; an encoding other
+// than gzip, or a JSON body that does not parse, is an error.
+func transformResponse(h http.Header, body []byte, m MessageTransformConfig) ([]byte, error) {
+	raw := body
+	switch encoding := h.Get("Content-Encoding"); encoding {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("decoding gzip: %w", err)
+		}
+		if body, err = io.ReadAll(zr); err != nil {
+			return nil, fmt.Errorf("decoding gzip: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+	if !isJSON(h.Get("Content-Type")) && !json.Valid(body) {
+		return raw, nil
+	}
+	out, err := transformJSON(body, m)
+	if err != nil {
+		return nil, err
+	}
+	h.Del("Content-Encoding")
+	h.Del("Content-Length")
+	return out, nil
+}
+
+func (q QueryTransformConfig) changes() bool {
+	return len(q.Rename) > 0 || len(q.Remove) > 0 || len(q.Add) > 0
+}
+
+func (m MessageTransformConfig) changesHeaders() bool {
+	return len(m.AddHeaders) > 0 || len(m.RemoveHeaders) > 0 || len(m.RenameHeaders) > 0
+}
+
+func (m MessageTransformConfig) changesBody() bool {
+	return len(m.RenameFields) > 0 || len(m.RemoveFields) > 0
+}
+
+func transformHeaders(h http.Header, m MessageTransformConfig) {
+	for from, to := range m.RenameHeaders {
+		if values, ok := h[http.CanonicalHeaderKey(from)]; ok {
+			h.Del(from)
+			for _, v := range values {
+				h.Add(to, v)
+			}
+		}
+	}
+	for _, name := range m.RemoveHeaders {
+		h.Del(name)
+	}
+	for name, value := range m.AddHeaders {
+		h.Set(name, value)
+	}
+}
+
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && isJSONMediaType(mediaType)
+}
+
+// transformJSON renames and removes fields in a JSON document. Field paths
+// are dot separated and arrays are walked element by element, so
+// "credit_card" applies to every customer in a list response.
+func transformJSON(data []byte, m MessageTransformConfig) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	for _, field := range m.RemoveFields {
+		editField(doc, strings.Split(field, "."), func(obj map[string]interface{}, key string) {
+			delete(obj, key)
+		})
+	}
+	for from, to := range m.RenameFields {
+		editField(doc, strings.Split(from, "."), func(obj map[string]interface{}, key string) {
+			if v, ok := obj[key]; ok {
+				delete(obj, key)
+				obj[to] = v
+			}
+		})
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func editField(v interface{}, path []string, edit func(obj map[string]interface{}, key string)) {
+	switch v := v.(type) {
+	case []interface{}:
+		for _, elem := range v {
+			editField(elem, path, edit)
+		}
+	case map[string]interface{}:
+		if len(path) == 1 {
+			edit(v, path[0])
+			return
+		}
+		if child, ok := v[path[0]]; ok {
+			editField(child, path[1:], edit)
+		}
+	}
+}
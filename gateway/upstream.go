@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errNoUpstream = errors.New("no healthy upstream instance")
+
+type upstreamPool struct {
+	name        string
+	instances   []*upstreamInstance
+	healthCheck HealthCheckConfig
+	next        uint32
+	stop        chan struct{}
+	// limiter is nil unless the upstream has a concurrency limit.
+	limiter *concurrencyLimiter
+	// breaker is nil unless the upstream has a circuit breaker.
+	breaker *circuitBreaker
+}
+
+type upstreamInstance struct {
+	URL      string
+	healthy  int32
+	draining int32
+	inFlight int64
+
+	mu          sync.Mutex
+	lastChecked time.Time
+	lastError   string
+}
+
+type instanceStatus struct {
+	URL         string    `json:"url"`
+	Healthy     bool      `json:"healthy"`
+	Draining    bool      `json:"draining"`
+	InFlight    int64     `json:"in_flight"`
+	LastChecked time.Time `json:"last_checked,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+func newUpstreamPool(name string, cfg UpstreamConfig) *upstreamPool {
+	p := &upstreamPool{name: name, healthCheck: cfg.HealthCheck, stop: make(chan struct{})}
+	if cfg.Concurrency != nil {
+		p.limiter = newConcurrencyLimiter(cfg.Concurrency)
+	}
+	if cfg.CircuitBreaker != nil {
+		p.breaker = newCircuitBreaker(cfg.CircuitBreaker)
+	}
+	for _, target := range cfg.Targets {
+		p.instances = append(p.instances, &upstreamInstance{URL: target, healthy: 1})
+	}
+	return p
+}
+
+// pick returns the next instance in round-robin order, skipping instances
+// that are unhealthy or being drained.
+func (p *upstreamPool) pick() (*upstreamInstance, error) {
+	n := len(p.instances)
+	start := atomic.AddUint32(&p.next, 1)
+	for i := 0; i < n; i++ {
+		inst := p.instances[(int(start)+i)%n]
+		if inst.available() {
+			return inst, nil
+		}
+	}
+	return nil, errNoUpstream
+}
+
+func (p *upstreamPool) instance(url string) *upstreamInstance {
+	for _, inst := range p.instances {
+		if inst.URL == url {
+			return inst
+		}
+	}
+	return nil
+}
+
+func (p *upstreamPool) status() []instanceStatus {
+	out := make([]instanceStatus, 0, len(p.instances))
+	for _, inst := range p.instances {
+		out = append(out, inst.status())
+	}
+	return out
+}
+
+// startHealthChecks polls every instance until the pool is closed. Pools
+// without a health check path are assumed healthy.
+func (p *upstreamPool) startHealthChecks() {
+	if p.healthCheck.Path == "" {
+		return
+	}
+	interval := p.healthCheck.Interval.Duration
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	timeout := p.healthCheck.Timeout.Duration
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			for _, inst := range p.instances {
+				inst.check(client, p.healthCheck.Path)
+			}
+			select {
+			case <-ticker.C:
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (p *upstreamPool) close() {
+	close(p.stop)
+}
+
+func (i *upstreamInstance) check(client *http.Client, path string) {
+	var errMsg string
+	resp, err := client.Get(i.URL + path)
+	if err != nil {
+		errMsg = err.Error()
+	} else {
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			errMsg = resp.Status
+		}
+	}
+
+	i.setHealthy(errMsg == "")
+	i.mu.Lock()
+	i.lastChecked = time.Now()
+	i.lastError = errMsg
+	i.mu.Unlock()
+}
+
+func (i *upstreamInstance) available() bool {
+	return atomic.LoadInt32(&i.healthy) == 1 && atomic.LoadInt32(&i.draining) == 0
+}
+
+func (i *upstreamInstance) setHealthy(v bool) {
+	atomic.StoreInt32(&i.healthy, boolToInt32(v))
+}
+
+func (i *upstreamInstance) setDraining(v bool) {
+	atomic.StoreInt32(&i.draining, boolToInt32(v))
+}
+
+func (i *upstreamInstance) isDraining() bool {
+	return atomic.LoadInt32(&i.draining) == 1
+}
+
+func (i *upstreamInstance) status() instanceStatus {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return instanceStatus{
+		URL:         i.URL,
+		Healthy:     atomic.LoadInt32(&i.healthy) == 1,
+		Draining:    i.isDraining(),
+		InFlight:    atomic.LoadInt64(&i.inFlight),
+		LastChecked: i.lastChecked,
+		LastError:   i.lastError,
+	}
+}
+
+func boolToInt32(v bool) int32 {
+	if v {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// maxViolations bounds how many problems a 400 lists.
+const maxViolations = 20
+
+type violation struct {
+	// In is path, query or body; Name is the parameter, or the dotted path
+	// of the body field with [i] for array elements.
+	In    string `json:"in"`
+	Name  string `json:"name,omitempty"`
+	Error string `json:"error"`
+}
+
+// validateMiddleware checks path parameters, query parameters and JSON
+// bodies against the route's OpenAPI spec, as clients see it, and answers 400
+// with every violation instead of proxying a request the service would
+// reject. Requests the spec does not describe, and every request before the
+// spec was first fetched, go through unchecked: the service stays the
+// authority. Refreshing the spec never holds requests up.
+func validateMiddleware(docs *openAPIDocs, rt *route, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		spec, _ := docs.routeSpec(rt, false)
+		if spec == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		op, pathValues := spec.match(r)
+		if op == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var body []byte
+		if op.body != nil && r.Body != nil && r.Body != http.NoBody {
+			var ok bool
+			if body, ok = bufferBody(w, r, rt.maxBodyBytes()); !ok {
+				return
+			}
+		}
+
+		v := &schemaValidator{schemas: spec.schemas, strict: rt.Validation.Strict}
+		v.request(op, pathValues, r, body)
+		if len(v.violations) > 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"error":      "Request does not match the API description",
+				"violations": v.violations,
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// match finds the operation for r and the values of its path parameters.
+func (s *routeSpec) match(r *http.Request) (*specOperation, map[string]string) {
+	for _, op := range s.ops {
+		if op.method != r.Method {
+			continue
+		}
+		m := op.path.FindStringSubmatch(r.URL.Path)
+		if m == nil {
+			continue
+		}
+		values := make(map[string]string)
+		for i, name := range op.path.SubexpNames() {
+			if name != "" {
+				values[name] = m[i]
+			}
+		}
+		return op, values
+	}
+	return nil, nil
+}
+
+// schemaValidator checks values against the subset of OpenAPI 3.0 schemas
+// the services use: types, nullable, enum, required and additional
+// properties, items, lengths, bounds, patterns, date formats and
+// allOf/anyOf/oneOf.
+type schemaValidator struct {
+	schemas map[string]interface{}
+	// strict treats objects without additionalProperties as closed and
+	// rejects undeclared query parameters.
+	strict     bool
+	violations []violation
+}
+
+func (v *schemaValidator) fail(in, name, format string, args ...interface{}) {
+	if len(v.violations) < maxViolations {
+		v.violations = append(v.violations, violation{In: in, Name: name, Error: fmt.Sprintf(format, args...)})
+	}
+}
+
+func (v *schemaValidator) request(op *specOperation, pathValues map[string]string, r *http.Request, body []byte) {
+	query := r.URL.Query()
+	declared := make(map[string]bool)
+	for _, p := range op.params {
+		name, _ := p["name"].(string)
+		schema := p["schema"]
+		switch p["in"] {
+		case "path":
+			if raw, ok := pathValues[name]; ok {
+				v.check(schema, paramValue(v.resolve(schema), []string{raw}, p), "path", name, 0)
+			}
+		case "query":
+			declared[name] = true
+			values, ok := query[name]
+			if !ok {
+				if p["required"] == true {
+					v.fail("query", name, "is required")
+				}
+				continue
+			}
+			v.check(schema, paramValue(v.resolve(schema), values, p), "query", name, 0)
+		}
+	}
+	if v.strict {
+		var unknown []string
+		for name := range query {
+			if !declared[name] {
+				unknown = append(unknown, name)
+			}
+		}
+		sort.Strings(unknown)
+		for _, name := range unknown {
+			v.fail("query", name, "is not a parameter of this operation")
+		}
+	}
+	if op.body != nil {
+		v.body(op.body, r.Header.Get("Content-Type"), body)
+	}
+}
+
+func (v *schemaValidator) body(requestBody map[string]interface{}, contentType string, body []byte) {
+	if len(bytes.TrimSpace(body)) == 0 {
+		if requestBody["required"] == true {
+			v.fail("body", "", "is required")
+		}
+		return
+	}
+	// Other media types are left to the body limits.
+	if !isJSON(contentType) {
+		return
+	}
+	var schema interface{}
+	found := false
+	for mediaType, c := range jsonObject(requestBody["content"]) {
+		if isJSON(mediaType) {
+			schema, found = jsonObject(c)["schema"], true
+		}
+	}
+	if !found {
+		return
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		v.fail("body", "", "is not valid JSON")
+		return
+	}
+	v.check(schema, doc, "body", "", 0)
+}
+
+// paramValue converts the raw values of a parameter to what its schema
+// expects, so that they can be checked like JSON. Values that do not convert
+// stay strings and fail the type check.
+func paramValue(schema map[string]interface{}, raw []string, param map[string]interface{}) interface{} {
+	if schema["type"] == "array" {
+		if param["explode"] == false {
+			var split []string
+			for _, r := range raw {
+				split = append(split, strings.Split(r, ",")...)
+			}
+			raw = split
+		}
+		items := jsonObject(schema["items"])
+		out := make([]interface{}, len(raw))
+		for i, r := range raw {
+			out[i] = scalarParam(items, r)
+		}
+		return out
+	}
+	return scalarParam(schema, raw[0])
+}
+
+func scalarParam(schema map[string]interface{}, raw string) interface{} {
+	switch schema["type"] {
+	case "integer", "number":
+		if _, err := strconv.ParseFloat(raw, 64); err == nil {
+			return json.Number(raw)
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(raw); err == nil {
+			return b
+		}
+	}
+	return raw
+}
+
+// resolve follows references to component schemas.
+func (v *schemaValidator) resolve(schema interface{}) map[string]interface{} {
+	s := jsonObject(schema)
+	for i := 0; i < 8 && s != nil; i++ {
+		ref, ok := s["$ref"].(string)
+		if !ok {
+			return s
+		}
+		s = jsonObject(v.schemas[strings.TrimPrefix(ref, "#/components/schemas/")])
+	}
+	return s
+}
+
+func (v *schemaValidator) check(schema, value interface{}, in, name string, depth int) {
+	s := v.resolve(schema)
+	if s == nil || depth > 32 {
+		return
+	}
+	for _, sub := range jsonList(s["allOf"]) {
+		v.check(sub, value, in, name, depth+1)
+	}
+	if alts := jsonList(s["anyOf"]); len(alts) > 0 && v.matching(alts, value, depth) == 0 {
+		v.fail(in, name, "matches none of the allowed schemas")
+	}
+	if alts := jsonList(s["oneOf"]); len(alts) > 0 && v.matching(alts, value, depth) != 1 {
+		v.fail(in, name, "must match exactly one of the allowed schemas")
+	}
+
+	typ, _ := s["type"].(string)
+	if typ == "" && s["properties"] != nil {
+		typ = "object"
+	}
+	if value == nil {
+		if typ != "" && s["nullable"] != true {
+			v.fail(in, name, "must not be null")
+		}
+		return
+	}
+	if typ != "" && !hasType(value, typ) {
+		v.fail(in, name, "must be %s, not %s", article(typ), article(jsonType(value)))
+		return
+	}
+	if enum := jsonList(s["enum"]); len(enum) > 0 && !inEnum(enum, value) {
+		v.fail(in, name, "must be one of %s", enumList(enum))
+	}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		v.checkObject(s, value, in, name, depth)
+	case []interface{}:
+		if min, ok := number(s["minItems"]); ok && float64(len(value)) < min {
+			v.fail(in, name, "must have at least %v items", min)
+		}
+		if max, ok := number(s["maxItems"]); ok && float64(len(value)) > max {
+			v.fail(in, name, "must have at most %v items", max)
+		}
+		for i, elem := range value {
+			v.check(s["items"], elem, in, fmt.Sprintf("%s[%d]", name, i), depth+1)
+		}
+	case string:
+		n := float64(utf8.RuneCountInString(value))
+		if min, ok := number(s["minLength"]); ok && n < min {
+			v.fail(in, name, "must be at least %v characters", min)
+		}
+		if max, ok := number(s["maxLength"]); ok && n > max {
+			v.fail(in, name, "must be at most %v characters", max)
+		}
+		if pattern, ok := s["pattern"].(string); ok {
+			if re := schemaPattern(pattern); re != nil && !re.MatchString(value) {
+				v.fail(in, name, "must match %s", pattern)
+			}
+		}
+		v.checkFormat(s, value, in, name)
+	case json.Number:
+		f, _ := value.Float64()
+		if min, ok := number(s["minimum"]); ok && (f < min || f == min && s["exclusiveMinimum"] == true) {
+			v.fail(in, name, "must be at least %v", min)
+		}
+		if max, ok := number(s["maximum"]); ok && (f > max || f == max && s["exclusiveMaximum"] == true) {
+			v.fail(in, name, "must be at most %v", max)
+		}
+	}
+}
+
+func (v *schemaValidator) checkObject(s map[string]interface{}, obj map[string]interface{}, in, name string, depth int) {
+	props := jsonObject(s["properties"])
+	for _, req := range jsonList(s["required"]) {
+		key, _ := req.(string)
+		// Read-only fields are set by the service and never sent.
+		if _, ok := obj[key]; !ok && v.resolve(props[key])["readOnly"] != true {
+			v.fail(in, joinField(name, key), "is required")
+		}
+	}
+
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if prop, ok := props[key]; ok {
+			v.check(prop, obj[key], in, joinField(name, key), depth+1)
+			continue
+		}
+		switch extra := s["additionalProperties"].(type) {
+		case map[string]interface{}:
+			v.check(extra, obj[key], in, joinField(name, key), depth+1)
+		case bool:
+			if !extra {
+				v.fail(in, joinField(name, key), "is not a known field")
+			}
+		default:
+			if v.strict {
+				v.fail(in, joinField(name, key), "is not a known field")
+			}
+		}
+	}
+}
+
+func (v *schemaValidator) checkFormat(s map[string]interface{}, value, in, name string) {
+	var layout string
+	switch s["format"] {
+	case "date-time":
+		layout = time.RFC3339
+	case "date":
+		layout = "2006-01-02"
+	default:
+		return
+	}
+	if _, err := time.Parse(layout, value); err != nil {
+		v.fail(in, name, "must be a %s like %s", s["format"], layout)
+	}
+}
+
+// matching counts the schemas among alts that value satisfies.
+func (v *schemaValidator) matching(alts []interface{}, value interface{}, depth int) int {
+	n := 0
+	for _, alt := range alts {
+		sub := &schemaValidator{schemas: v.schemas, strict: v.strict}
+		sub.check(alt, value, "", "", depth+1)
+		if len(sub.violations) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func hasType(value interface{}, typ string) bool {
+	switch typ {
+	case "integer":
+		n, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := strconv.ParseInt(n.String(), 10, 64)
+		return err == nil
+	case "number":
+		_, ok := value.(json.Number)
+		return ok
+	}
+	return jsonType(value) == typ
+}
+
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case bool:
+		return "boolean"
+	}
+	return "null"
+}
+
+func article(typ string) string {
+	switch typ {
+	case "integer", "array", "object":
+		return "an " + typ
+	case "null":
+		return typ
+	}
+	return "a " + typ
+}
+
+// inEnum compares by JSON encoding, so 1 in a spec matches 1 in a request.
+func inEnum(enum []interface{}, value interface{}) bool {
+	got, _ := json.Marshal(value)
+	for _, e := range enum {
+		if want, _ := json.Marshal(e); bytes.Equal(got, want) {
+			return true
+		}
+	}
+	return false
+}
+
+func enumList(enum []interface{}) string {
+	parts := make([]string, len(enum))
+	for i, e := range enum {
+		b, _ := json.Marshal(e)
+		parts[i] = string(b)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func number(v interface{}) (float64, bool) {
+	f, ok := v.(float64)
+	return f, ok
+}
+
+func jsonList(v interface{}) []interface{} {
+	l, _ := v.([]interface{})
+	return l
+}
+
+func joinField(name, key string) string {
+	if name == "" {
+		return key
+	}
+	return name + "." + key
+}
+
+var schemaPatterns sync.Map
+
+// schemaPattern compiles a schema's pattern once. Patterns Go cannot compile
+// are not checked.
+func schemaPattern(pattern string) *regexp.Regexp {
+	if re, ok := schemaPatterns.Load(pattern); ok {
+		return re.(*regexp.Regexp)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil
+	}
+	schemaPatterns.Store(pattern, re)
+	return re
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sync/atomic"
+)
+
+const (
+	wafActionBlock = "block"
+	wafActionLog   = "log"
+	wafActionScore = "score"
+)
+
+// defaultWAFRules are used when the config enables the WAF on a route but
+// defines no rules of its own.
+func defaultWAFRules() []WAFRuleConfig {
+	return []WAFRuleConfig{
+		{
+			ID:      "sqli-union-select",
+			Targets: []string{"path", "query", "body"},
+			Pattern: `(?i)\bunion\b[\s/*]+(all[\s/*]+)?select\b`,
+			Action:  wafActionBlock,
+		},
+		{
+			ID:      "sqli-tautology",
+			Targets: []string{"path", "query", "body"},
+			Pattern: `(?i)['"]\s*(or|and)\s+['"\d\w]+\s*=\s*['"\d\w]+`,
+			Action:  wafActionScore,
+			Score:   5,
+		},
+		{
+			ID:      "sqli-comment-or-stacked",
+			Targets: []string{"path", "query", "body"},
+			Pattern: `(?i)(;\s*(drop|delete|insert|update|alter|truncate)\b|--\s*$|/\*.*\*/)`,
+			Action:  wafActionScore,
+			Score:   5,
+		},
+		{
+			ID:      "path-traversal",
+			Targets: []string{"path", "query"},
+			Pattern: `(?i)(\.\./|\.\.\\|%2e%2e|%252e)`,
+			Action:  wafActionBlock,
+		},
+		{
+			ID:        "oversized-parameter",
+			Targets:   []string{"query", "headers"},
+			MaxLength: 4096,
+			Action:    wafActionBlock,
+		},
+	}
+}
+
+type wafRule struct {
+	WAFRuleConfig
+	pattern *regexp.Regexp
+	targets map[string]bool
+	hits    int64
+}
+
+type wafRuleStatus struct {
+	WAFRuleConfig
+	Hits int64 `json:"hits"`
+}
+
+type wafEngine struct {
+	rules        map[string]*wafRule
+	order        []string
+	blockScore   int
+	maxBodyBytes int64
+}
+
+func newWAFEngine(cfg WAFConfig) (*wafEngine, error) {
+	ruleCfgs := cfg.Rules
+	if len(ruleCfgs) == 0 {
+		ruleCfgs = defaultWAFRules()
+	}
+	e := &wafEngine{
+		rules:        make(map[string]*wafRule),
+		blockScore:   cfg.BlockScore,
+		maxBodyBytes: cfg.MaxBodyBytes,
+	}
+	if e.blockScore <= 0 {
+		e.blockScore = 5
+	}
+	if e.maxBodyBytes <= 0 {
+		e.maxBodyBytes = 64 << 10
+	}
+
+	for _, rc := range ruleCfgs {
+		if rc.ID == "" || e.rules[rc.ID] != nil {
+			return nil, fmt.Errorf("waf rule id %q is empty or duplicated", rc.ID)
+		}
+		switch rc.Action {
+		case wafActionBlock, wafActionLog, wafActionScore:
+		default:
+			return nil, fmt.Errorf("waf rule %q has unknown action %q", rc.ID, rc.Action)
+		}
+		rule := &wafRule{WAFRuleConfig: rc, targets: make(map[string]bool)}
+		for _, t := range rc.Targets {
+			switch t {
+			case "method", "path", "query", "headers", "body":
+				rule.targets[t] = true
+			default:
+				return nil, fmt.Errorf("waf rule %q has unknown target %q", rc.ID, t)
+			}
+		}
+		if rc.Pattern != "" {
+			re, err := regexp.Compile(rc.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("waf rule %q: %w", rc.ID, err)
+			}
+			rule.pattern = re
+		} else if rc.MaxLength <= 0 {
+			return nil, fmt.Errorf("waf rule %q needs a pattern or max_length", rc.ID)
+		}
+		e.rules[rc.ID] = rule
+		e.order = append(e.order, rc.ID)
+	}
+	return e, nil
+}
+
+// forRoute returns the rules a route enabled, all rules when it named none.
+func (e *wafEngine) forRoute(cfg *RouteWAFConfig) ([]*wafRule, error) {
+	ids := cfg.Rules
+	if len(ids) == 0 {
+		ids = e.order
+	}
+	rules := make([]*wafRule, 0, len(ids))
+	for _, id := range ids {
+		rule, ok := e.rules[id]
+		if !ok {
+			return nil, fmt.Errorf("unknown waf rule %q", id)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (e *wafEngine) status() []wafRuleStatus {
+	out := make([]wafRuleStatus, 0, len(e.order))
+	for _, id := range e.order {
+		rule := e.rules[id]
+		out = append(out, wafRuleStatus{WAFRuleConfig: rule.WAFRuleConfig, Hits: atomic.LoadInt64(&rule.hits)})
+	}
+	return out
+}
+
+// matches reports whether the rule fires on any of the values collected for
+// its targets.
+func (rule *wafRule) matches(fields map[string][]string) bool {
+	for target := range rule.targets {
+		for _, v := range fields[target] {
+			if rule.MaxLength > 0 && len(v) > rule.MaxLength {
+				return true
+			}
+			if rule.pattern != nil && rule.pattern.MatchString(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wafMiddleware runs the route's rules against the request. Block rules
+// reject immediately; score rules add up and reject once the route's block
+// score is reached; log rules only log.
+func wafMiddleware(rt *route, e *wafEngine, rules []*wafRule, next http.Handler) http.Handler {
+	blockScore := e.blockScore
+	if rt.WAF.BlockScore > 0 {
+		blockScore = rt.WAF.BlockScore
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fields, err := wafFields(r, e.maxBodyBytes)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Error reading request body"})
+			return
+		}
+
+		score := 0
+		for _, rule := range rules {
+			if !rule.matches(fields) {
+				continue
+			}
+			atomic.AddInt64(&rule.hits, 1)
+			log.Printf("WAF: rule %s (%s) matched %s %s on route %s", rule.ID, rule.Action, r.Method, r.URL.Path, rt.name())
+
+			switch rule.Action {
+			case wafActionBlock:
+				writeJSON(w, http.StatusForbidden, map[string]string{"error": "Forbidden"})
+				return
+			case wafActionScore:
+				score += rule.Score
+			}
+		}
+		if score >= blockScore {
+			log.Printf("WAF: blocked %s %s on route %s with score %d", r.Method, r.URL.Path, rt.name(), score)
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "Forbidden"})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// wafFields collects the inspected parts of a request. Only the first
+// maxBody bytes of the body are examined; the body is restored for the
+// upstream untouched.
+func wafFields(r *http.Request, maxBody int64) (map[string][]string, error) {
+	fields := map[string][]string{
+		"method": {r.Method},
+		"path":   {r.URL.Path, r.URL.EscapedPath()},
+	}
+
+	for key, values := range r.URL.Query() {
+		fields["query"] = append(fields["query"], key)
+		fields["query"] = append(fields["query"], values...)
+	}
+
+	for key, values := range r.Header {
+		if key == "Authorization" {
+			continue
+		}
+		fields["headers"] = append(fields["headers"], values...)
+	}
+
+	if r.Body != nil && r.Body != http.NoBody {
+		head, err := io.ReadAll(io.LimitReader(r.Body, maxBody))
+		if err != nil {
+			return nil, err
+		}
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+		fields["body"] = []string{string(head)}
+	}
+	return fields, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
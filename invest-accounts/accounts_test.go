@@ -2,17 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 var (
@@ -222,6 +230,190 @@ func TestDeleteInvestAccount(t *testing.T) {
 	}
 }
 
+func TestGetInvestAccountsByOwner(t *testing.T) {
+	clearTestData()
+	insertMockInvestAccounts([]InvestAccount{
+		{OwnerId: 1, ClientSurveyNumber: 123, Share: "ABC", InvestedAmountOfMoney: 1000.0, FreeAmountOfMoney: 500.0},
+		{OwnerId: 2, ClientSurveyNumber: 456, Share: "DEF", InvestedAmountOfMoney: 2000.0, FreeAmountOfMoney: 1000.0},
+		{OwnerId: 3, ClientSurveyNumber: 789, Share: "GHI", InvestedAmountOfMoney: 3000.0, FreeAmountOfMoney: 1500.0},
+	})
+
+	rr := httptest.NewRecorder()
+	GetInvestAccounts(rr, httptest.NewRequest("GET", "/invest-account?owner_id=1&owner_id=3", nil))
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var response []InvestAccount
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Error decoding JSON response: %v", err)
+	}
+	if len(response) != 2 {
+		t.Fatalf("Expected 2 invest accounts, got %d", len(response))
+	}
+	for _, account := range response {
+		if account.OwnerId != 1 && account.OwnerId != 3 {
+			t.Errorf("Got an account of owner %d", account.OwnerId)
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	GetInvestAccounts(rr, httptest.NewRequest("GET", "/invest-account?owner_id=1&owner_id=x", nil))
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("Handler returned wrong status code for an invalid owner ID: got %v want %v", status, http.StatusBadRequest)
+	}
+}
+
+func TestCreateInvestAccountBodyLimits(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"too large", "application/json", `{"share": "` + strings.Repeat("A", maxBodyBytes) + `"}`, http.StatusRequestEntityTooLarge},
+		{"not JSON", "text/plain", `{"share": "ABC"}`, http.StatusUnsupportedMediaType},
+		{"too deep", "application/json", strings.Repeat("[", maxJSONDepth+1) + strings.Repeat("]", maxJSONDepth+1), http.StatusBadRequest},
+		{"unknown field", "application/json", `{"share": "ABC", "owner": 1}`, http.StatusBadRequest},
+		{"trailing data", "application/json", `{"share": "ABC"} {}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/invest-account", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", tt.contentType)
+		rr := httptest.NewRecorder()
+		CreateInvestAccount(rr, req)
+
+		if rr.Code != tt.status {
+			t.Errorf("%s: Handler returned wrong status code: got %v want %v", tt.name, rr.Code, tt.status)
+		}
+		var response map[string]string
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil || response["error"] == "" {
+			t.Errorf("%s: Expected a JSON error, got %q", tt.name, rr.Body.String())
+		}
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	rr := httptest.NewRecorder()
+	OpenAPIHandler(rr, httptest.NewRequest("GET", "/openapi.json", nil))
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var doc struct {
+		Paths      map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]map[string]interface{} `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("Error decoding JSON response: %v", err)
+	}
+
+	for path, methods := range map[string][]string{
+		"/invest-account":      {"get", "post"},
+		"/invest-account/{id}": {"get", "put", "delete"},
+	} {
+		for _, method := range methods {
+			if _, ok := doc.Paths[path][method]; !ok {
+				t.Errorf("Expected %s %s in the document", method, path)
+			}
+		}
+	}
+
+	// The schema follows the model's JSON encoding.
+	props := doc.Components.Schemas["InvestAccount"].Properties
+	encoded, _ := json.Marshal(InvestAccount{})
+	var fields map[string]interface{}
+	json.Unmarshal(encoded, &fields)
+	if len(props) != len(fields) {
+		t.Errorf("Expected %d schema properties, got %d", len(fields), len(props))
+	}
+	for name := range fields {
+		if _, ok := props[name]; !ok {
+			t.Errorf("Field %s is missing from the schema", name)
+		}
+	}
+	if props["id"]["readOnly"] != true || props["owner_id"]["type"] != "integer" || props["free_amount_of_money"]["type"] != "number" {
+		t.Errorf("Unexpected property schemas: %v", props)
+	}
+}
+
+func TestGRPCInvestAccounts(t *testing.T) {
+	clearTestData()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newGRPCServer()
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := NewInvestAccountsClient(conn)
+	ctx := context.Background()
+
+	if _, err := client.CreateInvestAccount(ctx, &CreateInvestAccountRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument without an account, got %v", err)
+	}
+
+	created, err := client.CreateInvestAccount(ctx, &CreateInvestAccountRequest{InvestAccount: &InvestAccountRecord{
+		OwnerId: 1, ClientSurveyNumber: 123, Share: "ABC", InvestedAmountOfMoney: 1000.0, FreeAmountOfMoney: 500.0,
+	}})
+	if err != nil {
+		t.Fatalf("CreateInvestAccount failed: %v", err)
+	}
+	insertMockInvestAccount(InvestAccount{OwnerId: 2, ClientSurveyNumber: 456, Share: "DEF", InvestedAmountOfMoney: 2000.0, FreeAmountOfMoney: 1000.0})
+
+	got, err := client.GetInvestAccount(ctx, &GetInvestAccountRequest{Id: created.Id})
+	if err != nil {
+		t.Fatalf("GetInvestAccount failed: %v", err)
+	}
+	if got.OwnerId != 1 || got.Share != "ABC" {
+		t.Errorf("Expected the created account, got %v", got)
+	}
+
+	stream, err := client.ListInvestAccounts(ctx, &ListInvestAccountsRequest{OwnerIds: []int32{1}})
+	if err != nil {
+		t.Fatalf("ListInvestAccounts failed: %v", err)
+	}
+	var listed []*InvestAccountRecord
+	for {
+		account, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ListInvestAccounts failed: %v", err)
+		}
+		listed = append(listed, account)
+	}
+	if len(listed) != 1 || listed[0].Id != created.Id {
+		t.Errorf("Expected only the account of owner 1, got %v", listed)
+	}
+
+	created.Share = "XYZ"
+	if _, err := client.UpdateInvestAccount(ctx, &UpdateInvestAccountRequest{Id: created.Id, InvestAccount: created}); err != nil {
+		t.Fatalf("UpdateInvestAccount failed: %v", err)
+	}
+	if got, _ := client.GetInvestAccount(ctx, &GetInvestAccountRequest{Id: created.Id}); got == nil || got.Share != "XYZ" {
+		t.Errorf("Expected the updated share, got %v", got)
+	}
+
+	if _, err := client.DeleteInvestAccount(ctx, &DeleteInvestAccountRequest{Id: created.Id}); err != nil {
+		t.Fatalf("DeleteInvestAccount failed: %v", err)
+	}
+	if _, err := client.GetInvestAccount(ctx, &GetInvestAccountRequest{Id: created.Id}); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound after deleting, got %v", err)
+	}
+}
+
 func insertMockInvestAccounts(accounts []InvestAccount) {
 	for _, account := range accounts {
 		_, err := db.Exec("INSERT INTO invest_accounts.public.invest_accounts (owner_id, client_survey_number, share, invested_amount_of_money, free_amount_of_money) VALUES ($1, $2, $3, $4, $5)",
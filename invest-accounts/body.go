@@ -0,0 +1,93 @@
+// The customers and invest-accounts services are separate package mains, so
+// each has a copy of this file. customers/body.go is the canonical one:
+// change it and copy it to invest-accounts/body.go, which must stay
+// identical. The JSON depth check is the one in gateway/body.go.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+)
+
+const (
+	maxBodyBytes = 1 << 20
+	maxJSONDepth = 16
+)
+
+// bodyError is a request body problem that maps to a specific status code.
+type bodyError struct {
+	status  int
+	message string
+}
+
+func (e *bodyError) Error() string {
+	return e.message
+}
+
+// decodeJSONBody decodes a JSON request body into dst. It rejects bodies over
+// maxBodyBytes (413), non-JSON content types (415), and payloads that are
+// nested too deeply, carry unknown fields or trailing data (400).
+func decodeJSONBody(r *http.Request, dst interface{}) error {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return &bodyError{http.StatusUnsupportedMediaType, "Content-Type must be application/json"}
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxBodyBytes+1))
+	if err != nil {
+		return &bodyError{http.StatusBadRequest, "Bad request"}
+	}
+	if len(data) > maxBodyBytes {
+		return &bodyError{http.StatusRequestEntityTooLarge, "Request body too large"}
+	}
+	if err := checkJSONDepth(data); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		return &bodyError{http.StatusBadRequest, "Bad request: " + err.Error()}
+	}
+	if dec.More() {
+		return &bodyError{http.StatusBadRequest, "Bad request: unexpected data after JSON body"}
+	}
+	return nil
+}
+
+func checkJSONDepth(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &bodyError{http.StatusBadRequest, "Bad request: " + err.Error()}
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+			if depth > maxJSONDepth {
+				return &bodyError{http.StatusBadRequest, "JSON nesting too deep"}
+			}
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+}
+
+func respondWithBodyError(w http.ResponseWriter, err error) {
+	var be *bodyError
+	if errors.As(err, &be) {
+		respondWithError(w, be.status, be.message)
+		return
+	}
+	respondWithError(w, http.StatusBadRequest, "Bad request")
+}
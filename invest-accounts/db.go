@@ -51,3 +51,10 @@ func initDB() {
 		log.Fatalf("Failed to connect to the database after %d attempts", maxAttempts)
 	}
 }
+
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
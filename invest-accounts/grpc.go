@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+
+	"github.com/lib/pq"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// investAccountsServer serves the InvestAccounts gRPC API from the same table
+// as the REST handlers.
+type investAccountsServer struct {
+	UnimplementedInvestAccountsServer
+}
+
+func newGRPCServer() *grpc.Server {
+	srv := grpc.NewServer(grpc.MaxRecvMsgSize(maxBodyBytes))
+	RegisterInvestAccountsServer(srv, investAccountsServer{})
+	return srv
+}
+
+func (investAccountsServer) ListInvestAccounts(req *ListInvestAccountsRequest, stream InvestAccounts_ListInvestAccountsServer) error {
+	query := "SELECT " + investAccountColumns + " FROM invest_accounts.public.invest_accounts"
+	var args []interface{}
+	if len(req.OwnerIds) > 0 {
+		query += " WHERE owner_id = ANY($1)"
+		args = append(args, pq.Array(req.OwnerIds))
+	}
+
+	rows, err := db.QueryContext(stream.Context(), query, args...)
+	if err != nil {
+		log.Println("Error querying invest account:", err)
+		return status.Error(codes.Internal, "Internal server error")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c InvestAccount
+		if err := scanInvestAccount(rows, &c); err != nil {
+			log.Println("Error scanning invest account row:", err)
+			return status.Error(codes.Internal, "Internal server error")
+		}
+		if err := stream.Send(investAccountToProto(c)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (investAccountsServer) GetInvestAccount(ctx context.Context, req *GetInvestAccountRequest) (*InvestAccountRecord, error) {
+	var c InvestAccount
+	err := scanInvestAccount(db.QueryRowContext(ctx, "SELECT "+investAccountColumns+" FROM invest_accounts.public.invest_accounts WHERE id = $1", req.Id), &c)
+	if err == sql.ErrNoRows {
+		return nil, status.Error(codes.NotFound, "Invest account not found")
+	}
+	if err != nil {
+		log.Println("Error querying invest account by ID:", err)
+		return nil, status.Error(codes.Internal, "Internal server error")
+	}
+	return investAccountToProto(c), nil
+}
+
+func (investAccountsServer) CreateInvestAccount(ctx context.Context, req *CreateInvestAccountRequest) (*InvestAccountRecord, error) {
+	if req.InvestAccount == nil {
+		return nil, status.Error(codes.InvalidArgument, "invest_account is required")
+	}
+	c := investAccountFromProto(req.InvestAccount)
+
+	err := db.QueryRowContext(ctx, "INSERT INTO invest_accounts.public.invest_accounts(owner_id, client_survey_number, share, invested_amount_of_money, free_amount_of_money) VALUES($1, $2, $3, $4, $5) RETURNING id",
+		c.OwnerId, c.ClientSurveyNumber, c.Share, c.InvestedAmountOfMoney, c.FreeAmountOfMoney).Scan(&c.ID)
+	if err != nil {
+		log.Println("Error inserting new invest account:", err)
+		return nil, status.Error(codes.Internal, "Internal server error")
+	}
+	return investAccountToProto(c), nil
+}
+
+func (investAccountsServer) UpdateInvestAccount(ctx context.Context, req *UpdateInvestAccountRequest) (*emptypb.Empty, error) {
+	if req.InvestAccount == nil {
+		return nil, status.Error(codes.InvalidArgument, "invest_account is required")
+	}
+	c := investAccountFromProto(req.InvestAccount)
+
+	_, err := db.ExecContext(ctx, "UPDATE invest_accounts.public.invest_accounts SET owner_id=$1, client_survey_number=$2, share=$3, invested_amount_of_money=$4, free_amount_of_money=$5 WHERE id=$6",
+		c.OwnerId, c.ClientSurveyNumber, c.Share, c.InvestedAmountOfMoney, c.FreeAmountOfMoney, req.Id)
+	if err != nil {
+		log.Println("Error updating invest account:", err)
+		return nil, status.Error(codes.Internal, "Internal server error")
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (investAccountsServer) DeleteInvestAccount(ctx context.Context, req *DeleteInvestAccountRequest) (*emptypb.Empty, error) {
+	_, err := db.ExecContext(ctx, "DELETE FROM invest_accounts.public.invest_accounts WHERE id = $1", req.Id)
+	if err != nil {
+		log.Println("Error deleting invest account:", err)
+		return nil, status.Error(codes.Internal, "Internal server error")
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func investAccountToProto(c InvestAccount) *InvestAccountRecord {
+	return &InvestAccountRecord{
+		Id:                    int32(c.ID),
+		OwnerId:               int32(c.OwnerId),
+		ClientSurveyNumber:    int32(c.ClientSurveyNumber),
+		Share:                 c.Share,
+		InvestedAmountOfMoney: c.InvestedAmountOfMoney,
+		FreeAmountOfMoney:     c.FreeAmountOfMoney,
+	}
+}
+
+func investAccountFromProto(p *InvestAccountRecord) InvestAccount {
+	return InvestAccount{
+		ID:                    int(p.Id),
+		OwnerId:               int(p.OwnerId),
+		ClientSurveyNumber:    int(p.ClientSurveyNumber),
+		Share:                 p.Share,
+		InvestedAmountOfMoney: p.InvestedAmountOfMoney,
+		FreeAmountOfMoney:     p.FreeAmountOfMoney,
+	}
+}
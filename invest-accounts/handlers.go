@@ -5,12 +5,42 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
+	"github.com/lib/pq"
 )
 
+// investAccountColumns are the columns scanInvestAccount reads, in order.
+const investAccountColumns = "id, owner_id, client_survey_number, share, invested_amount_of_money, free_amount_of_money"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanInvestAccount(row rowScanner, c *InvestAccount) error {
+	return row.Scan(&c.ID, &c.OwnerId, &c.ClientSurveyNumber, &c.Share, &c.InvestedAmountOfMoney, &c.FreeAmountOfMoney)
+}
+
 func GetInvestAccounts(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query("SELECT * FROM invest_accounts.public.invest_accounts")
+	query := "SELECT " + investAccountColumns + " FROM invest_accounts.public.invest_accounts"
+	var args []interface{}
+	if ownerIDStrs := r.URL.Query()["owner_id"]; len(ownerIDStrs) > 0 {
+		ownerIDs := make([]int64, 0, len(ownerIDStrs))
+		for _, ownerIDStr := range ownerIDStrs {
+			ownerID, err := strconv.ParseInt(ownerIDStr, 10, 64)
+			if err != nil {
+				log.Println("Invalid owner ID:", err)
+				respondWithError(w, http.StatusBadRequest, "Invalid owner ID")
+				return
+			}
+			ownerIDs = append(ownerIDs, ownerID)
+		}
+		query += " WHERE owner_id = ANY($1)"
+		args = append(args, pq.Array(ownerIDs))
+	}
+
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		log.Println("Error querying invest account:", err)
 		respondWithError(w, http.StatusInternalServerError, "Internal server error")
@@ -18,10 +48,10 @@ func GetInvestAccounts(w http.ResponseWriter, r *http.Request) {
 	}
 	defer rows.Close()
 
-	var investAccounts []InvestAccount
+	investAccounts := []InvestAccount{}
 	for rows.Next() {
 		var c InvestAccount
-		err := rows.Scan(&c.ID, &c.OwnerId, &c.ClientSurveyNumber, &c.Share, &c.InvestedAmountOfMoney, &c.FreeAmountOfMoney)
+		err := scanInvestAccount(rows, &c)
 		if err != nil {
 			log.Println("Error scanning invest account row:", err)
 			respondWithError(w, http.StatusInternalServerError, "Internal server error")
@@ -39,9 +69,7 @@ func GetInvestAccount(w http.ResponseWriter, r *http.Request) {
 	id := params["id"]
 
 	var c InvestAccount
-	err := db.QueryRow("SELECT id, owner_id, client_survey_number, share, invested_amount_of_money, free_amount_of_money FROM invest_accounts.public.invest_accounts WHERE id = $1", id).Scan(
-		&c.ID, &c.OwnerId, &c.ClientSurveyNumber, &c.Share, &c.InvestedAmountOfMoney, &c.FreeAmountOfMoney,
-	)
+	err := scanInvestAccount(db.QueryRow("SELECT "+investAccountColumns+" FROM invest_accounts.public.invest_accounts WHERE id = $1", id), &c)
 	if err != nil {
 		log.Println("Error querying invest account by ID:", err)
 		if err == sql.ErrNoRows {
@@ -58,10 +86,10 @@ func GetInvestAccount(w http.ResponseWriter, r *http.Request) {
 
 func CreateInvestAccount(w http.ResponseWriter, r *http.Request) {
 	var newAccount InvestAccount
-	err := json.NewDecoder(r.Body).Decode(&newAccount)
+	err := decodeJSONBody(r, &newAccount)
 	if err != nil {
 		log.Println("Error decoding request body:", err)
-		respondWithError(w, http.StatusBadRequest, "Bad request")
+		respondWithBodyError(w, err)
 		return
 	}
 
@@ -82,10 +110,10 @@ func UpdateInvestAccount(w http.ResponseWriter, r *http.Request) {
 	id := params["id"]
 
 	var updatedAccount InvestAccount
-	err := json.NewDecoder(r.Body).Decode(&updatedAccount)
+	err := decodeJSONBody(r, &updatedAccount)
 	if err != nil {
 		log.Println("Error decoding request body:", err)
-		respondWithError(w, http.StatusBadRequest, "Bad request")
+		respondWithBodyError(w, err)
 		return
 	}
 
@@ -114,8 +142,8 @@ func DeleteInvestAccount(w http.ResponseWriter, r *http.Request) {
 }
 
 func respondWithError(w http.ResponseWriter, statusCode int, message string) {
-	w.WriteHeader(statusCode)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
 	errMsg := map[string]string{"error": message}
 	json.NewEncoder(w).Encode(errMsg)
 }
@@ -0,0 +1,280 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             (unknown)
+// source: invest_accounts.proto
+
+package main
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// InvestAccountsClient is the client API for InvestAccounts service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type InvestAccountsClient interface {
+	// ListInvestAccounts streams all accounts, or only those of the given owners.
+	ListInvestAccounts(ctx context.Context, in *ListInvestAccountsRequest, opts ...grpc.CallOption) (InvestAccounts_ListInvestAccountsClient, error)
+	GetInvestAccount(ctx context.Context, in *GetInvestAccountRequest, opts ...grpc.CallOption) (*InvestAccountRecord, error)
+	CreateInvestAccount(ctx context.Context, in *CreateInvestAccountRequest, opts ...grpc.CallOption) (*InvestAccountRecord, error)
+	UpdateInvestAccount(ctx context.Context, in *UpdateInvestAccountRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	DeleteInvestAccount(ctx context.Context, in *DeleteInvestAccountRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+}
+
+type investAccountsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewInvestAccountsClient(cc grpc.ClientConnInterface) InvestAccountsClient {
+	return &investAccountsClient{cc}
+}
+
+func (c *investAccountsClient) ListInvestAccounts(ctx context.Context, in *ListInvestAccountsRequest, opts ...grpc.CallOption) (InvestAccounts_ListInvestAccountsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &InvestAccounts_ServiceDesc.Streams[0], "/investaccounts.v1.InvestAccounts/ListInvestAccounts", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &investAccountsListInvestAccountsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type InvestAccounts_ListInvestAccountsClient interface {
+	Recv() (*InvestAccountRecord, error)
+	grpc.ClientStream
+}
+
+type investAccountsListInvestAccountsClient struct {
+	grpc.ClientStream
+}
+
+func (x *investAccountsListInvestAccountsClient) Recv() (*InvestAccountRecord, error) {
+	m := new(InvestAccountRecord)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *investAccountsClient) GetInvestAccount(ctx context.Context, in *GetInvestAccountRequest, opts ...grpc.CallOption) (*InvestAccountRecord, error) {
+	out := new(InvestAccountRecord)
+	err := c.cc.Invoke(ctx, "/investaccounts.v1.InvestAccounts/GetInvestAccount", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *investAccountsClient) CreateInvestAccount(ctx context.Context, in *CreateInvestAccountRequest, opts ...grpc.CallOption) (*InvestAccountRecord, error) {
+	out := new(InvestAccountRecord)
+	err := c.cc.Invoke(ctx, "/investaccounts.v1.InvestAccounts/CreateInvestAccount", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *investAccountsClient) UpdateInvestAccount(ctx context.Context, in *UpdateInvestAccountRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/investaccounts.v1.InvestAccounts/UpdateInvestAccount", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *investAccountsClient) DeleteInvestAccount(ctx context.Context, in *DeleteInvestAccountRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/investaccounts.v1.InvestAccounts/DeleteInvestAccount", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// InvestAccountsServer is the server API for InvestAccounts service.
+// All implementations must embed UnimplementedInvestAccountsServer
+// for forward compatibility
+type InvestAccountsServer interface {
+	// ListInvestAccounts streams all accounts, or only those of the given owners.
+	ListInvestAccounts(*ListInvestAccountsRequest, InvestAccounts_ListInvestAccountsServer) error
+	GetInvestAccount(context.Context, *GetInvestAccountRequest) (*InvestAccountRecord, error)
+	CreateInvestAccount(context.Context, *CreateInvestAccountRequest) (*InvestAccountRecord, error)
+	UpdateInvestAccount(context.Context, *UpdateInvestAccountRequest) (*emptypb.Empty, error)
+	DeleteInvestAccount(context.Context, *DeleteInvestAccountRequest) (*emptypb.Empty, error)
+	mustEmbedUnimplementedInvestAccountsServer()
+}
+
+// UnimplementedInvestAccountsServer must be embedded to have forward compatible implementations.
+type UnimplementedInvestAccountsServer struct {
+}
+
+func (UnimplementedInvestAccountsServer) ListInvestAccounts(*ListInvestAccountsRequest, InvestAccounts_ListInvestAccountsServer) error {
+	return status.Errorf(codes.Unimplemented, "method ListInvestAccounts not implemented")
+}
+func (UnimplementedInvestAccountsServer) GetInvestAccount(context.Context, *GetInvestAccountRequest) (*InvestAccountRecord, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetInvestAccount not implemented")
+}
+func (UnimplementedInvestAccountsServer) CreateInvestAccount(context.Context, *CreateInvestAccountRequest) (*InvestAccountRecord, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateInvestAccount not implemented")
+}
+func (UnimplementedInvestAccountsServer) UpdateInvestAccount(context.Context, *UpdateInvestAccountRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateInvestAccount not implemented")
+}
+func (UnimplementedInvestAccountsServer) DeleteInvestAccount(context.Context, *DeleteInvestAccountRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteInvestAccount not implemented")
+}
+func (UnimplementedInvestAccountsServer) mustEmbedUnimplementedInvestAccountsServer() {}
+
+// UnsafeInvestAccountsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to InvestAccountsServer will
+// result in compilation errors.
+type UnsafeInvestAccountsServer interface {
+	mustEmbedUnimplementedInvestAccountsServer()
+}
+
+func RegisterInvestAccountsServer(s grpc.ServiceRegistrar, srv InvestAccountsServer) {
+	s.RegisterService(&InvestAccounts_ServiceDesc, srv)
+}
+
+func _InvestAccounts_ListInvestAccounts_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListInvestAccountsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(InvestAccountsServer).ListInvestAccounts(m, &investAccountsListInvestAccountsServer{stream})
+}
+
+type InvestAccounts_ListInvestAccountsServer interface {
+	Send(*InvestAccountRecord) error
+	grpc.ServerStream
+}
+
+type investAccountsListInvestAccountsServer struct {
+	grpc.ServerStream
+}
+
+func (x *investAccountsListInvestAccountsServer) Send(m *InvestAccountRecord) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _InvestAccounts_GetInvestAccount_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetInvestAccountRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(InvestAccountsServer).GetInvestAccount(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/investaccounts.v1.InvestAccounts/GetInvestAccount",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(InvestAccountsServer).GetInvestAccount(ctx, req.(*GetInvestAccountRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _InvestAccounts_CreateInvestAccount_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateInvestAccountRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(InvestAccountsServer).CreateInvestAccount(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/investaccounts.v1.InvestAccounts/CreateInvestAccount",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(InvestAccountsServer).CreateInvestAccount(ctx, req.(*CreateInvestAccountRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _InvestAccounts_UpdateInvestAccount_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateInvestAccountRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(InvestAccountsServer).UpdateInvestAccount(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/investaccounts.v1.InvestAccounts/UpdateInvestAccount",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(InvestAccountsServer).UpdateInvestAccount(ctx, req.(*UpdateInvestAccountRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _InvestAccounts_DeleteInvestAccount_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteInvestAccountRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(InvestAccountsServer).DeleteInvestAccount(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/investaccounts.v1.InvestAccounts/DeleteInvestAccount",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(InvestAccountsServer).DeleteInvestAccount(ctx, req.(*DeleteInvestAccountRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// InvestAccounts_ServiceDesc is the grpc.ServiceDesc for InvestAccounts service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var InvestAccounts_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "investaccounts.v1.InvestAccounts",
+	HandlerType: (*InvestAccountsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetInvestAccount",
+			Handler:    _InvestAccounts_GetInvestAccount_Handler,
+		},
+		{
+			MethodName: "CreateInvestAccount",
+			Handler:    _InvestAccounts_CreateInvestAccount_Handler,
+		},
+		{
+			MethodName: "UpdateInvestAccount",
+			Handler:    _InvestAccounts_UpdateInvestAccount_Handler,
+		},
+		{
+			MethodName: "DeleteInvestAccount",
+			Handler:    _InvestAccounts_DeleteInvestAccount_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ListInvestAccounts",
+			Handler:       _InvestAccounts_ListInvestAccounts_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "invest_accounts.proto",
+}
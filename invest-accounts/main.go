@@ -4,6 +4,7 @@ import (
 	"github.com/gorilla/mux"
 
 	"log"
+	"net"
 	"net/http"
 )
 
@@ -16,6 +17,17 @@ func main() {
 	router.HandleFunc("/invest-account", CreateInvestAccount).Methods("POST")
 	router.HandleFunc("/invest-account/{id}", UpdateInvestAccount).Methods("PUT")
 	router.HandleFunc("/invest-account/{id}", DeleteInvestAccount).Methods("DELETE")
+	router.HandleFunc("/openapi.json", OpenAPIHandler).Methods("GET")
+
+	grpcAddr := getEnv("GRPC_ADDR", ":9092")
+	lis, err := net.Listen("tcp", grpcAddr)
+	if err != nil {
+		log.Fatal("Error listening for gRPC:", err)
+	}
+	go func() {
+		log.Println("gRPC server started on", grpcAddr)
+		log.Fatal(newGRPCServer().Serve(lis))
+	}()
 
 	log.Println("Server started on port 8082")
 	log.Fatal(http.ListenAndServe(":8082", router))
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// OpenAPIHandler serves the service's OpenAPI 3 document. The schemas are
+// generated from the model types, so they cannot drift from the handlers.
+func OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(openAPIDocument())
+}
+
+func openAPIDocument() map[string]interface{} {
+	account := map[string]interface{}{"$ref": "#/components/schemas/InvestAccount"}
+	idParam := map[string]interface{}{
+		"name": "id", "in": "path", "required": true,
+		"schema": map[string]interface{}{"type": "integer"},
+	}
+	body := map[string]interface{}{
+		"required": true,
+		"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": account}},
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info":    map[string]interface{}{"title": "Invest Accounts API", "version": "1.0.0"},
+		"paths": map[string]interface{}{
+			"/invest-account": map[string]interface{}{
+				"get": map[string]interface{}{
+					"operationId": "listInvestAccounts",
+					"summary":     "List invest accounts",
+					"parameters": []interface{}{map[string]interface{}{
+						"name": "owner_id", "in": "query", "description": "Only return accounts of these customers; repeat for several.",
+						"schema":  map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "integer"}},
+						"style":   "form",
+						"explode": true,
+					}},
+					"responses": map[string]interface{}{
+						"200": jsonResponse("The invest accounts", map[string]interface{}{"type": "array", "items": account}),
+						"400": errorResponse("Invalid owner ID"),
+						"500": errorResponse("Internal server error"),
+					},
+				},
+				"post": map[string]interface{}{
+					"operationId": "createInvestAccount",
+					"summary":     "Create an invest account",
+					"requestBody": body,
+					"responses": map[string]interface{}{
+						"201": jsonResponse("The created account with its ID", account),
+						"400": errorResponse("Malformed body or unknown fields"),
+						"413": errorResponse("Request body too large"),
+						"415": errorResponse("Content-Type is not application/json"),
+						"500": errorResponse("Internal server error"),
+					},
+				},
+			},
+			"/invest-account/{id}": map[string]interface{}{
+				"parameters": []interface{}{idParam},
+				"get": map[string]interface{}{
+					"operationId": "getInvestAccount",
+					"summary":     "Get an invest account",
+					"responses": map[string]interface{}{
+						"200": jsonResponse("The invest account", account),
+						"404": errorResponse("Invest account not found"),
+						"500": errorResponse("Internal server error"),
+					},
+				},
+				"put": map[string]interface{}{
+					"operationId": "updateInvestAccount",
+					"summary":     "Replace an invest account's fields",
+					"requestBody": body,
+					"responses": map[string]interface{}{
+						"200": map[string]interface{}{"description": "Updated"},
+						"400": errorResponse("Malformed body or unknown fields"),
+						"413": errorResponse("Request body too large"),
+						"415": errorResponse("Content-Type is not application/json"),
+						"500": errorResponse("Internal server error"),
+					},
+				},
+				"delete": map[string]interface{}{
+					"operationId": "deleteInvestAccount",
+					"summary":     "Delete an invest account",
+					"responses": map[string]interface{}{
+						"200": map[string]interface{}{"description": "Deleted"},
+						"500": errorResponse("Internal server error"),
+					},
+				},
+			},
+		},
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}{
+				"InvestAccount": schemaFor(reflect.TypeOf(InvestAccount{})),
+				"Error": map[string]interface{}{
+					"type":       "object",
+					"properties": map[string]interface{}{"error": map[string]interface{}{"type": "string"}},
+				},
+			},
+		},
+	}
+}
+
+func jsonResponse(description string, schema interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"description": description,
+		"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}},
+	}
+}
+
+func errorResponse(description string) map[string]interface{} {
+	return jsonResponse(description, map[string]interface{}{"$ref": "#/components/schemas/Error"})
+}
+
+// schemaFor describes a model type by its JSON encoding. The id is assigned
+// by the database and ignored on writes, so it is read-only.
+func schemaFor(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Struct:
+		props := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			schema := schemaFor(f.Type)
+			if name == "id" {
+				schema["readOnly"] = true
+			}
+			props[name] = schema
+		}
+		return map[string]interface{}{"type": "object", "properties": props}
+	case t.Kind() == reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem())}
+	case t.Kind() == reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]interface{}{"type": "number", "format": "double"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	default:
+		return map[string]interface{}{"type": "string"}
+	}
+}
@@ -0,0 +1,30 @@
+#!/bin/sh
+# Regenerates the Go code for the gRPC APIs. Every service and the gateway is
+# a flat package main, so each gets its own copy of the generated files:
+#
+#   customers.proto        customers/ and gateway/
+#   invest_accounts.proto  invest-accounts/ and gateway/
+#
+# The copies must stay byte for byte the same. Never edit them by hand; change
+# the .proto and run this script, which regenerates all of them together.
+#
+# Requires buf, protoc-gen-go v1.28.1 and protoc-gen-go-grpc v1.2.0 on PATH.
+set -e
+cd "$(dirname "$0")/.."
+
+generate() {
+	proto=$1
+	out=$2
+	buf generate proto --path "proto/$proto" --template "{
+		\"version\": \"v1\",
+		\"plugins\": [
+			{\"plugin\": \"go\", \"out\": \"$out\", \"opt\": [\"paths=source_relative\", \"M$proto=./;main\"]},
+			{\"plugin\": \"go-grpc\", \"out\": \"$out\", \"opt\": [\"paths=source_relative\", \"M$proto=./;main\"]}
+		]
+	}"
+}
+
+generate customers.proto customers
+generate invest_accounts.proto invest-accounts
+generate customers.proto gateway
+generate invest_accounts.proto gateway